@@ -20,11 +20,11 @@ type authenticationPayload struct {
 func makeAuthenticationPayload(authInfo AuthInfo) (ret authenticationPayload, sharedSecret [32]byte) {
 	/*
 		Authentication data:
-		+----------+----------------+---------------------+-------------+--------------+--------+------------+
-		|  _UID_   | _Proxy Method_ | _Encryption Method_ | _Timestamp_ | _Session Id_ | _Flag_ | _reserved_ |
-		+----------+----------------+---------------------+-------------+--------------+--------+------------+
-		| 16 bytes | 12 bytes       | 1 byte              | 8 bytes     | 4 bytes      | 1 byte | 6 bytes    |
-		+----------+----------------+---------------------+-------------+--------------+--------+------------+
+		+----------+----------------+---------------------+-------------+--------------+--------+----------------+------------+
+		|  _UID_   | _Proxy Method_ | _Encryption Method_ | _Timestamp_ | _Session Id_ | _Flag_ | _Capabilities_ | _reserved_ |
+		+----------+----------------+---------------------+-------------+--------------+--------+----------------+------------+
+		| 16 bytes | 12 bytes       | 1 byte              | 8 bytes     | 4 bytes      | 1 byte | 4 bytes        | 2 bytes    |
+		+----------+----------------+---------------------+-------------+--------------+--------+----------------+------------+
 	*/
 	ephPv, ephPub, _ := ecdh.GenerateKey(authInfo.WorldState.Rand)
 	copy(ret.randPubKey[:], ecdh.Marshal(ephPub))
@@ -39,6 +39,8 @@ func makeAuthenticationPayload(authInfo AuthInfo) (ret authenticationPayload, sh
 	if authInfo.Unordered {
 		plaintext[41] |= UNORDERED_FLAG
 	}
+	// servers that don't know about capabilities ignore these bytes
+	binary.BigEndian.PutUint32(plaintext[42:46], uint32(authInfo.Capabilities))
 
 	copy(sharedSecret[:], ecdh.GenerateSharedSecret(ephPv, authInfo.ServerPubKey))
 	ciphertextWithTag, _ := common.AESGCMEncrypt(ret.randPubKey[:12], sharedSecret[:], plaintext)
@@ -59,6 +59,7 @@ func MakeSession(connConfig RemoteConnConfig, authInfo AuthInfo, dialer common.D
 		Valve:              nil,
 		Unordered:          authInfo.Unordered,
 		MsgOnWireSizeLimit: appDataMaxLength,
+		Capabilities:       authInfo.Capabilities,
 	}
 	sesh := mux.MakeSession(authInfo.SessionId, seshConfig)
 
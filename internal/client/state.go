@@ -38,6 +38,8 @@ type RawConfig struct {
 	CDNOriginHost string // nullable
 	StreamTimeout int    // nullable
 	KeepAlive     int    // nullable
+	// comma-separated names of the multiplexing capabilities to advertise, see mux.ParseCapabilities
+	Capabilities string // nullable
 }
 
 type RemoteConnConfig struct {
@@ -59,6 +61,7 @@ type AuthInfo struct {
 	ProxyMethod      string
 	EncryptionMethod byte
 	Unordered        bool
+	Capabilities     mux.Capability
 	ServerPubKey     crypto.PublicKey
 	MockDomain       string
 	WorldState       common.WorldState
@@ -135,6 +138,12 @@ func (raw *RawConfig) ProcessRawConfig(worldState common.WorldState) (local Loca
 
 	auth.UID = raw.UID
 	auth.Unordered = raw.UDP
+	if raw.Capabilities != "" {
+		auth.Capabilities, err = mux.ParseCapabilities(strings.Split(raw.Capabilities, ","))
+		if err != nil {
+			return
+		}
+	}
 	if raw.ServerName == "" {
 		return nullErr("ServerName")
 	}
@@ -167,6 +176,8 @@ func (raw *RawConfig) ProcessRawConfig(worldState common.WorldState) (local Loca
 		auth.EncryptionMethod = mux.EncryptionMethodAESGCM
 	case "chacha20-poly1305":
 		auth.EncryptionMethod = mux.EncryptionMethodChaha20Poly1305
+	case "xor-stream":
+		auth.EncryptionMethod = mux.EncryptionMethodXorStream
 	default:
 		err = fmt.Errorf("unknown encryption method %v", raw.EncryptionMethod)
 		return
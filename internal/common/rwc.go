@@ -0,0 +1,143 @@
+package common
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// rwcAddr is the address of both ends of a connection wrapped by WrapRWC, as an io.ReadWriteCloser has no address
+type rwcAddr struct{}
+
+func (rwcAddr) Network() string { return "rwc" }
+func (rwcAddr) String() string  { return "rwc" }
+
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+// WrapRWC wraps rwc as a net.Conn, so that a carrier that isn't a net.Conn, such as an SSH channel, can be used as an
+// underlying connection of a session.
+//
+// An io.ReadWriteCloser has no deadlines, so SetDeadline, SetReadDeadline and SetWriteDeadline do nothing and Read and
+// Write may block forever. A session doesn't rely on deadlines of its underlying connections, but other users of the
+// net.Conn may. Use WrapRWCWithReadDeadline if read deadlines are needed. LocalAddr and RemoteAddr return a placeholder
+// address with the network "rwc"
+func WrapRWC(rwc io.ReadWriteCloser) net.Conn {
+	return &rwcConn{rwc}
+}
+
+func (c *rwcConn) LocalAddr() net.Addr                { return rwcAddr{} }
+func (c *rwcConn) RemoteAddr() net.Addr               { return rwcAddr{} }
+func (c *rwcConn) SetDeadline(t time.Time) error      { return nil }
+func (c *rwcConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *rwcConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+type deadlineRWCConn struct {
+	rwcConn
+
+	// held by Read throughout, so that reads of the underlying rwc are never concurrent
+	readM sync.Mutex
+	// receives the result of a read of rwc that is in progress. nil if there isn't one
+	pending chan readResult
+	// data read from rwc that didn't fit into the buffer of the Read that returned it
+	leftover []byte
+
+	deadlineM    sync.Mutex
+	readDeadline time.Time
+	// closed when readDeadline is changed
+	deadlineChanged chan struct{}
+}
+
+// WrapRWCWithReadDeadline is like WrapRWC, but read deadlines are emulated. Reads of rwc are done in the background, so
+// that a Read can return a timeout error once its deadline has passed. As a read of rwc can't be cancelled, it carries on
+// after the timeout, and the data it reads is returned by the next Read, so nothing is lost. Write deadlines are still
+// ignored, as a Write that has timed out can't tell how much of its data will end up written. SetDeadline only sets the
+// read deadline
+func WrapRWCWithReadDeadline(rwc io.ReadWriteCloser) net.Conn {
+	return &deadlineRWCConn{
+		rwcConn:         rwcConn{rwc},
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+func (c *deadlineRWCConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *deadlineRWCConn) SetReadDeadline(t time.Time) error {
+	c.deadlineM.Lock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	c.deadlineM.Unlock()
+	return nil
+}
+
+func (c *deadlineRWCConn) Read(b []byte) (int, error) {
+	c.readM.Lock()
+	defer c.readM.Unlock()
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if c.pending == nil {
+		pending := make(chan readResult, 1)
+		buf := make([]byte, len(b))
+		go func() {
+			n, err := c.ReadWriteCloser.Read(buf)
+			pending <- readResult{buf[:n], err}
+		}()
+		c.pending = pending
+	}
+
+	for {
+		c.deadlineM.Lock()
+		deadline := c.readDeadline
+		deadlineChanged := c.deadlineChanged
+		c.deadlineM.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, timeoutError{}
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case res := <-c.pending:
+			if timer != nil {
+				timer.Stop()
+			}
+			c.pending = nil
+			n := copy(b, res.data)
+			c.leftover = res.data[n:]
+			return n, res.err
+		case <-timeout:
+			return 0, timeoutError{}
+		case <-deadlineChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
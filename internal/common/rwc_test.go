@@ -0,0 +1,88 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type pipeRWC struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipeRWC) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+// makeRWCPair returns two connected io.ReadWriteClosers that aren't net.Conns
+func makeRWCPair() (pipeRWC, pipeRWC) {
+	r0, w0 := io.Pipe()
+	r1, w1 := io.Pipe()
+	return pipeRWC{r0, w1}, pipeRWC{r1, w0}
+}
+
+func TestWrapRWC(t *testing.T) {
+	a, b := makeRWCPair()
+	conn := WrapRWC(a)
+	assert.Equal(t, "rwc", conn.LocalAddr().Network())
+	assert.Equal(t, "rwc", conn.RemoteAddr().Network())
+	assert.NoError(t, conn.SetDeadline(time.Now()))
+
+	go b.Write([]byte{1, 2, 3})
+	buf := make([]byte, 3)
+	_, err := io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, buf)
+
+	go conn.Write([]byte{4, 5})
+	_, err = io.ReadFull(b, buf[:2])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{4, 5}, buf[:2])
+
+	conn.Close()
+	_, err = b.Read(buf)
+	assert.Error(t, err)
+}
+
+func TestWrapRWCWithReadDeadline(t *testing.T) {
+	a, b := makeRWCPair()
+	conn := WrapRWCWithReadDeadline(a)
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 4)
+	_, err := conn.Read(buf)
+	if assert.Error(t, err) {
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout())
+	}
+	_, err = conn.Read(buf)
+	assert.Error(t, err, "a passed deadline doesn't persist")
+
+	// the read that timed out is still pending and its data isn't lost
+	_ = conn.SetReadDeadline(time.Time{})
+	go b.Write([]byte{1, 2, 3, 4})
+	small := make([]byte, 3)
+	n, err := conn.Read(small)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, small[:n])
+	n, err = conn.Read(small)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{4}, small[:n])
+
+	t.Run("deadline extended while reading", func(t *testing.T) {
+		_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		go func() {
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			time.Sleep(50 * time.Millisecond)
+			b.Write([]byte{5})
+		}()
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{5}, buf[:n])
+	})
+}
@@ -1,20 +1,27 @@
 package common
 
 import (
-	"errors"
 	"github.com/gorilla/websocket"
 	"io"
+	"net"
 	"sync"
 	"time"
 )
 
-// WebSocketConn implements io.ReadWriteCloser
-// it makes websocket.Conn binary-oriented
+// WebSocketConn implements net.Conn over a websocket.Conn, so that it can be used as an underlying connection of a
+// session. Each Write is sent as one binary message. Read returns data from one message at a time, so a Read with a
+// buffer large enough for the whole message returns all of it. What doesn't fit into the buffer is returned by the
+// following Reads. Messages that aren't binary are skipped
 type WebSocketConn struct {
 	*websocket.Conn
 	writeM sync.Mutex
+
+	// the reader of the message being read, if it hasn't been read to the end
+	reader io.Reader
 }
 
+var _ net.Conn = (*WebSocketConn)(nil)
+
 func (ws *WebSocketConn) Write(data []byte) (int, error) {
 	ws.writeM.Lock()
 	err := ws.WriteMessage(websocket.BinaryMessage, data)
@@ -27,36 +34,61 @@ func (ws *WebSocketConn) Write(data []byte) (int, error) {
 }
 
 func (ws *WebSocketConn) Read(buf []byte) (n int, err error) {
-	t, r, err := ws.NextReader()
-	if err != nil {
-		return 0, err
-	}
-	if t != websocket.BinaryMessage {
+	if len(buf) == 0 {
 		return 0, nil
 	}
-
-	// Read until io.EOL for one full message
 	for {
-		var read int
-		read, err = r.Read(buf[n:])
-		if err != nil {
+		if ws.reader == nil {
+			var t int
+			t, ws.reader, err = ws.NextReader()
+			if err != nil {
+				ws.reader = nil
+				return 0, err
+			}
+			if t != websocket.BinaryMessage {
+				ws.reader = nil
+				continue
+			}
+		}
+
+		// Read until io.EOF for one full message, or until buf is full
+		for n < len(buf) {
+			var read int
+			read, err = ws.reader.Read(buf[n:])
+			n += read
 			if err == io.EOF {
+				ws.reader = nil
 				err = nil
 				break
-			} else {
-				break
-			}
-		} else {
-			// There may be data available to read but n == len(buf)-1, read==0 because buffer is full
-			if read == 0 {
-				err = errors.New("nothing more is read. message may be larger than buffer")
-				break
+			} else if err != nil {
+				ws.reader = nil
+				return n, err
 			}
 		}
-		n += read
+		if n > 0 {
+			return n, nil
+		}
+		// the rest of the message was empty
 	}
-	return
 }
+
+// KeepAlive sends a ping to the remote every interval, so that intermediaries such as CDNs don't close the
+// connection for being idle. The remote replies with pongs as long as it's reading from the connection, which
+// WebSocketConn on either end does as part of Read. It stops once the connection is closed
+func (ws *WebSocketConn) KeepAlive(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			// WriteControl can be called concurrently with Write
+			err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval))
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
 func (ws *WebSocketConn) Close() error {
 	ws.writeM.Lock()
 	defer ws.writeM.Unlock()
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeWebSocketPair(t *testing.T) (client *WebSocketConn, server *websocket.Conn) {
+	serverCh := make(chan *websocket.Conn, 1)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		serverCh <- c
+	}))
+	t.Cleanup(httpServer.Close)
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-serverCh
+	t.Cleanup(func() { server.Close() })
+	return &WebSocketConn{Conn: c}, server
+}
+
+func TestWebSocketConn(t *testing.T) {
+	client, server := makeWebSocketPair(t)
+	defer client.Close()
+
+	t.Run("write", func(t *testing.T) {
+		_, err := client.Write([]byte{1, 2, 3})
+		assert.NoError(t, err)
+		typ, msg, err := server.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, websocket.BinaryMessage, typ)
+		assert.Equal(t, []byte{1, 2, 3}, msg)
+	})
+
+	t.Run("one message per read", func(t *testing.T) {
+		_ = server.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3})
+		_ = server.WriteMessage(websocket.BinaryMessage, []byte{4, 5})
+		buf := make([]byte, 10)
+		n, err := client.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1, 2, 3}, buf[:n])
+		n, err = client.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{4, 5}, buf[:n])
+	})
+
+	t.Run("message larger than buffer", func(t *testing.T) {
+		_ = server.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3, 4, 5})
+		_ = server.WriteMessage(websocket.BinaryMessage, []byte{6, 7})
+		buf := make([]byte, 2)
+		var got [][]byte
+		for i := 0; i < 4; i++ {
+			n, err := client.Read(buf)
+			assert.NoError(t, err)
+			got = append(got, append([]byte{}, buf[:n]...))
+		}
+		assert.Equal(t, [][]byte{{1, 2}, {3, 4}, {5}, {6, 7}}, got)
+	})
+
+	t.Run("non-binary messages are skipped", func(t *testing.T) {
+		_ = server.WriteMessage(websocket.TextMessage, []byte("text"))
+		_ = server.WriteMessage(websocket.BinaryMessage, []byte{}) // empty
+		_ = server.WriteMessage(websocket.BinaryMessage, []byte{1})
+		buf := make([]byte, 10)
+		n, err := client.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1}, buf[:n])
+	})
+
+	t.Run("keep alive", func(t *testing.T) {
+		pinged := make(chan struct{}, 1)
+		server.SetPingHandler(func(string) error {
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		go func() {
+			// control frames are handled while reading
+			_, _, _ = server.ReadMessage()
+		}()
+		client.KeepAlive(10 * time.Millisecond)
+		select {
+		case <-pinged:
+		case <-time.After(time.Second):
+			t.Error("no ping received")
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		client.Close()
+		_, err := client.Read(make([]byte, 10))
+		assert.Error(t, err)
+		assert.NotEqual(t, io.EOF, err)
+	})
+}
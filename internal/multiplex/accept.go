@@ -0,0 +1,145 @@
+package multiplex
+
+import (
+	"sync"
+	"time"
+)
+
+// ResetCodeAcceptTimeout is the code of the StreamResetError returned by a stream reset because it wasn't accepted
+// within SessionConfig.AcceptTimeout
+const ResetCodeAcceptTimeout uint32 = 0xfffffffd
+
+// acceptQueue holds streams opened by the remote until they are returned by Accept. It's a queue rather than a
+// channel so that streams that time out waiting can be taken out of the middle of it
+type acceptQueue struct {
+	m       sync.Mutex
+	streams []*Stream
+	backlog int
+	closed  bool
+	// if timeout is set, expire is called with each stream still in the queue timeout after it was pushed
+	timeout time.Duration
+	expire  func(*Stream)
+	// closed once a stream has been pushed or taken out, then replaced by the next call of notified. nil
+	// while no one is waiting
+	pushedCh chan struct{}
+	poppedCh chan struct{}
+}
+
+func makeAcceptQueue(backlog int, timeout time.Duration, expire func(*Stream)) *acceptQueue {
+	return &acceptQueue{backlog: backlog, timeout: timeout, expire: expire}
+}
+
+// push adds s to the queue, waiting for room if the backlog is full. It returns false if the queue has been closed
+func (q *acceptQueue) push(s *Stream) bool {
+	for {
+		q.m.Lock()
+		if q.closed {
+			q.m.Unlock()
+			return false
+		}
+		if len(q.streams) < q.backlog {
+			q.streams = append(q.streams, s)
+			if q.timeout > 0 {
+				s.acceptTimer = time.AfterFunc(q.timeout, func() {
+					if q.remove(s) {
+						q.expire(s)
+					}
+				})
+			}
+			notify(&q.pushedCh)
+			q.m.Unlock()
+			return true
+		}
+		popped := notified(&q.poppedCh)
+		q.m.Unlock()
+		<-popped
+	}
+}
+
+// pop takes the first stream out of the queue, waiting for one if it's empty. It returns nil once the queue has been
+// closed
+func (q *acceptQueue) pop() *Stream {
+	for {
+		q.m.Lock()
+		if q.closed {
+			q.m.Unlock()
+			return nil
+		}
+		if len(q.streams) > 0 {
+			s := q.streams[0]
+			q.streams[0] = nil
+			q.streams = q.streams[1:]
+			if s.acceptTimer != nil {
+				s.acceptTimer.Stop()
+			}
+			notify(&q.poppedCh)
+			q.m.Unlock()
+			return s
+		}
+		pushed := notified(&q.pushedCh)
+		q.m.Unlock()
+		<-pushed
+	}
+}
+
+// remove takes s out of the queue, and returns whether it was still in it
+func (q *acceptQueue) remove(s *Stream) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for i, queued := range q.streams {
+		if queued == s {
+			copy(q.streams[i:], q.streams[i+1:])
+			q.streams[len(q.streams)-1] = nil
+			q.streams = q.streams[:len(q.streams)-1]
+			notify(&q.poppedCh)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *acceptQueue) pending() int {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return len(q.streams)
+}
+
+// close wakes up everyone waiting on the queue, and makes push and pop fail from then on
+func (q *acceptQueue) close() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.closed = true
+	for _, s := range q.streams {
+		if s.acceptTimer != nil {
+			s.acceptTimer.Stop()
+		}
+	}
+	notify(&q.pushedCh)
+	notify(&q.poppedCh)
+}
+
+// notified returns a channel that is closed by the next call of notify on ch. The queue's lock must be held by the
+// caller
+func notified(ch *chan struct{}) <-chan struct{} {
+	if *ch == nil {
+		*ch = make(chan struct{})
+	}
+	return *ch
+}
+
+// notify closes ch if anyone is waiting on it. The queue's lock must be held by the caller
+func notify(ch *chan struct{}) {
+	if *ch != nil {
+		close(*ch)
+		*ch = nil
+	}
+}
+
+// acceptTimedOut resets s, which has been taken out of the accept backlog as it hasn't been accepted within
+// AcceptTimeout
+func (sesh *Session) acceptTimedOut(s *Stream) {
+	sesh.Logger.Debugf("stream %v of session %v isn't accepted within %v", s.id, sesh.id, sesh.AcceptTimeout)
+	if err := s.Reset(ResetCodeAcceptTimeout); err != nil {
+		sesh.Logger.Debugf("failed to reset stream %v not accepted: %v", s.id, err)
+	}
+}
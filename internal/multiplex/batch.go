@@ -0,0 +1,129 @@
+package multiplex
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Frames of any streams can be packed into the payload of one frameBatch frame, so that they are sent in a single
+// record, which is encrypted and padded once rather than once per frame. This matters when many small frames are
+// sent at once, such as the acknowledgements of many resumable streams. Each frame in a batch is encoded as
+//
+//	| compact frame header | payload length (uvarint) | payload |
+//
+// with the extraLen field of the compact header unused. Batches can't be nested, and are only sent to a remote that
+// supports CapFrameBatching. A batch doesn't belong to any stream, so like other such frames it's encrypted with a
+// Seq from Session.nextControlSeq. The frames in it aren't encrypted on their own, and keep their StreamID and Seq.
+
+var errBadBatch = errors.New("frame batch is malformed")
+
+// batchedFrameLen returns the length of f encoded in a batch
+func batchedFrameLen(f *Frame) int {
+	var tmp [binary.MaxVarintLen64]byte
+	return compactFrameHeaderLen(f) + binary.PutUvarint(tmp[:], uint64(len(f.Payload))) + len(f.Payload)
+}
+
+// appendBatchedFrame appends f encoded for a batch to batch
+func appendBatchedFrame(batch []byte, f *Frame) []byte {
+	header := make([]byte, compactFrameHeaderLen(f))
+	putCompactFrameHeader(header, f, 0)
+	batch = append(batch, header...)
+	batch = appendUvarint(batch, uint64(len(f.Payload)))
+	return append(batch, f.Payload...)
+}
+
+// parseBatch calls recv with each frame packed in batch, stopping at the first error. The payloads of the frames are
+// slices of batch
+func parseBatch(batch []byte, recv func(f *Frame) error) error {
+	for len(batch) > 0 {
+		if batch[0] != compactHeaderMarker {
+			return errBadBatch
+		}
+		f, _, n, err := parseCompactFrameHeader(batch)
+		if err != nil || f.Closing == frameBatch {
+			return errBadBatch
+		}
+		batch = batch[n:]
+		payloadLen, n := binary.Uvarint(batch)
+		if n <= 0 || payloadLen > uint64(len(batch)-n) {
+			return errBadBatch
+		}
+		f.Payload = batch[n : n+int(payloadLen)]
+		batch = batch[n+int(payloadLen):]
+		if err := recv(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recvBatch handles each frame packed in the payload of a frameBatch frame as if it had been received on its own
+func (sesh *Session) recvBatch(batch []byte, connId uint32) error {
+	return parseBatch(batch, func(f *Frame) error {
+		if sesh.FrameHook != nil {
+			sesh.FrameHook(f, false)
+		}
+		return sesh.handleFrame(f, connId)
+	})
+}
+
+// WriteFrames is like WriteFrame for several frames at once. If the remote supports CapFrameBatching, they are
+// packed into as few records as possible, which saves encrypting, padding and sending each of them separately.
+// Frames in different records may go through different connections, so the remote may receive them out of order
+// in an unordered session
+func (sesh *Session) WriteFrames(frames []*Frame) error {
+	if sesh.IsClosed() {
+		return ErrBrokenSession
+	}
+	for _, f := range frames {
+		if streamI, ok := sesh.streams.Load(f.StreamID); ok && streamI != nil {
+			return ErrStreamIDInUse
+		}
+	}
+	return sesh.sendFrames(frames)
+}
+
+// sendFrames sends frames that don't belong to any Stream, batched if the remote supports CapFrameBatching
+func (sesh *Session) sendFrames(frames []*Frame) error {
+	if !sesh.PeerSupports(CapFrameBatching) {
+		for _, f := range frames {
+			if err := sesh.sendControlFrame(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	limit := sesh.frameUnitLimit()
+	var batch []byte
+	var batched []*Frame
+	flush := func() error {
+		var err error
+		if len(batched) == 1 {
+			// not worth the overhead of a batch
+			err = sesh.sendControlFrame(batched[0])
+		} else if len(batched) > 1 {
+			err = sesh.sendControlFrame(&Frame{StreamID: 0xffffffff, Closing: frameBatch, Payload: batch})
+		}
+		batch = batch[:0]
+		batched = batched[:0]
+		return err
+	}
+	for _, f := range frames {
+		frameLen := batchedFrameLen(f)
+		if len(batch)+frameLen > limit {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if frameLen > limit {
+			if err := sesh.sendControlFrame(f); err != nil {
+				return err
+			}
+			continue
+		}
+		batch = appendBatchedFrame(batch, f)
+		batched = append(batched, f)
+	}
+	return flush()
+}
@@ -0,0 +1,175 @@
+package multiplex
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBatch(t *testing.T) {
+	frames := []*Frame{
+		{2, 0, closingNothing, []byte{1, 2, 3}},
+		{0xfffffffe, 1 << 40, messageEnd, make([]byte, 300)},
+		{4, 7, closingStream, nil},
+	}
+	var batch []byte
+	for _, f := range frames {
+		before := len(batch)
+		batch = appendBatchedFrame(batch, f)
+		assert.Equal(t, batchedFrameLen(f), len(batch)-before)
+	}
+
+	var parsed []*Frame
+	err := parseBatch(batch, func(f *Frame) error {
+		parsed = append(parsed, f)
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, parsed, len(frames)) {
+		for i, f := range frames {
+			assert.Equal(t, f.StreamID, parsed[i].StreamID)
+			assert.Equal(t, f.Seq, parsed[i].Seq)
+			assert.Equal(t, f.Closing, parsed[i].Closing)
+			assert.Equal(t, len(f.Payload), len(parsed[i].Payload))
+		}
+	}
+
+	nested := appendBatchedFrame(nil, &Frame{0xffffffff, 0, frameBatch, batch})
+	for name, malformed := range map[string][]byte{
+		"truncated":       batch[:len(batch)-1],
+		"standard header": make([]byte, frameHeaderLength),
+		"nested":          nested,
+	} {
+		err := parseBatch(malformed, func(f *Frame) error { return nil })
+		assert.Equal(t, errBadBatch, err, name)
+	}
+}
+
+func TestSession_WriteFrames(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+
+	run := func(t *testing.T, serverCaps Capability, batched bool) {
+		clientConfig := SessionConfig{Obfuscator: obfuscator, Role: RoleClient, Capabilities: SupportedCapabilities}
+		serverConfig := clientConfig.Derive()
+		serverConfig.Capabilities = serverCaps
+		var batches int32
+		var seqM sync.Mutex
+		batchSeqs := make(map[uint64]bool)
+		serverConfig.FrameHook = func(f *Frame, outbound bool) {
+			if !outbound && f.Closing == frameBatch {
+				atomic.AddInt32(&batches, 1)
+				seqM.Lock()
+				batchSeqs[f.Seq] = true
+				seqM.Unlock()
+			}
+		}
+		clientSesh := MakeSession(0, clientConfig)
+		serverSesh := MakeSession(0, serverConfig)
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+		assert.NoError(t, serverSesh.SetPeerCapabilities(SupportedCapabilities))
+		assert.Eventually(t, func() bool {
+			return atomic.LoadUint32(&clientSesh.peerCapabilities) == uint32(serverCaps)
+		}, time.Second, 10*time.Millisecond, "capabilities aren't received")
+
+		// the first frames of new streams, more than fit in one record
+		const numStreams = 50
+		payload := make([]byte, 1000)
+		var frames []*Frame
+		for i := 0; i < numStreams; i++ {
+			frames = append(frames, &Frame{uint32(2 * (i + 1)), 0, closingNothing, payload})
+		}
+		assert.NoError(t, clientSesh.WriteFrames(frames))
+
+		for i := 0; i < numStreams; i++ {
+			stream, err := serverSesh.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Eventually(t, func() bool {
+				return stream.(*Stream).Buffered() == len(payload)
+			}, time.Second, 10*time.Millisecond)
+		}
+		if batched {
+			// each record holds up to MaxFramePayload bytes of frames
+			assert.True(t, atomic.LoadInt32(&batches) > 1, "frames aren't batched")
+			assert.True(t, atomic.LoadInt32(&batches) < numStreams/5, "batches aren't filled")
+			seqM.Lock()
+			assert.Len(t, batchSeqs, int(atomic.LoadInt32(&batches)), "batches are sent with the same nonce")
+			seqM.Unlock()
+		} else {
+			assert.Zero(t, atomic.LoadInt32(&batches), "batch sent to a remote that doesn't support them")
+		}
+
+		stream, err := clientSesh.OpenStream()
+		assert.NoError(t, err)
+		assert.Equal(t, ErrStreamIDInUse, clientSesh.WriteFrames([]*Frame{{StreamID: stream.ID()}}))
+	}
+
+	t.Run("batched", func(t *testing.T) {
+		run(t, SupportedCapabilities, true)
+	})
+	t.Run("remote doesn't support batching", func(t *testing.T) {
+		run(t, SupportedCapabilities&^CapFrameBatching, false)
+	})
+}
+
+// countingConn counts the records written into it
+type countingConn struct {
+	net.Conn
+	m       sync.Mutex
+	records int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.m.Lock()
+	c.records++
+	c.m.Unlock()
+	return c.Conn.Write(b)
+}
+
+// Each record is encrypted once, so the number of records per op is the number of AEAD operations
+func BenchmarkSession_WriteFrames(b *testing.B) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	const numFrames = 64
+	frames := make([]*Frame, numFrames)
+	for i := range frames {
+		frames[i] = &Frame{uint32(2 * (i + 1)), 0, closingNothing, make([]byte, 64)}
+	}
+
+	for name, peerCaps := range map[string]Capability{
+		"batched":   SupportedCapabilities,
+		"per frame": SupportedCapabilities &^ CapFrameBatching,
+	} {
+		b.Run(name, func(b *testing.B) {
+			sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Capabilities: SupportedCapabilities})
+			defer sesh.Close()
+			atomic.StoreUint32(&sesh.peerCapabilities, uint32(peerCaps))
+			conn := &countingConn{Conn: connutil.Discard()}
+			sesh.AddConnection(conn)
+			b.SetBytes(numFrames * 64)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = sesh.WriteFrames(frames)
+			}
+			b.StopTimer()
+			conn.m.Lock()
+			b.ReportMetric(float64(conn.records)/float64(b.N), "records/op")
+			conn.m.Unlock()
+		})
+	}
+}
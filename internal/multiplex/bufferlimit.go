@@ -0,0 +1,51 @@
+package multiplex
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// BufferedBytesPolicy decides what a Session does once the data it has received but not yet read exceeds
+// SessionConfig.MaxBufferedBytes
+type BufferedBytesPolicy int
+
+const (
+	// CloseSession closes the whole Session
+	CloseSession BufferedBytesPolicy = iota
+	// ResetLargestStreams resets the streams with the most unread data, largest first, until the Session is back
+	// within the limit, so that a few streams that aren't being read can't take the rest down with them. Reads of a
+	// stream reset this way, on either end, return a *StreamResetError with ResetCodeBufferLimit
+	ResetLargestStreams
+)
+
+// ResetCodeBufferLimit is the code of the StreamResetError returned by a stream reset under ResetLargestStreams
+const ResetCodeBufferLimit uint32 = 0xfffffffe
+
+// shedBuffered resets the streams with the most unread data until bufferedBytes is back within MaxBufferedBytes.
+// Their unread data is discarded straight away, while telling the remote is left to another goroutine, as it may
+// wait for the stream's writes, which may in turn be waiting for the connection data is being received from
+func (sesh *Session) shedBuffered() {
+	for atomic.LoadInt64(&sesh.bufferedBytes) > int64(sesh.MaxBufferedBytes) {
+		var largest *Stream
+		var largestUnread int64
+		sesh.streams.Range(func(_, streamI interface{}) bool {
+			if streamI == nil {
+				return true
+			}
+			s := streamI.(*Stream)
+			if unread := atomic.LoadInt64(&s.unread); unread > largestUnread {
+				largest, largestUnread = s, unread
+			}
+			return true
+		})
+		if largest == nil {
+			// what's left is counted by streams that are being closed
+			return
+		}
+		sesh.Logger.Debugf("resetting stream %v of session %v with %v bytes unread, as MaxBufferedBytes is exceeded",
+			largest.id, sesh.id, largestUnread)
+		largest.recvBuf.reset(&StreamResetError{Code: ResetCodeBufferLimit})
+		largest.releaseBuffered(math.MaxInt64)
+		go largest.Reset(ResetCodeBufferLimit)
+	}
+}
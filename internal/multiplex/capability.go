@@ -0,0 +1,123 @@
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Capability is a feature of the multiplexing protocol that older versions don't support. Each Capability is a bit
+// in a bitmask, so that a set of them can be advertised at once. Bits unknown to us are kept but otherwise ignored.
+type Capability uint32
+
+const (
+	// CapConnMigration is support for the hints sent by Session.AddPreferredConnection
+	CapConnMigration Capability = 1 << iota
+	// CapGoaway is support for the frames sent by Session.Goaway
+	CapGoaway
+	// CapStreamMeta is support for streams opened with Session.OpenStreamWithMeta
+	CapStreamMeta
+	// CapConnProbe is support for probes sent when SessionConfig.ProbeInterval is set
+	CapConnProbe
+	// CapMessages is support for messages written with Stream.WriteMessage
+	CapMessages
+	// CapConnRemoval is support for connections removed with Session.RemoveConnection
+	CapConnRemoval
+	// CapPathMTU is support for path MTU probes sent when SessionConfig.PathMTUDiscovery is set
+	CapPathMTU
+	// CapCompactHeader is support for frames with compact headers, which are sent unless SessionConfig.PaddingScheme
+	// is set
+	CapCompactHeader
+	// CapStreamResumption is support for resuming streams with MakeSessionFromToken when
+	// SessionConfig.ResumableStreams is set
+	CapStreamResumption
+	// CapFrameBatching is support for frames packed into one record, as sent by Session.WriteFrames
+	CapFrameBatching
+	// CapConnRekey is support for connections rekeyed with Session.RekeyConnection
+	CapConnRekey
+)
+
+// SupportedCapabilities is the set of all capabilities supported by this version
+const SupportedCapabilities = CapConnMigration | CapGoaway | CapStreamMeta | CapConnProbe | CapMessages | CapConnRemoval |
+	CapPathMTU | CapCompactHeader | CapStreamResumption | CapFrameBatching | CapConnRekey
+
+// capabilityNames are the names capabilities are configured by, as taken by ParseCapabilities
+var capabilityNames = map[string]Capability{
+	"conn-migration":    CapConnMigration,
+	"goaway":            CapGoaway,
+	"stream-meta":       CapStreamMeta,
+	"conn-probe":        CapConnProbe,
+	"messages":          CapMessages,
+	"conn-removal":      CapConnRemoval,
+	"path-mtu":          CapPathMTU,
+	"compact-header":    CapCompactHeader,
+	"stream-resumption": CapStreamResumption,
+	"frame-batching":    CapFrameBatching,
+	"conn-rekey":        CapConnRekey,
+}
+
+// ParseCapabilities returns the set of capabilities named in names, such as "goaway" or "compact-header", matched
+// case-insensitively. Each Capability is named after its constant, in lowercase with words separated by hyphens, and
+// without the Cap prefix. An unknown name is an error
+func ParseCapabilities(names []string) (Capability, error) {
+	var caps Capability
+	for _, name := range names {
+		c, ok := capabilityNames[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability %v", name)
+		}
+		caps |= c
+	}
+	return caps, nil
+}
+
+const capabilitiesLen = 4
+
+var errBadCapabilities = errors.New("capabilities advertised by the remote are malformed")
+
+// PeerSupports returns whether both us and the remote have advertised all of caps
+func (sesh *Session) PeerSupports(caps Capability) bool {
+	peerCaps := Capability(atomic.LoadUint32(&sesh.peerCapabilities))
+	return sesh.Capabilities&caps == caps && peerCaps&caps == caps
+}
+
+// SetPeerCapabilities records capabilities advertised by the remote outside of the session, such as during
+// authentication. If the remote has advertised any, it must be able to receive ours, so they are sent in turn. It
+// should be called after a connection has been added
+func (sesh *Session) SetPeerCapabilities(caps Capability) error {
+	atomic.StoreUint32(&sesh.peerCapabilities, uint32(caps))
+	if caps == 0 {
+		return nil
+	}
+	if err := sesh.sendCapabilities(); err != nil {
+		return err
+	}
+	return sesh.issueResumptionSecret()
+}
+
+// sendCapabilities sends our capabilities to the remote, unless they've been sent already
+func (sesh *Session) sendCapabilities() error {
+	if sesh.Capabilities == 0 || !atomic.CompareAndSwapUint32(&sesh.capabilitiesSent, 0, 1) {
+		return nil
+	}
+	payload := make([]byte, capabilitiesLen)
+	putU32(payload, uint32(sesh.Capabilities))
+	return sesh.sendControlFrame(&Frame{
+		StreamID: 0xffffffff,
+		Closing:  advertCapabilities,
+		Payload:  payload,
+	})
+}
+
+func (sesh *Session) recvCapabilities(payload []byte) error {
+	// later versions may append more to the payload
+	if len(payload) < capabilitiesLen {
+		return errBadCapabilities
+	}
+	atomic.StoreUint32(&sesh.peerCapabilities, u32(payload))
+	if err := sesh.sendCapabilities(); err != nil {
+		return err
+	}
+	return sesh.issueResumptionSecret()
+}
@@ -0,0 +1,149 @@
+package multiplex
+
+import (
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_PeerSupports(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+
+	makePair := func(clientCaps, serverCaps Capability) (*Session, *Session) {
+		clientSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Capabilities: clientCaps})
+		serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Capabilities: serverCaps})
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+		return clientSesh, serverSesh
+	}
+
+	t.Run("both support", func(t *testing.T) {
+		// a capability unknown to us
+		const capFromFuture Capability = 1 << 31
+		clientSesh, serverSesh := makePair(SupportedCapabilities|capFromFuture, SupportedCapabilities)
+		// as told during authentication
+		err := serverSesh.SetPeerCapabilities(clientSesh.Capabilities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, serverSesh.PeerSupports(CapGoaway|CapConnMigration))
+		assert.False(t, serverSesh.PeerSupports(capFromFuture), "we don't support it")
+		assert.Eventually(t, func() bool {
+			return clientSesh.PeerSupports(CapGoaway | CapConnMigration)
+		}, time.Second, 10*time.Millisecond)
+		assert.False(t, clientSesh.PeerSupports(capFromFuture), "server doesn't support it")
+	})
+
+	t.Run("old client", func(t *testing.T) {
+		clientSesh, serverSesh := makePair(0, SupportedCapabilities)
+		err := serverSesh.SetPeerCapabilities(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, serverSesh.PeerSupports(CapGoaway))
+		assert.Equal(t, uint32(0), atomic.LoadUint32(&serverSesh.capabilitiesSent), "capabilities sent to a client that doesn't understand them")
+		assert.False(t, clientSesh.PeerSupports(CapGoaway))
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+		assert.Equal(t, errBadCapabilities, sesh.recvCapabilities([]byte{1, 2}))
+	})
+}
+
+func TestParseCapabilities(t *testing.T) {
+	caps, err := ParseCapabilities(nil)
+	assert.NoError(t, err)
+	assert.Zero(t, caps)
+
+	caps, err = ParseCapabilities([]string{"goaway", "Compact-Header"})
+	assert.NoError(t, err)
+	assert.Equal(t, CapGoaway|CapCompactHeader, caps)
+
+	var all []string
+	for name := range capabilityNames {
+		all = append(all, name)
+	}
+	caps, err = ParseCapabilities(all)
+	assert.NoError(t, err)
+	assert.Equal(t, SupportedCapabilities, caps, "not every capability has a name")
+
+	_, err = ParseCapabilities([]string{"goaway", "teleportation"})
+	assert.Error(t, err)
+}
+
+func TestSession_CompactHeader(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	// TLS record header + compact header + one byte of payload + GCM tag
+	const compactRecordLen = 5 + minCompactHeaderLength + 1 + 16
+
+	run := func(t *testing.T, clientCaps, serverCaps Capability, padding PaddingScheme, wantCompact bool) {
+		clientSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Capabilities: clientCaps, PaddingScheme: padding})
+		serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Capabilities: serverCaps, PaddingScheme: padding})
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+		c, s := connutil.AsyncPipe()
+		clientRecorder := &recordingConn{Conn: c}
+		serverRecorder := &recordingConn{Conn: s}
+		clientSesh.AddConnection(common.NewTLSConn(clientRecorder))
+		serverSesh.AddConnection(common.NewTLSConn(serverRecorder))
+		if err := serverSesh.SetPeerCapabilities(clientCaps); err != nil {
+			t.Fatal(err)
+		}
+		assert.Eventually(t, func() bool {
+			return atomic.LoadUint32(&clientSesh.peerCapabilities) == uint32(serverCaps)
+		}, time.Second, 10*time.Millisecond)
+
+		stream, _ := clientSesh.OpenStream()
+		_, err := stream.Write([]byte{1})
+		assert.NoError(t, err)
+		serverStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = serverStream.Write([]byte{2})
+		assert.NoError(t, err)
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(serverStream, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1}, buf)
+		_, err = io.ReadFull(stream, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{2}, buf)
+
+		for _, recorder := range []*recordingConn{clientRecorder, serverRecorder} {
+			recorder.m.Lock()
+			last := recorder.written[len(recorder.written)-1]
+			recorder.m.Unlock()
+			if wantCompact {
+				assert.Equal(t, compactRecordLen, len(last))
+			} else {
+				assert.Greater(t, len(last), compactRecordLen)
+			}
+		}
+	}
+
+	t.Run("both support", func(t *testing.T) {
+		run(t, SupportedCapabilities, SupportedCapabilities, PaddingScheme{}, true)
+	})
+	t.Run("client doesn't support", func(t *testing.T) {
+		run(t, SupportedCapabilities&^CapCompactHeader, SupportedCapabilities, PaddingScheme{}, false)
+	})
+	t.Run("server doesn't support", func(t *testing.T) {
+		run(t, SupportedCapabilities, SupportedCapabilities&^CapCompactHeader, PaddingScheme{}, false)
+	})
+	t.Run("padded", func(t *testing.T) {
+		run(t, SupportedCapabilities, SupportedCapabilities, PaddingScheme{BucketSize: 64}, false)
+	})
+}
@@ -0,0 +1,48 @@
+package multiplex
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// Frames obfuscated with EncryptionMethodPlain or EncryptionMethodXorStream aren't authenticated, so corrupted frames
+// would be delivered as they are. With SessionConfig.FrameChecksum, a CRC32 of the frame header fields and the
+// payload (including any padding) is appended to the payload before it is obfuscated, and frames received with a
+// wrong checksum are dropped. This detects accidental corruption, not tampering.
+
+const checksumLen = 4
+
+// ErrCorruptFrame is returned when a frame received has a checksum that doesn't match its content
+var ErrCorruptFrame = errors.New("frame checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func frameChecksum(streamID uint32, seq uint64, closing uint8, payload []byte) uint32 {
+	var header [13]byte
+	putU32(header[0:4], streamID)
+	putU64(header[4:12], seq)
+	header[12] = closing
+	crc := crc32.Update(0, crcTable, header[:])
+	return crc32.Update(crc, crcTable, payload)
+}
+
+// checksumTrailerLen returns the number of bytes added to each frame payload for its checksum
+func (sesh *Session) checksumTrailerLen() int {
+	if sesh.FrameChecksum {
+		return checksumLen
+	}
+	return 0
+}
+
+// verifyChecksum checks the checksum at the end of the payload of f and strips it
+func verifyChecksum(f *Frame) error {
+	if len(f.Payload) < checksumLen {
+		return ErrCorruptFrame
+	}
+	payload := f.Payload[:len(f.Payload)-checksumLen]
+	if u32(f.Payload[len(payload):]) != frameChecksum(f.StreamID, f.Seq, f.Closing, payload) {
+		return ErrCorruptFrame
+	}
+	f.Payload = payload
+	return nil
+}
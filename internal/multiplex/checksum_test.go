@@ -0,0 +1,62 @@
+package multiplex
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_FrameChecksum(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+
+	for _, paddingScheme := range []PaddingScheme{{}, {BucketSize: 512}} {
+		sesh := MakeSession(0, SessionConfig{
+			Obfuscator:    obfuscator,
+			FrameChecksum: true,
+			PaddingScheme: paddingScheme,
+		})
+
+		obfsBuf := make([]byte, sesh.MsgOnWireSizeLimit)
+		for _, payloadLen := range []int{1, 100, 1000, sesh.maxStreamUnitWrite} {
+			payload := make([]byte, payloadLen)
+			rand.Read(payload)
+			f := &Frame{
+				StreamID: 1,
+				Seq:      2,
+				Closing:  closingNothing,
+				Payload:  payload,
+			}
+			n, err := sesh.obfs(f, obfsBuf, 0)
+			if err != nil {
+				t.Fatalf("failed to obfs payload of length %v: %v", payloadLen, err)
+			}
+			assert.LessOrEqual(t, n, sesh.MsgOnWireSizeLimit)
+
+			corrupted := make([]byte, n)
+			copy(corrupted, obfsBuf[:n])
+			corrupted[frameHeaderLength] ^= 0x01
+
+			resultFrame, err := sesh.deobfs(obfsBuf[:n])
+			if err != nil {
+				t.Fatalf("failed to deobfs payload of length %v: %v", payloadLen, err)
+			}
+			if !bytes.Equal(payload, resultFrame.Payload) {
+				t.Errorf("expecting %x, got %x", payload, resultFrame.Payload)
+			}
+
+			err = sesh.recvDataFromRemote(corrupted, 0)
+			if n-salsa20NonceSize > frameHeaderLength {
+				assert.Equal(t, ErrCorruptFrame, err, "corrupted frame of length %v is accepted", payloadLen)
+			} else {
+				// the header is decrypted with a corrupted nonce, so the frame may be rejected before its checksum
+				// is checked
+				assert.Error(t, err, "corrupted frame of length %v is accepted", payloadLen)
+			}
+		}
+		assert.Zero(t, sesh.streamCount(), "corrupted frames opened streams")
+	}
+}
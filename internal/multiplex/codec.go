@@ -0,0 +1,32 @@
+package multiplex
+
+// ObfsCodec serialises and obfuscates frames, and the reverse, with an Obfuscator, through the same Obfser and
+// Deobfser a session uses. It's meant for testing code that produces or consumes Cloak frames without setting up a
+// Session. Session-level processing configured in SessionConfig, such as padding and checksums, isn't applied.
+// It's safe for concurrent use
+type ObfsCodec struct {
+	obfuscator Obfuscator
+}
+
+// NewObfsCodec returns an ObfsCodec using obfuscator, which must have been made with MakeObfuscator
+func NewObfsCodec(obfuscator Obfuscator) *ObfsCodec {
+	return &ObfsCodec{obfuscator: obfuscator}
+}
+
+// Encode returns f serialised and obfuscated, as a session would send it through an underlying connection before
+// compact headers are negotiated. The payload of f must not be empty
+func (c *ObfsCodec) Encode(f *Frame) ([]byte, error) {
+	buf := make([]byte, frameHeaderLength+len(f.Payload)+c.obfuscator.maxOverhead)
+	n, err := c.obfuscator.Obfs(f, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Decode deobfuscates and parses a frame as a session would receive it from an underlying connection, with either a
+// standard or a compact header. b isn't modified, and the payload of the returned frame doesn't share memory with it.
+// It returns ErrShortFrame or ErrAuthFailed like a Deobfser
+func (c *ObfsCodec) Decode(b []byte) (*Frame, error) {
+	return c.obfuscator.anyDeobfser()(append([]byte(nil), b...))
+}
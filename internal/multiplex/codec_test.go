@@ -0,0 +1,84 @@
+package multiplex
+
+import (
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObfsCodec(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+
+	for name, method := range map[string]byte{
+		"plain":             EncryptionMethodPlain,
+		"aes-gcm":           EncryptionMethodAESGCM,
+		"chacha20-poly1305": EncryptionMethodChaha20Poly1305,
+		"xor-stream":        EncryptionMethodXorStream,
+	} {
+		t.Run(name, func(t *testing.T) {
+			obfuscator, _ := MakeObfuscator(method, sessionKey)
+			codec := NewObfsCodec(obfuscator)
+			payload := make([]byte, 100)
+			rand.Read(payload)
+			f := &Frame{StreamID: 1, Seq: 42, Closing: messageEnd, Payload: payload}
+
+			encoded, err := codec.Encode(f)
+			if !assert.NoError(t, err) {
+				return
+			}
+			original := append([]byte(nil), encoded...)
+			decoded, err := codec.Decode(encoded)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, f, decoded)
+			assert.Equal(t, original, encoded, "Decode modified its input")
+
+			_, err = codec.Encode(&Frame{StreamID: 1})
+			assert.Error(t, err, "empty payload")
+			_, err = codec.Decode(encoded[:10])
+			assert.Equal(t, ErrShortFrame, err)
+		})
+	}
+
+	t.Run("interoperates with sessions", func(t *testing.T) {
+		obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+		codec := NewObfsCodec(obfuscator)
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+		defer sesh.Close()
+		c, s := connutil.AsyncPipe()
+		sesh.AddConnection(common.NewTLSConn(s))
+		remote := common.NewTLSConn(c)
+
+		// a frame encoded by the codec is received by the session
+		encoded, _ := codec.Encode(&Frame{StreamID: 1, Seq: 0, Closing: closingNothing, Payload: []byte{1, 2, 3}})
+		_, err := remote.Write(encoded)
+		assert.NoError(t, err)
+		stream, err := sesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(stream, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1, 2, 3}, buf)
+
+		// a frame sent by the session is decoded by the codec
+		_, err = stream.Write([]byte{4, 5, 6})
+		assert.NoError(t, err)
+		recvBuf := make([]byte, 1024)
+		n, err := remote.Read(recvBuf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		decoded, err := codec.Decode(recvBuf[:n])
+		if assert.NoError(t, err) {
+			assert.Equal(t, &Frame{StreamID: 1, Seq: 0, Closing: closingNothing, Payload: []byte{4, 5, 6}}, decoded)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrIncompatibleConfig is wrapped by errors returned by SessionConfig.CompatibleWith
+var ErrIncompatibleConfig = errors.New("incompatible session configs")
+
+// Derive returns a config for the remote end of a session made with c, such as the server-side config of a session
+// whose client-side config is c. Everything that must be the same on both ends, like the Obfuscator, Unordered,
+// MsgOnWireSizeLimit and PaddingScheme, is copied, and Role is swapped. Valve, Dialer, MinConnections, KeyLogWriter,
+// NoAccept and all callbacks are cleared, as they belong to one end only. Other settings are copied, and can be
+// changed afterwards
+func (c SessionConfig) Derive() SessionConfig {
+	d := c
+	switch c.Role {
+	case RoleClient:
+		d.Role = RoleServer
+	case RoleServer:
+		d.Role = RoleClient
+	}
+	d.Valve = nil
+	d.Dialer = nil
+	d.MinConnections = 0
+	d.OnReorderGap = nil
+	d.OnDrop = nil
+	d.OnNewStream = nil
+	d.FrameHook = nil
+	d.PaddingHook = nil
+	d.OnError = nil
+	d.OnGoaway = nil
+	d.KeyLogWriter = nil
+	d.NoAccept = false
+	return d
+}
+
+// CompatibleWith checks that a session made with c can talk to a remote session made with remote. It returns an
+// error wrapping ErrIncompatibleConfig that names the first mismatch found, or nil. Configs on two ends can't be
+// checked against each other by MakeSession, so mismatches otherwise show up as frames failing authentication or
+// being dropped
+func (c SessionConfig) CompatibleWith(remote SessionConfig) error {
+	if c.obfuscator().encryptionMethod != remote.obfuscator().encryptionMethod {
+		return fmt.Errorf("%w: encryption methods differ", ErrIncompatibleConfig)
+	}
+	if c.SessionKey != remote.SessionKey {
+		return fmt.Errorf("%w: session keys differ", ErrIncompatibleConfig)
+	}
+	if c.Unordered != remote.Unordered {
+		return fmt.Errorf("%w: Unordered differs", ErrIncompatibleConfig)
+	}
+	if !rolesCompatible(c.Role, remote.Role) {
+		return fmt.Errorf("%w: roles must be opposite or both RoleUnspecified", ErrIncompatibleConfig)
+	}
+	if c.PaddingScheme != remote.PaddingScheme {
+		return fmt.Errorf("%w: PaddingScheme differs", ErrIncompatibleConfig)
+	}
+	if c.FrameChecksum != remote.FrameChecksum {
+		return fmt.Errorf("%w: FrameChecksum differs", ErrIncompatibleConfig)
+	}
+	if c.ResumableStreams != remote.ResumableStreams {
+		return fmt.Errorf("%w: ResumableStreams differs", ErrIncompatibleConfig)
+	}
+	if c.Timestamped != remote.Timestamped {
+		return fmt.Errorf("%w: Timestamped differs", ErrIncompatibleConfig)
+	}
+	if c.MimicTLSRecordSizes != remote.MimicTLSRecordSizes {
+		return fmt.Errorf("%w: MimicTLSRecordSizes differs", ErrIncompatibleConfig)
+	}
+	if (c.ConnPrefix == nil) != (remote.ConnPrefix == nil) {
+		return fmt.Errorf("%w: ConnPrefix is only set on one end", ErrIncompatibleConfig)
+	}
+	if c.msgOnWireSizeLimit() > remote.connReceiveBufferSize() {
+		return fmt.Errorf("%w: MsgOnWireSizeLimit %v exceeds the remote's ConnReceiveBufferSize %v",
+			ErrIncompatibleConfig, c.msgOnWireSizeLimit(), remote.connReceiveBufferSize())
+	}
+	if remote.msgOnWireSizeLimit() > c.connReceiveBufferSize() {
+		return fmt.Errorf("%w: the remote's MsgOnWireSizeLimit %v exceeds ConnReceiveBufferSize %v",
+			ErrIncompatibleConfig, remote.msgOnWireSizeLimit(), c.connReceiveBufferSize())
+	}
+	return nil
+}
+
+// obfuscator returns the Obfuscator a session made with c uses, which is remade with the first of EncryptionMethods
+// available if it's set
+func (c SessionConfig) obfuscator() Obfuscator {
+	if len(c.EncryptionMethods) == 0 {
+		return c.Obfuscator
+	}
+	method, err := SelectEncryptionMethod(c.EncryptionMethods)
+	if err != nil {
+		log.Errorf("keeping the configured obfuscator: %v", err)
+		return c.Obfuscator
+	}
+	obfuscator, err := MakeObfuscator(method, c.SessionKey)
+	if err != nil {
+		log.Errorf("keeping the configured obfuscator: failed to make one with %v: %v", encryptionMethodName(method), err)
+		return c.Obfuscator
+	}
+	return obfuscator
+}
+
+func rolesCompatible(a, b SessionRole) bool {
+	switch a {
+	case RoleClient:
+		return b == RoleServer
+	case RoleServer:
+		return b == RoleClient
+	default:
+		return b == RoleUnspecified
+	}
+}
+
+// msgOnWireSizeLimit is MsgOnWireSizeLimit with the default MakeSession uses applied
+func (c SessionConfig) msgOnWireSizeLimit() int {
+	if c.MsgOnWireSizeLimit <= 0 {
+		return defaultSendRecvBufSize - 1024
+	}
+	return c.MsgOnWireSizeLimit
+}
+
+// connReceiveBufferSize is ConnReceiveBufferSize with the default MakeSession uses applied
+func (c SessionConfig) connReceiveBufferSize() int {
+	if c.ConnReceiveBufferSize <= 0 {
+		return defaultSendRecvBufSize
+	}
+	return c.ConnReceiveBufferSize
+}
@@ -0,0 +1,132 @@
+package multiplex
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionConfig_Derive(t *testing.T) {
+	var sessionKey [32]byte
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	clientConfig := SessionConfig{
+		Obfuscator:         obfuscator,
+		Unordered:          true,
+		Role:               RoleClient,
+		MsgOnWireSizeLimit: 1500,
+		PaddingScheme:      PaddingScheme{BucketSize: 256},
+		FrameChecksum:      true,
+		MinConnections:     2,
+		OnError:            func(err error) {},
+	}
+
+	serverConfig := clientConfig.Derive()
+	assert.Equal(t, RoleServer, serverConfig.Role)
+	assert.Equal(t, clientConfig.Obfuscator.SessionKey, serverConfig.Obfuscator.SessionKey)
+	assert.True(t, serverConfig.Unordered)
+	assert.Equal(t, 1500, serverConfig.MsgOnWireSizeLimit)
+	assert.Equal(t, 0, serverConfig.MinConnections)
+	assert.Nil(t, serverConfig.OnError)
+	assert.NoError(t, clientConfig.CompatibleWith(serverConfig))
+	assert.NoError(t, serverConfig.CompatibleWith(clientConfig))
+
+	t.Run("derived session works", func(t *testing.T) {
+		clientConfig.OnError = nil
+		client := MakeSession(0, clientConfig)
+		server := MakeSession(0, serverConfig)
+		c, s := connutil.AsyncPipe()
+		client.AddConnection(common.NewTLSConn(c))
+		server.AddConnection(common.NewTLSConn(s))
+		defer client.Close()
+		defer server.Close()
+
+		stream, err := client.OpenStream()
+		assert.NoError(t, err)
+		_, err = stream.Write([]byte{1, 2, 3})
+		assert.NoError(t, err)
+		accepted, err := server.Accept()
+		assert.NoError(t, err)
+		buf := make([]byte, 3)
+		_, err = accepted.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1, 2, 3}, buf)
+	})
+
+	mismatches := map[string]func(c *SessionConfig){
+		"encryption method": func(c *SessionConfig) {
+			c.Obfuscator, _ = MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+		},
+		"session key": func(c *SessionConfig) {
+			c.Obfuscator, _ = MakeObfuscator(EncryptionMethodAESGCM, [32]byte{1})
+		},
+		"unordered":      func(c *SessionConfig) { c.Unordered = false },
+		"role":           func(c *SessionConfig) { c.Role = RoleClient },
+		"padding":        func(c *SessionConfig) { c.PaddingScheme = PaddingScheme{} },
+		"checksum":       func(c *SessionConfig) { c.FrameChecksum = false },
+		"timestamped":    func(c *SessionConfig) { c.Timestamped = true },
+		"resumable":      func(c *SessionConfig) { c.ResumableStreams = true },
+		"tls records":    func(c *SessionConfig) { c.MimicTLSRecordSizes = true },
+		"prefix":         func(c *SessionConfig) { c.ConnPrefix = func() []byte { return []byte{1} } },
+		"receive buffer": func(c *SessionConfig) { c.ConnReceiveBufferSize = 1000 },
+		"frame size":     func(c *SessionConfig) { c.MsgOnWireSizeLimit = defaultSendRecvBufSize * 2 },
+	}
+	for name, mismatch := range mismatches {
+		t.Run(name, func(t *testing.T) {
+			remote := clientConfig.Derive()
+			mismatch(&remote)
+			err := clientConfig.CompatibleWith(remote)
+			assert.True(t, errors.Is(err, ErrIncompatibleConfig), "got %v", err)
+		})
+	}
+}
+
+func TestSessionConfig_EncryptionMethods(t *testing.T) {
+	var sessionKey [32]byte
+	config := SessionConfig{
+		Obfuscator:        Obfuscator{SessionKey: sessionKey},
+		Role:              RoleClient,
+		EncryptionMethods: []byte{EncryptionMethodChaha20Poly1305, EncryptionMethodAESGCM, EncryptionMethodPlain},
+	}
+
+	sesh := MakeSession(0, config)
+	// depends on the build
+	expected, _ := SelectEncryptionMethod(config.EncryptionMethods)
+	assert.Equal(t, expected, sesh.Obfuscator.encryptionMethod)
+	assert.Equal(t, sessionKey, sesh.SessionKey)
+
+	t.Run("restricted", func(t *testing.T) {
+		defer restrictEncryptionMethods(EncryptionMethodPlain, EncryptionMethodAESGCM)()
+		clientSesh := MakeSession(0, config)
+		serverSesh := MakeSession(0, config.Derive())
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+		assert.Equal(t, byte(EncryptionMethodAESGCM), clientSesh.Obfuscator.encryptionMethod)
+		assert.NoError(t, config.CompatibleWith(config.Derive()))
+
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+		stream, _ := clientSesh.OpenStream()
+		_, err := stream.Write([]byte{1})
+		assert.NoError(t, err)
+		_, err = serverSesh.Accept()
+		assert.NoError(t, err)
+	})
+
+	t.Run("none available", func(t *testing.T) {
+		defer restrictEncryptionMethods(EncryptionMethodPlain)()
+		obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+		config := SessionConfig{Obfuscator: obfuscator, EncryptionMethods: []byte{EncryptionMethodAESGCM}}
+		sesh := MakeSession(0, config)
+		assert.Equal(t, byte(EncryptionMethodPlain), sesh.Obfuscator.encryptionMethod, "configured obfuscator not kept")
+	})
+
+	t.Run("different choices", func(t *testing.T) {
+		remote := config.Derive()
+		remote.EncryptionMethods = []byte{EncryptionMethodPlain}
+		assert.True(t, errors.Is(config.CompatibleWith(remote), ErrIncompatibleConfig))
+	})
+}
@@ -0,0 +1,227 @@
+package multiplex
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Frames are obfuscated with the session's Obfuscator before the connection they are sent through is picked. A
+// connection with an Obfuscator of its own is wrapped in an obfsConn, which re-obfuscates each frame written into it
+// with the connection's Obfuscator, and each frame read from it with the session's, so that the rest of the session
+// is unaware of it. This costs an extra decryption and encryption of every frame through the connection.
+//
+// The key of such a connection can be replaced with Session.RekeyConnection, which sends rekeyConn through the
+// connection as the last frame obfuscated with the current key. Its payload starts with the number of times the
+// sender has rekeyed the connection, this one included:
+//
+//	| counter (uint64) |
+//
+// The next key is derived from the current one and the counter with HKDF-SHA256 on both ends, so it's never sent.
+// The obfsConn switches to it for frames it writes once it has written rekeyConn, and the obfsConn at the remote end
+// switches to it for frames it reads once it has read rekeyConn. The current key is then forgotten, so a key that
+// leaks later doesn't expose frames sent before it. Each direction is rekeyed on its own, and the rest of the session
+// carries on through other connections as usual.
+
+const rekeyConnLen = 8
+
+// rekeyInfo is the HKDF info the next key of a connection is derived with, followed by the counter of rekeyConn
+const rekeyInfo = "rekey"
+
+var errNoConnObfuscator = errors.New("connection has no obfuscator of its own")
+var errBadRekeyConn = errors.New("connection rekey frame is malformed")
+
+// obfsConn re-obfuscates frames between the Obfuscator of a session and that of one of its connections
+type obfsConn struct {
+	net.Conn
+	session *Obfuscator
+	logger  Logger
+	// obfuscator obfuscates frames written, and is guarded by writeM. recvObfuscator deobfuscates frames read. They
+	// start out the same, and are replaced separately on rekeying
+	obfuscator     *Obfuscator
+	recvObfuscator *Obfuscator
+
+	// serialises rekeying, so that rekeyConn frames are written in the order of their counters
+	rekeyM sync.Mutex
+	// the number of times the obfuscator of each direction has been replaced. rekeysSent is guarded by rekeyM
+	rekeysSent uint64
+	rekeysRecv uint64
+
+	writeM   sync.Mutex
+	writeIn  []byte
+	writeOut []byte
+
+	readBuf []byte
+}
+
+// AddConnectionWithObfuscator is like AddConnection, but frames sent and received through conn are obfuscated with
+// obfuscator instead of the session's Obfuscator, so that each path a multipath session takes can be obfuscated
+// differently. The remote must add its end of conn with the same obfuscator. Padding, checksums and the other
+// settings of the session still apply
+func (sesh *Session) AddConnectionWithObfuscator(conn net.Conn, obfuscator Obfuscator) error {
+	if _, err := sesh.sb.addConnWithObfuscator(conn, familyOf(conn.RemoteAddr()), &obfuscator); err != nil {
+		return err
+	}
+	addrs := []net.Addr{conn.LocalAddr(), conn.RemoteAddr()}
+	sesh.addrs.Store(addrs)
+	return nil
+}
+
+// RekeyConnection replaces the key the connection of connId, as listed by Connections, obfuscates frames sent through
+// it with, without disturbing the rest of the session. The connection must have been added with
+// AddConnectionWithObfuscator. The new key is derived from the current one on both ends, and the encryption method
+// stays the same. Frames already written into the connection are still deobfuscated with the old key by the remote,
+// which switches to the new one on its own for the frames that follow. Frames the remote sends through the connection
+// are obfuscated with the old key until it rekeys the connection too. The remote must support this, which can be
+// checked with PeerSupports(CapConnRekey)
+func (sesh *Session) RekeyConnection(connId uint32) error {
+	if sesh.IsClosed() {
+		return ErrBrokenSession
+	}
+	connI, ok := sesh.sb.conns.Load(connId)
+	if !ok {
+		return errNoSuchConn
+	}
+	c, ok := connI.(*obfsConn)
+	if !ok {
+		return errNoConnObfuscator
+	}
+	c.rekeyM.Lock()
+	defer c.rekeyM.Unlock()
+	payload := make([]byte, rekeyConnLen)
+	putU64(payload, c.rekeysSent+1)
+	err := sesh.sendControlFrameTo(&Frame{
+		StreamID: 0xffffffff,
+		Closing:  rekeyConn,
+		Payload:  append(payload, genRandomPadding()...),
+	}, connId)
+	if err != nil {
+		return err
+	}
+	c.rekeysSent++
+	return nil
+}
+
+// recvRekeyConn logs that the remote has rekeyed the connection of connId. The connection has already switched to
+// the new key by the time the frame arrives
+func (sesh *Session) recvRekeyConn(connId uint32) error {
+	connI, ok := sesh.sb.conns.Load(connId)
+	if !ok {
+		return nil
+	}
+	if _, ok := connI.(*obfsConn); !ok {
+		sesh.Logger.Warnf("remote of session %v rekeyed connection %v, which has no obfuscator of its own", sesh.id,
+			connId)
+		return nil
+	}
+	sesh.Logger.Debugf("remote of session %v rekeyed connection %v", sesh.id, connId)
+	return nil
+}
+
+// nextConnObfuscator derives the Obfuscator that replaces current when a connection is rekeyed for the counter-th
+// time
+func nextConnObfuscator(current *Obfuscator, counter uint64) (*Obfuscator, error) {
+	info := make([]byte, len(rekeyInfo)+8)
+	copy(info, rekeyInfo)
+	putU64(info[len(rekeyInfo):], counter)
+	var key [32]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, current.SessionKey[:], nil, info), key[:]); err != nil {
+		return nil, err
+	}
+	obfuscator, err := MakeObfuscator(current.encryptionMethod, key)
+	if err != nil {
+		return nil, err
+	}
+	return &obfuscator, nil
+}
+
+// rekeyCounter returns the counter in the payload of rekeyConn
+func rekeyCounter(payload []byte) (uint64, error) {
+	if len(payload) < rekeyConnLen {
+		return 0, errBadRekeyConn
+	}
+	return u64(payload), nil
+}
+
+// isRekeyConn returns whether f is rekeyConn
+func isRekeyConn(f *Frame) bool {
+	return f.StreamID == 0xffffffff && f.Closing == rekeyConn
+}
+
+// Write re-obfuscates a frame obfuscated with the session's Obfuscator with that of the connection. b isn't modified,
+// as it may be sent again through another connection
+func (c *obfsConn) Write(b []byte) (int, error) {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+	c.writeIn = append(c.writeIn[:0], b...)
+	// the frame may have a compact header
+	f, err := c.session.anyDeobfser()(c.writeIn)
+	if err != nil {
+		return 0, err
+	}
+	outLen := frameHeaderLength + len(f.Payload) + c.obfuscator.maxOverhead + salsa20NonceSize
+	if cap(c.writeOut) < outLen {
+		c.writeOut = make([]byte, outLen)
+	}
+	i, err := c.obfuscator.Obfs(f, c.writeOut[:outLen], 0)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.Conn.Write(c.writeOut[:i])
+	if err != nil {
+		return 0, err
+	}
+	if isRekeyConn(f) {
+		// the remote switches to the next Obfuscator after reading this frame
+		counter, err := rekeyCounter(f.Payload)
+		if err != nil {
+			return 0, err
+		}
+		next, err := nextConnObfuscator(c.obfuscator, counter)
+		if err != nil {
+			return 0, err
+		}
+		c.obfuscator = next
+	}
+	return len(b), nil
+}
+
+// Read reads a frame obfuscated with the connection's Obfuscator and returns it obfuscated with the session's. Frames
+// that fail to be deobfuscated are dropped
+func (c *obfsConn) Read(b []byte) (int, error) {
+	if len(c.readBuf) < len(b) {
+		c.readBuf = make([]byte, len(b))
+	}
+	for {
+		n, err := c.Conn.Read(c.readBuf[:len(b)])
+		if err != nil {
+			return 0, err
+		}
+		f, err := c.recvObfuscator.Deobfs(c.readBuf[:n])
+		if err != nil {
+			c.logger.Debugf("dropping a frame that failed to be deobfuscated with the connection's obfuscator: %v", err)
+			continue
+		}
+		if isRekeyConn(f) {
+			// the remote obfuscates frames after this one with the next Obfuscator
+			counter, err := rekeyCounter(f.Payload)
+			if err != nil {
+				return 0, err
+			}
+			if counter != c.rekeysRecv+1 {
+				return 0, errBadRekeyConn
+			}
+			next, err := nextConnObfuscator(c.recvObfuscator, counter)
+			if err != nil {
+				return 0, err
+			}
+			c.recvObfuscator = next
+			c.rekeysRecv = counter
+		}
+		return c.session.Obfs(f, b, 0)
+	}
+}
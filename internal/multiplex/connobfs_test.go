@@ -0,0 +1,227 @@
+package multiplex
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingConn keeps a copy of everything written into it
+type recordingConn struct {
+	net.Conn
+	m       sync.Mutex
+	written [][]byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.m.Lock()
+	c.written = append(c.written, append([]byte{}, b...))
+	c.m.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestSession_AddConnectionWithObfuscator(t *testing.T) {
+	var sessionKey, connKey [32]byte
+	rand.Read(sessionKey[:])
+	rand.Read(connKey[:])
+	sessionObfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+	connObfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, connKey)
+	config := SessionConfig{
+		Obfuscator: sessionObfuscator,
+		Unordered:  true,
+		Role:       RoleClient,
+	}
+	clientSesh := MakeSession(0, config)
+	serverSesh := MakeSession(0, config.Derive())
+	defer clientSesh.Close()
+	defer serverSesh.Close()
+
+	c0, s0 := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c0))
+	serverSesh.AddConnection(common.NewTLSConn(s0))
+	c1, s1 := connutil.AsyncPipe()
+	recorder := &recordingConn{Conn: c1}
+	clientSesh.AddConnectionWithObfuscator(common.NewTLSConn(recorder), connObfuscator)
+	serverSesh.AddConnectionWithObfuscator(common.NewTLSConn(s1), connObfuscator)
+
+	var methods []byte
+	for _, info := range clientSesh.Connections() {
+		methods = append(methods, info.EncryptionMethod)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i] < methods[j] })
+	assert.Equal(t, []byte{EncryptionMethodAESGCM, EncryptionMethodChaha20Poly1305}, methods)
+
+	// frames of the stream are spread over both connections
+	stream, _ := clientSesh.OpenStream()
+	const numMsgs = 100
+	var sent []int
+	for i := 0; i < numMsgs; i++ {
+		msg := make([]byte, 100)
+		rand.Read(msg)
+		msg[0] = byte(i)
+		sent = append(sent, i)
+		_, err := stream.Write(msg)
+		assert.NoError(t, err)
+	}
+
+	remoteStream, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var received []int
+	buf := make([]byte, 1000)
+	for i := 0; i < numMsgs; i++ {
+		n, err := remoteStream.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 100, n)
+		received = append(received, int(buf[0]))
+	}
+	sort.Ints(received)
+	assert.Equal(t, sent, received)
+
+	// frames through the connection with its own obfuscator can't be deobfuscated with the session's
+	recorder.m.Lock()
+	defer recorder.m.Unlock()
+	if assert.NotEmpty(t, recorder.written) {
+		for _, record := range recorder.written {
+			frame := append([]byte{}, record[5:]...)
+			_, err := sessionObfuscator.Deobfs(frame)
+			assert.Error(t, err)
+			frame = append([]byte{}, record[5:]...)
+			_, err = connObfuscator.Deobfs(frame)
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestSession_RekeyConnection(t *testing.T) {
+	var sessionKey, connKey [32]byte
+	rand.Read(sessionKey[:])
+	rand.Read(connKey[:])
+	sessionObfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+	connObfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, connKey)
+	config := SessionConfig{
+		Obfuscator: sessionObfuscator,
+		Unordered:  true,
+		Role:       RoleClient,
+	}
+	clientSesh := MakeSession(0, config)
+	serverSesh := MakeSession(0, config.Derive())
+	defer clientSesh.Close()
+	defer serverSesh.Close()
+
+	c0, s0 := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c0))
+	serverSesh.AddConnection(common.NewTLSConn(s0))
+	c1, s1 := connutil.AsyncPipe()
+	recorder := &recordingConn{Conn: c1}
+	clientSesh.AddConnectionWithObfuscator(common.NewTLSConn(recorder), connObfuscator)
+	serverSesh.AddConnectionWithObfuscator(common.NewTLSConn(s1), connObfuscator)
+	connIdOf := func(sesh *Session, method byte) uint32 {
+		for _, info := range sesh.Connections() {
+			if info.EncryptionMethod == method {
+				return info.ID
+			}
+		}
+		return 0
+	}
+
+	// frames are spread over both connections while one of them is rekeyed
+	stream, _ := clientSesh.OpenStream()
+	var sent int
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := stream.Write(make([]byte, 100)); err != nil {
+				t.Error(err)
+				return
+			}
+			sent++
+		}
+	}()
+	remoteStream, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var received int
+	buf := make([]byte, 1000)
+	for ; received < 10; received++ {
+		_, err = remoteStream.Read(buf)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, errNoConnObfuscator, clientSesh.RekeyConnection(connIdOf(clientSesh, EncryptionMethodChaha20Poly1305)))
+	connId := connIdOf(clientSesh, EncryptionMethodAESGCM)
+	// rekeyed twice, so that the second key is derived from the first one
+	rekeyedFrom := make([]int, 2)
+	for i := range rekeyedFrom {
+		assert.NoError(t, clientSesh.RekeyConnection(connId))
+		recorder.m.Lock()
+		rekeyedFrom[i] = len(recorder.written)
+		recorder.m.Unlock()
+		assert.Eventually(t, func() bool {
+			recorder.m.Lock()
+			defer recorder.m.Unlock()
+			return len(recorder.written) > rekeyedFrom[i]+10
+		}, time.Second, time.Millisecond, "nothing is sent through the rekeyed connection")
+	}
+	close(stop)
+	<-stopped
+	for ; received < sent; received++ {
+		_, err = remoteStream.Read(buf)
+		if !assert.NoError(t, err, "frames are lost on rekeying") {
+			return
+		}
+	}
+
+	// the keys are derived rather than sent
+	firstKey, err := nextConnObfuscator(&connObfuscator, 1)
+	assert.NoError(t, err)
+	secondKey, err := nextConnObfuscator(firstKey, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(EncryptionMethodAESGCM), secondKey.encryptionMethod)
+	deobfsWith := func(obfuscator *Obfuscator, record []byte) error {
+		_, err := obfuscator.Deobfs(append([]byte{}, record[5:]...))
+		return err
+	}
+	recorder.m.Lock()
+	for _, record := range recorder.written[rekeyedFrom[0]:rekeyedFrom[1]] {
+		assert.Error(t, deobfsWith(&connObfuscator, record))
+		assert.NoError(t, deobfsWith(firstKey, record))
+	}
+	for _, record := range recorder.written[rekeyedFrom[1]:] {
+		assert.Error(t, deobfsWith(firstKey, record))
+		assert.NoError(t, deobfsWith(secondKey, record))
+	}
+	recorder.m.Unlock()
+
+	// the other direction is still obfuscated with the old key until the remote rekeys it too
+	assert.NoError(t, serverSesh.RekeyConnection(connIdOf(serverSesh, EncryptionMethodAESGCM)))
+	const numReplies = 100
+	for i := 0; i < numReplies; i++ {
+		_, err := remoteStream.Write(make([]byte, 100))
+		assert.NoError(t, err)
+	}
+	for i := 0; i < numReplies; i++ {
+		_, err = stream.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+}
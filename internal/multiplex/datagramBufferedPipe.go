@@ -9,24 +9,53 @@ import (
 	"time"
 )
 
+// DropPolicy decides which datagrams are dropped once a stream in an unordered session has reached
+// SessionConfig.UnorderedBufferLimit
+type DropPolicy int
+
+const (
+	// DropNewest drops datagrams arriving while the buffer is full
+	DropNewest DropPolicy = iota
+	// DropOldest drops the oldest unread datagrams to make room for those arriving
+	DropOldest
+)
+
 // datagramBufferedPipe is the same as streamBufferedPipe with the exception that it's message-oriented,
 // instead of byte-oriented. The integrity of datagrams written into this buffer is preserved.
 // it won't get chopped up into individual bytes
 type datagramBufferedPipe struct {
 	pLens []int
 	// lazily allocated
-	buf       *bytes.Buffer
-	closed    bool
+	buf    *bytes.Buffer
+	closed bool
+	// while set, reads wait as if there were no data
+	paused    bool
 	rwCond    *sync.Cond
 	wtTimeout time.Duration
 	rDeadline time.Time
 
 	timeoutTimer *time.Timer
+
+	// the capacity allocated for buf when data is first written, and the amount of data in buf beyond which Write
+	// blocks until some of it has been read
+	initialSize int
+	sizeLimit   int
+
+	// if non-nil, returned instead of io.EOF by reads from a closed and drained pipe
+	closeErr error
+
+	// if dropLimit is non-zero, datagrams are dropped according to dropPolicy instead of Write blocking, so that there
+	// is never more than dropLimit bytes of unread data. onDrop, if set, is called with the number of datagrams and
+	// bytes dropped by each Write, after the lock is released
+	dropLimit  int
+	dropPolicy DropPolicy
+	onDrop     func(datagrams int, bytes int)
 }
 
 func NewDatagramBufferedPipe() *datagramBufferedPipe {
 	d := &datagramBufferedPipe{
-		rwCond: sync.NewCond(&sync.Mutex{}),
+		rwCond:    sync.NewCond(&sync.Mutex{}),
+		sizeLimit: recvBufferSizeLimit,
 	}
 	return d
 }
@@ -39,7 +68,7 @@ func (d *datagramBufferedPipe) Read(target []byte) (int, error) {
 	}
 	for {
 		if d.closed && len(d.pLens) == 0 {
-			return 0, io.EOF
+			return 0, d.eof()
 		}
 
 		hasRDeadline := !d.rDeadline.IsZero()
@@ -49,7 +78,7 @@ func (d *datagramBufferedPipe) Read(target []byte) (int, error) {
 			}
 		}
 
-		if len(d.pLens) > 0 {
+		if len(d.pLens) > 0 && !d.paused {
 			break
 		}
 
@@ -77,7 +106,7 @@ func (d *datagramBufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
 	}
 	for {
 		if d.closed && len(d.pLens) == 0 {
-			return 0, io.EOF
+			return 0, d.eof()
 		}
 
 		hasRDeadline := !d.rDeadline.IsZero()
@@ -87,7 +116,7 @@ func (d *datagramBufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
 			}
 		}
 
-		if len(d.pLens) > 0 {
+		if len(d.pLens) > 0 && !d.paused {
 			var dataLen int
 			dataLen, d.pLens = d.pLens[0], d.pLens[1:]
 			written, er := w.Write(d.buf.Next(dataLen))
@@ -98,7 +127,7 @@ func (d *datagramBufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
 			}
 			d.rwCond.Broadcast()
 		} else {
-			if d.wtTimeout == 0 {
+			if d.wtTimeout == 0 || d.paused {
 				if hasRDeadline {
 					d.broadcastAfter(time.Until(d.rDeadline))
 				}
@@ -113,6 +142,12 @@ func (d *datagramBufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 func (d *datagramBufferedPipe) Write(f Frame) (toBeClosed bool, err error) {
+	var droppedDatagrams, droppedBytes int
+	defer func() {
+		if droppedDatagrams > 0 && d.onDrop != nil {
+			d.onDrop(droppedDatagrams, droppedBytes)
+		}
+	}()
 	d.rwCond.L.Lock()
 	defer d.rwCond.L.Unlock()
 	if d.buf == nil {
@@ -122,20 +157,39 @@ func (d *datagramBufferedPipe) Write(f Frame) (toBeClosed bool, err error) {
 		if d.closed {
 			return true, io.ErrClosedPipe
 		}
-		if d.buf.Len() <= recvBufferSizeLimit {
+		if d.dropLimit > 0 {
+			break
+		}
+		if d.buf.Len() <= d.sizeLimit {
 			// if d.buf gets too large, write() will panic. We don't want this to happen
 			break
 		}
 		d.rwCond.Wait()
 	}
 
-	if f.Closing != closingNothing {
+	if !carriesData(f.Closing) {
 		d.closed = true
 		d.rwCond.Broadcast()
 		return true, nil
 	}
 
 	dataLen := len(f.Payload)
+	if d.dropLimit > 0 && d.buf.Len()+dataLen > d.dropLimit {
+		if d.dropPolicy == DropNewest || dataLen > d.dropLimit {
+			droppedDatagrams, droppedBytes = 1, dataLen
+			return false, nil
+		}
+		for d.buf.Len()+dataLen > d.dropLimit {
+			d.buf.Next(d.pLens[0])
+			droppedDatagrams++
+			droppedBytes += d.pLens[0]
+			d.pLens = d.pLens[1:]
+		}
+	}
+
+	if d.buf.Cap() == 0 {
+		d.buf.Grow(d.initialSize)
+	}
 	d.pLens = append(d.pLens, dataLen)
 	d.buf.Write(f.Payload)
 	// err will always be nil
@@ -152,6 +206,81 @@ func (d *datagramBufferedPipe) Close() error {
 	return nil
 }
 
+// readMessage reads the next datagram, as each of them is a whole message
+func (d *datagramBufferedPipe) readMessage() ([]byte, error) {
+	d.rwCond.L.Lock()
+	defer d.rwCond.L.Unlock()
+	if d.buf == nil {
+		d.buf = new(bytes.Buffer)
+	}
+	for {
+		if d.closed && len(d.pLens) == 0 {
+			return nil, d.eof()
+		}
+
+		hasRDeadline := !d.rDeadline.IsZero()
+		if hasRDeadline {
+			if time.Until(d.rDeadline) <= 0 {
+				return nil, ErrTimeout
+			}
+		}
+
+		if len(d.pLens) > 0 && !d.paused {
+			break
+		}
+
+		if hasRDeadline {
+			d.broadcastAfter(time.Until(d.rDeadline))
+		}
+		d.rwCond.Wait()
+	}
+	var dataLen int
+	dataLen, d.pLens = d.pLens[0], d.pLens[1:]
+	msg := append([]byte(nil), d.buf.Next(dataLen)...)
+	d.rwCond.Broadcast()
+	return msg, nil
+}
+
+func (d *datagramBufferedPipe) reset(err error) {
+	d.rwCond.L.Lock()
+	defer d.rwCond.L.Unlock()
+
+	d.closed = true
+	if d.closeErr == nil {
+		// the first reason given stays
+		d.closeErr = err
+	}
+	d.pLens = nil
+	if d.buf != nil {
+		d.buf.Reset()
+	}
+	d.rwCond.Broadcast()
+}
+
+func (d *datagramBufferedPipe) setPaused(paused bool) {
+	d.rwCond.L.Lock()
+	defer d.rwCond.L.Unlock()
+
+	d.paused = paused
+	d.rwCond.Broadcast()
+}
+
+func (d *datagramBufferedPipe) eof() error {
+	if d.closeErr != nil {
+		return d.closeErr
+	}
+	return io.EOF
+}
+
+func (d *datagramBufferedPipe) buffered() int {
+	d.rwCond.L.Lock()
+	defer d.rwCond.L.Unlock()
+	if d.buf == nil {
+		return 0
+	}
+	return d.buf.Len()
+}
+
 func (d *datagramBufferedPipe) SetReadDeadline(t time.Time) {
 	d.rwCond.L.Lock()
 	defer d.rwCond.L.Unlock()
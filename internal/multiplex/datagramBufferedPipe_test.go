@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDatagramBuffer_RW(t *testing.T) {
@@ -138,3 +140,50 @@ func TestDatagramBuffer_CloseThenRead(t *testing.T) {
 		return
 	}
 }
+
+func TestDatagramBuffer_DropPolicy(t *testing.T) {
+	// writes ten 4-byte datagrams into a pipe with room for three, and returns those read and the drops reported
+	run := func(policy DropPolicy) (read []byte, droppedDatagrams int, droppedBytes int) {
+		pipe := NewDatagramBufferedPipe()
+		pipe.dropLimit = 12
+		pipe.dropPolicy = policy
+		pipe.onDrop = func(datagrams int, bytes int) {
+			droppedDatagrams += datagrams
+			droppedBytes += bytes
+		}
+		for i := byte(0); i < 10; i++ {
+			toBeClosed, err := pipe.Write(Frame{Payload: []byte{i, i, i, i}})
+			if toBeClosed || err != nil {
+				t.Fatalf("write %v failed: %v", i, err)
+			}
+		}
+		// too large to ever fit
+		_, _ = pipe.Write(Frame{Payload: make([]byte, 13)})
+		pipe.Close()
+		buf := make([]byte, 16)
+		for {
+			n, err := pipe.Read(buf)
+			if err != nil {
+				return
+			}
+			read = append(read, buf[0])
+			if n != 4 {
+				t.Errorf("read %v bytes, expecting 4", n)
+			}
+		}
+	}
+
+	t.Run("drop newest", func(t *testing.T) {
+		read, datagrams, bytes := run(DropNewest)
+		assert.Equal(t, []byte{0, 1, 2}, read)
+		assert.Equal(t, 8, datagrams)
+		assert.Equal(t, 7*4+13, bytes)
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		read, datagrams, bytes := run(DropOldest)
+		assert.Equal(t, []byte{7, 8, 9}, read)
+		assert.Equal(t, 8, datagrams)
+		assert.Equal(t, 7*4+13, bytes)
+	})
+}
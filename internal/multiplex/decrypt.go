@@ -0,0 +1,103 @@
+package multiplex
+
+import (
+	"net"
+	"sync"
+)
+
+// With SessionConfig.DecryptWorkers, records received are deobfuscated by a pool of goroutines shared by all
+// connections of a session, rather than by the goroutine reading each connection, so that deobfuscation can make use
+// of several cores even when most data comes through one connection. Each connection still has a single goroutine
+// acting on its frames, which takes them in the order their records arrived, so frames are handled in the same order
+// as without the pool.
+
+// decryptJob is a record received, to be deobfuscated by a worker
+type decryptJob struct {
+	data  []byte
+	frame *Frame
+	err   error
+	// closed once frame or err is set
+	done chan struct{}
+}
+
+// decryptWorker deobfuscates records until the session is closed
+func (sesh *Session) decryptWorker() {
+	for {
+		select {
+		case job := <-sesh.decryptJobs:
+			sesh.decrypt(job)
+		case <-sesh.done:
+			return
+		}
+	}
+}
+
+func (sesh *Session) decrypt(job *decryptJob) {
+	defer close(job.done)
+	defer sesh.recoverRecv(&job.err)
+	job.frame, job.err = sesh.deobfs(job.data)
+}
+
+// decryptPipeline passes records received from a connection to the decryption workers, and acts on their frames in
+// the order the records arrived
+type decryptPipeline struct {
+	sesh *Session
+	// jobs handed to the workers, in the order their records arrived
+	queue      chan *decryptJob
+	finishOnce sync.Once
+	// closed once all frames in queue have been acted on
+	delivered chan struct{}
+}
+
+func (sb *switchboard) startDecryptPipeline(connId uint32, conn net.Conn, health *connHealth) *decryptPipeline {
+	p := &decryptPipeline{
+		sesh:      sb.session,
+		queue:     make(chan *decryptJob, sb.session.DecryptWorkers),
+		delivered: make(chan struct{}),
+	}
+	go func() {
+		defer close(p.delivered)
+		stopped := false
+		for job := range p.queue {
+			<-job.done
+			if stopped {
+				continue
+			}
+			err := job.err
+			if err == nil {
+				err = sb.recvDeobfsed(job.frame, connId)
+			}
+			if sb.recvFailed(connId, conn, health, err) {
+				stopped = true
+				// so that switchboard.deplex stops reading from it
+				_ = conn.Close()
+			}
+		}
+	}()
+	return p
+}
+
+// recvDeobfsed passes a deobfuscated frame received from the connection of connId to the session, recovering from any
+// panic like recvFrame
+func (sb *switchboard) recvDeobfsed(frame *Frame, connId uint32) (err error) {
+	defer sb.session.recoverRecv(&err)
+	return sb.session.recvDeobfsed(frame, connId)
+}
+
+// submit hands a record over to the workers. It returns false if the session has been closed
+func (p *decryptPipeline) submit(data []byte) bool {
+	job := &decryptJob{data: data, done: make(chan struct{})}
+	select {
+	case p.sesh.decryptJobs <- job:
+	case <-p.sesh.done:
+		return false
+	}
+	p.queue <- job
+	return true
+}
+
+// finish waits for the frames of all records submitted to be acted on. No record can be submitted afterwards
+func (p *decryptPipeline) finish() {
+	p.finishOnce.Do(func() { close(p.queue) })
+	<-p.delivered
+}
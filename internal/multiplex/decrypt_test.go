@@ -0,0 +1,94 @@
+package multiplex
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_DecryptWorkers(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	// an unordered stream delivers datagrams in the order they are acted on, so any reordering by the workers shows
+	clientConfig := SessionConfig{Obfuscator: obfuscator, Unordered: true, DecryptWorkers: 4}
+	clientSesh := MakeSession(0, clientConfig)
+	serverSesh := MakeSession(0, clientConfig.Derive())
+	defer clientSesh.Close()
+	defer serverSesh.Close()
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	const datagrams = 2000
+	stream, _ := clientSesh.OpenStream()
+	go func() {
+		for i := 0; i < datagrams; i++ {
+			// of varying lengths, so that they take varying times to deobfuscate
+			datagram := make([]byte, 4+rand.Intn(1000))
+			binary.BigEndian.PutUint32(datagram, uint32(i))
+			_, _ = stream.Write(datagram)
+		}
+	}()
+	serverStream, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := make([]byte, 2048)
+	for i := 0; i < datagrams; i++ {
+		n, err := serverStream.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if !assert.True(t, n >= 4) || !assert.Equal(t, uint32(i), binary.BigEndian.Uint32(buf), "frames are reordered") {
+			return
+		}
+	}
+}
+
+// recordsConn returns a copy of record on each Read, count times, then io.EOF
+type recordsConn struct {
+	net.Conn
+	record []byte
+	count  int
+}
+
+func (c *recordsConn) Read(b []byte) (int, error) {
+	if c.count == 0 {
+		return 0, io.EOF
+	}
+	c.count--
+	return copy(b, c.record), nil
+}
+
+func BenchmarkSession_DecryptWorkers(b *testing.B) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	// frames that are acted on by doing nothing, so that only receiving and deobfuscating them is measured
+	payload := make([]byte, 16384)
+	rand.Read(payload)
+	sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+	record := make([]byte, sesh.obfsBufLen(len(payload)))
+	n, _ := sesh.Obfs(&Frame{StreamID: 0xffffffff, Closing: probeReply, Payload: payload}, record, 0)
+	record = record[:n]
+	sesh.Close()
+
+	for _, workers := range []int{1, 4} {
+		b.Run(strconv.Itoa(workers)+" workers", func(b *testing.B) {
+			sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, DecryptWorkers: workers})
+			b.SetBytes(int64(len(record)))
+			b.ResetTimer()
+			// the session is closed once the connection has been read to the end
+			sesh.AddConnection(&recordsConn{Conn: connutil.Discard(), record: record, count: b.N})
+			<-sesh.done
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package multiplex
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// An underlying connection is removed from a session without losing frames by draining it. The end removing it stops
+// sending new frames through it, waits for frames being written into it, and then sends closingConn through it as the
+// last frame. The remote does the same on receiving closingConn. Each end carries on reading from the connection
+// until it receives closingConn, so that nothing sent before it is lost. The end that receives closingConn in reply to
+// its own, having received everything, closes the connection.
+
+// remoteDrainTimeout bounds how long we drain a connection the remote is removing
+const remoteDrainTimeout = 30 * time.Second
+
+var errLastConn = errors.New("cannot remove the last connection of a session that can't be resumed")
+
+// RemoveConnection takes the underlying connection of connId, as listed by Connections, out of the session and closes
+// it, without dropping frames sent through it in either direction. Streams sending through it carry on through other
+// connections. Frames already being written into it are waited for, and the remote is told to do the same. The
+// connection is closed once the remote has closed it too. This is bounded by timeout, after which the connection is
+// closed regardless: frames still being written into it are sent through other connections instead, but frames on
+// their way through it may be lost. It blocks until the connection is closed.
+//
+// The last connection can only be removed if the session has a ResumptionWindow. The remote must support connection
+// removal, which can be checked with PeerSupports(CapConnRemoval)
+func (sesh *Session) RemoveConnection(connId uint32, timeout time.Duration) error {
+	if sesh.IsClosed() {
+		return ErrBrokenSession
+	}
+	if _, ok := sesh.sb.conns.Load(connId); !ok {
+		return errNoSuchConn
+	}
+	if sesh.ResumptionWindow <= 0 && sesh.sb.connsCount() <= 1 {
+		return errLastConn
+	}
+	return sesh.sb.drainConn(connId, timeout)
+}
+
+// drainConn takes the connection of connId out of the pool so that no new frames are sent through it, waits for frames
+// being written into it, and then sends closingConn through it. The connection is closed once switchboard.deplex has
+// stopped reading from it, which is when closingConn has been received from the remote, or when the remote has closed
+// it. This is bounded by timeout
+func (sb *switchboard) drainConn(connId uint32, timeout time.Duration) error {
+	connI, ok := sb.conns.Load(connId)
+	if !ok {
+		return errNoSuchConn
+	}
+	healthI, ok := sb.health.Load(connId)
+	if !ok {
+		return errNoSuchConn
+	}
+	conn, health := connI.(net.Conn), healthI.(*connHealth)
+
+	// taken out of the pool first, so that writes that find the connection removed pick another one
+	sb.conns.Delete(connId)
+	sb.connInfos.Delete(connId)
+	atomic.CompareAndSwapUint32(&sb.preferredConnId, connId, 0)
+	sb.updatePathMTU()
+	if !atomic.CompareAndSwapUint32(&health.removed, 0, 1) {
+		return errNoSuchConn
+	}
+	sb.session.Logger.Debugf("draining connection %v of session %v", connId, sb.session.id)
+	defer sb.health.Delete(connId)
+	sb.connRemoved("the last connection has been removed")
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	drained := make(chan struct{})
+	go func() {
+		// writes starting after this see that the connection has been removed
+		health.writeM.Lock()
+		health.writeM.Unlock()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-timer.C:
+		sb.session.Logger.Debugf("timed out draining connection %v of session %v", connId, sb.session.id)
+		// writes in progress fail and are sent through other connections
+		return conn.Close()
+	}
+
+	f := &Frame{
+		StreamID: 0xffffffff,
+		Closing:  closingConn,
+		Payload:  genRandomPadding(),
+	}
+	obfsBuf := make([]byte, sb.session.obfsBufLen(len(f.Payload)))
+	i, err := sb.session.obfs(f, obfsBuf, 0)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	n, err := conn.Write(obfsBuf[:i])
+	sb.valve.AddTx(int64(n))
+	sb.sent.add(n)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	select {
+	case <-health.deplexDone:
+	case <-timer.C:
+		sb.session.Logger.Debugf("timed out waiting for the remote to drain connection %v of session %v", connId,
+			sb.session.id)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,82 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_RemoveConnection(t *testing.T) {
+	clientSesh, serverSesh, _ := makeSessionPair(1)
+	go serverSesh.ServeEcho()
+	addConn := func() {
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+	}
+
+	stream, _ := clientSesh.OpenStream()
+	chunk := make([]byte, 1024)
+
+	// keeps writing until the connections have been removed. What is echoed back is buffered in the meantime
+	var removed uint32
+	sentCh := make(chan []byte, 1)
+	go func() {
+		var sent []byte
+		for atomic.LoadUint32(&removed) == 0 {
+			rand.Read(chunk)
+			_, err := stream.Write(chunk)
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			sent = append(sent, chunk...)
+			time.Sleep(time.Millisecond)
+		}
+		sentCh <- sent
+	}()
+
+	// each time, the only connection the stream can be sending through is replaced while it's sending
+	for i := 0; i < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+		connId := clientSesh.Connections()[0].ID
+		addConn()
+		err := clientSesh.RemoveConnection(connId, time.Second)
+		assert.NoError(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreUint32(&removed, 1)
+	sent := <-sentCh
+
+	echoed := make([]byte, len(sent))
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(stream, echoed)
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out reading echoed data, which may have been lost")
+	}
+	assert.True(t, bytes.Equal(sent, echoed), "data is corrupted")
+
+	assert.False(t, clientSesh.IsClosed())
+	assert.False(t, serverSesh.IsClosed())
+	assert.Len(t, clientSesh.Connections(), 1)
+	assert.Eventually(t, func() bool {
+		return len(serverSesh.Connections()) == 1
+	}, time.Second, 10*time.Millisecond, "the remote hasn't removed the connections")
+
+	lastConnId := clientSesh.Connections()[0].ID
+	assert.Equal(t, errLastConn, clientSesh.RemoveConnection(lastConnId, time.Second))
+	assert.Equal(t, errNoSuchConn, clientSesh.RemoveConnection(lastConnId+100, time.Second))
+}
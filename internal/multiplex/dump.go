@@ -0,0 +1,114 @@
+package multiplex
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// recordedError is the last error from receiving a frame, kept for Session.Dump
+type recordedError struct {
+	err  error
+	time time.Time
+}
+
+// recordError keeps err as the last error of the session
+func (sesh *Session) recordError(err error) {
+	sesh.lastError.Store(recordedError{err, time.Now()})
+}
+
+func encryptionMethodName(method byte) string {
+	switch method {
+	case EncryptionMethodPlain:
+		return "plain"
+	case EncryptionMethodAESGCM:
+		return "aes-gcm"
+	case EncryptionMethodChaha20Poly1305:
+		return "chacha20-poly1305"
+	case EncryptionMethodXorStream:
+		return "xor-stream"
+	default:
+		return fmt.Sprintf("unknown (%v)", method)
+	}
+}
+
+func familyName(family AddressFamily) string {
+	switch family {
+	case FamilyIPv4:
+		return "IPv4"
+	case FamilyIPv6:
+		return "IPv6"
+	default:
+		return "unspecified"
+	}
+}
+
+// Dump returns a human-readable snapshot of the state of the session, meant to be attached to bug reports. It covers
+// the session's settings, its underlying connections, its streams, how long it has been up and the last error from
+// receiving a frame. It only reads the state of the session, and can be called at any time, including concurrently
+// and after the session is closed. The format isn't stable and shouldn't be parsed
+func (sesh *Session) Dump() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "session %v\n", sesh.id)
+	if sesh.IsClosed() {
+		fmt.Fprintf(&b, "  state: closed (%v)\n", sesh.TerminalMsg())
+	} else if sesh.sb.awaitingResumption() {
+		fmt.Fprintf(&b, "  state: awaiting resumption\n")
+	} else {
+		fmt.Fprintf(&b, "  state: open\n")
+	}
+	fmt.Fprintf(&b, "  uptime: %v\n", time.Since(sesh.createdAt).Round(time.Millisecond))
+	if sesh.Unordered {
+		fmt.Fprintf(&b, "  mode: unordered\n")
+	} else {
+		fmt.Fprintf(&b, "  mode: ordered\n")
+	}
+	fmt.Fprintf(&b, "  encryption: %v\n", encryptionMethodName(sesh.Obfuscator.encryptionMethod))
+	fmt.Fprintf(&b, "  peer capabilities: %#x\n", atomic.LoadUint32(&sesh.peerCapabilities))
+	fmt.Fprintf(&b, "  max frame payload: %v\n", sesh.MaxFramePayload())
+
+	conns := sesh.Connections()
+	fmt.Fprintf(&b, "  connections: %v\n", len(conns))
+	for _, info := range conns {
+		fmt.Fprintf(&b, "    %v: %v -> %v, family %v, encryption %v", info.ID, info.LocalAddr, info.RemoteAddr,
+			familyName(info.Family), encryptionMethodName(info.EncryptionMethod))
+		if info.Preferred {
+			fmt.Fprintf(&b, ", preferred")
+		}
+		if healthI, ok := sesh.sb.health.Load(info.ID); ok {
+			health := healthI.(*connHealth)
+			if sesh.ProbeInterval > 0 {
+				lastRecv := time.Unix(0, atomic.LoadInt64(&health.lastRecv))
+				fmt.Fprintf(&b, ", last received %v ago", time.Since(lastRecv).Round(time.Millisecond))
+			}
+			if pathMTU := atomic.LoadUint32(&health.pathMTU); pathMTU > 0 {
+				fmt.Fprintf(&b, ", path MTU %v", pathMTU)
+			}
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+
+	fmt.Fprintf(&b, "  active streams: %v\n", sesh.streamCount())
+	fmt.Fprintf(&b, "  pending accepts: %v\n", sesh.PendingAccepts())
+	if sesh.MaxBufferedBytes > 0 {
+		fmt.Fprintf(&b, "  buffered bytes: %v of %v\n", atomic.LoadInt64(&sesh.bufferedBytes), sesh.MaxBufferedBytes)
+	} else {
+		fmt.Fprintf(&b, "  buffered bytes: not counted without MaxBufferedBytes\n")
+	}
+	sent, received := sesh.Throughput()
+	fmt.Fprintf(&b, "  throughput: %.0f B/s sent, %.0f B/s received\n", sent, received)
+	if !sesh.Unordered {
+		fmt.Fprintf(&b, "  head-of-line blocked: %v\n", sesh.HeadOfLineBlocked())
+	}
+	if delay, jitter, ok := sesh.OneWayDelay(); ok {
+		fmt.Fprintf(&b, "  one-way delay: %v, jitter %v\n", delay, jitter)
+	}
+
+	if last, ok := sesh.lastError.Load().(recordedError); ok {
+		fmt.Fprintf(&b, "  last error: %v (%v ago)\n", last.err, time.Since(last.time).Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(&b, "  last error: none\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package multiplex
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_Dump(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	sesh := setupSesh(false, sessionKey, EncryptionMethodAESGCM)
+	remote := setupSesh(false, sessionKey, EncryptionMethodAESGCM)
+	defer remote.Close()
+
+	c, s := connutil.AsyncPipe()
+	sesh.AddConnection(common.NewTLSConn(c))
+	remote.AddConnection(common.NewTLSConn(s))
+	stream, _ := sesh.OpenStream()
+	_, _ = stream.Write([]byte{1, 2, 3})
+
+	// a frame failing to be deobfuscated is recorded as the last error
+	c1, s1 := connutil.AsyncPipe()
+	sesh.AddConnection(common.NewTLSConn(c1))
+	garbage := make([]byte, 64)
+	rand.Read(garbage)
+	_, _ = common.NewTLSConn(s1).Write(garbage)
+	assert.Eventually(t, func() bool {
+		_, ok := sesh.lastError.Load().(recordedError)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	dump := sesh.Dump()
+	assert.Contains(t, dump, "state: open")
+	assert.Contains(t, dump, "mode: ordered")
+	assert.Contains(t, dump, "encryption: aes-gcm")
+	assert.Contains(t, dump, "connections: 2")
+	assert.Contains(t, dump, "active streams: 1")
+	assert.Contains(t, dump, "head-of-line blocked: 0s")
+	assert.Contains(t, dump, "last error: ")
+	assert.NotContains(t, dump, "last error: none")
+
+	t.Run("concurrently", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_ = sesh.Dump()
+			}()
+			go func() {
+				defer wg.Done()
+				_, _ = stream.Write([]byte{1, 2, 3})
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		sesh.SetTerminalMsg("test")
+		_ = sesh.Close()
+		assert.Contains(t, sesh.Dump(), "state: closed (test)")
+	})
+}
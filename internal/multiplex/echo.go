@@ -0,0 +1,26 @@
+package multiplex
+
+import "io"
+
+// ServeEcho accepts streams opened by the remote and writes everything read from each of them back into it, so that
+// the session can serve as a loopback target for integration tests and health checks. Each stream is echoed in its
+// own goroutine, and closed once the remote has closed it. ServeEcho blocks until the session is closed, then
+// returns nil
+func (sesh *Session) ServeEcho() error {
+	for {
+		stream, err := sesh.Accept()
+		if err == ErrBrokenSession {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer stream.Close()
+			_, err := io.Copy(stream, stream)
+			if err != nil {
+				sesh.Logger.Debugf("stopped echoing stream of session %v: %v", sesh.id, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,44 @@
+package multiplex
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_ServeEcho(t *testing.T) {
+	const numStreams = 500
+	clientSession, serverSession, _ := makeSessionPair(2)
+	served := make(chan error)
+	go func() {
+		served <- serverSession.ServeEcho()
+	}()
+
+	streams := make([]net.Conn, numStreams)
+	for i := 0; i < numStreams; i++ {
+		stream, err := clientSession.OpenStream()
+		if !assert.NoError(t, err) {
+			return
+		}
+		streams[i] = stream
+	}
+	runEchoTest(t, streams, 4096)
+
+	// echoed streams are closed once the remote has closed them
+	for _, stream := range streams {
+		_ = stream.Close()
+	}
+	assert.Eventually(t, func() bool {
+		return serverSession.streamCount() == 0
+	}, time.Second, 10*time.Millisecond, "echoed streams aren't closed")
+
+	_ = serverSession.Close()
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Error("ServeEcho doesn't return once the session is closed")
+	}
+}
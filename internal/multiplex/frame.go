@@ -1,14 +1,185 @@
 package multiplex
 
+import (
+	"encoding/binary"
+	"errors"
+)
+
 const (
 	closingNothing = iota
 	closingStream
 	closingSession
+	// not a closing frame. It tells the remote to prefer the connection it arrived on
+	hintPreferConn
+	// the sender won't process streams opened by the remote with IDs greater than the one its payload starts with
+	closingGoaway
+	// not a closing frame. Its payload starts with the capabilities of the sender
+	advertCapabilities
+	// abruptly closes a stream. Its payload starts with an error code. Data not yet read by the receiver is discarded.
+	// If it's sent as a control frame, the code is followed by the ID of the stream
+	closingReset
+	// not a closing frame. It's the first frame of a stream opened with Session.OpenStreamWithMeta and its payload
+	// is the metadata of the stream
+	streamMeta
+	// not a closing frame. The receiver replies with probeReply through the connection it arrived on
+	probeConn
+	// not a closing frame. It's the reply to probeConn
+	probeReply
+	// not a closing frame. A data frame whose payload is the end of a message written with Stream.WriteMessage
+	messageEnd
+	// the last frame sent through the connection it arrived on, which the sender is removing from the session
+	closingConn
+	// not a closing frame. A path MTU probe, whose payload starts with the size of the probe. The receiver replies
+	// with pathMTUReply through the connection it arrived on
+	pathMTUProbe
+	// not a closing frame. It's the reply to pathMTUProbe and its payload starts with the size of the probe
+	pathMTUReply
+	// not a closing frame. Its payload starts with the ID of a stream and a Seq. The sender has read all frames of
+	// the stream before Seq, which the receiver no longer needs to keep for resumption
+	streamAck
+	// not a closing frame. Its payload is the secret the receiver resumes the streams of the session with
+	resumptionSecret
+	// not a closing frame. Its payload is the secret issued with resumptionSecret, followed by where to resume each
+	// stream from
+	resumeStreams
+	// not a closing frame. Its payload is a batch of frames, which are received as if they had arrived on their own
+	frameBatch
+	// not a closing frame. The last frame the sender obfuscates with the current Obfuscator of the connection it
+	// arrived on, which has one of its own. Its payload starts with the counter the next one is derived with
+	rekeyConn
 )
 
+// carriesData returns whether frames with this Closing value carry stream data
+func carriesData(closing uint8) bool {
+	return closing == closingNothing || closing == messageEnd
+}
+
 type Frame struct {
 	StreamID uint32
 	Seq      uint64
 	Closing  uint8
 	Payload  []byte
 }
+
+// A compact frame header holds the same fields as the standard one, with StreamID and Seq encoded as uvarints, so
+// that frames of streams with small IDs and sequence numbers take fewer bytes:
+//
+//	| compactHeaderMarker | Closing | extraLen | StreamID (uvarint) | Seq (uvarint) |
+//
+// The marker tells it apart from a standard header, whose first byte is the most significant byte of StreamID. This
+// means a session using compact headers can't receive standard frames of streams with IDs from 0xfe000000 to
+// 0xfeffffff, which are far beyond the number of streams opened in practice. A compact header is only used when it's
+// shorter than the standard one.
+const compactHeaderMarker = 0xfe
+
+// minCompactHeaderLength is the length of a compact header with a one-byte StreamID and Seq
+const minCompactHeaderLength = 5
+
+// compactFrameHeaderLen returns the length of the compact header of f
+func compactFrameHeaderLen(f *Frame) int {
+	var tmp [binary.MaxVarintLen64]byte
+	return 3 + binary.PutUvarint(tmp[:], uint64(f.StreamID)) + binary.PutUvarint(tmp[:], f.Seq)
+}
+
+// putCompactFrameHeader writes the compact header of f into header, which must be at least compactFrameHeaderLen(f)
+// long, and returns its length
+func putCompactFrameHeader(header []byte, f *Frame, extraLen byte) int {
+	header[0] = compactHeaderMarker
+	header[1] = f.Closing
+	header[2] = extraLen
+	i := 3
+	i += binary.PutUvarint(header[i:], uint64(f.StreamID))
+	i += binary.PutUvarint(header[i:], f.Seq)
+	return i
+}
+
+// appendUvarint appends x encoded as a uvarint to buf
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+// parseCompactFrameHeader parses the compact header at the start of b, returning a Frame with its fields, the number
+// of extra bytes after the payload and the length of the header. It returns ErrShortFrame if b ends before the header
+// does, and errBadCompactHeader if a field is out of range
+func parseCompactFrameHeader(b []byte) (*Frame, byte, int, error) {
+	if len(b) < minCompactHeaderLength {
+		return nil, 0, 0, ErrShortFrame
+	}
+	f := &Frame{Closing: b[1]}
+	extraLen := b[2]
+	i := 3
+	streamID, n := binary.Uvarint(b[i:])
+	if n == 0 {
+		return nil, 0, 0, ErrShortFrame
+	}
+	if n < 0 || streamID > 0xffffffff {
+		return nil, 0, 0, errBadCompactHeader
+	}
+	i += n
+	f.StreamID = uint32(streamID)
+	f.Seq, n = binary.Uvarint(b[i:])
+	if n == 0 {
+		return nil, 0, 0, ErrShortFrame
+	}
+	if n < 0 {
+		return nil, 0, 0, errBadCompactHeader
+	}
+	i += n
+	return f, extraLen, i, nil
+}
+
+var errBadCompactHeader = errors.New("compact frame header is malformed")
+
+// maxFrameLen is the maximum length of a serialised frame. Frames are sent in TLS records, which can't be longer
+const maxFrameLen = 1<<16 - 1
+
+// ErrFrameTooLong is returned by UnmarshalFrame when the input is longer than any frame can be
+var ErrFrameTooLong = errors.New("frame is too long")
+
+// putFrameHeader serialises the fields of f into header, followed by the number of extra bytes after the payload
+func putFrameHeader(header []byte, f *Frame, extraLen byte) {
+	putU32(header[0:4], f.StreamID)
+	putU64(header[4:12], f.Seq)
+	header[12] = f.Closing
+	header[13] = extraLen
+}
+
+// parseFrameHeader returns a Frame with the fields in header, without its payload, and the number of extra bytes
+// after the payload
+func parseFrameHeader(header []byte) (*Frame, byte) {
+	return &Frame{
+		StreamID: u32(header[0:4]),
+		Seq:      u64(header[4:12]),
+		Closing:  header[12],
+	}, header[13]
+}
+
+// MarshalFrame serialises f as it is before being obfuscated: the frame header followed by the payload, with no extra
+// bytes. It's the inverse of UnmarshalFrame
+func MarshalFrame(f *Frame) []byte {
+	buf := make([]byte, frameHeaderLength+len(f.Payload))
+	putFrameHeader(buf[:frameHeaderLength], f, 0)
+	copy(buf[frameHeaderLength:], f.Payload)
+	return buf
+}
+
+// UnmarshalFrame parses a frame serialised by MarshalFrame, or deobfuscated from a frame serialised by an Obfser.
+// The payload of the returned frame is a slice of b. It returns ErrShortFrame if b is too short to contain a frame
+// with a non-empty payload, and ErrFrameTooLong if b is longer than any frame can be
+func UnmarshalFrame(b []byte) (*Frame, error) {
+	if len(b) > maxFrameLen {
+		return nil, ErrFrameTooLong
+	}
+	if len(b) < frameHeaderLength {
+		return nil, ErrShortFrame
+	}
+	f, extraLen := parseFrameHeader(b[:frameHeaderLength])
+	payloadLen := len(b) - frameHeaderLength - int(extraLen)
+	if payloadLen <= 0 {
+		return nil, ErrShortFrame
+	}
+	f.Payload = b[frameHeaderLength : frameHeaderLength+payloadLen]
+	return f, nil
+}
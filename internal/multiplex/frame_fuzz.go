@@ -0,0 +1,22 @@
+// +build gofuzz
+
+package multiplex
+
+import "bytes"
+
+// FuzzFrame fuzzes the parsing of frame headers, independently of obfuscation
+func FuzzFrame(data []byte) int {
+	f, err := UnmarshalFrame(data)
+	if err != nil {
+		return 0
+	}
+	reparsed, err := UnmarshalFrame(MarshalFrame(f))
+	if err != nil {
+		panic(err)
+	}
+	if reparsed.StreamID != f.StreamID || reparsed.Seq != f.Seq || reparsed.Closing != f.Closing ||
+		!bytes.Equal(reparsed.Payload, f.Payload) {
+		panic("frame changed after being marshalled again")
+	}
+	return 1
+}
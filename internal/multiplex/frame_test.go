@@ -0,0 +1,94 @@
+package multiplex
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalFrame(t *testing.T) {
+	f := &Frame{
+		StreamID: 0x01020304,
+		Seq:      0x0102030405060708,
+		Closing:  closingStream,
+		Payload:  []byte{1, 2, 3},
+	}
+	b := MarshalFrame(f)
+	assert.Len(t, b, frameHeaderLength+len(f.Payload))
+	parsed, err := UnmarshalFrame(b)
+	assert.NoError(t, err)
+	assert.Equal(t, f, parsed)
+
+	t.Run("extra bytes", func(t *testing.T) {
+		withExtra := append(MarshalFrame(f), 0, 0)
+		withExtra[13] = 2
+		parsed, err := UnmarshalFrame(withExtra)
+		assert.NoError(t, err)
+		assert.Equal(t, f.Payload, parsed.Payload)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for i := 0; i <= frameHeaderLength; i++ {
+			_, err := UnmarshalFrame(b[:i])
+			assert.Equal(t, ErrShortFrame, err)
+		}
+		tooManyExtra := MarshalFrame(f)
+		tooManyExtra[13] = byte(len(f.Payload))
+		_, err := UnmarshalFrame(tooManyExtra)
+		assert.Equal(t, ErrShortFrame, err)
+		tooManyExtra[13] = 0xff
+		_, err = UnmarshalFrame(tooManyExtra)
+		assert.Equal(t, ErrShortFrame, err)
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		_, err := UnmarshalFrame(make([]byte, maxFrameLen+1))
+		assert.Equal(t, ErrFrameTooLong, err)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			b := make([]byte, rand.Intn(64))
+			rand.Read(b)
+			f, err := UnmarshalFrame(b)
+			if err == nil {
+				assert.NotEmpty(t, f.Payload)
+			}
+		}
+	})
+}
+
+func TestCompactFrameHeader(t *testing.T) {
+	streamIDs := []uint32{0, 1, 127, 128, 16383, 16384, 1<<21 - 1, 1 << 21, 1<<28 - 1, 1 << 28, math.MaxUint32 - 1, math.MaxUint32}
+	seqs := []uint64{0, 1, 127, 128, 16383, 16384, 1<<35 - 1, 1 << 35, 1<<56 - 1, 1 << 56, math.MaxUint64 - 1, math.MaxUint64}
+	for _, streamID := range streamIDs {
+		for _, seq := range seqs {
+			f := &Frame{StreamID: streamID, Seq: seq, Closing: closingStream}
+			header := make([]byte, compactFrameHeaderLen(f))
+			n := putCompactFrameHeader(header, f, 7)
+			assert.Equal(t, len(header), n)
+
+			parsed, extraLen, parsedLen, err := parseCompactFrameHeader(header)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			assert.Equal(t, n, parsedLen)
+			assert.Equal(t, byte(7), extraLen)
+			assert.Equal(t, f, parsed)
+
+			_, _, _, err = parseCompactFrameHeader(header[:n-1])
+			assert.Equal(t, ErrShortFrame, err)
+		}
+	}
+	assert.Equal(t, minCompactHeaderLength, compactFrameHeaderLen(&Frame{}))
+
+	t.Run("stream id out of range", func(t *testing.T) {
+		header := []byte{compactHeaderMarker, 0, 0}
+		header = appendUvarint(header, math.MaxUint32+1)
+		header = appendUvarint(header, 0)
+		_, _, _, err := parseCompactFrameHeader(header)
+		assert.Equal(t, errBadCompactHeader, err)
+	})
+}
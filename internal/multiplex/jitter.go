@@ -0,0 +1,58 @@
+package multiplex
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+type JitterDistribution int
+
+const (
+	// JitterUniform draws delays uniformly from [0, SendJitter.Max]
+	JitterUniform JitterDistribution = iota
+	// JitterExponential draws delays from an exponential distribution with a mean of SendJitter.Max/4,
+	// truncated at SendJitter.Max. Most delays are short, with occasional long ones
+	JitterExponential
+)
+
+// SendJitter adds a random delay before each frame is sent through an underlying connection, so that the timings of
+// messages on the wire don't reveal the timings of data sent. This trades latency for stealth.
+type SendJitter struct {
+	// Max is the upper bound of the delay added before each send. Zero disables jitter
+	Max time.Duration
+	// Distribution decides how delays are drawn within [0, Max]
+	Distribution JitterDistribution
+}
+
+func (j SendJitter) enabled() bool { return j.Max > 0 }
+
+func (j SendJitter) delay() time.Duration {
+	switch j.Distribution {
+	case JitterExponential:
+		d := time.Duration(rand.ExpFloat64() * float64(j.Max) / 4)
+		if d > j.Max {
+			return j.Max
+		}
+		return d
+	default:
+		return time.Duration(rand.Int63n(int64(j.Max) + 1))
+	}
+}
+
+// jitterConn delays each Write to the connection it wraps. Writes to the same connection are serialised so that
+// their delays add up rather than overlap, while writes to different connections are delayed independently.
+type jitterConn struct {
+	net.Conn
+	jitter SendJitter
+
+	writeM sync.Mutex
+}
+
+func (c *jitterConn) Write(b []byte) (int, error) {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+	time.Sleep(c.jitter.delay())
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,64 @@
+package multiplex
+
+import (
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendJitter_delay(t *testing.T) {
+	for name, distribution := range map[string]JitterDistribution{
+		"uniform":     JitterUniform,
+		"exponential": JitterExponential,
+	} {
+		t.Run(name, func(t *testing.T) {
+			jitter := SendJitter{Max: 10 * time.Millisecond, Distribution: distribution}
+			for i := 0; i < 1000; i++ {
+				d := jitter.delay()
+				if d < 0 || d > jitter.Max {
+					t.Fatalf("delay %v out of bound", d)
+				}
+			}
+		})
+	}
+}
+
+func TestSession_SendJitter(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	seshConfig := SessionConfig{
+		Obfuscator: obfuscator,
+		SendJitter: SendJitter{Max: 20 * time.Millisecond},
+	}
+	clientSesh := MakeSession(0, seshConfig)
+	serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	testData := make([]byte, payloadLen)
+	rand.Read(testData)
+	stream, _ := clientSesh.OpenStream()
+	for i := 0; i < 10; i++ {
+		_, err := stream.Write(testData)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverStream, _ := serverSesh.Accept()
+	recvBuf := make([]byte, payloadLen)
+	for i := 0; i < 10; i++ {
+		_, err := io.ReadFull(serverStream, recvBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, testData, recvBuf)
+	}
+}
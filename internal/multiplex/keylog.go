@@ -0,0 +1,27 @@
+// +build keylog
+
+package multiplex
+
+import (
+	"encoding/hex"
+	"fmt"
+
+)
+
+// keyLogEnabled is whether this build writes session keys to SessionConfig.KeyLogWriter
+const keyLogEnabled = true
+
+// logKey writes a line with the session's ID, encryption method and key to KeyLogWriter, in the manner of
+// SSLKEYLOGFILE
+func (sesh *Session) logKey() {
+	if sesh.KeyLogWriter == nil {
+		return
+	}
+	sesh.Logger.Warnf("the key of session %v is being exported, so its traffic can be decrypted by anyone reading the "+
+		"key log", sesh.id)
+	_, err := fmt.Fprintf(sesh.KeyLogWriter, "CLOAK_SESSION_KEY %v %v %v\n", sesh.id,
+		encryptionMethodName(sesh.Obfuscator.encryptionMethod), hex.EncodeToString(sesh.SessionKey[:]))
+	if err != nil {
+		sesh.Logger.Errorf("failed to write the key of session %v to the key log: %v", sesh.id, err)
+	}
+}
@@ -0,0 +1,13 @@
+// +build !keylog
+
+package multiplex
+
+// keyLogEnabled is whether this build writes session keys to SessionConfig.KeyLogWriter
+const keyLogEnabled = false
+
+// logKey does nothing unless built with the keylog tag
+func (sesh *Session) logKey() {
+	if sesh.KeyLogWriter != nil {
+		sesh.Logger.Warnf("KeyLogWriter of session %v is ignored as this build doesn't have the keylog tag", sesh.id)
+	}
+}
@@ -0,0 +1,26 @@
+package multiplex
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_KeyLogWriter(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	var keyLog bytes.Buffer
+	sesh := MakeSession(42, SessionConfig{Obfuscator: obfuscator, KeyLogWriter: &keyLog})
+	defer sesh.Close()
+
+	if keyLogEnabled {
+		assert.Equal(t, "CLOAK_SESSION_KEY 42 aes-gcm "+hex.EncodeToString(sessionKey[:])+"\n", keyLog.String())
+	} else {
+		assert.Zero(t, keyLog.Len(), "key exported without the keylog tag")
+	}
+	assert.Nil(t, SessionConfig{KeyLogWriter: &keyLog}.Derive().KeyLogWriter)
+}
@@ -0,0 +1,103 @@
+package multiplex
+
+import (
+	"net"
+	"time"
+)
+
+// Lazy connections are added to a session as dialers, and only dialed once the session needs them: one connection is
+// wanted for each active stream, up to the number of lazy connections, and data can't be sent without one.
+// A failed dial is retried with the same backoff as maintainConns, for as long as the session is open.
+
+// lazyConn is a connection added with Session.AddLazyConnection
+type lazyConn struct {
+	dial func() (net.Conn, error)
+	// whether dialing has started. Guarded by switchboard.lazyM
+	dialed bool
+}
+
+// AddLazyConnection adds an underlying connection that isn't opened until it's needed, so that idle connections
+// aren't held open. dial is called to open it once there are more active streams than connections, or once data
+// needs to be sent while there is no connection. Until then, sending data waits for a lazy connection to be dialed
+// instead of failing. A failed dial is retried with exponential backoff until it succeeds or the session is closed.
+// Once opened, it's like a connection added with AddConnection, and isn't dialed again if it drops
+func (sesh *Session) AddLazyConnection(dial func() (net.Conn, error)) {
+	sb := sesh.sb
+	sb.lazyM.Lock()
+	sb.lazyConns = append(sb.lazyConns, &lazyConn{dial: dial})
+	sb.lazyM.Unlock()
+	sb.dialLazy(int(sesh.streamCount()))
+}
+
+// hasLazyConns returns whether any lazy connection has been added
+func (sb *switchboard) hasLazyConns() bool {
+	sb.lazyM.Lock()
+	defer sb.lazyM.Unlock()
+	return len(sb.lazyConns) > 0
+}
+
+// dialLazy starts dialing lazy connections until there are as many connections, open or being dialed, as wanted
+func (sb *switchboard) dialLazy(wanted int) {
+	sb.lazyM.Lock()
+	defer sb.lazyM.Unlock()
+	have := sb.connsCount() + sb.lazyDialing
+	for _, lc := range sb.lazyConns {
+		if have >= wanted {
+			return
+		}
+		if lc.dialed {
+			continue
+		}
+		lc.dialed = true
+		sb.lazyDialing++
+		have++
+		go sb.dialLazyConn(lc)
+	}
+}
+
+// dialLazyConn dials lc until it succeeds, then adds it to the session
+func (sb *switchboard) dialLazyConn(lc *lazyConn) {
+	defer func() {
+		sb.lazyM.Lock()
+		sb.lazyDialing--
+		sb.lazyM.Unlock()
+	}()
+	backoff := minDialBackoff
+	for {
+		conn, err := lc.dial()
+		if err == nil {
+			if sb.session.IsClosed() {
+				conn.Close()
+				return
+			}
+			sb.session.Logger.Debugf("lazy connection of session %v dialed", sb.session.id)
+			if err := sb.session.AddConnection(conn); err != nil {
+				sb.session.Logger.Warnf("failed to add a lazy connection to session %v: %v", sb.session.id, err)
+				conn.Close()
+			}
+			return
+		}
+		sb.session.Logger.Warnf("failed to dial a lazy connection for session %v, retrying in %v: %v", sb.session.id,
+			backoff, err)
+		select {
+		case <-sb.session.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxDialBackoff {
+			backoff = maxDialBackoff
+		}
+	}
+}
+
+// waitLazy dials a lazy connection if there is no connection, and waits until there is one or the session is closed
+func (sb *switchboard) waitLazy() error {
+	sb.dialLazy(1)
+	select {
+	case <-sb.ready():
+		return nil
+	case <-sb.session.done:
+		return errBrokenSwitchboard
+	}
+}
@@ -0,0 +1,92 @@
+package multiplex
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_AddLazyConnection(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	config := SessionConfig{Obfuscator: obfuscator, Role: RoleClient}
+
+	// makeDialer returns a dialer of connections to remote that fails the first failures times
+	makeDialer := func(remote *Session, failures int32) (func() (net.Conn, error), *int32) {
+		var dials int32
+		return func() (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) <= failures {
+				return nil, errors.New("failed to dial")
+			}
+			c, s := connutil.AsyncPipe()
+			remote.AddConnection(common.NewTLSConn(s))
+			return common.NewTLSConn(c), nil
+		}, &dials
+	}
+
+	t.Run("dialed on demand", func(t *testing.T) {
+		sesh := MakeSession(0, config)
+		remote := MakeSession(0, config.Derive())
+		defer sesh.Close()
+		defer remote.Close()
+		dial0, dials0 := makeDialer(remote, 0)
+		dial1, dials1 := makeDialer(remote, 0)
+		sesh.AddLazyConnection(dial0)
+		sesh.AddLazyConnection(dial1)
+		time.Sleep(50 * time.Millisecond)
+		assert.Zero(t, atomic.LoadInt32(dials0)+atomic.LoadInt32(dials1), "dialed before being needed")
+
+		stream, _ := sesh.OpenStream()
+		assert.Eventually(t, func() bool {
+			return len(sesh.Connections()) == 1
+		}, time.Second, 10*time.Millisecond, "the first stream doesn't trigger a dial")
+		assert.Equal(t, int32(1), atomic.LoadInt32(dials0)+atomic.LoadInt32(dials1))
+
+		_, err := stream.Write([]byte{1})
+		assert.NoError(t, err)
+		_, err = remote.Accept()
+		assert.NoError(t, err)
+
+		_, _ = sesh.OpenStream()
+		assert.Eventually(t, func() bool {
+			return len(sesh.Connections()) == 2
+		}, time.Second, 10*time.Millisecond, "the second stream doesn't trigger a dial")
+
+		// no more lazy connections to dial
+		_, _ = sesh.OpenStream()
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, int32(2), atomic.LoadInt32(dials0)+atomic.LoadInt32(dials1))
+	})
+
+	t.Run("failed dials retried", func(t *testing.T) {
+		sesh := MakeSession(0, config)
+		remote := MakeSession(0, config.Derive())
+		defer sesh.Close()
+		defer remote.Close()
+		dial, dials := makeDialer(remote, 2)
+		sesh.AddLazyConnection(dial)
+
+		stream, _ := sesh.OpenStream()
+		// waits for the lazy connection instead of failing
+		_, err := stream.Write([]byte{1})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(3), atomic.LoadInt32(dials))
+
+		remoteStream, err := remote.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf := make([]byte, 1)
+		_, err = remoteStream.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1}, buf)
+	})
+}
@@ -0,0 +1,12 @@
+package multiplex
+
+// Logger is what a Session logs through. It's satisfied by logrus' *Logger and *Entry, so a session's logs can be
+// given fields, such as the user it belongs to, with an *Entry. Its methods may be called concurrently, including
+// from the paths receiving frames, so they should return quickly
+type Logger interface {
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
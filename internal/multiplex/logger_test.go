@@ -0,0 +1,66 @@
+package multiplex
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingLogger keeps the messages logged at warning level or above
+type recordingLogger struct {
+	m    sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) logged(substr string) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, msg := range l.msgs {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *recordingLogger) Tracef(format string, args ...interface{}) {}
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {}
+func (l *recordingLogger) Infof(format string, args ...interface{})  {}
+func (l *recordingLogger) Warnf(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...interface{}) { l.record(format, args...) }
+
+func TestSession_Logger(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+
+	sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+	assert.Equal(t, log.StandardLogger(), sesh.Logger)
+	sesh.Close()
+
+	logger := new(recordingLogger)
+	sesh = MakeSession(0, SessionConfig{Obfuscator: obfuscator, Logger: logger})
+	defer sesh.Close()
+	c, s := connutil.AsyncPipe()
+	sesh.AddConnection(common.NewTLSConn(c))
+	garbage := make([]byte, 64)
+	rand.Read(garbage)
+	_, _ = common.NewTLSConn(s).Write(garbage)
+	assert.Eventually(t, func() bool {
+		return logger.logged("failed to receive a frame")
+	}, time.Second, 10*time.Millisecond, "a frame failing to be received isn't logged")
+}
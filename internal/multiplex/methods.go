@@ -0,0 +1,11 @@
+// +build !fips
+
+package multiplex
+
+// availableEncryptionMethods is the set of encryption methods MakeObfuscator can use in this build
+var availableEncryptionMethods = []byte{
+	EncryptionMethodPlain,
+	EncryptionMethodAESGCM,
+	EncryptionMethodChaha20Poly1305,
+	EncryptionMethodXorStream,
+}
@@ -0,0 +1,11 @@
+// +build fips
+
+package multiplex
+
+// availableEncryptionMethods is the set of encryption methods MakeObfuscator can use in this build. Builds with the
+// fips tag are restricted to AES-GCM, the only FIPS-approved AEAD, and to EncryptionMethodPlain for proxy protocols
+// that encrypt data themselves
+var availableEncryptionMethods = []byte{
+	EncryptionMethodPlain,
+	EncryptionMethodAESGCM,
+}
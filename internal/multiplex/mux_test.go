@@ -13,23 +13,6 @@ import (
 	"time"
 )
 
-func serveEcho(l net.Listener) {
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			// TODO: pass the error back
-			return
-		}
-		go func() {
-			_, err := io.Copy(conn, conn)
-			if err != nil {
-				// TODO: pass the error back
-				return
-			}
-		}()
-	}
-}
-
 type connPair struct {
 	clientConn net.Conn
 	serverConn net.Conn
@@ -44,7 +27,7 @@ func makeSessionPair(numConn int) (*Session, *Session, []*connPair) {
 		Valve:      nil,
 		Unordered:  false,
 	}
-	serverConfig := clientConfig
+	serverConfig := clientConfig.Derive()
 
 	clientSession := MakeSession(uint32(sessionId), clientConfig)
 	serverSession := MakeSession(uint32(sessionId), serverConfig)
@@ -99,7 +82,7 @@ func TestMultiplex(t *testing.T) {
 	const maxMsgLen = 16384
 
 	clientSession, serverSession, _ := makeSessionPair(numConns)
-	go serveEcho(serverSession)
+	go serverSession.ServeEcho()
 
 	streams := make([]net.Conn, numStreams)
 	for i := 0; i < numStreams; i++ {
@@ -140,7 +123,7 @@ func TestMultiplex(t *testing.T) {
 
 func TestMux_StreamClosing(t *testing.T) {
 	clientSession, serverSession, _ := makeSessionPair(1)
-	go serveEcho(serverSession)
+	go serverSession.ServeEcho()
 
 	// read after closing stream
 	testData := make([]byte, 128)
@@ -164,3 +147,75 @@ func TestMux_StreamClosing(t *testing.T) {
 		t.Errorf("incorrect data read back")
 	}
 }
+
+func TestMux_UnorderedStreamClosing(t *testing.T) {
+	sessionKey := [32]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31}
+	obfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+	clientConfig := SessionConfig{Obfuscator: obfuscator, Unordered: true}
+	clientSession := MakeSession(1, clientConfig)
+	serverSession := MakeSession(1, clientConfig.Derive())
+	defer clientSession.Close()
+	defer serverSession.Close()
+	c, s := connutil.AsyncPipe()
+	clientSession.AddConnection(common.NewTLSConn(c))
+	serverSession.AddConnection(common.NewTLSConn(s))
+
+	datagrams := [][]byte{{1}, {2, 2}, {3, 3, 3}}
+	recvBuf := make([]byte, 128)
+
+	t.Run("closed locally", func(t *testing.T) {
+		stream, _ := clientSession.OpenStream()
+		_, err := stream.Write([]byte{0})
+		assert.NoError(t, err)
+		serverStream, err := serverSession.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = serverStream.Read(recvBuf)
+		assert.NoError(t, err)
+		for _, d := range datagrams {
+			_, err = serverStream.Write(d)
+			assert.NoError(t, err)
+		}
+
+		n, err := stream.Read(recvBuf)
+		assert.NoError(t, err)
+		assert.Equal(t, datagrams[0], recvBuf[:n])
+		// the rest are buffered by the time they can be read
+		assert.Eventually(t, func() bool {
+			return stream.recvBuf.(*datagramBufferedPipe).buffered() == 5
+		}, time.Second, 10*time.Millisecond)
+		assert.NoError(t, stream.Close())
+		for _, d := range datagrams[1:] {
+			n, err := stream.Read(recvBuf)
+			assert.NoError(t, err, "can't read residual datagram")
+			assert.Equal(t, d, recvBuf[:n])
+		}
+		_, err = stream.Read(recvBuf)
+		assert.Equal(t, ErrBrokenStream, err)
+	})
+
+	t.Run("closed by remote", func(t *testing.T) {
+		stream, _ := clientSession.OpenStream()
+		_, err := stream.Write([]byte{0})
+		assert.NoError(t, err)
+		serverStream, err := serverSession.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, d := range datagrams {
+			_, err = serverStream.Write(d)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, serverStream.Close())
+
+		assert.Eventually(t, stream.isClosed, time.Second, 10*time.Millisecond, "stream isn't closed by the remote")
+		for _, d := range datagrams {
+			n, err := stream.Read(recvBuf)
+			assert.NoError(t, err, "can't read residual datagram")
+			assert.Equal(t, d, recvBuf[:n])
+		}
+		_, err = stream.Read(recvBuf)
+		assert.Equal(t, ErrBrokenStream, err)
+	})
+}
@@ -9,16 +9,40 @@ import (
 	"github.com/cbeuw/Cloak/internal/common"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/salsa20"
+	"io"
 )
 
 type Obfser func(*Frame, []byte, int) (int, error)
 type Deobfser func([]byte) (*Frame, error)
 
+var u16 = binary.BigEndian.Uint16
 var u32 = binary.BigEndian.Uint32
 var u64 = binary.BigEndian.Uint64
+var putU16 = binary.BigEndian.PutUint16
 var putU32 = binary.BigEndian.PutUint32
 var putU64 = binary.BigEndian.PutUint64
 
+// ErrShortFrame is returned by a Deobfser when the input is too short to contain a whole frame. This is likely due
+// to an incomplete read
+var ErrShortFrame = errors.New("frame is truncated")
+
+// ErrAuthFailed is returned by a Deobfser when the frame fails authentication. This may be due to an attack or
+// a wrong key
+var ErrAuthFailed = errors.New("frame authentication failed")
+
+// Rand is the source of randomness used for nonces and padding. If it is nil, crypto/rand is used.
+// It can be replaced with a deterministic source to produce reproducible output in tests. It must not be changed
+// while any Session is in use.
+var Rand io.Reader
+
+func randRead(buf []byte) {
+	if Rand == nil {
+		common.CryptoRandRead(buf)
+	} else {
+		common.RandRead(Rand, buf)
+	}
+}
+
 const frameHeaderLength = 14
 const salsa20NonceSize = 8
 
@@ -26,9 +50,15 @@ const (
 	EncryptionMethodPlain = iota
 	EncryptionMethodAESGCM
 	EncryptionMethodChaha20Poly1305
+	// EncryptionMethodXorStream XORs frame payloads with a keystream derived from the session key. It does NOT
+	// authenticate anything: frames can be tampered with undetected. It's only meant for trusted networks where
+	// the per-frame overhead of AEAD tags matters but payloads still shouldn't look like plaintext
+	EncryptionMethodXorStream
 )
 
 // Obfuscator is responsible for serialisation, obfuscation, and optional encryption of data frames.
+// The payload cipher is created once by MakeObfuscator and shared by Obfs and Deobfs, which are safe for concurrent
+// use by all streams of a session.
 type Obfuscator struct {
 	// Used in Stream.Write. Add multiplexing headers, encrypt and add TLS header
 	Obfs Obfser
@@ -36,7 +66,21 @@ type Obfuscator struct {
 	Deobfs     Deobfser
 	SessionKey [32]byte
 
-	maxOverhead int
+	encryptionMethod byte
+	maxOverhead      int
+
+	// obfsCompact is like Obfs, but serialises frames with compact headers where they are shorter. deobfsAny is like
+	// Deobfs, but also takes frames with compact headers. Sessions use them once both ends support CapCompactHeader
+	obfsCompact Obfser
+	deobfsAny   Deobfser
+}
+
+// anyDeobfser returns a Deobfser that takes frames with standard or compact headers
+func (o *Obfuscator) anyDeobfser() Deobfser {
+	if o.deobfsAny != nil {
+		return o.deobfsAny
+	}
+	return o.Deobfs
 }
 
 // MakeObfs returns a function of type Obfser. An Obfser takes three arguments:
@@ -45,6 +89,12 @@ type Obfuscator struct {
 // is in the byte slice used as buffer (2nd argument). payloadOffsetInBuf specifies
 // the index at which data belonging to *Frame.Payload starts in the buffer.
 func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Obfser {
+	return makeObfs(salsaKey, payloadCipher, false, randRead)
+}
+
+// makeObfs returns an Obfser, which serialises frames with compact headers where they are shorter if compact is true.
+// readRand fills the random bytes frames are padded with
+func makeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD, compact bool, readRand func([]byte)) Obfser {
 	// The method here is to use the first payloadCipher.NonceSize() bytes of the serialised frame header
 	// as iv/nonce for the AEAD cipher to encrypt the frame payload. Then we use
 	// the authentication tag produced appended to the end of the ciphertext (of size payloadCipher.Overhead())
@@ -60,6 +110,11 @@ func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Obfser {
 	// independently) by a stream, or after 2^32-1 streams created in a single session. We consider these number
 	// to be large enough that they may never happen in reasonable time frames. Of course, different sessions
 	// will produce the same combination of stream id and frame sequence, but they will have different session keys.
+	// Frames that don't belong to any stream have the stream id 0xffffffff, which no stream is given, and a frame
+	// sequence from a counter of the session's own, which each end starts from a different point (see
+	// Session.nextControlSeq).
+	// A client resuming the streams of a session with MakeSessionFromToken sends all stream frames from a new,
+	// random sequence, as the frames the original client sent after the token was made aren't known.
 	//
 	// Salsa20 is assumed to be given a unique nonce each time because we assume the tags produced by payloadCipher
 	// AEAD is unique each time, as payloadCipher itself is given a unique iv/nonce each time due to points made above.
@@ -76,6 +131,11 @@ func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Obfser {
 	// We can't ensure its uniqueness ourselves, which is why plaintext mode must only be used when the user input
 	// is already random-like. For Cloak it would normally mean that the user is using a proxy protocol that sends
 	// encrypted data.
+	//
+	// A compact header (see compactHeaderMarker) is encrypted with Salsa20 in the same way. As it doesn't contain the
+	// stream id and frame sequence as they are in the standard header, the iv/nonce of payloadCipher is taken from the
+	// standard header of the frame instead, which both ends can produce from the fields of the frame. It is
+	// therefore the same as if the standard header were sent, and unique for the same reasons.
 	obfs := func(f *Frame, buf []byte, payloadOffsetInBuf int) (int, error) {
 		payloadLen := len(f.Payload)
 		if payloadLen == 0 {
@@ -95,30 +155,41 @@ func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Obfser {
 			}
 		}
 
-		usefulLen := frameHeaderLength + payloadLen + extraLen
+		headerLen := frameHeaderLength
+		if compact {
+			if compactLen := compactFrameHeaderLen(f); compactLen < frameHeaderLength {
+				headerLen = compactLen
+			}
+		}
+
+		usefulLen := headerLen + payloadLen + extraLen
 		if len(buf) < usefulLen {
 			return 0, errors.New("obfs buffer too small")
 		}
 		// we do as much in-place as possible to save allocation
-		payload := buf[frameHeaderLength : frameHeaderLength+payloadLen]
-		if payloadOffsetInBuf != frameHeaderLength {
-			// if payload is not at the correct location in buffer
+		payload := buf[headerLen : headerLen+payloadLen]
+		if payloadOffsetInBuf != headerLen {
+			// if payload is not at the correct location in buffer. It may overlap with where it should be, which copy
+			// allows
 			copy(payload, f.Payload)
 		}
 
-		header := buf[:frameHeaderLength]
-		putU32(header[0:4], f.StreamID)
-		putU64(header[4:12], f.Seq)
-		header[12] = f.Closing
-		header[13] = byte(extraLen)
+		var standardHeader [frameHeaderLength]byte
+		putFrameHeader(standardHeader[:], f, byte(extraLen))
+		header := buf[:headerLen]
+		if headerLen == frameHeaderLength {
+			copy(header, standardHeader[:])
+		} else {
+			putCompactFrameHeader(header, f, byte(extraLen))
+		}
 
 		if payloadCipher == nil {
 			if extraLen != 0 { // read nonce
 				extra := buf[usefulLen-extraLen : usefulLen]
-				common.CryptoRandRead(extra)
+				readRand(extra)
 			}
 		} else {
-			payloadCipher.Seal(payload[:0], header[:payloadCipher.NonceSize()], payload, nil)
+			payloadCipher.Seal(payload[:0], standardHeader[:payloadCipher.NonceSize()], payload, nil)
 		}
 
 		nonce := buf[usefulLen-salsa20NonceSize : usefulLen]
@@ -133,27 +204,50 @@ func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Obfser {
 // containing the message to be decrypted, and returns a *Frame containing the frame
 // information and plaintext
 func MakeDeobfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Deobfser {
+	return makeDeobfs(salsaKey, payloadCipher, false)
+}
+
+// makeDeobfs returns a Deobfser, which also takes frames with compact headers if compact is true
+func makeDeobfs(salsaKey [32]byte, payloadCipher cipher.AEAD, compact bool) Deobfser {
 	// frame header length + minimum data size (i.e. nonce size of salsa20)
 	const minInputLen = frameHeaderLength + salsa20NonceSize
+	const minCompactInputLen = minCompactHeaderLength + salsa20NonceSize
 	deobfs := func(in []byte) (*Frame, error) {
-		if len(in) < minInputLen {
-			return nil, fmt.Errorf("input size %v, but it cannot be shorter than %v bytes", len(in), minInputLen)
+		if len(in) < minCompactInputLen || (!compact && len(in) < minInputLen) {
+			// input cannot be shorter than minInputLen
+			return nil, ErrShortFrame
 		}
 
-		header := in[:frameHeaderLength]
-		pldWithOverHead := in[frameHeaderLength:] // payload + potential overhead
-
 		nonce := in[len(in)-salsa20NonceSize:]
-		salsa20.XORKeyStream(header, header, nonce, &salsaKey)
+		// the header is decrypted out of place first, as it may be shorter than frameHeaderLength and the bytes
+		// after it mustn't be touched
+		var decrypted [frameHeaderLength]byte
+		maxHeaderLen := copy(decrypted[:], in[:len(in)-salsa20NonceSize])
+		salsa20.XORKeyStream(decrypted[:maxHeaderLen], decrypted[:maxHeaderLen], nonce, &salsaKey)
 
-		streamID := u32(header[0:4])
-		seq := u64(header[4:12])
-		closing := header[12]
-		extraLen := header[13]
+		var ret *Frame
+		var extraLen byte
+		headerLen := frameHeaderLength
+		if compact && decrypted[0] == compactHeaderMarker {
+			var err error
+			ret, extraLen, headerLen, err = parseCompactFrameHeader(decrypted[:maxHeaderLen])
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			if len(in) < minInputLen {
+				return nil, ErrShortFrame
+			}
+			ret, extraLen = parseFrameHeader(decrypted[:])
+		}
+		header := in[:headerLen]
+		copy(header, decrypted[:headerLen])
+		pldWithOverHead := in[headerLen:] // payload + potential overhead
 
 		usefulPayloadLen := len(pldWithOverHead) - int(extraLen)
 		if usefulPayloadLen < 0 || usefulPayloadLen > len(pldWithOverHead) {
-			return nil, errors.New("extra length is negative or extra length is greater than total pldWithOverHead length")
+			// extra length is greater than total pldWithOverHead length
+			return nil, ErrShortFrame
 		}
 
 		var outputPayload []byte
@@ -165,33 +259,81 @@ func MakeDeobfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Deobfser {
 				outputPayload = pldWithOverHead[:usefulPayloadLen]
 			}
 		} else {
-			_, err := payloadCipher.Open(pldWithOverHead[:0], header[:payloadCipher.NonceSize()], pldWithOverHead, nil)
+			var standardHeader [frameHeaderLength]byte
+			putFrameHeader(standardHeader[:], ret, extraLen)
+			_, err := payloadCipher.Open(pldWithOverHead[:0], standardHeader[:payloadCipher.NonceSize()], pldWithOverHead, nil)
 			if err != nil {
-				return nil, err
+				return nil, ErrAuthFailed
 			}
 			outputPayload = pldWithOverHead[:usefulPayloadLen]
 		}
 
-		ret := &Frame{
-			StreamID: streamID,
-			Seq:      seq,
-			Closing:  closing,
-			Payload:  outputPayload,
-		}
+		ret.Payload = outputPayload
 		return ret, nil
 	}
 	return deobfs
 }
 
+// ErrEncryptionMethodUnavailable is returned when an encryption method can't be used in this build, such as one that
+// isn't FIPS-approved in a build with the fips tag
+var ErrEncryptionMethodUnavailable = errors.New("encryption method is unavailable in this build")
+
+// ObfuscatorMethodsAvailable returns the encryption methods MakeObfuscator can use in this build
+func ObfuscatorMethodsAvailable() []byte {
+	return append([]byte(nil), availableEncryptionMethods...)
+}
+
+func encryptionMethodAvailable(method byte) bool {
+	for _, available := range availableEncryptionMethods {
+		if method == available {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectEncryptionMethod returns the first of preferences that is available in this build. It returns an error
+// wrapping ErrEncryptionMethodUnavailable if none is
+func SelectEncryptionMethod(preferences []byte) (byte, error) {
+	for _, method := range preferences {
+		if encryptionMethodAvailable(method) {
+			return method, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: none of %v", ErrEncryptionMethodUnavailable, preferences)
+}
+
 func MakeObfuscator(encryptionMethod byte, sessionKey [32]byte) (obfuscator Obfuscator, err error) {
 	obfuscator = Obfuscator{
-		SessionKey: sessionKey,
+		SessionKey:       sessionKey,
+		encryptionMethod: encryptionMethod,
+	}
+	payloadCipher, err := makePayloadCipher(encryptionMethod, sessionKey)
+	if err != nil {
+		return
+	}
+	if payloadCipher == nil {
+		obfuscator.maxOverhead = salsa20NonceSize
+	} else {
+		obfuscator.maxOverhead = payloadCipher.Overhead()
+	}
+
+	obfuscator.Obfs = MakeObfs(sessionKey, payloadCipher)
+	obfuscator.Deobfs = MakeDeobfs(sessionKey, payloadCipher)
+	obfuscator.obfsCompact = makeObfs(sessionKey, payloadCipher, true, randRead)
+	obfuscator.deobfsAny = makeDeobfs(sessionKey, payloadCipher, true)
+	return
+}
+
+// makePayloadCipher returns the AEAD frame payloads are encrypted with by encryptionMethod, which is nil for
+// EncryptionMethodPlain
+func makePayloadCipher(encryptionMethod byte, sessionKey [32]byte) (payloadCipher cipher.AEAD, err error) {
+	if encryptionMethod <= EncryptionMethodXorStream && !encryptionMethodAvailable(encryptionMethod) {
+		return nil, fmt.Errorf("%w: %v", ErrEncryptionMethodUnavailable, encryptionMethodName(encryptionMethod))
 	}
-	var payloadCipher cipher.AEAD
 	switch encryptionMethod {
 	case EncryptionMethodPlain:
 		payloadCipher = nil
-		obfuscator.maxOverhead = salsa20NonceSize
 	case EncryptionMethodAESGCM:
 		var c cipher.Block
 		c, err = aes.NewCipher(sessionKey[:])
@@ -202,24 +344,21 @@ func MakeObfuscator(encryptionMethod byte, sessionKey [32]byte) (obfuscator Obfu
 		if err != nil {
 			return
 		}
-		obfuscator.maxOverhead = payloadCipher.Overhead()
 	case EncryptionMethodChaha20Poly1305:
 		payloadCipher, err = chacha20poly1305.New(sessionKey[:])
 		if err != nil {
 			return
 		}
-		obfuscator.maxOverhead = payloadCipher.Overhead()
+	case EncryptionMethodXorStream:
+		payloadCipher = &xorStream{key: sessionKey}
 	default:
-		return obfuscator, errors.New("Unknown encryption method")
+		return nil, errors.New("Unknown encryption method")
 	}
 
 	if payloadCipher != nil {
 		if payloadCipher.NonceSize() > frameHeaderLength {
-			return obfuscator, errors.New("payload AEAD's nonce size cannot be greater than size of frame header")
+			return nil, errors.New("payload AEAD's nonce size cannot be greater than size of frame header")
 		}
 	}
-
-	obfuscator.Obfs = MakeObfs(sessionKey, payloadCipher)
-	obfuscator.Deobfs = MakeDeobfs(sessionKey, payloadCipher)
 	return
 }
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"errors"
+	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/chacha20poly1305"
+	"math"
 	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 	"testing/quick"
 )
@@ -62,6 +66,14 @@ func TestGenerateObfs(t *testing.T) {
 			run(obfuscator, t)
 		}
 	})
+	t.Run("xor-stream", func(t *testing.T) {
+		obfuscator, err := MakeObfuscator(EncryptionMethodXorStream, sessionKey)
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
 	t.Run("unknown encryption method", func(t *testing.T) {
 		_, err := MakeObfuscator(0xff, sessionKey)
 		if err == nil {
@@ -70,6 +82,276 @@ func TestGenerateObfs(t *testing.T) {
 	})
 }
 
+func TestDeobfsErrors(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+
+	f := &Frame{
+		StreamID: 1,
+		Seq:      0,
+		Closing:  closingNothing,
+		Payload:  make([]byte, testPayloadLen),
+	}
+	obfsBuf := make([]byte, obfsBufLen)
+	n, _ := obfuscator.Obfs(f, obfsBuf, 0)
+
+	t.Run("short frame", func(t *testing.T) {
+		_, err := obfuscator.Deobfs(obfsBuf[:frameHeaderLength])
+		assert.Equal(t, ErrShortFrame, err)
+		err = sesh.recvDataFromRemote(obfsBuf[:frameHeaderLength], 0)
+		assert.Equal(t, ErrShortFrame, err)
+	})
+
+	t.Run("auth failure", func(t *testing.T) {
+		tampered := make([]byte, n)
+		copy(tampered, obfsBuf[:n])
+		tampered[frameHeaderLength] ^= 0xff
+		_, err := obfuscator.Deobfs(tampered)
+		assert.Equal(t, ErrAuthFailed, err)
+
+		copy(tampered, obfsBuf[:n])
+		tampered[frameHeaderLength] ^= 0xff
+		err = sesh.recvDataFromRemote(tampered, 0)
+		assert.Equal(t, ErrAuthFailed, err)
+	})
+}
+
+func TestObfuscator_Concurrent(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	for name, method := range map[string]byte{
+		"plain":             EncryptionMethodPlain,
+		"aes-gcm":           EncryptionMethodAESGCM,
+		"chacha20-poly1305": EncryptionMethodChaha20Poly1305,
+		"xor-stream":        EncryptionMethodXorStream,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// the cipher of an Obfuscator is shared by all streams of a session
+			obfuscator, _ := MakeObfuscator(method, sessionKey)
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(streamID uint32) {
+					defer wg.Done()
+					obfsBuf := make([]byte, obfsBufLen)
+					for seq := uint64(0); seq < 100; seq++ {
+						payload := make([]byte, testPayloadLen)
+						rand.Read(payload)
+						f := &Frame{streamID, seq, closingNothing, payload}
+						n, err := obfuscator.Obfs(f, obfsBuf, 0)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						res, err := obfuscator.Deobfs(obfsBuf[:n])
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if res.StreamID != streamID || res.Seq != seq || !bytes.Equal(payload, res.Payload) {
+							t.Error("frame is corrupted")
+							return
+						}
+					}
+				}(uint32(i))
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestObfuscator_CompactHeader(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	frames := []*Frame{
+		{1, 0, closingNothing, []byte{1}},
+		{3, 200, messageEnd, make([]byte, 100)},
+		{1 << 20, 1 << 30, closingNothing, make([]byte, 100)},
+		// compact headers would be longer than standard ones
+		{math.MaxUint32 - 1, math.MaxUint64, closingStream, make([]byte, 100)},
+		{math.MaxUint32, 0, advertCapabilities, make([]byte, 4)},
+	}
+	for name, method := range map[string]byte{
+		"plain":             EncryptionMethodPlain,
+		"aes-gcm":           EncryptionMethodAESGCM,
+		"chacha20-poly1305": EncryptionMethodChaha20Poly1305,
+		"xor-stream":        EncryptionMethodXorStream,
+	} {
+		t.Run(name, func(t *testing.T) {
+			obfuscator, _ := MakeObfuscator(method, sessionKey)
+			for _, f := range frames {
+				rand.Read(f.Payload)
+				obfsBuf := make([]byte, 512)
+				n, err := obfuscator.obfsCompact(f, obfsBuf, 0)
+				if !assert.NoError(t, err) {
+					continue
+				}
+				standardLen, _ := obfuscator.Obfs(f, make([]byte, 512), 0)
+				compactLen := compactFrameHeaderLen(f)
+				if compactLen < frameHeaderLength {
+					assert.Equal(t, standardLen-frameHeaderLength+compactLen, n)
+				} else {
+					assert.Equal(t, standardLen, n)
+				}
+
+				res, err := obfuscator.deobfsAny(obfsBuf[:n])
+				if !assert.NoError(t, err) {
+					continue
+				}
+				assert.Equal(t, f.StreamID, res.StreamID)
+				assert.Equal(t, f.Seq, res.Seq)
+				assert.Equal(t, f.Closing, res.Closing)
+				assert.Equal(t, f.Payload, res.Payload)
+
+				// standard frames are still taken
+				n, _ = obfuscator.Obfs(f, obfsBuf, 0)
+				res, err = obfuscator.deobfsAny(obfsBuf[:n])
+				if assert.NoError(t, err) {
+					assert.Equal(t, f.Payload, res.Payload)
+				}
+			}
+		})
+	}
+
+	t.Run("payload in buffer", func(t *testing.T) {
+		obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+		payload := make([]byte, 100)
+		rand.Read(payload)
+		obfsBuf := make([]byte, 512)
+		copy(obfsBuf[frameHeaderLength:], payload)
+		f := &Frame{1, 1, closingNothing, obfsBuf[frameHeaderLength : frameHeaderLength+len(payload)]}
+		n, err := obfuscator.obfsCompact(f, obfsBuf, frameHeaderLength)
+		if !assert.NoError(t, err) {
+			return
+		}
+		res, err := obfuscator.deobfsAny(obfsBuf[:n])
+		if assert.NoError(t, err) {
+			assert.Equal(t, payload, res.Payload)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+		obfsBuf := make([]byte, 512)
+		n, _ := obfuscator.obfsCompact(&Frame{1, 1, closingNothing, make([]byte, 100)}, obfsBuf, 0)
+		// as in standard headers, Closing and extraLen aren't part of the nonce, so only the marker, StreamID, Seq and
+		// payload are authenticated
+		for i := 0; i < n; i++ {
+			if i == 1 || i == 2 {
+				continue
+			}
+			tampered := append([]byte{}, obfsBuf[:n]...)
+			tampered[i] ^= 0x01
+			_, err := obfuscator.deobfsAny(tampered)
+			assert.Error(t, err, "byte %v tampered", i)
+		}
+	})
+}
+
+// restrictEncryptionMethods simulates a build in which only methods are available, until the returned function is
+// called
+func restrictEncryptionMethods(methods ...byte) (restore func()) {
+	saved := availableEncryptionMethods
+	availableEncryptionMethods = methods
+	return func() { availableEncryptionMethods = saved }
+}
+
+func TestSelectEncryptionMethod(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	assert.Equal(t, availableEncryptionMethods, ObfuscatorMethodsAvailable())
+
+	defer restrictEncryptionMethods(EncryptionMethodPlain, EncryptionMethodAESGCM)()
+	assert.Equal(t, []byte{EncryptionMethodPlain, EncryptionMethodAESGCM}, ObfuscatorMethodsAvailable())
+
+	method, err := SelectEncryptionMethod([]byte{EncryptionMethodChaha20Poly1305, EncryptionMethodAESGCM, EncryptionMethodPlain})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(EncryptionMethodAESGCM), method)
+
+	method, err = SelectEncryptionMethod([]byte{EncryptionMethodChaha20Poly1305, EncryptionMethodPlain})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(EncryptionMethodPlain), method, "no fallback to plaintext")
+
+	_, err = SelectEncryptionMethod([]byte{EncryptionMethodChaha20Poly1305, EncryptionMethodXorStream})
+	assert.True(t, errors.Is(err, ErrEncryptionMethodUnavailable))
+	_, err = SelectEncryptionMethod(nil)
+	assert.True(t, errors.Is(err, ErrEncryptionMethodUnavailable))
+
+	_, err = MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+	assert.True(t, errors.Is(err, ErrEncryptionMethodUnavailable))
+	_, err = MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	assert.NoError(t, err)
+}
+
+func TestXorStream(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodXorStream, sessionKey)
+
+	payload := make([]byte, testPayloadLen)
+	rand.Read(payload)
+	f := &Frame{
+		StreamID: 1,
+		Seq:      0,
+		Closing:  closingNothing,
+		Payload:  payload,
+	}
+	obfsBuf := make([]byte, obfsBufLen)
+	n, err := obfuscator.Obfs(f, obfsBuf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, frameHeaderLength+testPayloadLen+xorStreamTagSize, n)
+	if bytes.Contains(obfsBuf[:n], payload) {
+		t.Error("payload is sent in plaintext")
+	}
+
+	t.Run("tampering is not detected", func(t *testing.T) {
+		tampered := make([]byte, n)
+		copy(tampered, obfsBuf[:n])
+		tampered[frameHeaderLength] ^= 0xff
+		_, err := obfuscator.Deobfs(tampered)
+		assert.NoError(t, err)
+	})
+}
+
+func TestRand(t *testing.T) {
+	defer func() { Rand = nil }()
+
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	sesh := MakeSession(0, SessionConfig{
+		Obfuscator:    obfuscator,
+		PaddingScheme: PaddingScheme{MaxRandomPadding: 256},
+	})
+	f := &Frame{
+		StreamID: 1,
+		Seq:      0,
+		Closing:  closingNothing,
+		Payload:  []byte{42},
+	}
+
+	obfsWithSeed := func(seed int64) []byte {
+		Rand = rand.New(rand.NewSource(seed))
+		obfsBuf := make([]byte, sesh.MsgOnWireSizeLimit)
+		n, err := sesh.obfs(f, obfsBuf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obfsBuf[:n]
+	}
+
+	if !bytes.Equal(obfsWithSeed(42), obfsWithSeed(42)) {
+		t.Error("output differs with the same deterministic random source")
+	}
+	if bytes.Equal(obfsWithSeed(42), obfsWithSeed(43)) {
+		t.Error("output is the same with different random sources")
+	}
+}
+
 func BenchmarkObfs(b *testing.B) {
 	testPayload := make([]byte, 1024)
 	rand.Read(testPayload)
@@ -90,6 +372,7 @@ func BenchmarkObfs(b *testing.B) {
 
 		obfs := MakeObfs(key, payloadCipher)
 		b.SetBytes(int64(len(testFrame.Payload)))
+		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			obfs(testFrame, obfsBuf, 0)
@@ -101,6 +384,7 @@ func BenchmarkObfs(b *testing.B) {
 
 		obfs := MakeObfs(key, payloadCipher)
 		b.SetBytes(int64(len(testFrame.Payload)))
+		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			obfs(testFrame, obfsBuf, 0)
@@ -109,16 +393,27 @@ func BenchmarkObfs(b *testing.B) {
 	b.Run("plain", func(b *testing.B) {
 		obfs := MakeObfs(key, nil)
 		b.SetBytes(int64(len(testFrame.Payload)))
+		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			obfs(testFrame, obfsBuf, 0)
 		}
 	})
 	b.Run("chacha20Poly1305", func(b *testing.B) {
-		payloadCipher, _ := chacha20poly1305.New(key[:16])
+		payloadCipher, _ := chacha20poly1305.New(key[:])
 
 		obfs := MakeObfs(key, payloadCipher)
 		b.SetBytes(int64(len(testFrame.Payload)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			obfs(testFrame, obfsBuf, 0)
+		}
+	})
+	b.Run("xorStream", func(b *testing.B) {
+		obfs := MakeObfs(key, &xorStream{key: key})
+		b.SetBytes(int64(len(testFrame.Payload)))
+		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			obfs(testFrame, obfsBuf, 0)
@@ -137,6 +432,8 @@ func BenchmarkDeobfs(b *testing.B) {
 	}
 
 	obfsBuf := make([]byte, defaultSendRecvBufSize)
+	// Deobfs works in place, so each run is given a fresh copy of the obfuscated frame
+	deobfsBuf := make([]byte, defaultSendRecvBufSize)
 
 	var key [32]byte
 	rand.Read(key[:])
@@ -149,9 +446,11 @@ func BenchmarkDeobfs(b *testing.B) {
 		deobfs := MakeDeobfs(key, payloadCipher)
 
 		b.SetBytes(int64(n))
+		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			deobfs(obfsBuf[:n])
+			copy(deobfsBuf, obfsBuf[:n])
+			deobfs(deobfsBuf[:n])
 		}
 	})
 	b.Run("AES128GCM", func(b *testing.B) {
@@ -162,10 +461,12 @@ func BenchmarkDeobfs(b *testing.B) {
 		n, _ := obfs(testFrame, obfsBuf, 0)
 		deobfs := MakeDeobfs(key, payloadCipher)
 
-		b.ResetTimer()
 		b.SetBytes(int64(n))
+		b.ReportAllocs()
+		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			deobfs(obfsBuf[:n])
+			copy(deobfsBuf, obfsBuf[:n])
+			deobfs(deobfsBuf[:n])
 		}
 	})
 	b.Run("plain", func(b *testing.B) {
@@ -173,23 +474,42 @@ func BenchmarkDeobfs(b *testing.B) {
 		n, _ := obfs(testFrame, obfsBuf, 0)
 		deobfs := MakeDeobfs(key, nil)
 
-		b.ResetTimer()
 		b.SetBytes(int64(n))
+		b.ReportAllocs()
+		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			deobfs(obfsBuf[:n])
+			copy(deobfsBuf, obfsBuf[:n])
+			deobfs(deobfsBuf[:n])
 		}
 	})
 	b.Run("chacha20Poly1305", func(b *testing.B) {
-		payloadCipher, _ := chacha20poly1305.New(key[:16])
+		payloadCipher, _ := chacha20poly1305.New(key[:])
 
 		obfs := MakeObfs(key, payloadCipher)
 		n, _ := obfs(testFrame, obfsBuf, 0)
 		deobfs := MakeDeobfs(key, payloadCipher)
 
+		b.SetBytes(int64(n))
+		b.ReportAllocs()
 		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			copy(deobfsBuf, obfsBuf[:n])
+			deobfs(deobfsBuf[:n])
+		}
+	})
+	b.Run("xorStream", func(b *testing.B) {
+		payloadCipher := &xorStream{key: key}
+
+		obfs := MakeObfs(key, payloadCipher)
+		n, _ := obfs(testFrame, obfsBuf, 0)
+		deobfs := MakeDeobfs(key, payloadCipher)
+
 		b.SetBytes(int64(n))
+		b.ReportAllocs()
+		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			deobfs(obfsBuf[:n])
+			copy(deobfsBuf, obfsBuf[:n])
+			deobfs(deobfsBuf[:n])
 		}
 	})
 }
@@ -0,0 +1,81 @@
+package multiplex
+
+import (
+	"errors"
+)
+
+// Padded payloads end with a field recording the length of padding added
+const paddingLenFieldSize = 2
+
+const maxPaddingLen = 1<<(8*paddingLenFieldSize) - 1
+
+var errBadPadding = errors.New("padding length is greater than the padded payload")
+
+// PaddingScheme pads frames with random bytes before they are obfuscated, so that the sizes of messages on the wire
+// don't reveal the sizes of data sent. Padding is added into the frame payload and is therefore encrypted along with
+// it. Both ends of a Session must use padding for frames to be read correctly.
+type PaddingScheme struct {
+	// BucketSize, if non-zero, pads each obfuscated frame so that its size, including headers and overhead,
+	// is rounded up to a multiple of BucketSize
+	BucketSize int
+	// MaxRandomPadding, if non-zero, adds a further random amount of padding of up to MaxRandomPadding bytes
+	// to each frame
+	MaxRandomPadding int
+}
+
+func (p PaddingScheme) enabled() bool {
+	return p.BucketSize > 0 || p.MaxRandomPadding > 0
+}
+
+// paddedPayloadLen returns the length a payload of payloadLen bytes should be padded to, such that the obfuscated
+// frame, with overhead bytes added by the Obfuscator, is no larger than sizeLimit
+func (p PaddingScheme) paddedPayloadLen(payloadLen int, overhead int, sizeLimit int) int {
+	minLen := payloadLen + paddingLenFieldSize
+	size := frameHeaderLength + minLen + overhead
+	if p.BucketSize > 0 {
+		size = (size + p.BucketSize - 1) / p.BucketSize * p.BucketSize
+	}
+	if p.MaxRandomPadding > 0 {
+		size += randIntn(p.MaxRandomPadding + 1)
+	}
+	if size > sizeLimit {
+		size = sizeLimit
+	}
+
+	paddedLen := size - frameHeaderLength - overhead
+	if paddedLen < minLen {
+		return minLen
+	}
+	if paddedLen-minLen > maxPaddingLen {
+		return minLen + maxPaddingLen
+	}
+	return paddedLen
+}
+
+// pad fills padded after the first payloadLen bytes with random padding and the padding length field
+func pad(padded []byte, payloadLen int) {
+	padLenField := padded[len(padded)-paddingLenFieldSize:]
+	padding := padded[payloadLen : len(padded)-paddingLenFieldSize]
+	randRead(padding)
+	putU16(padLenField, uint16(len(padding)))
+}
+
+// depad returns the original payload of a padded one
+func depad(padded []byte) ([]byte, error) {
+	if len(padded) < paddingLenFieldSize {
+		return nil, errBadPadding
+	}
+	padLen := int(u16(padded[len(padded)-paddingLenFieldSize:]))
+	payloadLen := len(padded) - paddingLenFieldSize - padLen
+	if payloadLen < 0 {
+		return nil, errBadPadding
+	}
+	return padded[:payloadLen], nil
+}
+
+// randIntn returns a uniformly random int in [0, n)
+func randIntn(n int) int {
+	b := make([]byte, 4)
+	randRead(b)
+	return int(u32(b) % uint32(n))
+}
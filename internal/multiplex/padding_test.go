@@ -0,0 +1,142 @@
+package multiplex
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPadDepad(t *testing.T) {
+	payload := make([]byte, 100)
+	rand.Read(payload)
+	for _, paddedLen := range []int{len(payload) + paddingLenFieldSize, 512, 1024} {
+		padded := make([]byte, paddedLen)
+		copy(padded, payload)
+		pad(padded, len(payload))
+		depadded, err := depad(padded)
+		if err != nil {
+			t.Fatalf("failed to depad: %v", err)
+		}
+		if !bytes.Equal(payload, depadded) {
+			t.Errorf("expecting %x, got %x", payload, depadded)
+		}
+	}
+
+	_, err := depad([]byte{0x00})
+	assert.Equal(t, errBadPadding, err)
+	_, err = depad([]byte{0x00, 0x00, 0x03})
+	assert.Equal(t, errBadPadding, err)
+}
+
+func TestPaddingScheme_paddedPayloadLen(t *testing.T) {
+	const overhead = 16
+	bucket := PaddingScheme{BucketSize: 512}
+	for _, payloadLen := range []int{1, 100, 480, 481, 1000} {
+		paddedLen := bucket.paddedPayloadLen(payloadLen, overhead, 1<<16)
+		assert.Zero(t, (frameHeaderLength+paddedLen+overhead)%bucket.BucketSize, "payload length %v", payloadLen)
+		assert.GreaterOrEqual(t, paddedLen, payloadLen+paddingLenFieldSize)
+	}
+
+	limited := bucket.paddedPayloadLen(1000, overhead, 1100)
+	assert.Equal(t, 1100-frameHeaderLength-overhead, limited)
+
+	random := PaddingScheme{MaxRandomPadding: 64}
+	for i := 0; i < 100; i++ {
+		paddedLen := random.paddedPayloadLen(100, overhead, 1<<16)
+		assert.GreaterOrEqual(t, paddedLen, 100+paddingLenFieldSize)
+		assert.LessOrEqual(t, paddedLen, 100+paddingLenFieldSize+random.MaxRandomPadding)
+	}
+}
+
+func TestSession_Padding(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+	sesh := MakeSession(0, SessionConfig{
+		Obfuscator:    obfuscator,
+		PaddingScheme: PaddingScheme{BucketSize: 512},
+	})
+
+	obfsBuf := make([]byte, sesh.MsgOnWireSizeLimit)
+	for _, payloadLen := range []int{1, 100, 1000, sesh.maxStreamUnitWrite} {
+		payload := make([]byte, payloadLen)
+		rand.Read(payload)
+		f := &Frame{
+			StreamID: 1,
+			Seq:      0,
+			Closing:  closingNothing,
+			Payload:  payload,
+		}
+		n, err := sesh.obfs(f, obfsBuf, 0)
+		if err != nil {
+			t.Fatalf("failed to obfs payload of length %v: %v", payloadLen, err)
+		}
+		if n != sesh.MsgOnWireSizeLimit && n%512 != 0 {
+			t.Errorf("obfuscated length %v is not padded to a multiple of 512", n)
+		}
+
+		resultFrame, err := sesh.deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatalf("failed to deobfs payload of length %v: %v", payloadLen, err)
+		}
+		if !bytes.Equal(payload, resultFrame.Payload) {
+			t.Errorf("expecting %x, got %x", payload, resultFrame.Payload)
+		}
+	}
+}
+
+func TestSession_PaddingHook(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+
+	type padding struct {
+		payloadLen int
+		paddingLen int
+	}
+	var sent, received []padding
+	sesh := MakeSession(0, SessionConfig{
+		Obfuscator:    obfuscator,
+		PaddingScheme: PaddingScheme{BucketSize: 512},
+		PaddingHook: func(payloadLen int, paddingLen int, outbound bool) {
+			if outbound {
+				sent = append(sent, padding{payloadLen, paddingLen})
+			} else {
+				received = append(received, padding{payloadLen, paddingLen})
+			}
+		},
+	})
+
+	obfsBuf := make([]byte, sesh.MsgOnWireSizeLimit)
+	for _, payloadLen := range []int{1, 100, 1000} {
+		n, err := sesh.obfs(&Frame{StreamID: 1, Payload: make([]byte, payloadLen)}, obfsBuf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = sesh.deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, sent, len(received)) {
+			last := sent[len(sent)-1]
+			assert.Equal(t, payloadLen, last.payloadLen)
+			assert.Equal(t, n, frameHeaderLength+last.payloadLen+last.paddingLen+sesh.Obfuscator.maxOverhead,
+				"padding isn't all that is added to the payload")
+			assert.Equal(t, last, received[len(received)-1])
+		}
+	}
+
+	t.Run("padding disabled", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{
+			Obfuscator: obfuscator,
+			PaddingHook: func(int, int, bool) {
+				t.Error("padding hook is called")
+			},
+		})
+		n, _ := sesh.obfs(&Frame{StreamID: 1, Payload: make([]byte, 100)}, obfsBuf, 0)
+		_, err := sesh.deobfs(obfsBuf[:n])
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,39 @@
+package multiplex
+
+import "sync/atomic"
+
+// PeakStats are the high-water marks of a session's usage, for sizing its limits
+type PeakStats struct {
+	// Streams is the largest number of streams active at once
+	Streams int
+	// BufferedBytes is the largest amount of data received by all streams but not yet read at once. It's only counted
+	// if MaxBufferedBytes is set
+	BufferedBytes int64
+}
+
+// PeakStats returns the high-water marks since the session was made, or since they were last reset. If reset is set,
+// they start over from the current usage once read
+func (sesh *Session) PeakStats(reset bool) PeakStats {
+	if !reset {
+		return PeakStats{
+			Streams:       int(atomic.LoadInt64(&sesh.peakStreams)),
+			BufferedBytes: atomic.LoadInt64(&sesh.peakBufferedBytes),
+		}
+	}
+	streams := atomic.SwapInt64(&sesh.peakStreams, int64(sesh.streamCount()))
+	buffered := atomic.SwapInt64(&sesh.peakBufferedBytes, atomic.LoadInt64(&sesh.bufferedBytes))
+	// usage may have risen in between
+	raisePeak(&sesh.peakStreams, int64(sesh.streamCount()))
+	raisePeak(&sesh.peakBufferedBytes, atomic.LoadInt64(&sesh.bufferedBytes))
+	return PeakStats{Streams: int(streams), BufferedBytes: buffered}
+}
+
+// raisePeak sets *peak to v if v is larger
+func raisePeak(peak *int64, v int64) {
+	for {
+		old := atomic.LoadInt64(peak)
+		if v <= old || atomic.CompareAndSwapInt64(peak, old, v) {
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package multiplex
+
+import (
+	"io"
+	"testing"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_PeakStats(t *testing.T) {
+	t.Run("streams", func(t *testing.T) {
+		sesh := setupSesh(false, emptyKey, EncryptionMethodPlain)
+		sesh.AddConnection(connutil.Discard())
+		defer sesh.Close()
+
+		var streams []*Stream
+		for i := 0; i < 3; i++ {
+			stream, _ := sesh.OpenStream()
+			streams = append(streams, stream)
+		}
+		_ = streams[0].Close()
+		_ = streams[1].Close()
+		assert.Equal(t, 3, sesh.PeakStats(false).Streams)
+
+		_, _ = sesh.OpenStreamBatch(2)
+		assert.Equal(t, 3, sesh.PeakStats(false).Streams, "peak is raised without exceeding it")
+		_, _ = sesh.OpenStream()
+		assert.Equal(t, 4, sesh.PeakStats(true).Streams)
+		assert.Equal(t, 4, sesh.PeakStats(false).Streams, "reset below the current count")
+
+		_ = streams[2].Close()
+		assert.Equal(t, 4, sesh.PeakStats(true).Streams)
+		assert.Equal(t, 3, sesh.PeakStats(false).Streams)
+	})
+
+	t.Run("buffered bytes", func(t *testing.T) {
+		sesh := setupSesh(false, emptyKey, EncryptionMethodPlain)
+		sesh.MaxBufferedBytes = 1 << 20
+		obfsBuf := make([]byte, obfsBufLen)
+		for seq := uint64(0); seq < 3; seq++ {
+			n, _ := sesh.Obfs(&Frame{1, seq, closingNothing, make([]byte, 100)}, obfsBuf, 0)
+			assert.NoError(t, sesh.recvDataFromRemote(obfsBuf[:n], 0))
+		}
+		stream, _ := sesh.Accept()
+		_, err := io.ReadFull(stream, make([]byte, 250))
+		assert.NoError(t, err)
+
+		assert.Equal(t, int64(300), sesh.PeakStats(true).BufferedBytes)
+		assert.Equal(t, int64(50), sesh.PeakStats(false).BufferedBytes)
+	})
+}
@@ -0,0 +1,172 @@
+package multiplex
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// When SessionConfig.PathMTUDiscovery is set, the largest frame each underlying connection can deliver is searched for
+// in the style of DPLPMTUD (RFC 8899). Frames start off limited to basePathMTU, which almost every path can carry.
+// Probes of sizes between the largest one acknowledged and the smallest one known to be too large are sent through
+// the connection, and the remote replies to each through the same connection with its size. A probe is retried
+// pathMTUMaxProbes times before its size is taken as too large. The search stops once the two are within
+// pathMTUPrecision of each other. Frames are then limited to the smallest path MTU of all connections. Sizes are of
+// obfuscated frames, like MsgOnWireSizeLimit.
+
+// basePathMTU is the frame size assumed to fit through any path before probing, which is the minimum MTU required of
+// paths carrying QUIC
+const basePathMTU = 1200
+
+// pathMTUMaxProbes is the number of probes of a size sent before the size is taken as too large
+const pathMTUMaxProbes = 3
+
+// pathMTUPrecision is how close the path MTU found is to the true one
+const pathMTUPrecision = 16
+
+// defaultPathMTUProbeTimeout is how long a reply to a probe is waited for
+const defaultPathMTUProbeTimeout = time.Second
+
+// PathMTU returns the largest size of obfuscated frames sent by the session, which is MsgOnWireSizeLimit unless
+// PathMTUDiscovery is set. Otherwise it's the smallest path MTU discovered of all underlying connections, where a
+// connection that hasn't been probed yet counts as 1200 bytes. MaxFramePayload is lowered accordingly
+func (sesh *Session) PathMTU() int {
+	return sesh.frameSizeLimit()
+}
+
+// frameSizeLimit returns the largest size of an obfuscated frame that can be sent
+func (sesh *Session) frameSizeLimit() int {
+	if !sesh.PathMTUDiscovery {
+		return sesh.MsgOnWireSizeLimit
+	}
+	return int(atomic.LoadUint32(&sesh.sb.pathMTU))
+}
+
+// frameUnitLimit returns the largest payload of a frame that can be sent, which is maxStreamUnitWrite lowered to fit
+// the path MTU
+func (sesh *Session) frameUnitLimit() int {
+	return sesh.maxStreamUnitWrite - (sesh.MsgOnWireSizeLimit - sesh.frameSizeLimit())
+}
+
+// updatePathMTU sets the path MTU of the switchboard to the smallest of all connections. It's kept as is while there
+// isn't any connection
+func (sb *switchboard) updatePathMTU() {
+	if !sb.session.PathMTUDiscovery {
+		return
+	}
+	pathMTU := sb.session.MsgOnWireSizeLimit
+	found := false
+	sb.conns.Range(func(key, _ interface{}) bool {
+		found = true
+		connMTU := basePathMTU
+		if healthI, ok := sb.health.Load(key); ok {
+			if probed := atomic.LoadUint32(&healthI.(*connHealth).pathMTU); probed > 0 {
+				connMTU = int(probed)
+			}
+		}
+		if connMTU < pathMTU {
+			pathMTU = connMTU
+		}
+		return true
+	})
+	if found {
+		atomic.StoreUint32(&sb.pathMTU, uint32(pathMTU))
+	}
+}
+
+// discoverPathMTU searches for the path MTU of the connection of connId, until it's found or the connection is gone
+func (sb *switchboard) discoverPathMTU(connId uint32, health *connHealth) {
+	lo, hi := basePathMTU, sb.session.MsgOnWireSizeLimit+1
+	for hi-lo > pathMTUPrecision {
+		size := (lo + hi) / 2
+		acked, alive := sb.probePathMTU(connId, health, size)
+		if !alive {
+			return
+		}
+		if acked {
+			lo = size
+			atomic.StoreUint32(&health.pathMTU, uint32(size))
+			sb.updatePathMTU()
+		} else {
+			hi = size
+		}
+	}
+	sb.session.Logger.Debugf("path MTU of connection %v of session %v is %v", connId, sb.session.id, lo)
+	atomic.StoreUint32(&health.pathMTU, uint32(lo))
+	sb.updatePathMTU()
+}
+
+// probePathMTU sends probes of size through the connection of connId until one is acknowledged, or pathMTUMaxProbes
+// have timed out. alive is false if the connection or the session has gone in the meantime
+func (sb *switchboard) probePathMTU(connId uint32, health *connHealth, size int) (acked bool, alive bool) {
+	probe := &Frame{
+		StreamID: 0xffffffff,
+		Closing:  pathMTUProbe,
+	}
+	// the probe is padded minimally, so its payload is the size of the frame less all overheads. A compact header
+	// leaves more room for it
+	payloadLen := size - (sb.session.MsgOnWireSizeLimit - sb.session.maxStreamUnitWrite)
+	payloadLen += frameHeaderLength - sb.session.sentHeaderLen(probe)
+	probe.Payload = make([]byte, payloadLen)
+	putU32(probe.Payload, uint32(size))
+	for i := 0; i < pathMTUMaxProbes; i++ {
+		err := sb.session.sendControlFrameTo(probe, connId)
+		if err != nil {
+			// such as EMSGSIZE from a UDP socket
+			sb.session.Logger.Tracef("failed to send a path MTU probe of %v bytes: %v", size, err)
+		}
+
+		timer := time.NewTimer(sb.pathMTUProbeTimeout)
+	wait:
+		for {
+			select {
+			case ackedSize := <-health.pathMTUAck:
+				if ackedSize == uint32(size) {
+					timer.Stop()
+					return true, true
+				}
+				// a late reply to an earlier probe
+			case <-timer.C:
+				break wait
+			case <-health.deplexDone:
+				timer.Stop()
+				return false, false
+			case <-sb.session.done:
+				timer.Stop()
+				return false, false
+			}
+		}
+		if atomic.LoadUint32(&health.removed) == 1 {
+			return false, false
+		}
+	}
+	return false, true
+}
+
+// recvPathMTUProbe replies to a path MTU probe received through the connection of connId with its size
+func (sesh *Session) recvPathMTUProbe(payload []byte, connId uint32) error {
+	if len(payload) < 4 {
+		return nil
+	}
+	reply := append(make([]byte, 4), genRandomPadding()...)
+	copy(reply, payload[:4])
+	return sesh.sendControlFrameTo(&Frame{
+		StreamID: 0xffffffff,
+		Closing:  pathMTUReply,
+		Payload:  reply,
+	}, connId)
+}
+
+// recvPathMTUReply passes the size acknowledged by a reply to a path MTU probe to the prober of the connection
+func (sesh *Session) recvPathMTUReply(payload []byte, connId uint32) {
+	if len(payload) < 4 {
+		return
+	}
+	healthI, ok := sesh.sb.health.Load(connId)
+	if !ok {
+		return
+	}
+	select {
+	case healthI.(*connHealth).pathMTUAck <- u32(payload):
+	default:
+	}
+}
@@ -0,0 +1,86 @@
+package multiplex
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// mtuConn silently drops writes larger than mtu, like a path dropping oversized datagrams
+type mtuConn struct {
+	net.Conn
+	mtu int
+}
+
+func (c mtuConn) Write(b []byte) (int, error) {
+	if len(b) > c.mtu {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestSession_PathMTU(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+	config := SessionConfig{
+		Obfuscator:       obfuscator,
+		Unordered:        true,
+		PathMTUDiscovery: true,
+		Role:             RoleClient,
+	}
+
+	t.Run("discovered", func(t *testing.T) {
+		const mtu = 1400
+		clientSesh := MakeSession(0, config)
+		serverSesh := MakeSession(0, config.Derive())
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+		assert.Equal(t, basePathMTU, clientSesh.PathMTU())
+		clientSesh.sb.pathMTUProbeTimeout = 50 * time.Millisecond
+		serverSesh.sb.pathMTUProbeTimeout = 50 * time.Millisecond
+
+		c, s := connutil.AsyncPipe()
+		// the record header of TLSConn isn't part of a frame
+		clientSesh.AddConnection(common.NewTLSConn(mtuConn{c, mtu + 5}))
+		serverSesh.AddConnection(common.NewTLSConn(mtuConn{s, mtu + 5}))
+
+		assert.Eventually(t, func() bool {
+			return clientSesh.PathMTU() > mtu-pathMTUPrecision
+		}, 5*time.Second, 10*time.Millisecond, "path MTU not discovered")
+		assert.LessOrEqual(t, clientSesh.PathMTU(), mtu)
+		overhead := clientSesh.MsgOnWireSizeLimit - clientSesh.maxStreamUnitWrite
+		assert.Equal(t, clientSesh.PathMTU()-overhead, clientSesh.MaxFramePayload())
+
+		// a frame as large as allowed gets through
+		stream, _ := clientSesh.OpenStream()
+		data := make([]byte, clientSesh.MaxFramePayload())
+		rand.Read(data)
+		_, err := stream.Write(data)
+		assert.NoError(t, err)
+		_, err = stream.Write(make([]byte, clientSesh.MaxFramePayload()+1))
+		assert.Error(t, err)
+
+		remoteStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf := make([]byte, len(data))
+		n, err := remoteStream.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, data, buf[:n])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		config := config
+		config.PathMTUDiscovery = false
+		sesh := MakeSession(0, config)
+		defer sesh.Close()
+		assert.Equal(t, sesh.MsgOnWireSizeLimit, sesh.PathMTU())
+	})
+}
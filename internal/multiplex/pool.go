@@ -0,0 +1,51 @@
+package multiplex
+
+import "time"
+
+const (
+	minDialBackoff = 100 * time.Millisecond
+	maxDialBackoff = 30 * time.Second
+)
+
+// maintainConns dials new connections with session.Dialer whenever there are fewer than session.MinConnections,
+// until the session is closed. A failed dial is retried after a backoff, which doubles after each consecutive failure
+// up to maxDialBackoff
+func (sb *switchboard) maintainConns() {
+	backoff := minDialBackoff
+	for {
+		for sb.connsCount() < sb.session.MinConnections {
+			conn, err := sb.session.Dialer()
+			if err != nil {
+				sb.session.Logger.Warnf("failed to dial a connection for session %v, retrying in %v: %v", sb.session.id,
+					backoff, err)
+				select {
+				case <-sb.session.done:
+					return
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > maxDialBackoff {
+					backoff = maxDialBackoff
+				}
+				continue
+			}
+			backoff = minDialBackoff
+			if sb.session.IsClosed() {
+				conn.Close()
+				return
+			}
+			if err := sb.session.AddConnection(conn); err != nil {
+				// MinConnections is beyond MaxConnections
+				sb.session.Logger.Warnf("failed to add a dialed connection to session %v: %v", sb.session.id, err)
+				conn.Close()
+				break
+			}
+		}
+
+		select {
+		case <-sb.session.done:
+			return
+		case <-sb.connLost:
+		}
+	}
+}
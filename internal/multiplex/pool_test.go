@@ -0,0 +1,73 @@
+package multiplex
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_MinConnections(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+
+	const minConns = 2
+	var dialed uint32
+	clientSesh := MakeSession(0, SessionConfig{
+		Obfuscator:     obfuscator,
+		MinConnections: minConns,
+		Dialer: func() (net.Conn, error) {
+			if atomic.AddUint32(&dialed, 1) <= 2 {
+				return nil, errors.New("failed to dial")
+			}
+			c, s := connutil.AsyncPipe()
+			serverSesh.AddConnection(common.NewTLSConn(s))
+			return common.NewTLSConn(c), nil
+		},
+	})
+	defer clientSesh.Close()
+
+	assert.Eventually(t, func() bool {
+		return len(clientSesh.Connections()) == minConns
+	}, time.Second, 10*time.Millisecond, "connections aren't dialed")
+	assert.Equal(t, uint32(2+minConns), atomic.LoadUint32(&dialed))
+	assert.False(t, clientSesh.IsClosed())
+
+	err := clientSesh.RemoveConnection(clientSesh.Connections()[0].ID, time.Second)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(clientSesh.Connections()) == minConns
+	}, time.Second, 10*time.Millisecond, "the removed connection isn't replaced")
+	assert.Equal(t, uint32(2+minConns+1), atomic.LoadUint32(&dialed))
+
+	stream, _ := clientSesh.OpenStream()
+	_, err = stream.Write([]byte{1})
+	assert.NoError(t, err)
+	_, err = serverSesh.Accept()
+	assert.NoError(t, err)
+
+	t.Run("dial keeps failing", func(t *testing.T) {
+		var dialed uint32
+		sesh := MakeSession(0, SessionConfig{
+			Obfuscator:     obfuscator,
+			MinConnections: 1,
+			Dialer: func() (net.Conn, error) {
+				atomic.AddUint32(&dialed, 1)
+				return nil, errors.New("failed to dial")
+			},
+		})
+		// retried after 100ms then 200ms
+		time.Sleep(minDialBackoff * 7 / 2)
+		assert.Equal(t, uint32(3), atomic.LoadUint32(&dialed))
+		assert.False(t, sesh.IsClosed())
+		sesh.Close()
+	})
+}
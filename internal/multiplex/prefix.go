@@ -0,0 +1,40 @@
+package multiplex
+
+import (
+	"net"
+	"sync"
+)
+
+// prefixConn sends the data made by SessionConfig.ConnPrefix through the connection it wraps before anything else,
+// and discards the first read from the connection, which is the remote's prefix. The prefix is sent in a write of its
+// own, so the connection it wraps must keep writes apart, as common.TLSConn does, for the remote to read it on its own.
+type prefixConn struct {
+	net.Conn
+	prefix func() []byte
+
+	sendOnce sync.Once
+	sendErr  error
+
+	// only used by switchboard.deplex
+	prefixRead bool
+}
+
+func (c *prefixConn) Write(b []byte) (int, error) {
+	c.sendOnce.Do(func() {
+		_, c.sendErr = c.Conn.Write(c.prefix())
+	})
+	if c.sendErr != nil {
+		return 0, c.sendErr
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if !c.prefixRead {
+		if _, err := c.Conn.Read(b); err != nil {
+			return 0, err
+		}
+		c.prefixRead = true
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,66 @@
+package multiplex
+
+import (
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_ConnPrefix(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	// of varying lengths, as the remote doesn't need to know how long they are
+	prefix := func() []byte {
+		return append([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n"), make([]byte, rand.Intn(100))...)
+	}
+	clientConfig := SessionConfig{Obfuscator: obfuscator, Role: RoleClient, ConnPrefix: prefix}
+	clientSesh := MakeSession(0, clientConfig)
+	serverSesh := MakeSession(0, clientConfig.Derive())
+	defer clientSesh.Close()
+	defer serverSesh.Close()
+
+	var recorders []*recordingConn
+	for i := 0; i < 2; i++ {
+		c, s := connutil.AsyncPipe()
+		recorder := &recordingConn{Conn: common.NewTLSConn(c)}
+		recorders = append(recorders, recorder)
+		clientSesh.AddConnection(recorder)
+		serverSesh.AddConnection(common.NewTLSConn(s))
+	}
+
+	testData := make([]byte, 1<<16)
+	rand.Read(testData)
+	stream, _ := clientSesh.OpenStream()
+	go stream.Write(testData)
+	serverStream, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	recvBuf := make([]byte, len(testData))
+	_, err = io.ReadFull(serverStream, recvBuf)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, recvBuf)
+
+	// and the other way
+	go serverStream.Write(testData)
+	_, err = io.ReadFull(stream, recvBuf)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, recvBuf)
+
+	used := 0
+	for _, recorder := range recorders {
+		recorder.m.Lock()
+		if len(recorder.written) > 0 {
+			used++
+			assert.Equal(t, "GET / HTTP/1.1\r\nHost: example.com\r\n", string(recorder.written[0][:35]),
+				"prefix isn't sent first")
+		}
+		recorder.m.Unlock()
+	}
+	assert.NotZero(t, used)
+}
@@ -0,0 +1,101 @@
+package multiplex
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A connection can become a black hole, where writes succeed into kernel buffers but nothing ever arrives, without
+// being closed. When SessionConfig.ProbeInterval is set, each connection is regularly sent a probe which the remote
+// replies to through the same connection. Connections that have received nothing for ProbeTimeout are evicted from
+// the pool, and replaced using SessionConfig.Dialer if it's set.
+
+// connHealth tracks whether an underlying connection is still delivering data from the remote, and whether it's
+// still in use
+type connHealth struct {
+	// atomic. UnixNano of the last time anything was received from the connection. Only updated when probing
+	lastRecv int64
+	// atomic. 1 once the connection has been taken out of the pool by switchboard.removeConn or drainConn
+	removed uint32
+	// held for reading while data is being written into the connection, so that switchboard.drainConn can wait for
+	// writes in progress
+	writeM sync.RWMutex
+	// closed once switchboard.deplex has stopped reading from the connection
+	deplexDone chan struct{}
+	// atomic. The path MTU of the connection, or the largest size acknowledged so far. 0 until a probe has been
+	// acknowledged. Only set with session.PathMTUDiscovery
+	pathMTU uint32
+	// receives the sizes acknowledged by replies to path MTU probes
+	pathMTUAck chan uint32
+}
+
+// probeConns probes all connections every session.ProbeInterval and evicts the ones that haven't received anything
+// for session.ProbeTimeout, until the session is closed
+func (sb *switchboard) probeConns() {
+	ticker := time.NewTicker(sb.session.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sb.session.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		sb.conns.Range(func(key, connI interface{}) bool {
+			connId := key.(uint32)
+			healthI, ok := sb.health.Load(connId)
+			if !ok {
+				return true
+			}
+			health := healthI.(*connHealth)
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&health.lastRecv))) > sb.session.ProbeTimeout {
+				sb.evictConn(connId, connI.(net.Conn), health, "nothing has been received from it")
+				return true
+			}
+			err := sb.session.sendControlFrameTo(&Frame{
+				StreamID: 0xffffffff,
+				Closing:  probeConn,
+				Payload:  genRandomPadding(),
+			}, connId)
+			if err != nil {
+				sb.session.Logger.Debugf("failed to probe connection %v of session %v: %v", connId, sb.session.id, err)
+			}
+			return true
+		})
+	}
+}
+
+// evictConn takes a connection that is no longer delivering data out of the pool and closes it, then opens a new one
+// to replace it if the session has a Dialer
+func (sb *switchboard) evictConn(connId uint32, conn net.Conn, health *connHealth, reason string) {
+	sb.session.Logger.Debugf("evicting connection %v of session %v as %v", connId, sb.session.id, reason)
+	// with MinConnections, maintainConns replaces it
+	if sb.removeConn(connId, conn, health, "all connections have been evicted") && sb.session.Dialer != nil &&
+		sb.session.MinConnections <= 0 {
+		go sb.replenish()
+	}
+}
+
+// replenish opens a new connection with session.Dialer and adds it to the pool
+func (sb *switchboard) replenish() {
+	conn, err := sb.session.Dialer()
+	if err != nil {
+		sb.session.Logger.Errorf("failed to replace an evicted connection of session %v: %v", sb.session.id, err)
+		if sb.connsCount() == 0 && sb.session.ResumptionWindow <= 0 {
+			sb.close("failed to replace an evicted connection: " + err.Error())
+		}
+		return
+	}
+	if sb.session.IsClosed() {
+		conn.Close()
+		return
+	}
+	if err := sb.session.AddConnection(conn); err != nil {
+		sb.session.Logger.Warnf("failed to add the replacement of an evicted connection to session %v: %v",
+			sb.session.id, err)
+		conn.Close()
+	}
+}
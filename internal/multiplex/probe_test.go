@@ -0,0 +1,134 @@
+package multiplex
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_ConnProbe(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+	serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+
+	var dialed uint32
+	clientSesh := MakeSession(0, SessionConfig{
+		Obfuscator:    obfuscator,
+		ProbeInterval: 20 * time.Millisecond,
+		ProbeTimeout:  100 * time.Millisecond,
+		Dialer: func() (net.Conn, error) {
+			atomic.AddUint32(&dialed, 1)
+			c, s := connutil.AsyncPipe()
+			serverSesh.AddConnection(common.NewTLSConn(s))
+			return common.NewTLSConn(c), nil
+		},
+	})
+	defer clientSesh.Close()
+
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	testData := []byte{1, 2, 3}
+	stream, _ := clientSesh.OpenStream()
+	_, _ = stream.Write(testData)
+	serverStream, _ := serverSesh.Accept()
+	readBuf := make([]byte, len(testData))
+	_, err := io.ReadFull(serverStream, readBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writes into it succeed, but nothing ever comes out of it
+	blackHole, _ := connutil.AsyncPipe()
+	blackHoleId, _ := clientSesh.sb.addConn(common.NewTLSConn(blackHole))
+
+	assert.Eventually(t, func() bool {
+		conns := clientSesh.Connections()
+		for _, info := range conns {
+			if info.ID == blackHoleId {
+				return false
+			}
+		}
+		return len(conns) == 2
+	}, time.Second, 10*time.Millisecond, "the dead connection isn't replaced")
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&dialed))
+	assert.False(t, clientSesh.IsClosed())
+
+	// the healthy connection is kept, as the remote keeps replying to probes
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, clientSesh.Connections(), 2)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&dialed))
+
+	_, err = stream.Write(testData)
+	assert.NoError(t, err)
+	_, err = io.ReadFull(serverStream, readBuf)
+	assert.NoError(t, err, "active stream is disrupted")
+	assert.Equal(t, testData, readBuf)
+
+	t.Run("without dialer", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{
+			Obfuscator:    obfuscator,
+			ProbeInterval: 10 * time.Millisecond,
+		})
+		blackHole, _ := connutil.AsyncPipe()
+		sesh.AddConnection(common.NewTLSConn(blackHole))
+		assert.Eventually(t, sesh.IsClosed, time.Second, 10*time.Millisecond)
+		assert.Equal(t, "all connections have been evicted", sesh.TerminalMsg())
+	})
+}
+
+func TestSession_ControlFrameNonces(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+
+	for _, role := range []SessionRole{RoleClient, RoleUnspecified} {
+		var m sync.Mutex
+		sent := make(map[uint64]bool)
+		var repeated int
+		record := func(f *Frame, outbound bool) {
+			if !outbound || f.StreamID != 0xffffffff {
+				return
+			}
+			m.Lock()
+			defer m.Unlock()
+			if sent[f.Seq] {
+				repeated++
+			}
+			sent[f.Seq] = true
+		}
+		clientConfig := SessionConfig{
+			Obfuscator:    obfuscator,
+			Role:          role,
+			ProbeInterval: 10 * time.Millisecond,
+			FrameHook:     record,
+		}
+		serverConfig := clientConfig.Derive()
+		serverConfig.FrameHook = record
+		clientSesh := MakeSession(0, clientConfig)
+		serverSesh := MakeSession(0, serverConfig)
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+
+		// each end probes and replies to the probes of the other
+		time.Sleep(100 * time.Millisecond)
+		clientSesh.Close()
+		serverSesh.Close()
+
+		m.Lock()
+		assert.Greater(t, len(sent), 10)
+		assert.Zero(t, repeated, "control frames are sent with the same nonce")
+		m.Unlock()
+	}
+}
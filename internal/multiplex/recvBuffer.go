@@ -20,6 +20,15 @@ type recvBuffer interface {
 	// SetWriteToTimeout sets the duration a recvBuffer waits in a WriteTo call when nothing
 	// has been written for a while. After that duration it should return ErrTimeout
 	SetWriteToTimeout(d time.Duration)
+	// readMessage reads all data up to the end of the next message, marked by a messageEnd frame. Data already read
+	// by Read and WriteTo isn't returned again
+	readMessage() ([]byte, error)
+	// reset closes the recvBuffer and discards all data in it. Reads then return err, or io.EOF if err is nil
+	reset(err error)
+	// buffered returns the number of bytes that can be read without waiting for more frames
+	buffered() int
+	// setPaused makes reads wait as if there were no data while paused is set
+	setPaused(paused bool)
 }
 
 // size we want the amount of unread data in buffer to grow before recvBuffer.Write blocks.
@@ -0,0 +1,63 @@
+package multiplex
+
+import "sync"
+
+// In unordered sessions, a frame replayed by an attacker would be delivered again, as frames may legitimately arrive
+// in any order. With SessionConfig.ReplayProtection, each stream remembers which of the most recent
+// replayWindowSize sequence numbers it has received, and drops frames it has seen before or that are too old to
+// tell, like IPsec anti-replay (RFC 4303 s.3.4.3).
+
+// replayWindowSize is the number of sequence numbers, up to the greatest one received, that a replayWindow remembers.
+// It must be a multiple of 64
+const replayWindowSize = 1024
+
+type replayWindow struct {
+	m sync.Mutex
+	// one more than the greatest sequence number received. 0 if nothing has been received
+	next uint64
+	// the bit of seq is set if seq has been received
+	bitmap [replayWindowSize / 64]uint64
+}
+
+func (w *replayWindow) isSet(seq uint64) bool {
+	i := seq % replayWindowSize
+	return w.bitmap[i/64]&(1<<(i%64)) != 0
+}
+
+func (w *replayWindow) set(seq uint64) {
+	i := seq % replayWindowSize
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+func (w *replayWindow) clear(seq uint64) {
+	i := seq % replayWindowSize
+	w.bitmap[i/64] &^= 1 << (i % 64)
+}
+
+// accept records seq as received and returns true if it hasn't been received before and isn't older than the window
+func (w *replayWindow) accept(seq uint64) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if seq >= w.next {
+		// slide the window forward, forgetting the sequence numbers that fall out of it
+		if seq-w.next >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for s := w.next; s < seq; s++ {
+				w.clear(s)
+			}
+		}
+		w.set(seq)
+		w.next = seq + 1
+		return true
+	}
+	if w.next-seq > replayWindowSize {
+		// too old to tell whether it has been received
+		return false
+	}
+	if w.isSet(seq) {
+		return false
+	}
+	w.set(seq)
+	return true
+}
@@ -0,0 +1,60 @@
+package multiplex
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := new(replayWindow)
+	for _, seq := range []uint64{0, 2, 1, 5} {
+		assert.True(t, w.accept(seq), "new seq %v is dropped", seq)
+	}
+	for _, seq := range []uint64{0, 1, 2, 5} {
+		assert.False(t, w.accept(seq), "replayed seq %v is accepted", seq)
+	}
+	assert.True(t, w.accept(3), "reordered seq is dropped")
+
+	// slide the window past 4
+	assert.True(t, w.accept(4+replayWindowSize))
+	assert.False(t, w.accept(4), "seq older than the window is accepted")
+	assert.False(t, w.accept(5), "seq received before sliding is forgotten")
+	assert.True(t, w.accept(6), "new seq in the window is dropped")
+	assert.False(t, w.accept(6))
+
+	// slide the window by more than its size
+	assert.True(t, w.accept(10*replayWindowSize))
+	assert.True(t, w.accept(10*replayWindowSize-1))
+	assert.False(t, w.accept(9*replayWindowSize))
+}
+
+func TestSession_ReplayProtection(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+
+	for _, replayProtection := range []bool{false, true} {
+		sesh := MakeSession(0, SessionConfig{
+			Obfuscator:       obfuscator,
+			Unordered:        true,
+			ReplayProtection: replayProtection,
+		})
+		obfsBuf := make([]byte, obfsBufLen)
+		for _, seq := range []uint64{0, 2, 1, 2, 0, 3} {
+			n, _ := sesh.Obfs(&Frame{1, seq, closingNothing, []byte{byte(seq)}}, obfsBuf, 0)
+			err := sesh.recvDataFromRemote(obfsBuf[:n], 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		stream, _ := sesh.Accept()
+		pipe := stream.(*Stream).recvBuf.(*datagramBufferedPipe)
+		if replayProtection {
+			assert.Equal(t, 4, len(pipe.pLens), "replayed frames are delivered")
+		} else {
+			assert.Equal(t, 6, len(pipe.pLens))
+		}
+	}
+}
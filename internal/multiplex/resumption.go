@@ -0,0 +1,619 @@
+package multiplex
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+// With SessionConfig.ResumableStreams, a client can resume the streams of an ordered session after losing all of its
+// connections, even from a new process, without any data being lost or delivered twice.
+//
+// Once capabilities have been exchanged, the server issues the client a secret in a resumptionSecret frame. From then
+// on, the server keeps a copy of each frame it sends on a stream until the client acknowledges it in a streamAck
+// frame, which the client sends as data is read. Session.ResumptionToken gives the client its secret and, for each
+// stream, the first frame not read in full and how much of it has been read. A session made with
+// MakeSessionFromToken sends these in a resumeStreams frame through its first connection, and the server sends the
+// frames kept from there again. Streams that can't be resumed are reset. All of these are sent as control frames,
+// so that they don't take up the Seqs of the streams they are about.
+//
+// The original session may have sent frames after the token was made, which the new one doesn't know about, under the
+// same key. As a frame's StreamID and Seq make up the nonce it's encrypted with, the new session sends the frames of
+// all of its streams from a random Seq at or above 1<<62, which it tells the server in resumeStreams. Streams opened
+// afterwards start from it, and resumed streams from the one after it. The server keeps its own Seqs, and sends again
+// exactly the frames it sent before.
+
+// ResetCodeNotResumable is the code of the StreamResetError returned by a stream that couldn't be resumed, because
+// data it needed was no longer kept or the other end no longer knows about it
+const ResetCodeNotResumable uint32 = 0xffffffff
+
+const (
+	resumptionSecretLen   = 16
+	resumptionTokenV1     = 1
+	resumptionAckInterval = 100 * time.Millisecond
+	// the payload of streamAck starts with the ID of the stream acknowledged and the Seq it has been read up to
+	streamAckLen = 4 + 8
+	// the payload of closingReset sent as a control frame starts with the reset code and the ID of the stream reset
+	controlResetLen = resetCodeLen + 4
+)
+
+// ErrNoResumptionToken is returned by ResumptionToken when the server hasn't issued a secret to resume with, which it
+// only does once both ends have set ResumableStreams and advertised CapStreamResumption
+var ErrNoResumptionToken = errors.New("no resumption secret has been issued by the server")
+
+// ErrBadResumptionToken is returned by MakeSessionFromToken when the token is malformed
+var ErrBadResumptionToken = errors.New("malformed resumption token")
+
+var errBadResumption = errors.New("request to resume streams is malformed or has the wrong secret")
+var errNotResumable = errors.New("only ordered sessions with RoleClient and ResumableStreams, and without " +
+	"PaddingScheme or Timestamped, can resume streams")
+var errBadStreamAck = errors.New("stream acknowledgement is malformed")
+var errBadControlReset = errors.New("stream reset is malformed")
+
+// resumption is the state of stream resumption of a session
+type resumption struct {
+	// the secret issued by the server, as a []byte
+	secret atomic.Value
+	// atomic. 1 once the server has issued its secret, or once the client has started acknowledging data
+	started uint32
+	// the server's streams that frames are kept of, by ID. They are kept after being closed until the client has
+	// acknowledged all of their frames
+	retaining sync.Map
+	// the client's streams closed by the server with data not yet read, by ID. Open streams are acknowledged too
+	closedUnread sync.Map
+	// the payload of the resumeStreams frame sent through the first connection of a session made with
+	// MakeSessionFromToken. nil otherwise
+	request []byte
+	// requestM guards requested, which is set once request has been sent
+	requestM  sync.Mutex
+	requested bool
+}
+
+// retention holds the frames a server's stream has sent that the client hasn't acknowledged yet
+type retention struct {
+	m      sync.Mutex
+	frames []Frame
+	size   int
+	// whether any frame has been kept
+	started bool
+	// the stream can be resumed from any sequence number from from, inclusive, to end, exclusive
+	from uint64
+	end  uint64
+}
+
+// resumeEntry is where the client resumes a stream from
+type resumeEntry struct {
+	id uint32
+	// the first frame not read in full, and how many bytes of it have been read. skip is only in the token
+	seq  uint64
+	skip uint64
+	// the next frame the client sends. It's only sent to the server, as the client picks it anew when it resumes
+	nextSendSeq uint64
+}
+
+// appendResumeEntries appends entries as they are in a token if withSkip is true, or in resumeStreams otherwise
+func appendResumeEntries(buf []byte, entries []resumeEntry, withSkip bool) []byte {
+	buf = appendUvarint(buf, uint64(len(entries)))
+	for _, e := range entries {
+		buf = appendUvarint(buf, uint64(e.id))
+		buf = appendUvarint(buf, e.seq)
+		if withSkip {
+			buf = appendUvarint(buf, e.skip)
+		} else {
+			buf = appendUvarint(buf, e.nextSendSeq)
+		}
+	}
+	return buf
+}
+
+func parseResumeEntries(b []byte, withSkip bool) ([]resumeEntry, error) {
+	errMalformed := errBadResumption
+	if withSkip {
+		errMalformed = ErrBadResumptionToken
+	}
+	next := func() (uint64, error) {
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errMalformed
+		}
+		b = b[n:]
+		return x, nil
+	}
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	// each entry takes at least 3 bytes
+	if count > uint64(len(b)/3) {
+		return nil, errMalformed
+	}
+	entries := make([]resumeEntry, count)
+	for i := range entries {
+		var id uint64
+		if id, err = next(); err != nil {
+			return nil, err
+		}
+		if id > 0xfffffffe {
+			return nil, errMalformed
+		}
+		entries[i].id = uint32(id)
+		if entries[i].seq, err = next(); err != nil {
+			return nil, err
+		}
+		if withSkip {
+			entries[i].skip, err = next()
+		} else {
+			entries[i].nextSendSeq, err = next()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(b) != 0 {
+		return nil, errMalformed
+	}
+	return entries, nil
+}
+
+// issueResumptionSecret sends the client a secret to resume streams with, once both ends support it. It's only
+// issued once
+func (sesh *Session) issueResumptionSecret() error {
+	if sesh.Role != RoleServer || !sesh.ResumableStreams || sesh.Unordered || !sesh.PeerSupports(CapStreamResumption) {
+		return nil
+	}
+	if !atomic.CompareAndSwapUint32(&sesh.resumption.started, 0, 1) {
+		return nil
+	}
+	secret := make([]byte, resumptionSecretLen)
+	common.CryptoRandRead(secret)
+	sesh.resumption.secret.Store(secret)
+	return sesh.sendControlFrame(&Frame{
+		StreamID: 0xffffffff,
+		Closing:  resumptionSecret,
+		Payload:  secret,
+	})
+}
+
+func (sesh *Session) recvResumptionSecret(payload []byte) error {
+	if sesh.Role != RoleClient || !sesh.ResumableStreams || sesh.Unordered {
+		return nil
+	}
+	if len(payload) < resumptionSecretLen {
+		return errBadResumption
+	}
+	sesh.resumption.secret.Store(append([]byte(nil), payload[:resumptionSecretLen]...))
+	sesh.startAcking()
+	return nil
+}
+
+// startAcking starts acknowledging data read to the server, once there is a secret to resume with
+func (sesh *Session) startAcking() {
+	if atomic.CompareAndSwapUint32(&sesh.resumption.started, 0, 1) {
+		go sesh.ackStreams()
+	}
+}
+
+// ackStreams tells the server, every resumptionAckInterval, how far each stream has been read, until the session is
+// closed
+func (sesh *Session) ackStreams() {
+	ticker := time.NewTicker(resumptionAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sesh.done:
+			return
+		case <-ticker.C:
+		}
+		// the acknowledgements of all streams are sent together, so that they are batched if the server supports it
+		var acks []*Frame
+		var acked []*Stream
+		var ackedSeqs []uint64
+		// streams closed by the server that have been read in full, which no longer need acknowledging once acked
+		// has been sent
+		var drained []interface{}
+		// ack returns whether s has been acknowledged already
+		ack := func(s *Stream) bool {
+			seq, _ := s.resumePoint()
+			if seq == atomic.LoadUint64(&s.ackedSeq) {
+				return true
+			}
+			payload := make([]byte, streamAckLen)
+			putU32(payload, s.id)
+			putU64(payload[4:], seq)
+			acks = append(acks, &Frame{
+				StreamID: 0xffffffff,
+				Closing:  streamAck,
+				Payload:  append(payload, genRandomPadding()...),
+			})
+			acked = append(acked, s)
+			ackedSeqs = append(ackedSeqs, seq)
+			return false
+		}
+		sesh.RangeStreams(func(s *Stream) bool {
+			ack(s)
+			return true
+		})
+		sesh.resumption.closedUnread.Range(func(key, value interface{}) bool {
+			s := value.(*Stream)
+			// checked first, as more could be read in the meantime
+			read := s.Buffered() == 0
+			if !read {
+				ack(s)
+			} else if ack(s) {
+				sesh.resumption.closedUnread.Delete(key)
+			} else {
+				drained = append(drained, key)
+			}
+			return true
+		})
+		if len(acks) == 0 {
+			continue
+		}
+		if err := sesh.sendFrames(acks); err != nil {
+			sesh.Logger.Debugf("failed to acknowledge streams of session %v: %v", sesh.id, err)
+			continue
+		}
+		for i, s := range acked {
+			atomic.StoreUint64(&s.ackedSeq, ackedSeqs[i])
+		}
+		for _, key := range drained {
+			sesh.resumption.closedUnread.Delete(key)
+		}
+	}
+}
+
+// ResumptionToken returns a token with which the streams of the session can be resumed with MakeSessionFromToken, after
+// all of its connections have been lost, even from a new process. Each stream resumes from where it had been read up
+// to when the token was made, so it should be made once the application has dealt with the data it has read, such
+// as by writing it to disk, and may be made again as more is read. Data written to a stream after the token is made
+// is lost, and streams opened after it can't be resumed. Only a client with ResumableStreams can make a token, once
+// the server has issued a secret to resume with. Otherwise it returns ErrNoResumptionToken
+func (sesh *Session) ResumptionToken() ([]byte, error) {
+	secret, _ := sesh.resumption.secret.Load().([]byte)
+	if sesh.Role != RoleClient || secret == nil {
+		return nil, ErrNoResumptionToken
+	}
+	var entries []resumeEntry
+	add := func(s *Stream) {
+		e := resumeEntry{id: s.id}
+		e.seq, e.skip = s.resumePoint()
+		entries = append(entries, e)
+	}
+	sesh.RangeStreams(func(s *Stream) bool {
+		add(s)
+		return true
+	})
+	sesh.resumption.closedUnread.Range(func(_, value interface{}) bool {
+		add(value.(*Stream))
+		return true
+	})
+
+	token := make([]byte, 1+4, 1+4+resumptionSecretLen)
+	token[0] = resumptionTokenV1
+	putU32(token[1:], sesh.id)
+	token = append(token, secret...)
+	return appendResumeEntries(token, entries, true), nil
+}
+
+// MakeSessionFromToken makes a Session which resumes the streams of the session token was made from with
+// ResumptionToken. config must be compatible with the server's, as with MakeSession, and the Session has the same ID as
+// the original, which the server must use to find the session to add connections to. Once the first connection is
+// added, the server is asked to send again the data of each stream that hadn't been read, which is then received as if
+// the original session hadn't been interrupted. Data written before the token was made and not yet received by the
+// server isn't sent again, and data written by the original session after it was made is dropped by the server. The
+// streams are open from the start, and can be found with RangeStreams. A stream that the server can't resume is reset,
+// and its reads return a *StreamResetError with ResetCodeNotResumable
+func MakeSessionFromToken(config SessionConfig, token []byte) (*Session, error) {
+	if config.Role != RoleClient || !config.ResumableStreams || config.Unordered || config.PaddingScheme.enabled() ||
+		config.Timestamped {
+		return nil, errNotResumable
+	}
+	if len(token) < 1+4+resumptionSecretLen || token[0] != resumptionTokenV1 {
+		return nil, ErrBadResumptionToken
+	}
+	id := u32(token[1:])
+	secret := token[1+4 : 1+4+resumptionSecretLen]
+	entries, err := parseResumeEntries(token[1+4+resumptionSecretLen:], true)
+	if err != nil {
+		return nil, err
+	}
+
+	sesh := MakeSession(id, config)
+	// the original session may have sent control frames from the start of the client's half of the range already,
+	// under the same key
+	var seq [8]byte
+	randRead(seq[:])
+	sesh.controlSeq = u64(seq[:]) >> 1
+	// and frames of streams from the start of their Seqs, or beyond them if it was itself resumed
+	randRead(seq[:])
+	sesh.seqBase = 1<<62 | u64(seq[:])>>2
+	// one past it, so that the server can't take the first frame of a stream resumed for that of a new one
+	resumedSeq := sesh.seqBase + 1
+	for i := range entries {
+		entries[i].nextSendSeq = resumedSeq
+	}
+	request := make([]byte, resumptionSecretLen+8)
+	copy(request, secret)
+	putU64(request[resumptionSecretLen:], sesh.seqBase)
+	request = appendResumeEntries(request, entries, false)
+	if len(request) > sesh.maxStreamUnitWrite {
+		sesh.Close()
+		return nil, errors.New("too many streams to resume")
+	}
+	sesh.resumption.request = request
+	sesh.resumption.secret.Store(append([]byte(nil), secret...))
+
+	for _, e := range entries {
+		s := makeStream(sesh, e.id)
+		s.nextSendSeq = resumedSeq
+		s.resumeSeq, s.resumeSkip = e.seq, e.skip
+		atomic.StoreUint64(&s.ackedSeq, e.seq)
+		recvBuf := s.recvBuf.(*streamBuffer)
+		recvBuf.nextRecvSeq, recvBuf.lateFloor = e.seq, e.seq
+		sesh.streams.Store(e.id, s)
+		sesh.streamCountIncr()
+		if sesh.isLocalStreamID(e.id) {
+			if e.id >= sesh.nextStreamID {
+				sesh.nextStreamID = e.id + sesh.streamIDStep
+			}
+		} else if e.id > sesh.lastAcceptedID {
+			sesh.lastAcceptedID = e.id
+		}
+	}
+	sesh.startAcking()
+	return sesh, nil
+}
+
+// sendResumeRequest asks the server to resume the streams of a session made with MakeSessionFromToken, through conn
+// before it's used for anything else, so that the server knows the Seqs the streams carry on from before their frames
+// arrive. It's sent through the first connection added, or the next one if that fails. Connections added in the
+// meantime wait for it to be sent
+func (sesh *Session) sendResumeRequest(conn net.Conn) {
+	if sesh.resumption.request == nil {
+		return
+	}
+	sesh.resumption.requestM.Lock()
+	defer sesh.resumption.requestM.Unlock()
+	if sesh.resumption.requested {
+		return
+	}
+	f := &Frame{
+		StreamID: 0xffffffff,
+		Closing:  resumeStreams,
+		Payload:  sesh.resumption.request,
+	}
+	obfsBuf := make([]byte, sesh.obfsBufLen(len(f.Payload)))
+	i, err := sesh.obfs(f, obfsBuf, 0)
+	if err == nil {
+		_, err = conn.Write(obfsBuf[:i])
+	}
+	if err != nil {
+		sesh.Logger.Errorf("failed to ask session %v to be resumed: %v", sesh.id, err)
+		return
+	}
+	sesh.sb.valve.AddTx(int64(i))
+	sesh.sb.sent.add(i)
+	sesh.resumption.requested = true
+}
+
+// recvResumeStreams resumes the streams the client asks for, sending again the frames it hasn't read, and gives up on
+// the streams the client doesn't ask for, as it no longer knows about them
+func (sesh *Session) recvResumeStreams(payload []byte) error {
+	secret, _ := sesh.resumption.secret.Load().([]byte)
+	if sesh.Role != RoleServer || secret == nil || len(payload) < resumptionSecretLen+8 ||
+		subtle.ConstantTimeCompare(payload[:resumptionSecretLen], secret) != 1 {
+		return errBadResumption
+	}
+	entries, err := parseResumeEntries(payload[resumptionSecretLen+8:], false)
+	if err != nil {
+		return err
+	}
+	// streams the client opens from now on start from the Seq before the one those it resumes carry on from
+	atomic.StoreUint64(&sesh.remoteSeqBase, u64(payload[resumptionSecretLen:]))
+	sesh.Logger.Debugf("client of session %v is resuming %v streams", sesh.id, len(entries))
+
+	listed := make(map[uint32]bool, len(entries))
+	for _, e := range entries {
+		listed[e.id] = true
+		sesh.resumeStream(e)
+	}
+	sesh.RangeStreams(func(s *Stream) bool {
+		if !listed[s.id] {
+			s.abandon()
+		}
+		return true
+	})
+	sesh.resumption.retaining.Range(func(key, value interface{}) bool {
+		if !listed[key.(uint32)] {
+			sesh.resumption.retaining.Delete(key)
+		}
+		return true
+	})
+	return nil
+}
+
+func (sesh *Session) resumeStream(e resumeEntry) {
+	var frames []Frame
+	resumable := false
+	streamI, ok := sesh.resumption.retaining.Load(e.id)
+	if ok {
+		frames, resumable = streamI.(*Stream).retainedFrom(e.seq)
+	} else if streamI, ok = sesh.streams.Load(e.id); ok && streamI != nil {
+		// nothing has been kept since it was opened
+		s := streamI.(*Stream)
+		s.writingM.Lock()
+		resumable = s.nextSendSeq == e.seq
+		s.writingM.Unlock()
+	}
+	if !resumable {
+		sesh.Logger.Debugf("stream %v of session %v can't be resumed from %v", e.id, sesh.id, e.seq)
+		// the frames sent on the stream may not be known any more, so the reset is sent as a control frame rather
+		// than with the next Seq of the stream
+		payload := append(make([]byte, controlResetLen), genRandomPadding()...)
+		putU32(payload, ResetCodeNotResumable)
+		putU32(payload[resetCodeLen:], e.id)
+		err := sesh.sendControlFrame(&Frame{
+			StreamID: 0xffffffff,
+			Closing:  closingReset,
+			Payload:  payload,
+		})
+		if err != nil {
+			sesh.Logger.Debugf("failed to reset stream %v of session %v: %v", e.id, sesh.id, err)
+		}
+		sesh.resumption.retaining.Delete(e.id)
+		if streamI != nil {
+			streamI.(*Stream).abandon()
+		}
+		return
+	}
+	s := streamI.(*Stream)
+	if !s.isClosed() {
+		// frames the client sent and didn't know had arrived are sent again
+		s.releaseBuffered(s.recvBuf.(*streamBuffer).resumeRecv(e.nextSendSeq))
+	}
+	if len(frames) > 0 {
+		go s.resend(frames)
+	}
+}
+
+// retain keeps a copy of f, which is about to be sent by a server's stream, so that it can be sent again if the client
+// resumes the stream. The oldest frames are dropped once more than session.ResumptionBufferSize bytes are kept
+func (s *Stream) retain(f *Frame) {
+	r := s.retention
+	if r == nil || atomic.LoadUint32(&s.session.resumption.started) == 0 {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.started {
+		r.started = true
+		r.from = f.Seq
+		s.session.resumption.retaining.Store(s.id, s)
+	}
+	kept := *f
+	kept.Payload = append([]byte(nil), f.Payload...)
+	r.frames = append(r.frames, kept)
+	r.size += len(kept.Payload)
+	r.end = f.Seq + 1
+	for r.size > s.session.ResumptionBufferSize && len(r.frames) > 0 {
+		// the client can no longer resume from before what's left
+		r.size -= len(r.frames[0].Payload)
+		r.frames = r.frames[1:]
+		r.from = r.end
+		if len(r.frames) > 0 {
+			r.from = r.frames[0].Seq
+		}
+	}
+}
+
+// recvStreamAck passes the Seq acknowledged by a streamAck frame to the stream it acknowledges
+func (sesh *Session) recvStreamAck(payload []byte) error {
+	if len(payload) < streamAckLen {
+		return errBadStreamAck
+	}
+	if streamI, ok := sesh.resumption.retaining.Load(u32(payload)); ok {
+		streamI.(*Stream).recvAck(u64(payload[4:]))
+	}
+	return nil
+}
+
+// recvControlReset resets the stream named by a closingReset frame sent as a control frame, as if the frame had
+// arrived on the stream
+func (sesh *Session) recvControlReset(payload []byte) error {
+	if len(payload) < controlResetLen {
+		return errBadControlReset
+	}
+	id := u32(payload[resetCodeLen:])
+	streamI, ok := sesh.streams.Load(id)
+	if !ok || streamI == nil {
+		return nil
+	}
+	return streamI.(*Stream).recvReset(payload[:resetCodeLen])
+}
+
+// recvAck drops the kept frames before seq, which the client has read
+func (s *Stream) recvAck(seq uint64) {
+	r := s.retention
+	r.m.Lock()
+	i := 0
+	for i < len(r.frames) && seqLess(r.frames[i].Seq, seq) {
+		r.size -= len(r.frames[i].Payload)
+		i++
+	}
+	r.frames = r.frames[i:]
+	if seqLess(r.from, seq) {
+		r.from = seq
+		if seqLess(r.end, r.from) {
+			r.from = r.end
+		}
+	}
+	done := len(r.frames) == 0 && s.isClosed()
+	r.m.Unlock()
+	if done {
+		s.session.resumption.retaining.Delete(s.id)
+	}
+}
+
+// retainedFrom returns the kept frames from seq onwards, and false if the stream can't be resumed from seq
+func (s *Stream) retainedFrom(seq uint64) ([]Frame, bool) {
+	r := s.retention
+	r.m.Lock()
+	defer r.m.Unlock()
+	if seqLess(seq, r.from) || seqLess(r.end, seq) {
+		return nil, false
+	}
+	var frames []Frame
+	for _, f := range r.frames {
+		if !seqLess(f.Seq, seq) {
+			frames = append(frames, f)
+		}
+	}
+	return frames, true
+}
+
+// resend sends frames kept by retain again
+func (s *Stream) resend(frames []Frame) {
+	var connId uint32
+	for i := range frames {
+		f := frames[i]
+		obfsBuf := make([]byte, s.session.obfsBufLen(len(f.Payload)))
+		n, err := s.session.obfs(&f, obfsBuf, 0)
+		if err == nil {
+			_, err = s.session.sb.send(obfsBuf[:n], &connId)
+		}
+		if err != nil {
+			s.session.Logger.Debugf("failed to resend frame %v of stream %v: %v", f.Seq, s.id, err)
+			return
+		}
+	}
+}
+
+// abandon closes a server's stream that the client no longer knows about, without telling the client
+func (s *Stream) abandon() {
+	s.session.resumption.retaining.Delete(s.id)
+	if s.isClosed() {
+		return
+	}
+	payload := make([]byte, resetCodeLen)
+	putU32(payload, ResetCodeNotResumable)
+	if err := s.recvReset(payload); err != nil {
+		s.session.Logger.Debugf("failed to abandon stream %v: %v", s.id, err)
+	}
+}
+
+// resumePoint returns the sequence number of the first frame of a client's stream that hasn't been read in full, and
+// how many bytes of it have been read
+func (s *Stream) resumePoint() (seq uint64, skip uint64) {
+	seq, skip = s.recvBuf.(*streamBuffer).resumePoint()
+	if seq == s.resumeSeq {
+		// the bytes skipped when it was received
+		skip += s.resumeSkip
+	}
+	return seq, skip
+}
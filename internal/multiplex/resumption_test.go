@@ -0,0 +1,201 @@
+package multiplex
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_ResumeStreams(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+	// the nonces of the control frames sent by the server, the client and the resumed client, which all have the same
+	// key, and of the stream frames sent by the client and the resumed client. The server sends the same frames again
+	type nonce struct {
+		streamID uint32
+		seq      uint64
+	}
+	var nonceM sync.Mutex
+	controlSeqs := make(map[uint64]bool)
+	clientNonces := make(map[nonce]bool)
+	var repeatedSeqs, repeatedNonces int
+	recordNonce := func(client bool) func(f *Frame, outbound bool) {
+		return func(f *Frame, outbound bool) {
+			if !outbound {
+				return
+			}
+			nonceM.Lock()
+			defer nonceM.Unlock()
+			if f.StreamID == 0xffffffff {
+				if controlSeqs[f.Seq] {
+					repeatedSeqs++
+				}
+				controlSeqs[f.Seq] = true
+			} else if client {
+				n := nonce{f.StreamID, f.Seq}
+				if clientNonces[n] {
+					repeatedNonces++
+				}
+				clientNonces[n] = true
+			}
+		}
+	}
+	clientConfig := SessionConfig{
+		Obfuscator:           obfuscator,
+		Role:                 RoleClient,
+		Capabilities:         SupportedCapabilities,
+		ResumableStreams:     true,
+		ResumptionBufferSize: 4 << 20,
+		FrameHook:            recordNonce(true),
+	}
+	serverConfig := clientConfig.Derive()
+	serverConfig.ResumptionWindow = 5 * time.Second
+	serverConfig.FrameHook = recordNonce(false)
+	serverSesh := MakeSession(1, serverConfig)
+	defer serverSesh.Close()
+
+	connect := func(clientSesh *Session) net.Conn {
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+		return c
+	}
+
+	clientSesh := MakeSession(1, clientConfig)
+	_, err := clientSesh.ResumptionToken()
+	assert.Equal(t, ErrNoResumptionToken, err)
+	clientConn := connect(clientSesh)
+	assert.NoError(t, clientSesh.SetPeerCapabilities(serverSesh.Capabilities))
+	assert.Eventually(t, func() bool {
+		_, err := clientSesh.ResumptionToken()
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "no resumption secret is issued")
+
+	// the client asks for a download, half of which the server sends before the client restarts, and the rest after
+	download := make([]byte, 1<<20)
+	rand.Read(download)
+	stream, _ := clientSesh.OpenStream()
+	_, err = stream.Write([]byte("get"))
+	assert.NoError(t, err)
+	serverStream, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.ReadFull(serverStream, make([]byte, 3))
+	assert.NoError(t, err)
+	_, err = serverStream.Write(download[:len(download)/2])
+	assert.NoError(t, err)
+
+	const readBeforeRestart = 300001
+	received := make([]byte, readBeforeRestart)
+	_, err = io.ReadFull(stream, received)
+	assert.NoError(t, err)
+	token, err := clientSesh.ResumptionToken()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// written after the token was made, so the restarted client carries on from before it
+	_, err = stream.Write([]byte("more"))
+	assert.NoError(t, err)
+	// opened after the token was made, so the restarted client won't know about it
+	forgotten, _ := clientSesh.OpenStream()
+	_, _ = forgotten.Write([]byte{1})
+	forgottenOnServer, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _ = io.ReadFull(forgottenOnServer, make([]byte, 1))
+
+	// the client's process dies without closing its session, so its connection is just dropped
+	_ = clientConn.Close()
+	assert.Eventually(t, clientSesh.IsClosed, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, serverSesh.sb.awaitingResumption, time.Second, 10*time.Millisecond)
+	_, err = serverStream.Write(download[len(download)/2:])
+	assert.NoError(t, err)
+	assert.NoError(t, serverStream.Close())
+
+	resumed, err := MakeSessionFromToken(clientConfig, token)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resumed.Close()
+	assert.Equal(t, uint32(1), resumed.id)
+	connect(resumed)
+
+	var resumedStream *Stream
+	resumed.RangeStreams(func(s *Stream) bool {
+		resumedStream = s
+		return false
+	})
+	if !assert.NotNil(t, resumedStream) {
+		return
+	}
+	assert.Equal(t, stream.ID(), resumedStream.ID())
+	// sent from where the original client was when the token was made, which it has gone past since
+	_, err = resumedStream.Write([]byte("more"))
+	assert.NoError(t, err)
+	rest := make([]byte, len(download)-readBeforeRestart)
+	_, err = io.ReadFull(resumedStream, rest)
+	assert.NoError(t, err)
+	assert.Equal(t, download, append(received, rest...), "resumed download is corrupted")
+	_, err = resumedStream.Read(make([]byte, 1))
+	assert.Equal(t, ErrBrokenStream, err, "stream closed by the server isn't closed once resumed")
+
+	_, err = forgottenOnServer.Read(make([]byte, 1))
+	assert.Equal(t, &StreamResetError{Code: ResetCodeNotResumable}, err)
+
+	// the restarted client doesn't know the ID of the forgotten stream has been taken
+	reopened, err := resumed.OpenStream()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, forgotten.ID(), reopened.ID())
+	_, err = reopened.Write([]byte{2})
+	assert.NoError(t, err)
+	reopenedOnServer, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(reopenedOnServer, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{2}, buf)
+
+	// the server stops keeping what the client has read
+	assert.Eventually(t, func() bool {
+		_, retained := serverSesh.resumption.retaining.Load(stream.ID())
+		return !retained
+	}, time.Second, 10*time.Millisecond, "frames read are still kept")
+
+	nonceM.Lock()
+	assert.Zero(t, repeatedSeqs, "control frames are sent with the same nonce")
+	assert.Zero(t, repeatedNonces, "the resumed client sends frames with nonces the original one has used")
+	nonceM.Unlock()
+
+	t.Run("malformed token", func(t *testing.T) {
+		_, err := MakeSessionFromToken(clientConfig, token[:len(token)-1])
+		assert.Equal(t, ErrBadResumptionToken, err)
+		_, err = MakeSessionFromToken(serverConfig, token)
+		assert.Error(t, err)
+	})
+
+	t.Run("padded", func(t *testing.T) {
+		// frames sent again would be encrypted with the same nonce but different padding
+		config := clientConfig
+		config.PaddingScheme = PaddingScheme{MaxRandomPadding: 16}
+		sesh := MakeSession(2, config)
+		defer sesh.Close()
+		assert.False(t, sesh.ResumableStreams)
+		_, err := MakeSessionFromToken(config, token)
+		assert.Equal(t, errNotResumable, err)
+	})
+}
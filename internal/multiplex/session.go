@@ -1,31 +1,69 @@
 package multiplex
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/juju/ratelimit"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	acceptBacklog = 1024
+	defaultAcceptBacklog = 1024
 	// TODO: will this be a signature?
 	defaultSendRecvBufSize   = 20480
 	defaultInactivityTimeout = 30 * time.Second
+	defaultStreamWriteDelay  = 10 * time.Millisecond
+	// defaultResumptionBufferSize is the default size limit of outbound data a switchboard holds while it's waiting
+	// for resumption
+	defaultResumptionBufferSize = defaultSendRecvBufSize << 6
 )
 
 var ErrBrokenSession = errors.New("broken session")
+var ErrGoaway = errors.New("session is going away")
+var ErrTooManyStreams = errors.New("session has too many active streams")
+var ErrNoAccept = errors.New("session doesn't accept streams")
+var ErrTooManyConnections = errors.New("session has too many connections")
 var errRepeatSessionClosing = errors.New("trying to close a closed session")
 var errRepeatStreamClosing = errors.New("trying to close a closed stream")
 var errNoMultiplex = errors.New("a singleplexing session can have only one stream")
+var ErrStreamIDInUse = errors.New("stream id belongs to an active stream")
+var ErrStreamIDReserved = errors.New("stream id is reserved for streams opened by the remote or for control frames")
+var errStreamIDParity = errors.New("remote opened a stream with an id reserved for local streams")
+var errMaxBufferedBytes = errors.New("unread data received exceeds MaxBufferedBytes")
+var errStreamMetaTooLong = errors.New("stream metadata is too long")
+var errNegativeBatch = errors.New("cannot open a negative number of streams")
+var errBadGoaway = errors.New("goaway frame is malformed")
+
+// MaxStreamMetaLen is the maximum length of metadata that can be attached to a stream with OpenStreamWithMeta
+const MaxStreamMetaLen = 1024
+
+// ResetCodeRejected is the code of the StreamResetError returned by a stream the remote has rejected, whether by
+// OnNewStream, MaxStreamOpenRate or NoAccept
+const ResetCodeRejected uint32 = 0xfffffffc
 
 type switchboardStrategy int
 
+// SessionRole decides which stream IDs a Session uses for the streams it opens, so that streams opened by either end
+// can be told apart and never collide
+type SessionRole int
+
+const (
+	// RoleUnspecified opens streams with sequential IDs and accepts streams of any ID from the remote
+	RoleUnspecified SessionRole = iota
+	// RoleClient opens streams with even IDs and only accepts streams of odd IDs from the remote
+	RoleClient
+	// RoleServer opens streams with odd IDs and only accepts streams of even IDs from the remote
+	RoleServer
+)
+
 type SessionConfig struct {
 	Obfuscator
 
@@ -34,20 +72,260 @@ type SessionConfig struct {
 
 	Unordered bool
 
+	// PreferredFamily sets the address family of underlying connections to send data through whenever there are
+	// connections of this family. FamilyUnspecified means no preference
+	PreferredFamily AddressFamily
+
 	// A Singleplexing session always has just one stream
 	Singleplex bool
 
+	// Role decides the parity of IDs of streams opened by each end. Both ends must either have opposite roles,
+	// or both have RoleUnspecified
+	Role SessionRole
+
 	// maximum size of an obfuscated frame, including headers and overhead
 	MsgOnWireSizeLimit int
 
+	// PathMTUDiscovery searches for the largest frame each underlying connection can deliver, by sending probes of
+	// growing sizes up to MsgOnWireSizeLimit, which the remote acknowledges. Until a connection has been probed,
+	// frames are limited to 1200 bytes. They are then limited to the smallest size found of all connections, as
+	// returned by PathMTU. It's meant for unordered sessions over datagram transports, which fragment or drop
+	// oversized datagrams. Probing a connection is bounded to a few probes of each size and stops once its path MTU
+	// is found. The remote must support path MTU probes, which can be checked with PeerSupports(CapPathMTU). Without
+	// support, frames stay limited to 1200 bytes
+	PathMTUDiscovery bool
+
+	// PaddingScheme sets how frames are padded to hide the sizes of data sent. It must be the same on both ends.
+	// The zero value disables padding
+	PaddingScheme PaddingScheme
+
+	// FrameChecksum appends a checksum to each frame so that frames corrupted on the way are dropped instead of
+	// delivered. It's meant for EncryptionMethodPlain over unreliable transports, as other methods authenticate
+	// frames already. It must be the same on both ends
+	FrameChecksum bool
+
+	// Timestamped appends the time each frame is sent at to it, costing 8 bytes per frame, so that the one-way delay
+	// of data frames received and its jitter can be estimated with OneWayDelay. It's meant for real-time traffic,
+	// such as media over unordered sessions. It must be the same on both ends
+	Timestamped bool
+
+	// ReplayProtection drops frames of a stream in an unordered session that have been received before, which would
+	// otherwise be delivered again if replayed by an attacker. Frames arriving more than 1024 frames late are dropped
+	// too, as it can't be told whether they have been received. Ordered sessions never deliver a frame twice
+	ReplayProtection bool
+
+	// StrictSequencing closes the session with ErrSequenceViolation when a stream in an ordered session receives a
+	// frame it has already delivered, which the remote never sends and is likely a sign of corruption or tampering,
+	// instead of dropping the frame. Frames from before a gap skipped with ReorderSkip, or before where a stream is
+	// resumed, are still dropped, as they can legitimately arrive late or be sent again. It's ignored in unordered
+	// sessions
+	StrictSequencing bool
+
+	// EncryptionMethods, if set, is a list of encryption methods in order of preference. MakeSession remakes the
+	// Obfuscator with the first of them available in this build, as reported by ObfuscatorMethodsAvailable, and the
+	// Obfuscator's SessionKey, so only SessionKey needs to be set in it. The Obfuscator is kept if none is available.
+	// Both ends must end up with the same method, which CompatibleWith checks
+	EncryptionMethods []byte
+
+	// KeyLogWriter, if set, is written a line with the session's ID, encryption method and key in hex when the
+	// Session is made, like SSLKEYLOGFILE in TLS, so that captured traffic can be decrypted offline for debugging.
+	// Anyone who can read what's written can decrypt the session's traffic, and impersonate either end of it, so
+	// this must never be set outside of a lab. It's ignored unless the build has the keylog tag
+	KeyLogWriter io.Writer
+
+	// Capabilities is the set of capabilities advertised to the remote. Zero disables capability negotiation
+	Capabilities Capability
+
+	// MimicTLSRecordSizes sends frames in TLS records with sizes typical of real TLS traffic, instead of one record
+	// per frame, so that frame boundaries can't be told from record boundaries. Underlying connections must send each
+	// write in its own TLS record, as common.TLSConn does. It must be the same on both ends
+	MimicTLSRecordSizes bool
+
+	// ConnPrefix, if set, makes data sent through each underlying connection before any frame, such as what looks
+	// like the start of another protocol, so that the first bytes of a connection don't give it away. It's sent in a
+	// write of its own, and the first read from each connection is discarded as the remote's prefix, so underlying
+	// connections must send each write in its own TLS record, as common.TLSConn does. It must be set on both ends,
+	// and make prefixes no longer than the remote's ConnReceiveBufferSize
+	ConnPrefix func() []byte
+
+	// SendJitter sets the random delays added before frames are sent through each underlying connection.
+	// The zero value disables jitter
+	SendJitter SendJitter
+
+	// AcceptBacklog sets the number of streams opened by the remote that can wait to be returned by Accept. Receiving
+	// data through a connection is blocked when a new stream arrives on it while the backlog is full. Zero means the
+	// default of 1024
+	AcceptBacklog int
+	// AcceptTimeout, if set, bounds the time a stream opened by the remote waits in the accept backlog. Streams not
+	// accepted in time are taken out of the backlog and reset, and their reads and writes at the remote return a
+	// *StreamResetError with ResetCodeAcceptTimeout
+	AcceptTimeout time.Duration
+	// NoAccept is for sessions that only open streams, such as most clients. No accept backlog is allocated, Accept
+	// fails with ErrNoAccept, and streams opened by the remote are rejected as if by OnNewStream
+	NoAccept bool
+
 	// StreamSendBufferSize sets the buffer size used to send data from a Stream (Stream.obfsBuf)
 	StreamSendBufferSize int
+	// StreamWriteBuffer, if set, makes each stream hold back small writes until StreamWriteBuffer bytes have been
+	// written, so that they are sent in fewer frames, like a bufio.Writer. Data held back is sent after
+	// StreamWriteDelay, by Stream.Flush, or before the stream is closed, whichever comes first. It's meant for
+	// streams doing many small writes. Zero disables it, which suits interactive streams. Streams can opt out of it
+	// with Stream.SetNoDelay. It doesn't apply to unordered sessions, where each write is a datagram
+	StreamWriteBuffer int
+	// StreamWriteDelay is the longest data is held back by StreamWriteBuffer. Zero means the default of 10ms
+	StreamWriteDelay time.Duration
+	// InitialStreamBuffer sets the capacity allocated for a stream's receive buffer when it first receives data, which
+	// then grows as needed. A larger value saves reallocations for streams receiving a lot of data, while a smaller
+	// one saves memory for many streams receiving little data. Zero leaves it to the growth policy of bytes.Buffer
+	InitialStreamBuffer int
+	// MaxStreamBuffer caps the growth of a stream's receive buffer. Once it holds this many bytes not yet read,
+	// receiving data through the connection the next frame of the stream arrives on is blocked until some of it has
+	// been read. Zero means the default of 80 MiB
+	MaxStreamBuffer int
 	// ConnReceiveBufferSize sets the buffer size used to receive data from an underlying Conn (allocated in
 	// switchboard.deplex)
 	ConnReceiveBufferSize int
+	// MaxConnections caps the number of underlying connections a session can have at once, beyond which
+	// AddConnection fails with ErrTooManyConnections, so that a remote can't exhaust file descriptors by joining one
+	// session over and over. Zero means no limit
+	MaxConnections int
+	// DecryptWorkers sets the number of goroutines deobfuscating data received, shared by all connections. Frames are
+	// still acted on in the order they arrive on each connection. With fewer than 2, each connection's data is
+	// deobfuscated by the goroutine reading the connection. FrameHook and PaddingHook may then be called concurrently
+	DecryptWorkers int
+
+	// ReorderTimeout sets the duration a stream in an ordered session waits for a missing frame before giving up on
+	// it. Zero means waiting forever. If ReorderSkip is true, the stream skips the missing frames, reporting them to
+	// OnReorderGap if it's set. Otherwise the stream is closed, and Read returns ErrReorderTimeout once all data
+	// received before the missing frame has been read
+	ReorderTimeout time.Duration
+	ReorderSkip    bool
+	OnReorderGap   func(streamID uint32, firstMissing uint64, numMissing uint64)
+
+	// UnorderedBufferLimit, if set, bounds the unread data of each stream in an unordered session to
+	// UnorderedBufferLimit bytes. Once it's reached, datagrams are dropped according to DropPolicy instead of
+	// receiving being blocked until some have been read, as stale data is useless to real-time traffic such as media.
+	// Drops are reported to OnDrop if it's set. Dropped data stops counting towards MaxBufferedBytes, which should
+	// leave room for one more datagram per stream, as one is counted on arrival before it's dropped. It's ignored in
+	// ordered sessions
+	UnorderedBufferLimit int
+	DropPolicy           DropPolicy
+	// OnDrop is called with the number of datagrams a stream has dropped each time it drops some. It may be called
+	// concurrently
+	OnDrop func(streamID uint32, numDropped int)
+
+	// OnNewStream, if set, is called with the ID of each stream opened by the remote before it's created. If it
+	// returns false, the stream is rejected: it never reaches Accept, and the remote resets it, so that its reads and
+	// writes return a *StreamResetError with ResetCodeRejected. Later frames of a rejected stream are ignored. It may
+	// be called concurrently
+	OnNewStream func(id uint32) bool
+
+	// MaxStreamOpenRate limits the rate, in streams per second, at which the remote can open streams, so that a
+	// remote can't exhaust our resources by rapidly opening streams. Bursts of up to a second's worth of streams are
+	// allowed. Streams opened beyond the limit are rejected as if by OnNewStream. Zero means no limit
+	MaxStreamOpenRate float64
+
+	// MaxStreams caps the number of active streams, whether opened by us or by the remote, beyond which OpenStream
+	// fails with ErrTooManyStreams. Streams opened by the remote aren't refused because of it. Zero means no limit
+	MaxStreams int
+	// OpenStreamRetry makes OpenStream wait for a stream to end, instead of failing straight away, when MaxStreams has
+	// been reached
+	OpenStreamRetry OpenStreamRetry
+
+	// FrameHook, if set, is called with each frame sent before it's obfuscated (outbound is true) and with each frame
+	// received after it's deobfuscated (outbound is false), including frames that don't belong to any stream. It's
+	// meant for debugging and research. It runs on the hot path of every frame and may be called concurrently, so it
+	// should be fast. f must not be retained after the hook returns, as its payload is in a buffer that is reused.
+	// Mutating f is unsafe: changing a payload's length, or a frame's StreamID or Seq, can break the session
+	FrameHook func(f *Frame, outbound bool)
+
+	// PaddingHook, if set, is called with the length of the payload of each frame and the number of bytes of padding
+	// added to it before it's sent (outbound is true), or stripped from it after it's received (outbound is false),
+	// including the padding length field. It's meant for measuring the bandwidth cost of PaddingScheme, and is only
+	// called when PaddingScheme is enabled. Like FrameHook, it may be called concurrently
+	PaddingHook func(payloadLen int, paddingLen int, outbound bool)
+
+	// OnError, if set, is called with each error from receiving a frame through an underlying connection, such as a
+	// frame failing authentication. If receiving data has caused a panic, it is recovered from and the error wraps
+	// ErrRecvPanic. It may be called concurrently
+	OnError func(err error)
+
+	// Logger receives what the session logs about its operation, such as connections being evicted, frames failing
+	// to be received and timeouts. Defaults to logrus' standard logger, like the rest of the package
+	Logger Logger
+
+	// OnGoaway, if set, is called when the remote has called Goaway, with the greatest ID of streams opened by us
+	// that the remote will still process. Streams with greater IDs are closed, so they can be retried elsewhere
+	OnGoaway func(lastStreamID uint32)
+
+	// MaxBufferedBytes sets the maximum amount of data, in bytes, received by all streams of a Session but not yet read,
+	// including frames waiting to be put in order. What happens if the remote sends more than this is decided by
+	// BufferedBytesPolicy. It is a safeguard against a remote exhausting our memory. Zero means no limit
+	MaxBufferedBytes int
+	// BufferedBytesPolicy decides what happens once MaxBufferedBytes is exceeded. The default closes the Session
+	BufferedBytesPolicy BufferedBytesPolicy
 
 	// InactivityTimeout sets the duration a Session waits while it has no active streams before it closes itself
 	InactivityTimeout time.Duration
+
+	// StreamIdleTimeout sets the duration after which a stream with no data sent, received or read closes itself, like
+	// Stream.SetIdleTimeout, which can override it for a single stream. It lets abandoned streams be reclaimed. Zero
+	// means no limit
+	StreamIdleTimeout time.Duration
+
+	// HandshakeTimeout sets the duration a Session waits, from when it's made, to receive its first valid frame from
+	// the remote before it closes itself. It protects servers from remotes that open connections but never send
+	// anything. A Session that doesn't expect to hear from the remote before it sends something, such as a client,
+	// should leave it unset. Zero means no limit
+	HandshakeTimeout time.Duration
+
+	// MaxLifetime sets the duration after which a Session closes itself regardless of activity. Zero means no limit
+	MaxLifetime time.Duration
+
+	// ResumptionWindow sets the duration a Session stays alive after all of its underlying connections have dropped,
+	// waiting for a new connection to be added through AddConnection. Zero disables resumption, in which case the
+	// Session closes itself as soon as any of its underlying connections drops
+	ResumptionWindow time.Duration
+	// ResumptionBufferSize sets the maximum amount of outbound data, in bytes, held by a Session while it waits to be
+	// resumed. Sending more than this fails
+	ResumptionBufferSize int
+	// ResumableStreams lets a client that has lost all of its connections, even one restarted in a new process,
+	// resume the streams of an ordered session from where it had read up to, with a token from ResumptionToken passed
+	// to MakeSessionFromToken. This lets an interrupted download carry on instead of starting over. The server keeps
+	// the data it sends on each stream until the client has read it, up to ResumptionBufferSize bytes per stream, and
+	// needs a ResumptionWindow to outlive the client's connections. The remote must support it, which can be checked
+	// with PeerSupports(CapStreamResumption). It must be the same on both ends. It can't be used with PaddingScheme or
+	// Timestamped, as the frames sent again must be the same bytes as the first time they were encrypted
+	ResumableStreams bool
+
+	// TCPOptions, if set, are applied to each underlying connection added that is, or wraps, a TCP connection. Other
+	// connections are left alone
+	TCPOptions *TCPOptions
+
+	// ConnReadTimeout sets the duration each read from an underlying connection may block for. A connection from
+	// which nothing has been read for ConnReadTimeout is evicted, like one that fails probing. It should be longer
+	// than ProbeInterval if probing is enabled, or the remote may legitimately be quiet for longer. Zero means no limit
+	ConnReadTimeout time.Duration
+	// ConnWriteTimeout sets the duration each write into an underlying connection may block for, such as when the
+	// remote has stopped reading from it. A connection that times out is evicted, and the data being written is sent
+	// through another connection instead. Frames already written into it are lost. Zero means no limit
+	ConnWriteTimeout time.Duration
+
+	// ProbeInterval sets how often each underlying connection is probed for return traffic. A connection that has
+	// received nothing, including replies to probes, for ProbeTimeout is evicted, as it may have silently stopped
+	// delivering data. Frames already sent through it are lost. Zero disables probing. The remote must support
+	// probes, which can be checked with PeerSupports(CapConnProbe)
+	ProbeInterval time.Duration
+	// ProbeTimeout defaults to 3 times ProbeInterval
+	ProbeTimeout time.Duration
+	// Dialer, if set, is called to open a new underlying connection to replace each one evicted. Without a Dialer or a
+	// ResumptionWindow, the Session is closed once all of its connections have been evicted
+	Dialer func() (net.Conn, error)
+	// MinConnections, if set along with Dialer, is the number of underlying connections the Session keeps open. New
+	// connections are dialed in the background from the moment the Session is made, and whenever there are fewer,
+	// so that a connection is ready before the first stream is opened. Failed dials are retried with exponential
+	// backoff, and never close the Session
+	MinConnections int
 }
 
 // A Session represents a self-contained communication chain between local and remote. It manages its streams,
@@ -60,10 +338,28 @@ type Session struct {
 
 	// atomic
 	nextStreamID uint32
+	// the ID of the first stream opened by this end, and the increment between IDs of consecutive streams
+	firstStreamID uint32
+	streamIDStep  uint32
 
 	// atomic
 	activeStreamCount uint32
 	streams           sync.Map
+	// serialises reusing the IDs of closed streams, which are taken by nil in streams
+	streamIDM sync.Mutex
+	// signals OpenStream waiting for a stream to end. Only used with MaxStreams
+	slots streamSlots
+	// atomic. The amount of data received by all streams but not yet read. Only counted if MaxBufferedBytes > 0
+	bufferedBytes int64
+	// atomic. The high-water marks of activeStreamCount and bufferedBytes, returned by PeakStats
+	peakStreams       int64
+	peakBufferedBytes int64
+	// atomic. The Seq of the next frame sent that doesn't belong to any stream, see nextControlSeq
+	controlSeq uint64
+	// the Seq streams opened by this end start from, and that of streams opened by the remote, which is atomic. They
+	// are 0 unless a client has resumed the session with MakeSessionFromToken
+	seqBase       uint64
+	remoteSeqBase uint64
 
 	// Switchboard manages all connections to remote
 	sb *switchboard
@@ -71,118 +367,618 @@ type Session struct {
 	// Used for LocalAddr() and RemoteAddr() etc.
 	addrs atomic.Value
 
-	// For accepting new streams
-	acceptCh chan *Stream
+	// For accepting new streams. nil with NoAccept
+	accepts *acceptQueue
 
 	closed uint32
+	// closed when the session is closed
+	done chan struct{}
 
 	terminalMsg atomic.Value
 
+	createdAt time.Time
+	// the last error from receiving a frame, as a recordedError
+	lastError atomic.Value
+	// the one-way delay of data frames received. Only sampled with Timestamped
+	delay delayStats
+	// atomic. The time, in nanoseconds, ordered streams have spent waiting for missing frames
+	headOfLineBlocked int64
+
+	// only used with ResumableStreams
+	resumption resumption
+
+	// atomic. 1 once a valid frame has been received from the remote
+	established uint32
+
+	// records received, handed to the decryption workers. nil if DecryptWorkers is below 2
+	decryptJobs chan *decryptJob
+
+	// closes the session after MaxLifetime. nil if there's no limit
+	lifetimeTimer *time.Timer
+
+	// limits the rate streams are opened by the remote. nil if MaxStreamOpenRate isn't set
+	streamOpenBucket *ratelimit.Bucket
+
+	// goawayM guards lastAcceptedID and goawaySent, so that no stream opened by the remote is accepted beyond the
+	// last stream ID we've sent in a GOAWAY frame
+	goawayM        sync.Mutex
+	lastAcceptedID uint32
+	goawaySent     bool
+	// atomic. 1 once we've received a GOAWAY frame
+	remoteGoingAway uint32
+
+	// atomic. The capabilities advertised by the remote
+	peerCapabilities uint32
+	// atomic. 1 once our capabilities have been sent to the remote
+	capabilitiesSent uint32
+
 	// the max size passed to Write calls before it splits it into multiple frames
 	// i.e. the max size a piece of data can fit into a Frame.Payload
 	maxStreamUnitWrite int
 }
 
+// MakeSession makes a Session with config. The remote session must be made with a compatible config, which can be
+// made with config.Derive and checked with config.CompatibleWith
 func MakeSession(id uint32, config SessionConfig) *Session {
 	sesh := &Session{
 		id:            id,
 		SessionConfig: config,
-		nextStreamID:  1,
-		acceptCh:      make(chan *Stream, acceptBacklog),
+		done:          make(chan struct{}),
+		createdAt:     time.Now(),
+	}
+	if config.Logger == nil {
+		sesh.Logger = log.StandardLogger()
+	}
+	switch config.Role {
+	case RoleClient:
+		sesh.firstStreamID, sesh.streamIDStep = 2, 2
+	case RoleServer:
+		sesh.firstStreamID, sesh.streamIDStep = 1, 2
+	default:
+		sesh.firstStreamID, sesh.streamIDStep = 1, 1
+	}
+	sesh.nextStreamID = sesh.firstStreamID
+	switch config.Role {
+	case RoleServer:
+		sesh.controlSeq = 1 << 63
+	case RoleUnspecified:
+		// both ends count from a random point, so that they are unlikely to ever reach the same Seq
+		var seq [8]byte
+		randRead(seq[:])
+		sesh.controlSeq = u64(seq[:])
 	}
 	sesh.addrs.Store([]net.Addr{nil, nil})
+	sesh.Obfuscator = config.obfuscator()
+	sesh.logKey()
 
 	if config.Valve == nil {
 		sesh.Valve = UNLIMITED_VALVE
 	}
+	if config.AcceptBacklog < 0 {
+		sesh.Logger.Warnf("invalid AcceptBacklog %v, using the default", config.AcceptBacklog)
+	}
+	if config.AcceptBacklog <= 0 {
+		sesh.AcceptBacklog = defaultAcceptBacklog
+	}
+	if !sesh.NoAccept {
+		sesh.accepts = makeAcceptQueue(sesh.AcceptBacklog, sesh.AcceptTimeout, sesh.acceptTimedOut)
+	}
 	if config.StreamSendBufferSize <= 0 {
 		sesh.StreamSendBufferSize = defaultSendRecvBufSize
 	}
+	if config.StreamWriteDelay <= 0 {
+		sesh.StreamWriteDelay = defaultStreamWriteDelay
+	}
+	if config.InitialStreamBuffer < 0 {
+		sesh.InitialStreamBuffer = 0
+	}
+	if config.MaxStreamBuffer <= 0 {
+		sesh.MaxStreamBuffer = recvBufferSizeLimit
+	}
 	if config.ConnReceiveBufferSize <= 0 {
 		sesh.ConnReceiveBufferSize = defaultSendRecvBufSize
 	}
 	if config.MsgOnWireSizeLimit <= 0 {
 		sesh.MsgOnWireSizeLimit = defaultSendRecvBufSize - 1024
 	}
+	if sesh.MsgOnWireSizeLimit > sesh.ConnReceiveBufferSize {
+		// a remote with a config made by Derive would send frames we can't receive
+		sesh.Logger.Warnf("MsgOnWireSizeLimit %v exceeds ConnReceiveBufferSize %v, so the remote must use a smaller "+
+			"MsgOnWireSizeLimit", sesh.MsgOnWireSizeLimit, sesh.ConnReceiveBufferSize)
+	}
 	if config.InactivityTimeout == 0 {
 		sesh.InactivityTimeout = defaultInactivityTimeout
 	}
+	if config.ResumptionBufferSize <= 0 {
+		sesh.ResumptionBufferSize = defaultResumptionBufferSize
+	}
+	if config.ResumableStreams && (config.PaddingScheme.enabled() || config.Timestamped) {
+		// frames sent again would be padded or timestamped anew, and encrypted with the same nonce as the first time
+		sesh.Logger.Warnf("ResumableStreams can't be used with PaddingScheme or Timestamped, so it's turned off")
+		sesh.ResumableStreams = false
+	}
+	if config.ProbeTimeout <= 0 {
+		sesh.ProbeTimeout = 3 * config.ProbeInterval
+	}
 	// todo: validation. this must be smaller than StreamSendBufferSize
-	sesh.maxStreamUnitWrite = sesh.MsgOnWireSizeLimit - frameHeaderLength - sesh.Obfuscator.maxOverhead
+	sesh.maxStreamUnitWrite = sesh.MsgOnWireSizeLimit - frameHeaderLength - sesh.Obfuscator.maxOverhead - sesh.trailerLen()
+	if sesh.PaddingScheme.enabled() {
+		sesh.maxStreamUnitWrite -= paddingLenFieldSize
+	}
+
+	if sesh.OpenStreamRetry.InitialBackoff <= 0 {
+		sesh.OpenStreamRetry.InitialBackoff = defaultOpenStreamInitialBackoff
+	}
+	if sesh.OpenStreamRetry.MaxBackoff <= 0 {
+		sesh.OpenStreamRetry.MaxBackoff = defaultOpenStreamMaxBackoff
+	}
+
+	if sesh.MaxStreamOpenRate > 0 {
+		burst := int64(math.Ceil(sesh.MaxStreamOpenRate))
+		sesh.streamOpenBucket = ratelimit.NewBucketWithRate(sesh.MaxStreamOpenRate, burst)
+	}
+
+	if sesh.DecryptWorkers > 1 {
+		sesh.decryptJobs = make(chan *decryptJob)
+		for i := 0; i < sesh.DecryptWorkers; i++ {
+			go sesh.decryptWorker()
+		}
+	}
 
 	sesh.sb = makeSwitchboard(sesh)
+	if sesh.ProbeInterval > 0 {
+		go sesh.sb.probeConns()
+	}
+	if sesh.MinConnections > 0 {
+		if sesh.Dialer == nil {
+			sesh.Logger.Warnf("MinConnections is set without a Dialer, so no connection will be dialed")
+		} else {
+			go sesh.sb.maintainConns()
+		}
+	}
 	time.AfterFunc(sesh.InactivityTimeout, sesh.checkTimeout)
+	if sesh.HandshakeTimeout > 0 {
+		time.AfterFunc(sesh.HandshakeTimeout, sesh.checkHandshake)
+	}
+	if sesh.MaxLifetime > 0 {
+		// only started once assigned, as closeSession reads it when it fires
+		sesh.lifetimeTimer = time.AfterFunc(math.MaxInt64, sesh.expire)
+		sesh.lifetimeTimer.Reset(sesh.MaxLifetime)
+	}
 	return sesh
 }
 
 func (sesh *Session) streamCountIncr() uint32 {
-	return atomic.AddUint32(&sesh.activeStreamCount, 1)
+	count := atomic.AddUint32(&sesh.activeStreamCount, 1)
+	raisePeak(&sesh.peakStreams, int64(count))
+	return count
 }
 func (sesh *Session) streamCountDecr() uint32 {
-	return atomic.AddUint32(&sesh.activeStreamCount, ^uint32(0))
+	count := atomic.AddUint32(&sesh.activeStreamCount, ^uint32(0))
+	if sesh.MaxStreams > 0 {
+		sesh.slots.signal()
+	}
+	return count
 }
 func (sesh *Session) streamCount() uint32 {
 	return atomic.LoadUint32(&sesh.activeStreamCount)
 }
 
-// AddConnection is used to add an underlying connection to the connection pool
-func (sesh *Session) AddConnection(conn net.Conn) {
-	sesh.sb.addConn(conn)
+// AddConnection is used to add an underlying connection to the connection pool. It fails with ErrTooManyConnections
+// if the session already has MaxConnections connections, in which case conn is left to the caller to close
+func (sesh *Session) AddConnection(conn net.Conn) error {
+	return sesh.AddConnectionWithFamily(conn, familyOf(conn.RemoteAddr()))
+}
+
+// AddConnectionWithFamily is the same as AddConnection, but with the address family of conn given explicitly.
+// AddConnection infers the address family from conn.RemoteAddr(), which isn't possible if conn isn't an IP connection
+func (sesh *Session) AddConnectionWithFamily(conn net.Conn, family AddressFamily) error {
+	if _, err := sesh.sb.addConnOfFamily(conn, family); err != nil {
+		return err
+	}
+	addrs := []net.Addr{conn.LocalAddr(), conn.RemoteAddr()}
+	sesh.addrs.Store(addrs)
+	return nil
+}
+
+// AddPreferredConnection adds an underlying connection and sends all data through it while it's alive, with the other
+// connections as fallbacks. The remote is told to prefer the connection too for the data it sends. This is useful
+// to migrate traffic onto a better path, like when a client roams onto a new network. The remote must support
+// these hints, which can be checked with PeerSupports(CapConnMigration)
+func (sesh *Session) AddPreferredConnection(conn net.Conn) error {
+	connId, err := sesh.sb.addConn(conn)
+	if err != nil {
+		return err
+	}
+	sesh.sb.setPreferredConn(connId)
 	addrs := []net.Addr{conn.LocalAddr(), conn.RemoteAddr()}
 	sesh.addrs.Store(addrs)
+
+	return sesh.sendControlFrameTo(&Frame{
+		StreamID: 0xffffffff,
+		Closing:  hintPreferConn,
+		Payload:  genRandomPadding(),
+	}, connId)
+}
+
+// WaitReady blocks until the session has an underlying connection to send data through, or until ctx is done. It
+// returns immediately if the session already has one, and returns ErrBrokenSession if the session is closed
+func (sesh *Session) WaitReady(ctx context.Context) error {
+	if sesh.IsClosed() {
+		return ErrBrokenSession
+	}
+	sesh.sb.dialLazy(1)
+	ready := sesh.sb.ready()
+	select {
+	case <-ready:
+		return nil
+	default:
+	}
+	select {
+	case <-ready:
+		if sesh.IsClosed() {
+			return ErrBrokenSession
+		}
+		return nil
+	case <-sesh.done:
+		return ErrBrokenSession
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// OpenStream is similar to net.Dial. It opens up a new stream
+// Connections returns information on the underlying connections currently in the connection pool
+func (sesh *Session) Connections() []ConnInfo {
+	return sesh.sb.connInfoList()
+}
+
+// RangeStreams calls f for each active stream of the session, in no particular order, until f returns false. It's
+// meant for enumerating streams for administration. Streams opened or closed while it runs may or may not be visited.
+// f shouldn't block or close streams. To act on streams, collect them in f and do so once RangeStreams has returned
+func (sesh *Session) RangeStreams(f func(*Stream) bool) {
+	sesh.streams.Range(func(_, streamI interface{}) bool {
+		if streamI == nil {
+			return true
+		}
+		stream := streamI.(*Stream)
+		if stream.isClosed() {
+			return true
+		}
+		return f(stream)
+	})
+}
+
+// LocalAddrs returns the distinct local addresses of the underlying connections currently in the connection pool
+func (sesh *Session) LocalAddrs() []net.Addr {
+	var addrs []net.Addr
+	for _, info := range sesh.sb.connInfoList() {
+		addrs = appendDistinctAddr(addrs, info.LocalAddr)
+	}
+	return addrs
+}
+
+// RemoteAddrs returns the distinct remote addresses of the underlying connections currently in the connection pool
+func (sesh *Session) RemoteAddrs() []net.Addr {
+	var addrs []net.Addr
+	for _, info := range sesh.sb.connInfoList() {
+		addrs = appendDistinctAddr(addrs, info.RemoteAddr)
+	}
+	return addrs
+}
+
+func appendDistinctAddr(addrs []net.Addr, addr net.Addr) []net.Addr {
+	if addr == nil {
+		return addrs
+	}
+	for _, a := range addrs {
+		if a.Network() == addr.Network() && a.String() == addr.String() {
+			return addrs
+		}
+	}
+	return append(addrs, addr)
+}
+
+// OpenStream is similar to net.Dial. It opens up a new stream. If the session already has MaxStreams active streams,
+// it waits for one of them to end as set by OpenStreamRetry, and fails with ErrTooManyStreams if none does in time
 func (sesh *Session) OpenStream() (*Stream, error) {
+	return sesh.openStream(sesh.reserveStreams)
+}
+
+// TryOpenStream is like OpenStream, but never blocks. It returns false straight away if no stream can be opened,
+// such as when the session already has MaxStreams active streams, or is closed or going away
+func (sesh *Session) TryOpenStream() (*Stream, bool) {
+	stream, err := sesh.openStream(func(n int) error {
+		if !sesh.tryReserveStreams(n) {
+			return ErrTooManyStreams
+		}
+		return nil
+	})
+	return stream, err == nil
+}
+
+// openStream opens a new stream once reserve has counted it as active
+func (sesh *Session) openStream(reserve func(n int) error) (*Stream, error) {
 	if sesh.IsClosed() {
 		return nil, ErrBrokenSession
 	}
-	id := atomic.AddUint32(&sesh.nextStreamID, 1) - 1
+	if atomic.LoadUint32(&sesh.remoteGoingAway) == 1 || sesh.hasSentGoaway() {
+		return nil, ErrGoaway
+	}
+	if err := reserve(1); err != nil {
+		return nil, err
+	}
+	id := atomic.AddUint32(&sesh.nextStreamID, sesh.streamIDStep) - sesh.streamIDStep
 	// Because atomic.AddUint32 returns the value after incrementation
-	if sesh.Singleplex && id > 1 {
+	if sesh.Singleplex && id != sesh.firstStreamID {
 		// if there are more than one streams, which shouldn't happen if we are
 		// singleplexing
+		sesh.streamCountDecr()
+		return nil, errNoMultiplex
+	}
+	stream := sesh.storeLocalStream(id)
+	sesh.sb.dialLazy(int(sesh.streamCount()))
+	sesh.Logger.Tracef("stream %v of session %v opened", stream.id, sesh.id)
+	return stream, nil
+}
+
+// OpenStreamWithID is like OpenStream, but the stream gets id rather than the next free ID, so that the application
+// can decide which stream is which. It fails with ErrStreamIDInUse if id belongs to an active stream, and with
+// ErrStreamIDReserved if it has the parity of IDs of streams opened by the remote. OpenStream skips IDs taken this way.
+//
+// In an ordered session, the ID of a closed stream can be used again once the remote has closed the stream too. Until
+// then, the remote takes frames of the new stream as frames of the old one. IDs of reset streams are better not reused,
+// as their frames may still be on the way. IDs are never reused in an unordered session, where frames of the old
+// stream may still arrive after it has been closed.
+func (sesh *Session) OpenStreamWithID(id uint32) (*Stream, error) {
+	if id == 0xffffffff || (sesh.Role != RoleUnspecified && !sesh.isLocalStreamID(id)) {
+		return nil, ErrStreamIDReserved
+	}
+	if sesh.IsClosed() {
+		return nil, ErrBrokenSession
+	}
+	if atomic.LoadUint32(&sesh.remoteGoingAway) == 1 || sesh.hasSentGoaway() {
+		return nil, ErrGoaway
+	}
+	if sesh.Singleplex {
 		return nil, errNoMultiplex
 	}
+	if streamI, ok := sesh.streams.Load(id); ok && (streamI != nil || sesh.Unordered) {
+		return nil, ErrStreamIDInUse
+	}
+	if err := sesh.reserveStreams(1); err != nil {
+		return nil, err
+	}
 	stream := makeStream(sesh, id)
-	sesh.streams.Store(id, stream)
-	sesh.streamCountIncr()
-	log.Tracef("stream %v of session %v opened", id, sesh.id)
+	if _, taken := sesh.storeStream(stream, !sesh.Unordered); taken {
+		stream.SetIdleTimeout(0)
+		sesh.streamCountDecr()
+		return nil, ErrStreamIDInUse
+	}
+	if sesh.IsClosed() {
+		sesh.discardStreams([]*Stream{stream})
+		return nil, ErrBrokenSession
+	}
+	sesh.sb.dialLazy(int(sesh.streamCount()))
+	sesh.Logger.Tracef("stream %v of session %v opened", id, sesh.id)
 	return stream, nil
 }
 
-// Accept is similar to net.Listener's Accept(). It blocks and returns an incoming stream
+// storeLocalStream stores a new stream with id, or with the next free local ID if id has been taken by
+// OpenStreamWithID
+func (sesh *Session) storeLocalStream(id uint32) *Stream {
+	for {
+		stream := makeStream(sesh, id)
+		if _, taken := sesh.streams.LoadOrStore(id, stream); !taken {
+			return stream
+		}
+		stream.SetIdleTimeout(0)
+		id = atomic.AddUint32(&sesh.nextStreamID, sesh.streamIDStep) - sesh.streamIDStep
+	}
+}
+
+// storeStream stores stream unless its ID is taken, in which case it returns what has the ID. If reuse is set, the ID
+// of a closed stream isn't taken
+func (sesh *Session) storeStream(stream *Stream, reuse bool) (interface{}, bool) {
+	if !reuse {
+		return sesh.streams.LoadOrStore(stream.id, stream)
+	}
+	sesh.streamIDM.Lock()
+	defer sesh.streamIDM.Unlock()
+	if existing, ok := sesh.streams.Load(stream.id); ok && existing != nil {
+		return existing, true
+	}
+	sesh.streams.Store(stream.id, stream)
+	return nil, false
+}
+
+// OpenStreamBatch opens n streams at once, allocating all of their ids in one go, which is cheaper than calling
+// OpenStream n times when fanning out. Either all n streams are opened, or none of them are
+func (sesh *Session) OpenStreamBatch(n int) ([]*Stream, error) {
+	if n < 0 {
+		return nil, errNegativeBatch
+	}
+	if sesh.IsClosed() {
+		return nil, ErrBrokenSession
+	}
+	if atomic.LoadUint32(&sesh.remoteGoingAway) == 1 || sesh.hasSentGoaway() {
+		return nil, ErrGoaway
+	}
+	if n == 0 {
+		return []*Stream{}, nil
+	}
+	if sesh.Singleplex && n > 1 {
+		return nil, errNoMultiplex
+	}
+	if err := sesh.reserveStreams(n); err != nil {
+		return nil, err
+	}
+	span := sesh.streamIDStep * uint32(n)
+	firstId := atomic.AddUint32(&sesh.nextStreamID, span) - span
+	if sesh.Singleplex && firstId != sesh.firstStreamID {
+		sesh.streamCountDecr()
+		return nil, errNoMultiplex
+	}
+	streams := make([]*Stream, n)
+	for i := range streams {
+		streams[i] = sesh.storeLocalStream(firstId + uint32(i)*sesh.streamIDStep)
+	}
+	if sesh.IsClosed() {
+		// the session has been closed while the streams were being set up, so some of them may have been missed
+		// when it closed its streams
+		sesh.discardStreams(streams)
+		return nil, ErrBrokenSession
+	}
+	sesh.sb.dialLazy(int(sesh.streamCount()))
+	sesh.Logger.Tracef("streams %v to %v of session %v opened", firstId, streams[n-1].id, sesh.id)
+	return streams, nil
+}
+
+// discardStreams takes streams that have never been used out of the session, without telling the remote
+func (sesh *Session) discardStreams(streams []*Stream) {
+	for _, stream := range streams {
+		if !stream.markClosed(CloseInitiatorLocal) {
+			continue
+		}
+		_ = stream.recvBuf.Close()
+		sesh.streams.Delete(stream.id)
+		sesh.streamCountDecr()
+	}
+}
+
+// OpenStreamWithMeta is like OpenStream, but also attaches meta to the stream, such as where its data should be
+// relayed to. The remote can get meta with Stream.Meta as soon as it has accepted the stream. meta is sent to the
+// remote straight away, so the stream is opened on the remote end even if nothing is written to it. It must be no longer
+// than MaxStreamMetaLen or the maximum payload of a frame. The remote must support stream metadata, which can be
+// checked with PeerSupports(CapStreamMeta)
+func (sesh *Session) OpenStreamWithMeta(meta []byte) (*Stream, error) {
+	if len(meta) > MaxStreamMetaLen || len(meta) > sesh.frameUnitLimit() {
+		return nil, errStreamMetaTooLong
+	}
+	stream, err := sesh.OpenStream()
+	if err != nil || len(meta) == 0 {
+		return stream, err
+	}
+	err = stream.sendMeta(meta)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// WriteFrame obfuscates and sends f to the remote as is, bypassing the Stream abstraction. It is meant for
+// implementing custom protocols on top of a Session. f.StreamID must not belong to an active Stream of this session.
+// It is the caller's responsibility to set f.Seq and f.Closing such that the remote can make sense of the frame. The
+// Seq of a frame with StreamID 0xffffffff is replaced, as its StreamID and Seq must not repeat those of another frame.
+func (sesh *Session) WriteFrame(f *Frame) error {
+	if sesh.IsClosed() {
+		return ErrBrokenSession
+	}
+	if streamI, ok := sesh.streams.Load(f.StreamID); ok && streamI != nil {
+		return ErrStreamIDInUse
+	}
+	obfsBuf := make([]byte, sesh.obfsBufLen(len(f.Payload)))
+	i, err := sesh.obfs(f, obfsBuf, 0)
+	if err != nil {
+		return err
+	}
+	_, err = sesh.sb.send(obfsBuf[:i], new(uint32))
+	return err
+}
+
+// Accept is similar to net.Listener's Accept(). It blocks and returns an incoming stream. It fails with ErrNoAccept if
+// NoAccept is set
 func (sesh *Session) Accept() (net.Conn, error) {
+	if sesh.NoAccept {
+		return nil, ErrNoAccept
+	}
 	if sesh.IsClosed() {
 		return nil, ErrBrokenSession
 	}
-	stream := <-sesh.acceptCh
+	stream := sesh.accepts.pop()
 	if stream == nil {
 		return nil, ErrBrokenSession
 	}
-	log.Tracef("stream %v of session %v accepted", stream.id, sesh.id)
+	sesh.Logger.Tracef("stream %v of session %v accepted", stream.id, sesh.id)
 	return stream, nil
 }
 
+// IsUnordered returns whether the session is running in unordered mode
+func (sesh *Session) IsUnordered() bool {
+	return sesh.Unordered
+}
+
+// EncryptionMethod returns the encryption method of the session's Obfuscator
+func (sesh *Session) EncryptionMethod() byte {
+	return sesh.Obfuscator.encryptionMethod
+}
+
+// MaxFramePayload returns the maximum number of bytes of stream data that can be carried by a single frame,
+// after taking frame headers, encryption overhead and padding into account
+func (sesh *Session) MaxFramePayload() int {
+	return sesh.frameUnitLimit()
+}
+
+// PendingAccepts returns the number of streams opened by the remote that are waiting to be returned by Accept.
+// New streams can't be received once this reaches AcceptBacklog
+func (sesh *Session) PendingAccepts() int {
+	if sesh.NoAccept || sesh.IsClosed() {
+		return 0
+	}
+	return sesh.accepts.pending()
+}
+
+// Throughput returns the estimated rates, in bytes per second, at which data is being sent and received through the
+// session's connections, including framing and encryption overheads. The estimates are moving averages over roughly the
+// last second, and are cheap enough to be queried frequently
+func (sesh *Session) Throughput() (sent float64, received float64) {
+	now := time.Now()
+	return sesh.sb.sent.estimate(now), sesh.sb.received.estimate(now)
+}
+
+// HeadOfLineBlocked returns the total time streams of an ordered session have spent with frames received but held
+// back waiting for a missing frame before them, which is what multiplexing over fewer connections costs in latency.
+// Streams blocked at the same time are each counted, and the time is added once the missing frame has arrived or been
+// skipped. It's always zero in an unordered session
+func (sesh *Session) HeadOfLineBlocked() time.Duration {
+	return time.Duration(atomic.LoadInt64(&sesh.headOfLineBlocked))
+}
+
+func (sesh *Session) addHeadOfLineBlocked(blocked time.Duration) {
+	atomic.AddInt64(&sesh.headOfLineBlocked, int64(blocked))
+}
+
 func (sesh *Session) closeStream(s *Stream, active bool) error {
-	if atomic.SwapUint32(&s.closed, 1) == 1 {
+	return sesh.endStream(s, active, closingStream, genRandomPadding())
+}
+
+// endStream closes the stream. If active, the remote is notified with a frame of the closing type and payload given
+func (sesh *Session) endStream(s *Stream, active bool, closing uint8, payload []byte) error {
+	initiator := CloseInitiatorRemote
+	if active {
+		initiator = CloseInitiatorLocal
+	}
+	if !s.markClosed(initiator) {
 		return fmt.Errorf("closing stream %v: %w", s.id, errRepeatStreamClosing)
 	}
 	_ = s.recvBuf.Close() // recvBuf.Close should not return error
 
 	if active {
+		// unread data won't be read after the stream is closed locally
+		s.releaseBuffered(math.MaxInt64)
+
 		// Notify remote that this stream is closed
-		padding := genRandomPadding()
 		f := &Frame{
 			StreamID: s.id,
 			Seq:      s.nextSendSeq,
-			Closing:  closingStream,
-			Payload:  padding,
+			Closing:  closing,
+			Payload:  payload,
 		}
 		s.nextSendSeq++
+		s.retain(f)
 
-		obfsBuf := make([]byte, len(padding)+frameHeaderLength+sesh.Obfuscator.maxOverhead)
-		i, err := sesh.Obfs(f, obfsBuf, 0)
+		obfsBuf := make([]byte, sesh.obfsBufLen(len(payload)))
+		i, err := sesh.obfs(f, obfsBuf, 0)
 		if err != nil {
 			return err
 		}
@@ -190,9 +986,17 @@ func (sesh *Session) closeStream(s *Stream, active bool) error {
 		if err != nil {
 			return err
 		}
-		log.Tracef("stream %v actively closed. seq %v", s.id, f.Seq)
+		sesh.Logger.Tracef("stream %v actively closed. seq %v", s.id, f.Seq)
 	} else {
-		log.Tracef("stream %v passively closed", s.id)
+		sesh.Logger.Tracef("stream %v passively closed", s.id)
+		if s.retention != nil {
+			// closed by the client, which no longer needs its data
+			sesh.resumption.retaining.Delete(s.id)
+		}
+		if s.trackingReads() {
+			// acknowledged until what's left of it has been read
+			sesh.resumption.closedUnread.Store(s.id, s)
+		}
 	}
 
 	// We set it as nil to signify that the stream id had existed before.
@@ -200,23 +1004,204 @@ func (sesh *Session) closeStream(s *Stream, active bool) error {
 	// if the frame it received was from a new stream or a dying stream whose frame arrived late
 	sesh.streams.Store(s.id, nil)
 	if sesh.streamCountDecr() == 0 {
-		if sesh.Singleplex {
+		if sesh.Singleplex || sesh.hasSentGoaway() {
 			return sesh.Close()
 		} else {
-			log.Debugf("session %v has no active stream left", sesh.id)
+			sesh.Logger.Debugf("session %v has no active stream left", sesh.id)
 			time.AfterFunc(sesh.InactivityTimeout, sesh.checkTimeout)
 		}
 	}
 	return nil
 }
 
-// recvDataFromRemote deobfuscate the frame and read the Closing field. If it is a closing frame, it writes the frame
+// obfsBufLen returns the size of buffer needed to obfuscate a frame with a payload of payloadLen bytes
+func (sesh *Session) obfsBufLen(payloadLen int) int {
+	bufLen := payloadLen + frameHeaderLength + sesh.Obfuscator.maxOverhead + sesh.trailerLen()
+	if sesh.PaddingScheme.enabled() {
+		bufLen += paddingLenFieldSize
+		if bufLen < sesh.MsgOnWireSizeLimit {
+			bufLen = sesh.MsgOnWireSizeLimit
+		}
+	}
+	return bufLen
+}
+
+// nextControlSeq returns the Seq of the next frame sent that doesn't belong to any stream. As StreamID and Seq make up
+// the nonce a frame's payload is encrypted with, such frames can't all be sent with the same Seq. The remote ignores
+// it, and counts its own from a different point, which is the other half of the range if the sessions have roles
+func (sesh *Session) nextControlSeq() uint64 {
+	return atomic.AddUint64(&sesh.controlSeq, 1) - 1
+}
+
+// trailerLen returns the number of bytes appended to each frame payload for its timestamp and checksum
+func (sesh *Session) trailerLen() int {
+	return sesh.timestampTrailerLen() + sesh.checksumTrailerLen()
+}
+
+// obfs passes f to sesh.FrameHook, pads the payload of f according to sesh.PaddingScheme and appends the current time
+// if sesh.Timestamped is set and its checksum if sesh.FrameChecksum is set, then serialises and obfuscates f into buf.
+// If f doesn't belong to any stream, its Seq is replaced with the next one from nextControlSeq
+func (sesh *Session) obfs(f *Frame, buf []byte, payloadOffsetInBuf int) (int, error) {
+	if f.StreamID == 0xffffffff {
+		f.Seq = sesh.nextControlSeq()
+	}
+	if sesh.FrameHook != nil {
+		sesh.FrameHook(f, true)
+	}
+	if !sesh.PaddingScheme.enabled() && !sesh.FrameChecksum && !sesh.Timestamped {
+		return sesh.frameObfser()(f, buf, payloadOffsetInBuf)
+	}
+	trailerLen := sesh.trailerLen()
+	payloadLen := len(f.Payload)
+	paddedLen := payloadLen
+	if sesh.PaddingScheme.enabled() {
+		sizeLimit := sesh.frameSizeLimit()
+		if len(buf) < sizeLimit {
+			sizeLimit = len(buf)
+		}
+		paddedLen = sesh.PaddingScheme.paddedPayloadLen(payloadLen, sesh.Obfuscator.maxOverhead+trailerLen, sizeLimit)
+	}
+	if frameHeaderLength+paddedLen+trailerLen > len(buf) {
+		return 0, errors.New("obfs buffer too small")
+	}
+	padded := buf[frameHeaderLength : frameHeaderLength+paddedLen]
+	if payloadOffsetInBuf != frameHeaderLength {
+		copy(padded, f.Payload)
+	}
+	if sesh.PaddingScheme.enabled() {
+		pad(padded, payloadLen)
+		if sesh.PaddingHook != nil {
+			sesh.PaddingHook(payloadLen, paddedLen-payloadLen, true)
+		}
+	}
+	// the checksum covers the timestamp
+	covered := padded
+	if sesh.Timestamped {
+		putU64(buf[frameHeaderLength+paddedLen:], uint64(time.Now().UnixNano()))
+		covered = buf[frameHeaderLength : frameHeaderLength+paddedLen+timestampLen]
+	}
+	if sesh.FrameChecksum {
+		putU32(buf[frameHeaderLength+len(covered):], frameChecksum(f.StreamID, f.Seq, f.Closing, covered))
+	}
+
+	paddedFrame := *f
+	paddedFrame.Payload = buf[frameHeaderLength : frameHeaderLength+paddedLen+trailerLen]
+	return sesh.frameObfser()(&paddedFrame, buf, frameHeaderLength)
+}
+
+// compactHeaders returns whether frames are sent with compact headers, which they are once both ends support
+// CapCompactHeader, unless frames are padded, as a shorter header would throw off the sizes they are padded to
+func (sesh *Session) compactHeaders() bool {
+	return sesh.Obfuscator.obfsCompact != nil && !sesh.PaddingScheme.enabled() && sesh.PeerSupports(CapCompactHeader)
+}
+
+// frameObfser returns the Obfser frames are sent with
+func (sesh *Session) frameObfser() Obfser {
+	if sesh.compactHeaders() {
+		return sesh.Obfuscator.obfsCompact
+	}
+	return sesh.Obfs
+}
+
+// sentHeaderLen returns the length of the header f is sent with
+func (sesh *Session) sentHeaderLen(f *Frame) int {
+	if sesh.compactHeaders() {
+		if compactLen := compactFrameHeaderLen(f); compactLen < frameHeaderLength {
+			return compactLen
+		}
+	}
+	return frameHeaderLength
+}
+
+// frameDeobfser returns the Deobfser frames are received with. Once we have advertised CapCompactHeader, the remote
+// may send frames with compact headers at any time
+func (sesh *Session) frameDeobfser() Deobfser {
+	if sesh.Capabilities&CapCompactHeader != 0 {
+		return sesh.Obfuscator.anyDeobfser()
+	}
+	return sesh.Deobfs
+}
+
+// deobfs deobfuscates data into a frame, verifies and strips its checksum, timestamp and padding, then passes it to
+// sesh.FrameHook
+func (sesh *Session) deobfs(data []byte) (*Frame, error) {
+	frame, err := sesh.frameDeobfser()(data)
+	if err != nil {
+		return nil, err
+	}
+	if sesh.FrameChecksum {
+		err = verifyChecksum(frame)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sesh.Timestamped {
+		sentAt, err := stripTimestamp(frame)
+		if err != nil {
+			return nil, err
+		}
+		if frame.StreamID != 0xffffffff {
+			sesh.delay.add(time.Since(sentAt))
+		}
+	}
+	if sesh.PaddingScheme.enabled() {
+		paddedLen := len(frame.Payload)
+		frame.Payload, err = depad(frame.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if sesh.PaddingHook != nil {
+			sesh.PaddingHook(len(frame.Payload), paddedLen-len(frame.Payload), false)
+		}
+	}
+	if sesh.FrameHook != nil {
+		sesh.FrameHook(frame, false)
+	}
+	return frame, nil
+}
+
+// holdBuffered counts n bytes of unread data received towards MaxBufferedBytes, acting on BufferedBytesPolicy if
+// it's exceeded
+func (sesh *Session) holdBuffered(n int) error {
+	buffered := atomic.AddInt64(&sesh.bufferedBytes, int64(n))
+	raisePeak(&sesh.peakBufferedBytes, buffered)
+	if buffered <= int64(sesh.MaxBufferedBytes) {
+		return nil
+	}
+	if sesh.BufferedBytesPolicy == ResetLargestStreams {
+		sesh.shedBuffered()
+		return nil
+	}
+	sesh.SetTerminalMsg(errMaxBufferedBytes.Error())
+	sesh.passiveClose()
+	return errMaxBufferedBytes
+}
+
+// recvDataFromRemote deobfuscate the frame received from the connection of connId and read the Closing field. If the frame can't be deobfuscated, the error
+// from the Deobfser is returned unwrapped. If it is a closing frame, it writes the frame
 // to the stream buffer, otherwise it fetches the desired stream instance, or creates and stores one if it's a new
 // stream and then writes to the stream buffer
-func (sesh *Session) recvDataFromRemote(data []byte) error {
-	frame, err := sesh.Deobfs(data)
+func (sesh *Session) recvDataFromRemote(data []byte, connId uint32) error {
+	frame, err := sesh.deobfs(data)
 	if err != nil {
-		return fmt.Errorf("Failed to decrypt a frame for session %v: %v", sesh.id, err)
+		// ErrAuthFailed, ErrShortFrame and ErrCorruptFrame are returned as is so that the caller can tell them apart
+		return err
+	}
+	return sesh.recvDeobfsed(frame, connId)
+}
+
+// recvDeobfsed acts on a frame received from the connection of connId once it has been deobfuscated
+func (sesh *Session) recvDeobfsed(frame *Frame, connId uint32) error {
+	if atomic.LoadUint32(&sesh.established) == 0 {
+		atomic.StoreUint32(&sesh.established, 1)
+	}
+	return sesh.handleFrame(frame, connId)
+}
+
+// handleFrame acts on a frame received from the connection of connId, whether on its own or in a batch
+func (sesh *Session) handleFrame(frame *Frame, connId uint32) error {
+	if frame.Closing == frameBatch {
+		return sesh.recvBatch(frame.Payload, connId)
 	}
 
 	if frame.Closing == closingSession {
@@ -224,20 +1209,266 @@ func (sesh *Session) recvDataFromRemote(data []byte) error {
 		return sesh.passiveClose()
 	}
 
-	newStream := makeStream(sesh, frame.StreamID)
-	existingStreamI, existing := sesh.streams.LoadOrStore(frame.StreamID, newStream)
-	if existing {
-		if existingStreamI == nil {
-			// this is when the stream existed before but has since been closed. We do nothing
+	if frame.Closing == closingGoaway {
+		if len(frame.Payload) < 4 {
+			return errBadGoaway
+		}
+		sesh.recvGoaway(u32(frame.Payload))
+		return nil
+	}
+
+	if frame.Closing == advertCapabilities {
+		return sesh.recvCapabilities(frame.Payload)
+	}
+
+	if frame.Closing == probeConn {
+		return sesh.sendControlFrameTo(&Frame{
+			StreamID: 0xffffffff,
+			Closing:  probeReply,
+			Payload:  genRandomPadding(),
+		}, connId)
+	}
+
+	if frame.Closing == pathMTUProbe {
+		return sesh.recvPathMTUProbe(frame.Payload, connId)
+	}
+
+	if frame.Closing == pathMTUReply {
+		sesh.recvPathMTUReply(frame.Payload, connId)
+		return nil
+	}
+
+	if frame.Closing == probeReply {
+		// the connection is marked alive by switchboard.deplex as soon as anything is received
+		return nil
+	}
+
+	if frame.Closing == closingConn {
+		if healthI, ok := sesh.sb.health.Load(connId); ok && atomic.LoadUint32(&healthI.(*connHealth).removed) == 1 {
+			// the remote has drained the connection we are draining, and won't send anything more through it
+			return errConnDrained
+		}
+		sesh.Logger.Debugf("remote of session %v is removing connection %v", sesh.id, connId)
+		go sesh.sb.drainConn(connId, remoteDrainTimeout)
+		return nil
+	}
+
+	if frame.Closing == rekeyConn {
+		return sesh.recvRekeyConn(connId)
+	}
+
+	if frame.Closing == resumptionSecret {
+		return sesh.recvResumptionSecret(frame.Payload)
+	}
+
+	if frame.Closing == resumeStreams {
+		return sesh.recvResumeStreams(frame.Payload)
+	}
+
+	if frame.Closing == streamAck {
+		return sesh.recvStreamAck(frame.Payload)
+	}
+
+	if frame.Closing == closingReset && frame.StreamID == 0xffffffff {
+		return sesh.recvControlReset(frame.Payload)
+	}
+
+	if frame.Closing == hintPreferConn {
+		sesh.Logger.Debugf("remote of session %v prefers connection %v", sesh.id, connId)
+		sesh.sb.setPreferredConn(connId)
+		return nil
+	}
+
+	if sesh.Role != RoleUnspecified && sesh.isLocalStreamID(frame.StreamID) {
+		// we only ever store streams with local IDs when we open them
+		if streamI, ok := sesh.streams.Load(frame.StreamID); ok {
+			return recvFrameOfExistingStream(streamI, frame, connId)
+		}
+		return errStreamIDParity
+	}
+
+	existingStreamI, existing := sesh.streams.Load(frame.StreamID)
+	// the first frame of a stream on the ID of a closed one, which the remote has opened with OpenStreamWithID. An
+	// ordered stream that hasn't been reset is only closed once all of its frames have arrived, so this isn't a late
+	// frame of the old one
+	reusing := existing && existingStreamI == nil && !sesh.Unordered && sesh.opensStream(frame)
+	if existing && !reusing {
+		return recvFrameOfExistingStream(existingStreamI, frame, connId)
+	}
+
+	if !sesh.acceptNewStream(frame.StreamID) {
+		// a rejected stream is stored as if it had been closed, so that its later frames are ignored
+		if !reusing {
+			existingStreamI, existing := sesh.streams.LoadOrStore(frame.StreamID, nil)
+			if existing {
+				return recvFrameOfExistingStream(existingStreamI, frame, connId)
+			}
+		}
+		sesh.Logger.Debugf("session %v rejected new stream %v", sesh.id, frame.StreamID)
+		if !carriesData(frame.Closing) && frame.Closing != streamMeta {
+			// already closing
 			return nil
 		}
-		return existingStreamI.(*Stream).recvFrame(*frame)
+		return sesh.resetStream(frame.StreamID)
+	}
+
+	newStream := makeStream(sesh, frame.StreamID)
+	if frame.Closing == streamMeta {
+		// so that it's available as soon as the stream is accepted
+		newStream.storeMeta(frame.Payload)
+	}
+	existingStreamI, existing = sesh.storeStream(newStream, reusing)
+	if existing {
+		return recvFrameOfExistingStream(existingStreamI, frame, connId)
 	} else {
 		// new stream
 		sesh.streamCountIncr()
-		sesh.acceptCh <- newStream
-		return newStream.recvFrame(*frame)
+		sesh.accepts.push(newStream)
+		return newStream.recvFrame(*frame, connId)
+	}
+}
+
+// opensStream returns whether frame can be the first frame of a stream opened by the remote
+func (sesh *Session) opensStream(frame *Frame) bool {
+	return frame.Seq == atomic.LoadUint64(&sesh.remoteSeqBase) &&
+		(carriesData(frame.Closing) || frame.Closing == streamMeta)
+}
+
+func recvFrameOfExistingStream(streamI interface{}, frame *Frame, connId uint32) error {
+	if streamI == nil {
+		// this is when the stream existed before but has since been closed. We do nothing
+		return nil
+	}
+	return streamI.(*Stream).recvFrame(*frame, connId)
+}
+
+// acceptNewStream decides whether a new stream opened by the remote should be created or rejected
+func (sesh *Session) acceptNewStream(id uint32) bool {
+	if sesh.NoAccept {
+		sesh.Logger.Debugf("remote of session %v opened stream %v, but it doesn't accept streams", sesh.id, id)
+		return false
+	}
+	if sesh.streamOpenBucket != nil && sesh.streamOpenBucket.TakeAvailable(1) == 0 {
+		sesh.Logger.Debugf("remote of session %v opened stream %v beyond MaxStreamOpenRate", sesh.id, id)
+		return false
+	}
+	if sesh.OnNewStream != nil && !sesh.OnNewStream(id) {
+		return false
+	}
+	sesh.goawayM.Lock()
+	defer sesh.goawayM.Unlock()
+	if sesh.goawaySent {
+		// streams up to the last stream ID can still arrive late if there are multiple connections
+		return id <= sesh.lastAcceptedID
 	}
+	if id > sesh.lastAcceptedID {
+		sesh.lastAcceptedID = id
+	}
+	return true
+}
+
+func (sesh *Session) hasSentGoaway() bool {
+	sesh.goawayM.Lock()
+	defer sesh.goawayM.Unlock()
+	return sesh.goawaySent
+}
+
+// Goaway gracefully shuts down the session. It tells the remote the greatest ID of streams opened by the remote that
+// we've accepted. Those streams are allowed to finish, while streams opened by the remote later are rejected. No new
+// stream can be opened on either end, and the session closes itself once all of its streams are closed.
+// The remote must support GOAWAY frames, which can be checked with PeerSupports(CapGoaway)
+func (sesh *Session) Goaway() error {
+	if sesh.IsClosed() {
+		return ErrBrokenSession
+	}
+	sesh.goawayM.Lock()
+	sesh.goawaySent = true
+	lastStreamID := sesh.lastAcceptedID
+	sesh.goawayM.Unlock()
+
+	payload := make([]byte, 4)
+	putU32(payload, lastStreamID)
+	err := sesh.sendControlFrame(&Frame{
+		StreamID: 0xffffffff,
+		Closing:  closingGoaway,
+		Payload:  append(payload, genRandomPadding()...),
+	})
+	if err != nil {
+		return err
+	}
+	sesh.Logger.Debugf("session %v is going away after stream %v", sesh.id, lastStreamID)
+
+	if sesh.streamCount() == 0 {
+		err = sesh.Close()
+		if errors.Is(err, errRepeatSessionClosing) {
+			// the last stream has just been closed
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// recvGoaway closes streams opened by us that the remote won't process. If the session has RoleUnspecified, streams
+// opened by either end can't be told apart, so the streams are left to be closed by the remote once they send data
+func (sesh *Session) recvGoaway(lastStreamID uint32) {
+	sesh.Logger.Debugf("remote of session %v is going away after stream %v", sesh.id, lastStreamID)
+	atomic.StoreUint32(&sesh.remoteGoingAway, 1)
+	if sesh.Role != RoleUnspecified {
+		sesh.streams.Range(func(idI, streamI interface{}) bool {
+			id := idI.(uint32)
+			if streamI == nil || id <= lastStreamID || !sesh.isLocalStreamID(id) {
+				return true
+			}
+			err := streamI.(*Stream).passiveClose()
+			if err != nil && !errors.Is(err, errRepeatStreamClosing) {
+				sesh.Logger.Debugf("%v", err)
+			}
+			return true
+		})
+	}
+	if sesh.OnGoaway != nil {
+		sesh.OnGoaway(lastStreamID)
+	}
+}
+
+// resetStream tells the remote to reset a stream opened by it which we have rejected, and haven't sent anything on
+func (sesh *Session) resetStream(id uint32) error {
+	payload := append(make([]byte, resetCodeLen), genRandomPadding()...)
+	putU32(payload, ResetCodeRejected)
+	return sesh.sendControlFrame(&Frame{
+		StreamID: id,
+		Seq:      0,
+		Closing:  closingReset,
+		Payload:  payload,
+	})
+}
+
+// sendControlFrame sends a frame that doesn't belong to any Stream through any connection
+func (sesh *Session) sendControlFrame(f *Frame) error {
+	obfsBuf := make([]byte, sesh.obfsBufLen(len(f.Payload)))
+	i, err := sesh.obfs(f, obfsBuf, 0)
+	if err != nil {
+		return err
+	}
+	_, err = sesh.sb.send(obfsBuf[:i], new(uint32))
+	return err
+}
+
+// sendControlFrameTo sends a frame that doesn't belong to any Stream through the connection of connId only
+func (sesh *Session) sendControlFrameTo(f *Frame, connId uint32) error {
+	obfsBuf := make([]byte, sesh.obfsBufLen(len(f.Payload)))
+	i, err := sesh.obfs(f, obfsBuf, 0)
+	if err != nil {
+		return err
+	}
+	_, err = sesh.sb.sendTo(obfsBuf[:i], connId)
+	return err
+}
+
+// isLocalStreamID returns whether id has the parity of IDs of streams opened by this end
+func (sesh *Session) isLocalStreamID(id uint32) bool {
+	return id%2 == sesh.firstStreamID%2
 }
 
 func (sesh *Session) SetTerminalMsg(msg string) {
@@ -255,17 +1486,26 @@ func (sesh *Session) TerminalMsg() string {
 
 func (sesh *Session) closeSession(closeSwitchboard bool) error {
 	if atomic.SwapUint32(&sesh.closed, 1) == 1 {
-		log.Debugf("session %v has already been closed", sesh.id)
+		sesh.Logger.Debugf("session %v has already been closed", sesh.id)
 		return errRepeatSessionClosing
 	}
-	sesh.acceptCh <- nil
+	close(sesh.done)
+	if !sesh.NoAccept {
+		sesh.accepts.close()
+	}
+	if sesh.lifetimeTimer != nil {
+		sesh.lifetimeTimer.Stop()
+	}
 
 	sesh.streams.Range(func(key, streamI interface{}) bool {
 		if streamI == nil {
 			return true
 		}
 		stream := streamI.(*Stream)
-		atomic.StoreUint32(&stream.closed, 1)
+		if !stream.markClosed(CloseInitiatorSession) {
+			// being closed by endStream
+			return true
+		}
 		_ = stream.recvBuf.Close() // will not block
 		sesh.streams.Delete(key)
 		sesh.streamCountDecr()
@@ -279,39 +1519,60 @@ func (sesh *Session) closeSession(closeSwitchboard bool) error {
 }
 
 func (sesh *Session) passiveClose() error {
-	log.Debugf("attempting to passively close session %v", sesh.id)
+	sesh.Logger.Debugf("attempting to passively close session %v", sesh.id)
 	err := sesh.closeSession(true)
 	if err != nil {
 		return err
 	}
-	log.Debugf("session %v closed gracefully", sesh.id)
+	sesh.Logger.Debugf("session %v closed gracefully", sesh.id)
 	return nil
 }
 
 func genRandomPadding() []byte {
 	lenB := make([]byte, 1)
-	common.CryptoRandRead(lenB)
+	randRead(lenB)
 	pad := make([]byte, int(lenB[0])+1)
-	common.CryptoRandRead(pad)
+	randRead(pad)
 	return pad
 }
 
+// Close closes the session and all of its streams, and tells the remote to do the same. Like Stream.Close, data
+// already received by a stream can still be read after it's closed. Outbound data is flushed before underlying
+// connections are closed: writes to streams already in progress are allowed to finish, and data held while waiting for
+// resumption is sent once the session is resumed or dropped once the resumption window expires. The remote can read
+// all data sent through a connection before the closing notification, though frames sent through other connections
+// may arrive too late
 func (sesh *Session) Close() error {
-	log.Debugf("attempting to actively close session %v", sesh.id)
+	sesh.Logger.Debugf("attempting to actively close session %v", sesh.id)
+	var streams []*Stream
+	sesh.streams.Range(func(_, streamI interface{}) bool {
+		if streamI != nil {
+			streams = append(streams, streamI.(*Stream))
+		}
+		return true
+	})
 	err := sesh.closeSession(false)
 	if err != nil {
 		return err
 	}
+	for _, stream := range streams {
+		// wait for writes in progress, and send data held back
+		stream.writingM.Lock()
+		if err := stream.sendHeldWrites(); err != nil {
+			sesh.Logger.Debugf("failed to send data held back in stream %v: %v", stream.id, err)
+		}
+		stream.writingM.Unlock()
+	}
+	_ = sesh.sb.waitPending() // always returns an error as the session is closed
 	// we send a notice frame telling remote to close the session
 	pad := genRandomPadding()
 	f := &Frame{
 		StreamID: 0xffffffff,
-		Seq:      0,
 		Closing:  closingSession,
 		Payload:  pad,
 	}
-	obfsBuf := make([]byte, len(pad)+frameHeaderLength+sesh.Obfuscator.maxOverhead)
-	i, err := sesh.Obfs(f, obfsBuf, 0)
+	obfsBuf := make([]byte, sesh.obfsBufLen(len(pad)))
+	i, err := sesh.obfs(f, obfsBuf, 0)
 	if err != nil {
 		return err
 	}
@@ -321,7 +1582,7 @@ func (sesh *Session) Close() error {
 	}
 
 	sesh.sb.closeAll()
-	log.Debugf("session %v closed gracefully", sesh.id)
+	sesh.Logger.Debugf("session %v closed gracefully", sesh.id)
 	return nil
 }
 
@@ -329,11 +1590,39 @@ func (sesh *Session) IsClosed() bool {
 	return atomic.LoadUint32(&sesh.closed) == 1
 }
 
+// Done returns a channel that is closed once the session is closed, for whatever reason: Close, a closing frame
+// from the remote, a timeout, MaxLifetime or losing its connections. Like context.Context.Done, it can be used in a
+// select to tie the lifetime of goroutines to the session. TerminalMsg tells why the session was closed
+func (sesh *Session) Done() <-chan struct{} { return sesh.done }
+
 func (sesh *Session) checkTimeout() {
+	if sesh.sb.awaitingResumption() {
+		// the inactivity timer is paused during resumption, which has its own time limit
+		time.AfterFunc(sesh.InactivityTimeout, sesh.checkTimeout)
+		return
+	}
 	if sesh.streamCount() == 0 && !sesh.IsClosed() {
 		sesh.SetTerminalMsg("timeout")
 		sesh.Close()
 	}
 }
 
+// checkHandshake closes the session if nothing has been received from the remote within HandshakeTimeout
+func (sesh *Session) checkHandshake() {
+	if atomic.LoadUint32(&sesh.established) == 1 || sesh.IsClosed() {
+		return
+	}
+	sesh.SetTerminalMsg("handshake timeout")
+	sesh.passiveClose()
+}
+
+// expire closes the session once it has reached MaxLifetime, in the same way as if the remote has told us to close it
+func (sesh *Session) expire() {
+	if sesh.IsClosed() {
+		return
+	}
+	sesh.SetTerminalMsg("maximum lifetime reached")
+	sesh.passiveClose()
+}
+
 func (sesh *Session) Addr() net.Addr { return sesh.addrs.Load().([]net.Addr)[0] }
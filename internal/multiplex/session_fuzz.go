@@ -15,7 +15,7 @@ func setupSesh_fuzz(unordered bool) *Session {
 
 func Fuzz(data []byte) int {
 	sesh := setupSesh_fuzz(false)
-	err := sesh.recvDataFromRemote(data)
+	err := sesh.recvDataFromRemote(data, 0)
 	if err == nil {
 		return 1
 	}
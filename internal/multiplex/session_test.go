@@ -2,9 +2,16 @@ package multiplex
 
 import (
 	"bytes"
+	"context"
+	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/connutil"
+	"github.com/juju/ratelimit"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -69,6 +76,10 @@ func TestRecvDataFromRemote(t *testing.T) {
 			"chacha20-poly1305",
 			MakeObfuscatorUnwrap(EncryptionMethodChaha20Poly1305, sessionKey),
 		},
+		{
+			"xor-stream",
+			MakeObfuscatorUnwrap(EncryptionMethodXorStream, sessionKey),
+		},
 	}
 
 	for _, st := range sessionTypes {
@@ -82,7 +93,7 @@ func TestRecvDataFromRemote(t *testing.T) {
 						t.Error(err)
 						return
 					}
-					err = sesh.recvDataFromRemote(obfsBuf[:n])
+					err = sesh.recvDataFromRemote(obfsBuf[:n], 0)
 					if err != nil {
 						t.Error(err)
 						return
@@ -127,7 +138,7 @@ func TestRecvDataFromRemote_Closing_InOrder(t *testing.T) {
 	}
 	// create stream 1
 	n, _ := sesh.Obfs(f1, obfsBuf, 0)
-	err := sesh.recvDataFromRemote(obfsBuf[:n])
+	err := sesh.recvDataFromRemote(obfsBuf[:n], 0)
 	if err != nil {
 		t.Fatalf("receiving normal frame for stream 1: %v", err)
 	}
@@ -147,7 +158,7 @@ func TestRecvDataFromRemote_Closing_InOrder(t *testing.T) {
 		testPayload,
 	}
 	n, _ = sesh.Obfs(f2, obfsBuf, 0)
-	err = sesh.recvDataFromRemote(obfsBuf[:n])
+	err = sesh.recvDataFromRemote(obfsBuf[:n], 0)
 	if err != nil {
 		t.Fatalf("receiving normal frame for stream 2: %v", err)
 	}
@@ -167,7 +178,7 @@ func TestRecvDataFromRemote_Closing_InOrder(t *testing.T) {
 		testPayload,
 	}
 	n, _ = sesh.Obfs(f1CloseStream, obfsBuf, 0)
-	err = sesh.recvDataFromRemote(obfsBuf[:n])
+	err = sesh.recvDataFromRemote(obfsBuf[:n], 0)
 	if err != nil {
 		t.Fatalf("receiving stream closing frame for stream 1: %v", err)
 	}
@@ -194,7 +205,7 @@ func TestRecvDataFromRemote_Closing_InOrder(t *testing.T) {
 
 	// close stream 1 again
 	n, _ = sesh.Obfs(f1CloseStream, obfsBuf, 0)
-	err = sesh.recvDataFromRemote(obfsBuf[:n])
+	err = sesh.recvDataFromRemote(obfsBuf[:n], 0)
 	if err != nil {
 		t.Fatalf("receiving stream closing frame for stream 1 %v", err)
 	}
@@ -215,7 +226,7 @@ func TestRecvDataFromRemote_Closing_InOrder(t *testing.T) {
 		Payload:  testPayload,
 	}
 	n, _ = sesh.Obfs(fCloseSession, obfsBuf, 0)
-	err = sesh.recvDataFromRemote(obfsBuf[:n])
+	err = sesh.recvDataFromRemote(obfsBuf[:n], 0)
 	if err != nil {
 		t.Fatalf("receiving session closing frame: %v", err)
 	}
@@ -256,7 +267,7 @@ func TestRecvDataFromRemote_Closing_OutOfOrder(t *testing.T) {
 		testPayload,
 	}
 	n, _ := sesh.Obfs(f1CloseStream, obfsBuf, 0)
-	err := sesh.recvDataFromRemote(obfsBuf[:n])
+	err := sesh.recvDataFromRemote(obfsBuf[:n], 0)
 	if err != nil {
 		t.Fatalf("receiving out of order stream closing frame for stream 1: %v", err)
 	}
@@ -276,7 +287,7 @@ func TestRecvDataFromRemote_Closing_OutOfOrder(t *testing.T) {
 		testPayload,
 	}
 	n, _ = sesh.Obfs(f1, obfsBuf, 0)
-	err = sesh.recvDataFromRemote(obfsBuf[:n])
+	err = sesh.recvDataFromRemote(obfsBuf[:n], 0)
 	if err != nil {
 		t.Fatalf("receiving normal frame for stream 1: %v", err)
 	}
@@ -296,6 +307,874 @@ func TestRecvDataFromRemote_Closing_OutOfOrder(t *testing.T) {
 	}
 }
 
+func TestSession_CloseResidualData(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+
+	for name, unordered := range map[string]bool{"ordered": false, "unordered": true} {
+		t.Run(name, func(t *testing.T) {
+			seshConfig := SessionConfig{
+				Obfuscator: obfuscator,
+				Unordered:  unordered,
+			}
+			clientSesh := MakeSession(0, seshConfig)
+			serverSesh := MakeSession(0, seshConfig)
+			c, s := connutil.AsyncPipe()
+			clientSesh.AddConnection(common.NewTLSConn(c))
+			serverSesh.AddConnection(common.NewTLSConn(s))
+
+			testData := make([]byte, testPayloadLen)
+			rand.Read(testData)
+			stream, _ := clientSesh.OpenStream()
+			for i := 0; i < 3; i++ {
+				_, err := stream.Write(testData)
+				assert.NoError(t, err)
+			}
+			serverStream, _ := serverSesh.Accept()
+			buf := make([]byte, testPayloadLen)
+			_, err := io.ReadFull(serverStream, buf)
+			assert.NoError(t, err)
+
+			assert.NoError(t, clientSesh.Close())
+			assert.Eventually(t, serverSesh.IsClosed, time.Second, 10*time.Millisecond)
+
+			for i := 0; i < 2; i++ {
+				_, err = io.ReadFull(serverStream, buf)
+				assert.NoError(t, err, "can't read residual data after the session is closed")
+				assert.Equal(t, testData, buf)
+			}
+			_, err = serverStream.Read(buf)
+			assert.Equal(t, ErrBrokenStream, err)
+		})
+	}
+
+	t.Run("writes in progress are flushed", func(t *testing.T) {
+		seshConfig := SessionConfig{
+			Obfuscator: obfuscator,
+			SendJitter: SendJitter{Max: 5 * time.Millisecond},
+		}
+		clientSesh := MakeSession(0, seshConfig)
+		serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+
+		testData := make([]byte, 20*clientSesh.MaxFramePayload())
+		rand.Read(testData)
+		stream, _ := clientSesh.OpenStream()
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := stream.Write(testData)
+			writeErr <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, clientSesh.Close())
+		assert.NoError(t, <-writeErr)
+
+		serverStream, _ := serverSesh.Accept()
+		received, _ := ioutil.ReadAll(serverStream)
+		assert.Equal(t, testData, received)
+	})
+}
+
+func TestSession_WaitReady(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	config := SessionConfig{Obfuscator: obfuscator}
+
+	t.Run("cancelled", func(t *testing.T) {
+		sesh := MakeSession(0, config)
+		defer sesh.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, sesh.WaitReady(ctx))
+	})
+
+	t.Run("connection added", func(t *testing.T) {
+		sesh := MakeSession(0, config)
+		defer sesh.Close()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			sesh.AddConnection(connutil.Discard())
+		}()
+		assert.NoError(t, sesh.WaitReady(context.Background()))
+		// returns immediately once established
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.NoError(t, sesh.WaitReady(ctx))
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		sesh := MakeSession(0, config)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			sesh.passiveClose()
+		}()
+		assert.Equal(t, ErrBrokenSession, sesh.WaitReady(context.Background()))
+	})
+
+	t.Run("resumption", func(t *testing.T) {
+		resumableConfig := config
+		resumableConfig.ResumptionWindow = time.Second
+		sesh := MakeSession(0, resumableConfig)
+		defer sesh.Close()
+		c, s := connutil.AsyncPipe()
+		sesh.AddConnection(c)
+		assert.NoError(t, sesh.WaitReady(context.Background()))
+		s.Close()
+		assert.Eventually(t, sesh.sb.awaitingResumption, time.Second, 10*time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, sesh.WaitReady(ctx))
+		sesh.AddConnection(connutil.Discard())
+		assert.NoError(t, sesh.WaitReady(context.Background()))
+	})
+}
+
+func TestSession_PendingAccepts(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	seshConfigOrdered.Obfuscator = obfuscator
+	sesh := MakeSession(0, seshConfigOrdered)
+
+	obfsBuf := make([]byte, obfsBufLen)
+	for id := uint32(1); id <= 3; id++ {
+		f := &Frame{
+			id,
+			0,
+			closingNothing,
+			[]byte{1, 2, 3, 4},
+		}
+		n, _ := sesh.Obfs(f, obfsBuf, 0)
+		err := sesh.recvDataFromRemote(obfsBuf[:n], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, 3, sesh.PendingAccepts())
+
+	_, _ = sesh.Accept()
+	assert.Equal(t, 2, sesh.PendingAccepts())
+
+	sesh.Close()
+	assert.Equal(t, 0, sesh.PendingAccepts())
+}
+
+func TestSession_OpenStreamBatch(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Role: RoleClient})
+
+	first, _ := sesh.OpenStream()
+	const n = 10
+	streams, err := sesh.OpenStreamBatch(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, streams, n)
+	for i, stream := range streams {
+		assert.Equal(t, first.id+uint32(i+1)*2, stream.id)
+		streamI, ok := sesh.streams.Load(stream.id)
+		assert.True(t, ok)
+		assert.Equal(t, stream, streamI)
+	}
+	assert.Equal(t, uint32(n+1), sesh.streamCount())
+	next, _ := sesh.OpenStream()
+	assert.Equal(t, streams[n-1].id+2, next.id)
+
+	streams, err = sesh.OpenStreamBatch(0)
+	assert.NoError(t, err)
+	assert.Empty(t, streams)
+	_, err = sesh.OpenStreamBatch(-1)
+	assert.Equal(t, errNegativeBatch, err)
+
+	t.Run("discard", func(t *testing.T) {
+		streams, _ := sesh.OpenStreamBatch(3)
+		count := sesh.streamCount()
+		sesh.discardStreams(streams)
+		assert.Equal(t, count-3, sesh.streamCount())
+		for _, stream := range streams {
+			_, ok := sesh.streams.Load(stream.id)
+			assert.False(t, ok)
+			assert.True(t, stream.isClosed())
+		}
+	})
+
+	t.Run("singleplex", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Singleplex: true})
+		_, err := sesh.OpenStreamBatch(2)
+		assert.Equal(t, errNoMultiplex, err)
+		streams, err := sesh.OpenStreamBatch(1)
+		assert.NoError(t, err)
+		assert.Len(t, streams, 1)
+		_, err = sesh.OpenStreamBatch(1)
+		assert.Equal(t, errNoMultiplex, err)
+	})
+
+	t.Run("closed session", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+		sesh.Close()
+		_, err := sesh.OpenStreamBatch(2)
+		assert.Equal(t, ErrBrokenSession, err)
+	})
+}
+
+func TestSession_AcceptBacklog(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+
+	for _, backlog := range []int{0, -1} {
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, AcceptBacklog: backlog})
+		assert.Equal(t, defaultAcceptBacklog, sesh.accepts.backlog)
+	}
+
+	const backlog = 3
+	sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, AcceptBacklog: backlog})
+	assert.Equal(t, backlog, sesh.accepts.backlog)
+
+	obfsBuf := make([]byte, obfsBufLen)
+	recvNewStream := func(id uint32) error {
+		n, _ := sesh.Obfs(&Frame{id, 0, closingNothing, []byte{1, 2, 3, 4}}, obfsBuf, 0)
+		return sesh.recvDataFromRemote(obfsBuf[:n], 0)
+	}
+	for id := uint32(1); id <= backlog; id++ {
+		err := recvNewStream(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, backlog, sesh.PendingAccepts())
+
+	received := make(chan struct{})
+	go func() {
+		_ = recvNewStream(backlog + 1)
+		close(received)
+	}()
+	select {
+	case <-received:
+		t.Fatal("a stream is received while the backlog is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, _ = sesh.Accept()
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("a stream isn't received after the backlog has room")
+	}
+	assert.Equal(t, backlog, sesh.PendingAccepts())
+}
+
+func TestSession_AcceptTimeout(t *testing.T) {
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, emptyKey)
+	const timeout = 50 * time.Millisecond
+	clientConfig := SessionConfig{Obfuscator: obfuscator, Role: RoleClient}
+	serverConfig := clientConfig.Derive()
+	serverConfig.AcceptBacklog = 2
+	serverConfig.AcceptTimeout = timeout
+	clientSesh := MakeSession(0, clientConfig)
+	serverSesh := MakeSession(0, serverConfig)
+	defer clientSesh.Close()
+	defer serverSesh.Close()
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	unaccepted, _ := clientSesh.OpenStream()
+	_, _ = unaccepted.Write([]byte{1})
+	assert.Eventually(t, func() bool {
+		return serverSesh.PendingAccepts() == 1
+	}, time.Second, time.Millisecond)
+
+	// streams left in the backlog past the timeout are taken out of it and reset
+	assert.Eventually(t, func() bool {
+		return serverSesh.PendingAccepts() == 0 && serverSesh.streamCount() == 0
+	}, 10*timeout, time.Millisecond, "stream not accepted in time isn't reclaimed")
+	assert.Eventually(t, func() bool {
+		_, err := unaccepted.Read(make([]byte, 1))
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	_, err := unaccepted.Read(make([]byte, 1))
+	assert.Equal(t, &StreamResetError{Code: ResetCodeAcceptTimeout}, err)
+
+	// streams accepted in time aren't
+	accepted, _ := clientSesh.OpenStream()
+	_, _ = accepted.Write([]byte{2})
+	serverStream, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(2 * timeout)
+	_, err = accepted.Write([]byte{3})
+	assert.NoError(t, err)
+	received := make([]byte, 2)
+	_, err = io.ReadFull(serverStream, received)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{2, 3}, received)
+}
+
+func TestSession_NoAccept(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	clientConfig := SessionConfig{Obfuscator: obfuscator, Role: RoleClient, NoAccept: true}
+	clientSesh := MakeSession(0, clientConfig)
+	serverSesh := MakeSession(0, clientConfig.Derive())
+	defer serverSesh.Close()
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+	assert.Nil(t, clientSesh.accepts, "accept backlog allocated")
+
+	_, err := clientSesh.Accept()
+	assert.Equal(t, ErrNoAccept, err)
+
+	stream, err := clientSesh.OpenStream()
+	assert.NoError(t, err)
+	_, err = stream.Write([]byte{1})
+	assert.NoError(t, err)
+	serverStream, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.ReadFull(serverStream, make([]byte, 1))
+	assert.NoError(t, err)
+
+	// streams opened by the server are rejected
+	rejected, _ := serverSesh.OpenStream()
+	_, _ = rejected.Write([]byte{1})
+	assert.Eventually(t, func() bool {
+		_, err := rejected.Read(make([]byte, 1))
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "stream opened by the server isn't rejected")
+	assert.Equal(t, uint32(1), clientSesh.streamCount())
+
+	assert.NoError(t, clientSesh.Close())
+}
+
+func TestSession_OpenStreamWithID(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	clientConfig := SessionConfig{Obfuscator: obfuscator, Role: RoleClient}
+	clientSesh := MakeSession(0, clientConfig)
+	serverSesh := MakeSession(0, clientConfig.Derive())
+	defer clientSesh.Close()
+	defer serverSesh.Close()
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	exchange := func(stream *Stream) *Stream {
+		_, err := stream.Write([]byte{1})
+		assert.NoError(t, err)
+		serverStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		_, err = io.ReadFull(serverStream, make([]byte, 1))
+		assert.NoError(t, err)
+		return serverStream.(*Stream)
+	}
+
+	const id = 100
+	stream, err := clientSesh.OpenStreamWithID(id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint32(id), stream.ID())
+	serverStream := exchange(stream)
+	assert.Equal(t, uint32(id), serverStream.ID())
+
+	_, err = clientSesh.OpenStreamWithID(id)
+	assert.Equal(t, ErrStreamIDInUse, err)
+	_, err = clientSesh.OpenStreamWithID(id + 1)
+	assert.Equal(t, ErrStreamIDReserved, err, "stream opened with the parity of server streams")
+	_, err = clientSesh.OpenStreamWithID(0xffffffff)
+	assert.Equal(t, ErrStreamIDReserved, err)
+
+	// OpenStream skips the ID
+	atomic.StoreUint32(&clientSesh.nextStreamID, id)
+	skipping, err := clientSesh.OpenStream()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(id+2), skipping.ID())
+
+	// the ID can be used again once the stream is closed on both ends
+	assert.NoError(t, stream.Close())
+	assert.Eventually(t, func() bool {
+		_, err := serverStream.Read(make([]byte, 1))
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "stream isn't closed on the server")
+	reused, err := clientSesh.OpenStreamWithID(id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	reusedOnServer := exchange(reused)
+	assert.Equal(t, uint32(id), reusedOnServer.ID())
+	assert.NotSame(t, serverStream, reusedOnServer)
+}
+
+func TestSession_HeadOfLineBlocked(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	sesh := setupSesh(false, sessionKey, EncryptionMethodPlain)
+	obfsBuf := make([]byte, obfsBufLen)
+	recvFrame := func(seq uint64) {
+		n, _ := sesh.Obfs(&Frame{1, seq, closingNothing, []byte{byte(seq)}}, obfsBuf, 0)
+		assert.NoError(t, sesh.recvDataFromRemote(obfsBuf[:n], 0))
+	}
+
+	recvFrame(0)
+	assert.Zero(t, sesh.HeadOfLineBlocked(), "frames received in order are counted as blocked")
+
+	// frame 1 is withheld
+	const withheld = 50 * time.Millisecond
+	recvFrame(2)
+	recvFrame(3)
+	time.Sleep(withheld)
+	assert.Zero(t, sesh.HeadOfLineBlocked(), "counted before the missing frame has arrived")
+	recvFrame(1)
+	blocked := sesh.HeadOfLineBlocked()
+	assert.True(t, blocked >= withheld && blocked < 10*withheld, "unexpected blocked time %v", blocked)
+
+	stream, _ := sesh.Accept()
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(stream, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2, 3}, buf)
+
+	recvFrame(4)
+	assert.Equal(t, blocked, sesh.HeadOfLineBlocked())
+}
+
+func TestSession_OnNewStream(t *testing.T) {
+	clientSesh, serverSesh, _ := makeSessionPair(1)
+	serverSesh.OnNewStream = func(id uint32) bool {
+		return id != 2
+	}
+
+	accepted, _ := clientSesh.OpenStream()
+	rejected, _ := clientSesh.OpenStream()
+	_, err := accepted.Write([]byte{1})
+	assert.NoError(t, err)
+	_, err = rejected.Write([]byte{2})
+	assert.NoError(t, err)
+	_, err = rejected.Write([]byte{3})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return rejected.isClosed()
+	}, time.Second, 10*time.Millisecond, "rejected stream isn't reset")
+	assert.False(t, accepted.isClosed())
+	_, err = rejected.Read(make([]byte, 1))
+	assert.Equal(t, &StreamResetError{Code: ResetCodeRejected}, err)
+
+	serverStream, err := serverSesh.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, 1, serverStream.(*Stream).id)
+	assert.Equal(t, 0, serverSesh.PendingAccepts())
+	assert.EqualValues(t, 1, serverSesh.streamCount())
+	rejectedI, ok := serverSesh.streams.Load(uint32(2))
+	assert.True(t, ok)
+	assert.Nil(t, rejectedI)
+}
+
+func TestSession_MaxStreamOpenRate(t *testing.T) {
+	const rate = 20
+	clientSesh, serverSesh, _ := makeSessionPair(1)
+	serverSesh.streamOpenBucket = ratelimit.NewBucketWithRate(rate, rate)
+
+	sesh := MakeSession(0, SessionConfig{Obfuscator: serverSesh.Obfuscator, MaxStreamOpenRate: 2.5})
+	assert.EqualValues(t, 3, sesh.streamOpenBucket.Capacity(), "burst isn't a second's worth")
+
+	openStreams := func(n int) []*Stream {
+		streams := make([]*Stream, n)
+		for i := range streams {
+			streams[i], _ = clientSesh.OpenStream()
+			_, err := streams[i].Write([]byte{1})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return streams
+	}
+	countAccepted := func(streams []*Stream) int {
+		var accepted int
+		for _, stream := range streams {
+			if !stream.isClosed() {
+				accepted++
+			}
+		}
+		return accepted
+	}
+
+	// a burst above the rate
+	burst := openStreams(3 * rate)
+	assert.Eventually(t, func() bool {
+		return serverSesh.PendingAccepts()+(3*rate-countAccepted(burst)) == 3*rate
+	}, time.Second, 10*time.Millisecond, "rejected streams aren't reset")
+	accepted := countAccepted(burst)
+	assert.GreaterOrEqual(t, accepted, rate)
+	assert.Less(t, accepted, 2*rate, "too many streams in the burst are accepted")
+	assert.False(t, serverSesh.IsClosed())
+
+	// steady opens within the rate
+	var steady []*Stream
+	for i := 0; i < 5; i++ {
+		time.Sleep(2 * time.Second / rate)
+		steady = append(steady, openStreams(1)...)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, len(steady), countAccepted(steady), "streams opened within the rate are rejected")
+}
+
+func TestSession_Goaway(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	lastStreamIDs := make(chan uint32, 1)
+	clientSesh := MakeSession(0, SessionConfig{
+		Obfuscator: obfuscator,
+		Role:       RoleClient,
+		OnGoaway: func(lastStreamID uint32) {
+			lastStreamIDs <- lastStreamID
+		},
+	})
+	serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Role: RoleServer})
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	var serverStreams []net.Conn
+	var clientStreams []*Stream
+	for i := 0; i < 2; i++ {
+		stream, _ := clientSesh.OpenStream()
+		_, _ = stream.Write([]byte{1})
+		serverStream, _ := serverSesh.Accept()
+		clientStreams = append(clientStreams, stream)
+		serverStreams = append(serverStreams, serverStream)
+	}
+	unprocessed, _ := clientSesh.OpenStream()
+
+	err := serverSesh.Goaway()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case lastStreamID := <-lastStreamIDs:
+		assert.Equal(t, clientStreams[1].id, lastStreamID)
+	case <-time.After(time.Second):
+		t.Fatal("OnGoaway not called")
+	}
+	assert.True(t, unprocessed.isClosed(), "stream above the last stream id isn't closed")
+	_, err = clientSesh.OpenStream()
+	assert.Equal(t, ErrGoaway, err)
+	_, err = serverSesh.OpenStream()
+	assert.Equal(t, ErrGoaway, err)
+
+	t.Run("streams above the last stream id are rejected", func(t *testing.T) {
+		err := clientSesh.WriteFrame(&Frame{
+			StreamID: 100,
+			Seq:      0,
+			Closing:  closingNothing,
+			Payload:  []byte{1},
+		})
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			_, ok := serverSesh.streams.Load(uint32(100))
+			return ok
+		}, time.Second, 10*time.Millisecond)
+		streamI, _ := serverSesh.streams.Load(uint32(100))
+		assert.Nil(t, streamI)
+		assert.Zero(t, serverSesh.PendingAccepts())
+	})
+
+	t.Run("streams below the last stream id are allowed to finish", func(t *testing.T) {
+		for i, stream := range clientStreams {
+			_, err := stream.Write([]byte{2})
+			assert.NoError(t, err)
+			buf := make([]byte, 2)
+			_, err = io.ReadFull(serverStreams[i], buf)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte{1, 2}, buf)
+		}
+		assert.False(t, serverSesh.IsClosed())
+
+		for _, stream := range serverStreams {
+			stream.Close()
+		}
+		assert.Eventually(t, serverSesh.IsClosed, time.Second, 10*time.Millisecond,
+			"session isn't closed after its streams are closed")
+	})
+}
+
+func TestSession_MaxBufferedBytes(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	sesh := MakeSession(0, SessionConfig{
+		Obfuscator:       obfuscator,
+		MaxBufferedBytes: 4 * testPayloadLen,
+	})
+
+	obfsBuf := make([]byte, obfsBufLen)
+	seq := uint64(0)
+	recv := func(streamID uint32) error {
+		f := &Frame{
+			StreamID: streamID,
+			Seq:      seq,
+			Closing:  closingNothing,
+			Payload:  make([]byte, testPayloadLen),
+		}
+		seq++
+		n, _ := sesh.Obfs(f, obfsBuf, 0)
+		return sesh.recvDataFromRemote(obfsBuf[:n], 0)
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, recv(1))
+	}
+	stream, _ := sesh.Accept()
+
+	// reading releases buffered data
+	_, err := io.ReadFull(stream, make([]byte, 2*testPayloadLen))
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, recv(1))
+	}
+	assert.False(t, sesh.IsClosed())
+
+	// out of order frames are counted too
+	seq++
+	assert.Equal(t, errMaxBufferedBytes, recv(1))
+	assert.True(t, sesh.IsClosed(), "session isn't closed after a peer floods unread data")
+	assert.Equal(t, errMaxBufferedBytes.Error(), sesh.TerminalMsg())
+
+	t.Run("closing a stream releases its unread data", func(t *testing.T) {
+		sesh = MakeSession(0, SessionConfig{
+			Obfuscator:       obfuscator,
+			MaxBufferedBytes: 4 * testPayloadLen,
+		})
+		seq = 0
+		for i := 0; i < 4; i++ {
+			assert.NoError(t, recv(1))
+		}
+		stream, _ := sesh.Accept()
+		stream.Close()
+		seq = 0
+		for i := 0; i < 4; i++ {
+			assert.NoError(t, recv(3))
+		}
+		assert.False(t, sesh.IsClosed())
+	})
+
+	t.Run("resetting the largest streams", func(t *testing.T) {
+		const maxBufferedBytes = 32 << 10
+		clientConfig := SessionConfig{Obfuscator: obfuscator, Role: RoleClient}
+		serverConfig := clientConfig.Derive()
+		serverConfig.MaxBufferedBytes = maxBufferedBytes
+		serverConfig.BufferedBytesPolicy = ResetLargestStreams
+		clientSesh := MakeSession(0, clientConfig)
+		serverSesh := MakeSession(0, serverConfig)
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+
+		// one stream takes up most of the limit, then many small ones together exceed it
+		large, _ := clientSesh.OpenStream()
+		_, err := large.Write(make([]byte, 10<<10))
+		assert.NoError(t, err)
+		const numSmall = 30
+		for i := 0; i < numSmall; i++ {
+			small, _ := clientSesh.OpenStream()
+			_, err := small.Write(make([]byte, 1<<10))
+			assert.NoError(t, err)
+		}
+
+		buffered := func(s net.Conn) int { return s.(*Stream).Buffered() }
+		largeOnServer, _ := serverSesh.Accept()
+		for i := 0; i < numSmall; i++ {
+			small, err := serverSesh.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Eventually(t, func() bool { return buffered(small) == 1<<10 }, time.Second,
+				10*time.Millisecond, "a small stream is reset")
+		}
+		assert.False(t, serverSesh.IsClosed())
+		assert.True(t, atomic.LoadInt64(&serverSesh.bufferedBytes) <= maxBufferedBytes)
+
+		expected := &StreamResetError{Code: ResetCodeBufferLimit}
+		_, err = largeOnServer.Read(make([]byte, 1))
+		assert.Equal(t, expected, err, "the largest stream isn't reset")
+		assert.Eventually(t, func() bool {
+			_, err := large.Read(make([]byte, 1))
+			return assert.ObjectsAreEqual(expected, err)
+		}, time.Second, 10*time.Millisecond, "the remote isn't told of the reset")
+	})
+}
+
+func TestSession_StrictSequencing(t *testing.T) {
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, emptyKey)
+	for _, strict := range []bool{false, true} {
+		sesh := MakeSession(0, SessionConfig{
+			Obfuscator:       obfuscator,
+			StrictSequencing: strict,
+			ReorderTimeout:   10 * time.Millisecond,
+			ReorderSkip:      true,
+		})
+		obfsBuf := make([]byte, obfsBufLen)
+		recv := func(id uint32, seq uint64) error {
+			n, _ := sesh.Obfs(&Frame{id, seq, closingNothing, []byte{byte(seq)}}, obfsBuf, 0)
+			return sesh.recvDataFromRemote(obfsBuf[:n], 0)
+		}
+		for _, seq := range []uint64{0, 1, 3} {
+			assert.NoError(t, recv(1, seq))
+		}
+		stream, _ := sesh.Accept()
+		// 2 is skipped, so it may still arrive late
+		_, err := io.ReadFull(stream, make([]byte, 3))
+		assert.NoError(t, err)
+		assert.NoError(t, recv(1, 2), "late frame of a skipped gap is an error")
+		assert.False(t, sesh.IsClosed())
+
+		assert.NoError(t, recv(1, 4))
+		err = recv(1, 4)
+		if strict {
+			assert.Equal(t, ErrSequenceViolation, err)
+			assert.True(t, sesh.IsClosed(), "session isn't closed after a frame is delivered twice")
+		} else {
+			assert.NoError(t, err)
+			assert.False(t, sesh.IsClosed())
+			sesh.Close()
+		}
+	}
+}
+
+func TestSession_UnorderedBufferLimit(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+
+	for name, policy := range map[string]DropPolicy{"drop newest": DropNewest, "drop oldest": DropOldest} {
+		t.Run(name, func(t *testing.T) {
+			var dropped int32
+			sesh := MakeSession(0, SessionConfig{
+				Obfuscator:           obfuscator,
+				Unordered:            true,
+				UnorderedBufferLimit: 4 * testPayloadLen,
+				DropPolicy:           policy,
+				// a datagram arriving is counted before it's dropped
+				MaxBufferedBytes: 5 * testPayloadLen,
+				OnDrop: func(streamID uint32, numDropped int) {
+					assert.Equal(t, uint32(1), streamID)
+					atomic.AddInt32(&dropped, int32(numDropped))
+				},
+			})
+
+			obfsBuf := make([]byte, obfsBufLen)
+			// a flood of datagrams that aren't read doesn't block receiving
+			for seq := uint64(0); seq < 10; seq++ {
+				payload := make([]byte, testPayloadLen)
+				payload[0] = byte(seq)
+				n, _ := sesh.Obfs(&Frame{1, seq, closingNothing, payload}, obfsBuf, 0)
+				assert.NoError(t, sesh.recvDataFromRemote(obfsBuf[:n], 0))
+			}
+			assert.Equal(t, int32(6), atomic.LoadInt32(&dropped))
+			assert.False(t, sesh.IsClosed(), "dropped data still counts towards MaxBufferedBytes")
+
+			stream, _ := sesh.Accept()
+			first := byte(0)
+			if policy == DropOldest {
+				first = 6
+			}
+			buf := make([]byte, testPayloadLen)
+			for i := byte(0); i < 4; i++ {
+				_, err := stream.Read(buf)
+				assert.NoError(t, err)
+				assert.Equal(t, first+i, buf[0])
+			}
+			assert.Zero(t, stream.(*Stream).Buffered())
+		})
+	}
+}
+
+func TestSession_Parameters(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+	sesh := MakeSession(0, SessionConfig{
+		Obfuscator:         obfuscator,
+		Unordered:          true,
+		MsgOnWireSizeLimit: 1500,
+	})
+
+	assert.True(t, sesh.IsUnordered())
+	assert.EqualValues(t, EncryptionMethodChaha20Poly1305, sesh.EncryptionMethod())
+	assert.Equal(t, 1500-frameHeaderLength-obfuscator.maxOverhead, sesh.MaxFramePayload())
+
+	sesh = MakeSession(0, SessionConfig{
+		Obfuscator:         obfuscator,
+		MsgOnWireSizeLimit: 1500,
+		PaddingScheme:      PaddingScheme{BucketSize: 64},
+	})
+	assert.False(t, sesh.IsUnordered())
+	assert.Equal(t, 1500-frameHeaderLength-obfuscator.maxOverhead-paddingLenFieldSize, sesh.MaxFramePayload())
+}
+
+func TestSession_Role(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	clientSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Role: RoleClient})
+	serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Role: RoleServer})
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	clientStream, _ := clientSesh.OpenStream()
+	serverStream, _ := serverSesh.OpenStream()
+	assert.Zero(t, clientStream.id%2, "client opened a stream with an odd id")
+	assert.Equal(t, uint32(1), serverStream.id%2, "server opened a stream with an even id")
+	assert.False(t, clientStream.IsServerInitiated())
+	assert.True(t, serverStream.IsServerInitiated())
+
+	_, _ = clientStream.Write([]byte{1})
+	_, _ = serverStream.Write([]byte{2})
+	fromClient, _ := serverSesh.Accept()
+	fromServer, _ := clientSesh.Accept()
+	assert.Equal(t, clientStream.id, fromClient.(*Stream).id)
+	assert.Equal(t, serverStream.id, fromServer.(*Stream).id)
+	assert.False(t, fromClient.(*Stream).IsServerInitiated())
+	assert.True(t, fromServer.(*Stream).IsServerInitiated())
+
+	t.Run("reject remote stream with local parity", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, Role: RoleServer})
+		obfsBuf := make([]byte, obfsBufLen)
+		f := &Frame{
+			101,
+			0,
+			closingNothing,
+			[]byte{1, 2, 3, 4},
+		}
+		n, _ := sesh.Obfs(f, obfsBuf, 0)
+		err := sesh.recvDataFromRemote(obfsBuf[:n], 0)
+		assert.Equal(t, errStreamIDParity, err)
+		_, ok := sesh.streams.Load(f.StreamID)
+		assert.False(t, ok, "rejected stream is stored")
+		assert.Zero(t, sesh.PendingAccepts())
+	})
+}
+
 func TestParallelStreams(t *testing.T) {
 	var sessionKey [32]byte
 	rand.Read(sessionKey[:])
@@ -303,7 +1182,7 @@ func TestParallelStreams(t *testing.T) {
 	seshConfigOrdered.Obfuscator = obfuscator
 	sesh := MakeSession(0, seshConfigOrdered)
 
-	numStreams := acceptBacklog
+	numStreams := defaultAcceptBacklog
 	seqs := make([]*uint64, numStreams)
 	for i := range seqs {
 		seqs[i] = new(uint64)
@@ -336,7 +1215,7 @@ func TestParallelStreams(t *testing.T) {
 			n, _ := sesh.Obfs(frame, obfsBuf, 0)
 			obfsBuf = obfsBuf[0:n]
 
-			err := sesh.recvDataFromRemote(obfsBuf)
+			err := sesh.recvDataFromRemote(obfsBuf, 0)
 			if err != nil {
 				t.Error(err)
 			}
@@ -358,6 +1237,42 @@ func TestParallelStreams(t *testing.T) {
 	}
 }
 
+func TestSession_RangeStreams(t *testing.T) {
+	clientSesh, _, _ := makeSessionPair(1)
+	opened := make(map[uint32]bool)
+	for i := 0; i < 10; i++ {
+		stream, _ := clientSesh.OpenStream()
+		opened[stream.ID()] = true
+	}
+	closed, _ := clientSesh.OpenStream()
+	closed.Close()
+
+	visited := make(map[uint32]bool)
+	clientSesh.RangeStreams(func(stream *Stream) bool {
+		assert.False(t, visited[stream.ID()], "stream visited twice")
+		visited[stream.ID()] = true
+		return true
+	})
+	assert.Equal(t, opened, visited)
+
+	t.Run("early termination", func(t *testing.T) {
+		var count int
+		clientSesh.RangeStreams(func(*Stream) bool {
+			count++
+			return count < 3
+		})
+		assert.Equal(t, 3, count)
+	})
+
+	t.Run("closed session", func(t *testing.T) {
+		clientSesh.Close()
+		clientSesh.RangeStreams(func(*Stream) bool {
+			t.Error("stream of a closed session visited")
+			return true
+		})
+	})
+}
+
 func TestStream_SetReadDeadline(t *testing.T) {
 	var sessionKey [32]byte
 	rand.Read(sessionKey[:])
@@ -374,6 +1289,29 @@ func TestStream_SetReadDeadline(t *testing.T) {
 			}
 		})
 
+		t.Run("deadline persists until reset", func(t *testing.T) {
+			stream, _ := sesh.OpenStream()
+			_ = stream.SetReadDeadline(time.Now().Add(-1 * time.Second))
+			_, err := stream.Read(make([]byte, 1))
+			assert.Equal(t, ErrTimeout, err)
+			_, err = stream.Read(make([]byte, 1))
+			assert.Equal(t, ErrTimeout, err, "read deadline was cleared after it fired")
+
+			_ = stream.SetReadDeadline(time.Time{})
+			done := make(chan struct{})
+			go func() {
+				_, _ = stream.Read(make([]byte, 1))
+				close(done)
+			}()
+			select {
+			case <-done:
+				t.Error("Read returned after read deadline was reset")
+			case <-time.After(100 * time.Millisecond):
+			}
+			_ = stream.SetReadDeadline(time.Now())
+			<-done
+		})
+
 		t.Run("unblock when deadline passed", func(t *testing.T) {
 			stream, _ := sesh.OpenStream()
 
@@ -415,6 +1353,279 @@ func TestSession_timeoutAfter(t *testing.T) {
 	}, 5*seshConfigOrdered.InactivityTimeout, seshConfigOrdered.InactivityTimeout, "session should have timed out")
 }
 
+func TestSession_WriteFrame(t *testing.T) {
+	clientSesh, serverSesh, _ := makeSessionPair(1)
+
+	testPayload := make([]byte, testPayloadLen)
+	rand.Read(testPayload)
+	f := &Frame{
+		StreamID: 1000,
+		Seq:      0,
+		Closing:  closingNothing,
+		Payload:  testPayload,
+	}
+	err := clientSesh.WriteFrame(f)
+	if err != nil {
+		t.Fatalf("failed to write frame: %v", err)
+	}
+
+	stream, err := serverSesh.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint32(1000), stream.(*Stream).id)
+	recvBuf := make([]byte, testPayloadLen)
+	_, err = io.ReadFull(stream, recvBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testPayload, recvBuf)
+
+	managed, _ := clientSesh.OpenStream()
+	f.StreamID = managed.id
+	assert.Equal(t, ErrStreamIDInUse, clientSesh.WriteFrame(f))
+
+	clientSesh.Close()
+	assert.Equal(t, ErrBrokenSession, clientSesh.WriteFrame(f))
+}
+
+func TestSession_Resumption(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	seshConfig := SessionConfig{
+		Obfuscator:       obfuscator,
+		ResumptionWindow: 500 * time.Millisecond,
+	}
+
+	t.Run("resumed within window", func(t *testing.T) {
+		clientSesh := MakeSession(0, seshConfig)
+		serverSesh := MakeSession(0, seshConfig)
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+
+		c.Close()
+		assert.Eventually(t, func() bool {
+			return clientSesh.sb.awaitingResumption() && serverSesh.sb.awaitingResumption()
+		}, time.Second, 10*time.Millisecond, "sessions should be waiting for resumption")
+
+		testData := make([]byte, payloadLen)
+		rand.Read(testData)
+		stream, _ := clientSesh.OpenStream()
+		_, err := stream.Write(testData)
+		if err != nil {
+			t.Fatalf("writing to a session waiting for resumption: %v", err)
+		}
+
+		c, s = connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+
+		serverStream, err := serverSesh.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recvBuf := make([]byte, payloadLen)
+		_, err = io.ReadFull(serverStream, recvBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, testData, recvBuf)
+		assert.False(t, clientSesh.IsClosed())
+		assert.False(t, serverSesh.IsClosed())
+	})
+
+	t.Run("held data flushed in order", func(t *testing.T) {
+		clientSesh := MakeSession(0, seshConfig)
+		serverSesh := MakeSession(0, seshConfig)
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+		c.Close()
+		assert.Eventually(t, func() bool {
+			return clientSesh.sb.awaitingResumption() && serverSesh.sb.awaitingResumption()
+		}, time.Second, 10*time.Millisecond, "sessions should be waiting for resumption")
+
+		testData := make([]byte, 2*payloadLen)
+		rand.Read(testData)
+		stream, _ := clientSesh.OpenStream()
+		_, err := stream.Write(testData[:payloadLen])
+		assert.NoError(t, err)
+
+		// the held data is stuck in the new connection until the gate opens
+		c, s = connutil.AsyncPipe()
+		serverSesh.AddConnection(common.NewTLSConn(s))
+		gated := &gateConn{Conn: common.NewTLSConn(c), gate: make(chan struct{}), writing: make(chan struct{})}
+		go clientSesh.AddConnection(gated)
+		<-gated.writing
+
+		notBlocked := make(chan struct{})
+		go func() {
+			clientSesh.sb.awaitingResumption()
+			<-clientSesh.sb.ready()
+			close(notBlocked)
+		}()
+		select {
+		case <-notBlocked:
+		case <-time.After(time.Second):
+			t.Fatal("the switchboard is blocked while held data is flushed")
+		}
+
+		written := make(chan error)
+		go func() {
+			_, err := stream.Write(testData[payloadLen:])
+			written <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		close(gated.gate)
+		assert.NoError(t, <-written)
+
+		serverStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		recvBuf := make([]byte, len(testData))
+		_, err = io.ReadFull(serverStream, recvBuf)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, recvBuf, "data sent while held data is flushed overtakes it")
+	})
+
+	t.Run("not resumed within window", func(t *testing.T) {
+		sesh := MakeSession(0, seshConfig)
+		c, s := connutil.AsyncPipe()
+		sesh.AddConnection(c)
+		s.Close()
+
+		assert.Eventually(t, func() bool {
+			return sesh.IsClosed()
+		}, 5*seshConfig.ResumptionWindow, 10*time.Millisecond, "session should have closed after resumption window")
+	})
+
+	t.Run("resumption buffer full", func(t *testing.T) {
+		config := seshConfig
+		config.ResumptionBufferSize = payloadLen
+		sesh := MakeSession(0, config)
+		c, _ := connutil.AsyncPipe()
+		sesh.AddConnection(c)
+		c.Close()
+		assert.Eventually(t, sesh.sb.awaitingResumption, time.Second, 10*time.Millisecond)
+
+		stream, _ := sesh.OpenStream()
+		_, err := stream.Write(make([]byte, payloadLen))
+		assert.Equal(t, errResumptionBufferFull, err)
+	})
+}
+
+func TestSession_MaxLifetime(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	seshConfig := SessionConfig{
+		Obfuscator:  obfuscator,
+		MaxLifetime: 100 * time.Millisecond,
+	}
+	sesh := MakeSession(0, seshConfig)
+	sesh.AddConnection(connutil.Discard())
+	stream, _ := sesh.OpenStream()
+
+	assert.Eventually(t, func() bool {
+		return sesh.IsClosed()
+	}, 5*seshConfig.MaxLifetime, seshConfig.MaxLifetime, "session should have closed after its max lifetime")
+	assert.Equal(t, "maximum lifetime reached", sesh.TerminalMsg())
+
+	_, err := stream.Write([]byte{0x00})
+	assert.Equal(t, ErrBrokenStream, err)
+	_, err = sesh.OpenStream()
+	assert.Equal(t, ErrBrokenSession, err)
+}
+
+func TestSession_Done(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+
+	t.Run("inactivity timeout", func(t *testing.T) {
+		obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, InactivityTimeout: 50 * time.Millisecond})
+		sesh.AddConnection(connutil.Discard())
+		select {
+		case <-sesh.Done():
+			assert.Equal(t, "timeout", sesh.TerminalMsg())
+		case <-time.After(time.Second):
+			t.Error("Done not closed after the session timed out")
+		}
+	})
+
+	t.Run("closed by remote", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		select {
+		case <-serverSesh.Done():
+			t.Fatal("Done closed before the session is closed")
+		default:
+		}
+		_ = clientSesh.Close()
+		select {
+		case <-serverSesh.Done():
+		case <-time.After(time.Second):
+			t.Error("Done not closed after the remote closed the session")
+		}
+	})
+
+	t.Run("concurrent closes", func(t *testing.T) {
+		sesh := setupSesh(false, sessionKey, EncryptionMethodPlain)
+		sesh.AddConnection(connutil.Discard())
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(3)
+			go func() { defer wg.Done(); _ = sesh.Close() }()
+			go func() { defer wg.Done(); _ = sesh.passiveClose() }()
+			go func() { defer wg.Done(); sesh.expire() }()
+		}
+		wg.Wait()
+		<-sesh.Done()
+	})
+}
+
+func TestSession_HandshakeTimeout(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	seshConfig := SessionConfig{
+		Obfuscator:        obfuscator,
+		InactivityTimeout: 10 * time.Second,
+		HandshakeTimeout:  100 * time.Millisecond,
+	}
+
+	t.Run("silent remote", func(t *testing.T) {
+		sesh := MakeSession(0, seshConfig)
+		c, _ := connutil.AsyncPipe()
+		sesh.AddConnection(c)
+
+		assert.Eventually(t, func() bool {
+			return sesh.IsClosed()
+		}, 5*seshConfig.HandshakeTimeout, seshConfig.HandshakeTimeout/10, "session should have closed after its handshake timeout")
+		assert.Equal(t, "handshake timeout", sesh.TerminalMsg())
+	})
+
+	t.Run("remote sends a frame", func(t *testing.T) {
+		sesh := MakeSession(0, seshConfig)
+		defer sesh.Close()
+		remote := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+		defer remote.Close()
+		c, s := connutil.AsyncPipe()
+		sesh.AddConnection(common.NewTLSConn(s))
+		remote.AddConnection(common.NewTLSConn(c))
+		stream, _ := remote.OpenStream()
+		_, err := stream.Write([]byte{0x00})
+		assert.NoError(t, err)
+
+		time.Sleep(3 * seshConfig.HandshakeTimeout)
+		assert.False(t, sesh.IsClosed())
+	})
+}
+
 func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 	testPayload := make([]byte, testPayloadLen)
 	rand.Read(testPayload)
@@ -438,7 +1649,7 @@ func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 		b.SetBytes(int64(len(f.Payload)))
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			sesh.recvDataFromRemote(obfsBuf[:n])
+			sesh.recvDataFromRemote(obfsBuf[:n], 0)
 		}
 	})
 
@@ -451,7 +1662,7 @@ func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 		b.SetBytes(int64(len(f.Payload)))
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			sesh.recvDataFromRemote(obfsBuf[:n])
+			sesh.recvDataFromRemote(obfsBuf[:n], 0)
 		}
 	})
 
@@ -464,7 +1675,207 @@ func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 		b.SetBytes(int64(len(f.Payload)))
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			sesh.recvDataFromRemote(obfsBuf[:n])
+			sesh.recvDataFromRemote(obfsBuf[:n], 0)
+		}
+	})
+}
+
+// addrConn is a net.Conn with the addresses given
+type addrConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestSession_Addrs(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	sesh := MakeSession(7, SessionConfig{Obfuscator: obfuscator})
+	assert.Empty(t, sesh.LocalAddrs())
+	assert.Empty(t, sesh.RemoteAddrs())
+
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	local1 := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 50000}
+	local2 := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 50001}
+	for _, local := range []net.Addr{local1, local2} {
+		c, _ := connutil.AsyncPipe()
+		sesh.AddConnection(addrConn{common.NewTLSConn(c), local, remote})
+	}
+	assert.ElementsMatch(t, []net.Addr{local1, local2}, sesh.LocalAddrs())
+	assert.Equal(t, []net.Addr{remote}, sesh.RemoteAddrs(), "remote addresses aren't distinct")
+
+	stream, _ := sesh.OpenStream()
+	assert.Equal(t, StreamAddr{SessionID: 7, StreamID: stream.id}, stream.LocalAddr())
+	assert.Equal(t, stream.LocalAddr(), stream.RemoteAddr())
+	assert.Equal(t, "session 7 stream 1", stream.RemoteAddr().String())
+}
+
+func TestSession_FrameHook(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+
+	type hookedFrame struct {
+		streamID uint32
+		seq      uint64
+		closing  uint8
+		payload  []byte
+	}
+	var hookM sync.Mutex
+	hooked := map[bool][]hookedFrame{}
+	hook := func(f *Frame, outbound bool) {
+		hookM.Lock()
+		defer hookM.Unlock()
+		hooked[outbound] = append(hooked[outbound], hookedFrame{f.StreamID, f.Seq, f.Closing, append([]byte(nil), f.Payload...)})
+	}
+	seshConfig := SessionConfig{
+		Obfuscator:    obfuscator,
+		PaddingScheme: PaddingScheme{BucketSize: 512},
+		FrameHook:     hook,
+	}
+	clientSesh := MakeSession(0, seshConfig)
+	serverSesh := MakeSession(0, seshConfig)
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	testData := []byte{1, 2, 3}
+	stream, _ := clientSesh.OpenStream()
+	_, _ = stream.Write(testData)
+	serverStream, _ := serverSesh.Accept()
+	_, _ = io.ReadFull(serverStream, make([]byte, len(testData)))
+	_ = stream.Close()
+
+	assert.Eventually(t, func() bool {
+		hookM.Lock()
+		defer hookM.Unlock()
+		return len(hooked[false]) == 2
+	}, time.Second, 10*time.Millisecond)
+	hookM.Lock()
+	defer hookM.Unlock()
+	assert.Len(t, hooked[true], 2)
+	assert.Equal(t, hookedFrame{stream.id, 0, closingNothing, testData}, hooked[true][0])
+	assert.Equal(t, hooked[true][0], hooked[false][0], "inbound frame isn't depadded")
+	assert.Equal(t, uint8(closingStream), hooked[false][1].closing)
+}
+
+func TestSession_StreamBuffer(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	const numStreams = 10000
+
+	// heapFootprint returns the heap memory used by a session with numStreams streams that have each received a
+	// little data which hasn't been read
+	heapFootprint := func(unordered bool, initialStreamBuffer int) uint64 {
+		sesh := MakeSession(0, SessionConfig{
+			Obfuscator:          obfuscator,
+			Unordered:           unordered,
+			AcceptBacklog:       numStreams,
+			InitialStreamBuffer: initialStreamBuffer,
+		})
+		obfsBuf := make([]byte, obfsBufLen)
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		for id := uint32(1); id <= numStreams; id++ {
+			n, _ := sesh.Obfs(&Frame{id, 0, closingNothing, []byte{1, 2, 3, 4}}, obfsBuf, 0)
+			err := sesh.recvDataFromRemote(obfsBuf[:n], 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(sesh)
+		return after.HeapAlloc - before.HeapAlloc
+	}
+
+	for _, unordered := range []bool{false, true} {
+		small := heapFootprint(unordered, 0)
+		large := heapFootprint(unordered, 4096)
+		t.Logf("unordered=%v: %v bytes per stream by default, %v bytes with 4096 bytes of initial buffer",
+			unordered, small/numStreams, large/numStreams)
+		assert.Greater(t, large, small+numStreams*3072, "initial buffer isn't allocated")
+		assert.Less(t, small, uint64(numStreams*3072), "too much memory used by default")
+	}
+
+	t.Run("max stream buffer", func(t *testing.T) {
+		const maxStreamBuffer = 1000
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, MaxStreamBuffer: maxStreamBuffer})
+		obfsBuf := make([]byte, obfsBufLen)
+		recvFrame := func(seq uint64) error {
+			n, _ := sesh.Obfs(&Frame{1, seq, closingNothing, make([]byte, maxStreamBuffer)}, obfsBuf, 0)
+			return sesh.recvDataFromRemote(obfsBuf[:n], 0)
+		}
+		// the buffer has to hold more than maxStreamBuffer bytes before it blocks
+		assert.NoError(t, recvFrame(0))
+		assert.NoError(t, recvFrame(1))
+		received := make(chan struct{})
+		go func() {
+			_ = recvFrame(2)
+			close(received)
+		}()
+		select {
+		case <-received:
+			t.Fatal("data is received while the stream buffer is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+		stream, _ := sesh.Accept()
+		_, _ = io.ReadFull(stream, make([]byte, maxStreamBuffer+1))
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("data isn't received after the stream buffer has room")
 		}
 	})
+
+	// data waiting for room in the buffer doesn't stop the stream from being closed or reset
+	for name, end := range map[string]func(*Stream) error{
+		"closed while full": (*Stream).Close,
+		"reset while full":  func(s *Stream) error { return s.Reset(1) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			const maxStreamBuffer = 1000
+			sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, MaxStreamBuffer: maxStreamBuffer})
+			defer sesh.Close()
+			sesh.AddConnection(connutil.Discard())
+			obfsBuf := make([]byte, obfsBufLen)
+			recvFrame := func(seq uint64) error {
+				n, _ := sesh.Obfs(&Frame{1, seq, closingNothing, make([]byte, maxStreamBuffer)}, obfsBuf, 0)
+				return sesh.recvDataFromRemote(obfsBuf[:n], 0)
+			}
+			assert.NoError(t, recvFrame(0))
+			assert.NoError(t, recvFrame(1))
+			received := make(chan struct{})
+			go func() {
+				_ = recvFrame(2)
+				close(received)
+			}()
+			select {
+			case <-received:
+				t.Fatal("data is received while the stream buffer is full")
+			case <-time.After(50 * time.Millisecond):
+			}
+			stream, _ := sesh.Accept()
+
+			ended := make(chan error, 1)
+			go func() { ended <- end(stream.(*Stream)) }()
+			select {
+			case err := <-ended:
+				assert.NoError(t, err)
+			case <-time.After(time.Second):
+				t.Fatal("stream can't be ended while its buffer is full")
+			}
+			select {
+			case <-received:
+			case <-time.After(time.Second):
+				t.Fatal("data waiting for room in the buffer is still waiting once the stream has ended")
+			}
+		})
+	}
 }
@@ -0,0 +1,340 @@
+package multiplex
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/salsa20"
+)
+
+// Several sessions can share one underlying connection through a SharedConn, which gives each session a virtual
+// connection of its own. Every message sent through the shared connection is prefixed with the ID of the session it
+// belongs to, as a big-endian uint32 encrypted with Salsa20:
+//
+//	+------------+---------------------------------------------+
+//	| Session ID |            Data written by the session      |
+//	+------------+---------------------------------------------+
+//	|  4 bytes   |               Variable, >= 8 bytes          |
+//	+------------+---------------------------------------------+
+//
+// Like the header of a frame, the session ID is encrypted under a key both ends share, using the last 8 bytes of the
+// data as nonce. Data written by a session is an obfuscated frame, which always ends in at least 8 bytes that look
+// random, so the session ID doesn't show up on the wire. Each write of a session is one message, so the shared
+// connection must keep message boundaries, returning exactly one message per Read as common.TLSConn does.
+
+const sharedConnIDLen = 4
+
+// sharedConnReadBufSize fits the largest message a common.TLSConn can carry
+const sharedConnReadBufSize = 1 << 16
+
+// sharedConnBacklog is the number of messages a virtual connection holds before reading from the shared connection
+// is blocked
+const sharedConnBacklog = 256
+
+var errSharedConnClosed = errors.New("shared connection is closed")
+var errSharedConnMsgTooShort = errors.New("message is too short to encrypt its session ID")
+
+// SharedConnConfig configures a SharedConn
+type SharedConnConfig struct {
+	// Key encrypts the session IDs messages are tagged with. Both ends of the shared connection must use the same key
+	Key [32]byte
+	// OnNewID, if not nil, is called with the virtual connection of each session ID that hasn't been seen before, so
+	// that a server can make a Session for it and add the connection to it. The message is then delivered through the
+	// virtual connection. Messages of unknown session IDs are dropped if OnNewID is nil
+	OnNewID func(sessionId uint32, conn net.Conn)
+	// Logger receives what the shared connection logs about messages it drops. log.StandardLogger() is used if it's nil
+	Logger Logger
+}
+
+// A SharedConn carries the underlying connections of several sessions over one net.Conn, routing messages received to
+// the virtual connection of the session whose ID they are tagged with
+type SharedConn struct {
+	conn net.Conn
+	key  [32]byte
+	// holds a token while a message is being written to conn. A channel rather than a mutex, so that waiting for it can
+	// be bounded by a write deadline
+	writeTurn chan struct{}
+
+	connsM sync.Mutex
+	conns  map[uint32]*sharedSubConn
+	// called with the virtual connection of each session ID first seen in a message received. nil drops such messages
+	onNewID func(sessionId uint32, conn net.Conn)
+	logger  Logger
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewSharedConn starts routing messages received through conn to virtual connections as config describes. Reading
+// from conn is blocked while the virtual connection a message belongs to has a backlog of messages not yet read
+func NewSharedConn(conn net.Conn, config SharedConnConfig) *SharedConn {
+	sc := &SharedConn{
+		conn:      conn,
+		key:       config.Key,
+		writeTurn: make(chan struct{}, 1),
+		conns:     make(map[uint32]*sharedSubConn),
+		onNewID:   config.OnNewID,
+		logger:    config.Logger,
+		done:      make(chan struct{}),
+	}
+	if sc.logger == nil {
+		sc.logger = log.StandardLogger()
+	}
+	go sc.route()
+	return sc
+}
+
+// Conn returns the virtual connection of sessionId, which can be added to the Session with sessionId. The same
+// connection is returned until it's closed
+func (sc *SharedConn) Conn(sessionId uint32) net.Conn {
+	c, _ := sc.subConn(sessionId)
+	return c
+}
+
+// subConn returns the virtual connection of sessionId, making it if it doesn't exist, in which case created is true
+func (sc *SharedConn) subConn(sessionId uint32) (c *sharedSubConn, created bool) {
+	sc.connsM.Lock()
+	defer sc.connsM.Unlock()
+	if c, ok := sc.conns[sessionId]; ok {
+		return c, false
+	}
+	c = &sharedSubConn{
+		sc:            sc,
+		sessionId:     sessionId,
+		recvCh:        make(chan []byte, sharedConnBacklog),
+		closed:        make(chan struct{}),
+		readDeadline:  makeSharedConnDeadline(),
+		writeDeadline: makeSharedConnDeadline(),
+	}
+	select {
+	case <-sc.done:
+		close(c.closed)
+		return c, true
+	default:
+	}
+	sc.conns[sessionId] = c
+	return c, true
+}
+
+// Close closes the shared connection and all virtual connections
+func (sc *SharedConn) Close() error {
+	var err error
+	sc.closeOnce.Do(func() {
+		close(sc.done)
+		err = sc.conn.Close()
+		sc.connsM.Lock()
+		for _, c := range sc.conns {
+			c.closeOnce.Do(func() { close(c.closed) })
+		}
+		sc.conns = make(map[uint32]*sharedSubConn)
+		sc.connsM.Unlock()
+	})
+	return err
+}
+
+// route reads messages from the shared connection and passes each to the virtual connection of its session ID, until
+// reading fails
+func (sc *SharedConn) route() {
+	defer sc.Close()
+	buf := make([]byte, sharedConnReadBufSize)
+	for {
+		n, err := sc.conn.Read(buf)
+		if err != nil {
+			sc.logger.Debugf("shared connection closed: %v", err)
+			return
+		}
+		if n < sharedConnIDLen+salsa20NonceSize {
+			sc.logger.Debugf("dropping a message of %v bytes too short for a session ID", n)
+			continue
+		}
+		sc.cryptID(buf[:n])
+		sessionId := binary.BigEndian.Uint32(buf)
+
+		var c *sharedSubConn
+		if sc.onNewID == nil {
+			sc.connsM.Lock()
+			c = sc.conns[sessionId]
+			sc.connsM.Unlock()
+			if c == nil {
+				sc.logger.Debugf("dropping a message of unknown session %v", sessionId)
+				continue
+			}
+		} else {
+			var created bool
+			c, created = sc.subConn(sessionId)
+			if created {
+				sc.onNewID(sessionId, c)
+			}
+		}
+
+		msg := make([]byte, n-sharedConnIDLen)
+		copy(msg, buf[sharedConnIDLen:n])
+		select {
+		case c.recvCh <- msg:
+		case <-c.closed:
+		case <-sc.done:
+			return
+		}
+	}
+}
+
+// cryptID encrypts or decrypts the session ID msg starts with, using the last salsa20NonceSize bytes of msg as nonce
+func (sc *SharedConn) cryptID(msg []byte) {
+	nonce := msg[len(msg)-salsa20NonceSize:]
+	salsa20.XORKeyStream(msg[:sharedConnIDLen], msg[:sharedConnIDLen], nonce, &sc.key)
+}
+
+// sharedSubConn is the virtual connection of one session over a SharedConn
+type sharedSubConn struct {
+	sc        *SharedConn
+	sessionId uint32
+
+	recvCh chan []byte
+	// the rest of a message that didn't fit into the buffer of the Read that returned it
+	leftover []byte
+
+	readDeadline  *sharedConnDeadline
+	writeDeadline *sharedConnDeadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *sharedSubConn) Read(b []byte) (int, error) {
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+	select {
+	case msg := <-c.recvCh:
+		n := copy(b, msg)
+		c.leftover = msg[n:]
+		return n, nil
+	case <-c.closed:
+		return 0, io.EOF
+	case <-c.readDeadline.wait():
+		return 0, ErrTimeout
+	}
+}
+
+// Write sends b as one message, which fails with ErrTimeout if the write deadline passes while messages of other
+// virtual connections are being written. If writing to the shared connection itself fails, such as when it's still
+// blocked at the write deadline, part of the message may have been sent, so the shared connection is closed
+func (c *sharedSubConn) Write(b []byte) (int, error) {
+	if len(b) < salsa20NonceSize {
+		return 0, errSharedConnMsgTooShort
+	}
+	select {
+	case <-c.closed:
+		return 0, errSharedConnClosed
+	default:
+	}
+	msg := make([]byte, sharedConnIDLen+len(b))
+	binary.BigEndian.PutUint32(msg, c.sessionId)
+	copy(msg[sharedConnIDLen:], b)
+	c.sc.cryptID(msg)
+
+	select {
+	case c.sc.writeTurn <- struct{}{}:
+	case <-c.closed:
+		return 0, errSharedConnClosed
+	case <-c.writeDeadline.wait():
+		return 0, ErrTimeout
+	}
+	n, err := 0, c.sc.conn.SetWriteDeadline(c.writeDeadline.get())
+	if err == nil {
+		n, err = c.sc.conn.Write(msg)
+	}
+	<-c.sc.writeTurn
+	if err != nil {
+		c.sc.logger.Debugf("failed to write to shared connection: %v", err)
+		c.sc.Close()
+	}
+	n -= sharedConnIDLen
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// Close closes the virtual connection without affecting the shared connection or other virtual connections. Messages
+// later received with its session ID are dropped, or passed to a new virtual connection through onNewID
+func (c *sharedSubConn) Close() error {
+	c.sc.connsM.Lock()
+	if c.sc.conns[c.sessionId] == c {
+		delete(c.sc.conns, c.sessionId)
+	}
+	c.sc.connsM.Unlock()
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *sharedSubConn) LocalAddr() net.Addr                { return c.sc.conn.LocalAddr() }
+func (c *sharedSubConn) RemoteAddr() net.Addr               { return c.sc.conn.RemoteAddr() }
+func (c *sharedSubConn) SetReadDeadline(t time.Time) error  { c.readDeadline.set(t); return nil }
+func (c *sharedSubConn) SetWriteDeadline(t time.Time) error { c.writeDeadline.set(t); return nil }
+
+func (c *sharedSubConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// sharedConnDeadline is a deadline of a virtual connection, which has a channel closed once it passes
+type sharedConnDeadline struct {
+	mu     sync.Mutex
+	t      time.Time
+	timer  *time.Timer
+	passed chan struct{}
+}
+
+func makeSharedConnDeadline() *sharedConnDeadline {
+	return &sharedConnDeadline{passed: make(chan struct{})}
+}
+
+// set sets the deadline to t. A zero t means no deadline
+func (d *sharedConnDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer has fired, so wait for it to close passed before replacing it
+		<-d.passed
+	}
+	d.timer = nil
+	d.t = t
+
+	select {
+	case <-d.passed:
+		d.passed = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return
+	}
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.passed)
+		return
+	}
+	passed := d.passed
+	d.timer = time.AfterFunc(dur, func() { close(passed) })
+}
+
+func (d *sharedConnDeadline) get() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t
+}
+
+// wait returns a channel closed once the deadline passes
+func (d *sharedConnDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.passed
+}
@@ -0,0 +1,214 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedConn(t *testing.T) {
+	// each session has its own key, so that a frame routed to the wrong session fails authentication
+	configs := make(map[uint32]SessionConfig)
+	for _, id := range []uint32{1, 2} {
+		var sessionKey [32]byte
+		rand.Read(sessionKey[:])
+		obfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+		configs[id] = SessionConfig{Obfuscator: obfuscator, Role: RoleClient}
+	}
+
+	var sharedKey [32]byte
+	rand.Read(sharedKey[:])
+
+	c, s := connutil.AsyncPipe()
+	clientShared := NewSharedConn(common.NewTLSConn(c), SharedConnConfig{Key: sharedKey})
+	defer clientShared.Close()
+	serverSessions := make(chan *Session, len(configs))
+	serverShared := NewSharedConn(common.NewTLSConn(s), SharedConnConfig{
+		Key: sharedKey,
+		OnNewID: func(sessionId uint32, conn net.Conn) {
+			sesh := MakeSession(sessionId, configs[sessionId].Derive())
+			sesh.AddConnection(conn)
+			serverSessions <- sesh
+		},
+	})
+	defer serverShared.Close()
+
+	const dataLen = 1 << 18
+	const chunkLen = 1024
+	sent := make(map[uint32][]byte)
+	var wg sync.WaitGroup
+	for id, config := range configs {
+		data := make([]byte, dataLen)
+		rand.Read(data)
+		sent[id] = data
+
+		sesh := MakeSession(id, config)
+		defer sesh.Close()
+		sesh.AddConnection(clientShared.Conn(id))
+		stream, err := sesh.OpenStream()
+		if !assert.NoError(t, err) {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// frames of both sessions are interleaved on the shared connection
+			for i := 0; i < dataLen; i += chunkLen {
+				if _, err := stream.Write(data[i : i+chunkLen]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for range configs {
+		var sesh *Session
+		select {
+		case sesh = <-serverSessions:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no session made for a new session ID")
+		}
+		defer sesh.Close()
+		stream, err := sesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		received := make([]byte, dataLen)
+		_, err = io.ReadFull(stream, received)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(sent[sesh.id], received), "data of session %v corrupted", sesh.id)
+	}
+	wg.Wait()
+
+	t.Run("unknown session dropped", func(t *testing.T) {
+		c, s := connutil.AsyncPipe()
+		sender := NewSharedConn(common.NewTLSConn(c), SharedConnConfig{Key: sharedKey})
+		defer sender.Close()
+		receiver := NewSharedConn(common.NewTLSConn(s), SharedConnConfig{Key: sharedKey})
+		defer receiver.Close()
+		known := receiver.Conn(1)
+
+		_, _ = sender.Conn(2).Write([]byte("session2"))
+		_, _ = sender.Conn(1).Write([]byte("session1"))
+		buf := make([]byte, 10)
+		n, err := known.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("session1"), buf[:n])
+	})
+
+	t.Run("session ID encrypted", func(t *testing.T) {
+		// messages are read off the pipe as written, without a record layer to strip
+		c, s := connutil.AsyncPipe()
+		sender := NewSharedConn(c, SharedConnConfig{Key: sharedKey})
+		defer sender.Close()
+		defer s.Close()
+
+		// identical messages differ in their last 8 bytes only, which must be enough to change the tag
+		msg := make([]byte, 100)
+		tags := make(map[[sharedConnIDLen]byte]bool)
+		buf := make([]byte, sharedConnIDLen+len(msg))
+		for i := 0; i < 10; i++ {
+			rand.Read(msg[len(msg)-salsa20NonceSize:])
+			_, err := sender.Conn(1).Write(msg)
+			if !assert.NoError(t, err) {
+				return
+			}
+			if _, err := io.ReadFull(s, buf); !assert.NoError(t, err) {
+				return
+			}
+			var tag [sharedConnIDLen]byte
+			copy(tag[:], buf)
+			assert.NotEqual(t, [sharedConnIDLen]byte{0, 0, 0, 1}, tag)
+			tags[tag] = true
+		}
+		assert.Len(t, tags, 10)
+	})
+
+	t.Run("message too short", func(t *testing.T) {
+		c, s := connutil.AsyncPipe()
+		sender := NewSharedConn(common.NewTLSConn(c), SharedConnConfig{Key: sharedKey})
+		defer sender.Close()
+		defer s.Close()
+		_, err := sender.Conn(1).Write(make([]byte, salsa20NonceSize-1))
+		assert.Equal(t, errSharedConnMsgTooShort, err)
+	})
+
+	t.Run("read deadline", func(t *testing.T) {
+		c, s := connutil.AsyncPipe()
+		receiver := NewSharedConn(common.NewTLSConn(c), SharedConnConfig{Key: sharedKey})
+		defer receiver.Close()
+		defer s.Close()
+		conn := receiver.Conn(1)
+
+		_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 10))
+		assert.Equal(t, ErrTimeout, err)
+
+		// a deadline moved on while Read is blocked applies to it
+		_ = conn.SetReadDeadline(time.Now().Add(time.Hour))
+		readErr := make(chan error)
+		go func() {
+			_, err := conn.Read(make([]byte, 10))
+			readErr <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		_ = conn.SetReadDeadline(time.Now())
+		select {
+		case err := <-readErr:
+			assert.Equal(t, ErrTimeout, err)
+		case <-time.After(time.Second):
+			t.Fatal("Read not unblocked by a deadline set while blocked")
+		}
+
+		_ = conn.SetReadDeadline(time.Time{})
+		sender := NewSharedConn(common.NewTLSConn(s), SharedConnConfig{Key: sharedKey})
+		_, _ = sender.Conn(1).Write([]byte("session1"))
+		buf := make([]byte, 10)
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("session1"), buf[:n])
+	})
+
+	t.Run("write deadline", func(t *testing.T) {
+		// nothing reads from s, so the first write blocks on the shared connection and the second waits for it
+		c, s := net.Pipe()
+		defer s.Close()
+		sender := NewSharedConn(common.NewTLSConn(c), SharedConnConfig{Key: sharedKey})
+		defer sender.Close()
+
+		conn1, conn2 := sender.Conn(1), sender.Conn(2)
+		_ = conn1.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+		_ = conn2.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		errs := make(chan error, 2)
+		go func() {
+			_, err := conn1.Write([]byte("session1"))
+			errs <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+		go func() {
+			_, err := conn2.Write([]byte("session2"))
+			errs <- err
+		}()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errs:
+				assert.True(t, timedOut(err, time.Now()), "%v", err)
+			case <-time.After(time.Second):
+				t.Fatal("Write not unblocked by its deadline")
+			}
+		}
+		// the timed out write may have been partly sent, so the shared connection can't be used anymore
+		_, err := conn1.Write([]byte("session1"))
+		assert.Error(t, err)
+	})
+}
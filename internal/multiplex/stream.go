@@ -2,16 +2,46 @@ package multiplex
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
-	"time"
-
-	log "github.com/sirupsen/logrus"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var ErrBrokenStream = errors.New("broken stream")
+var errEmptyMessage = errors.New("message cannot be empty")
+
+// the length of the error code at the start of the payload of a reset frame
+const resetCodeLen = 4
+
+// StreamResetError is returned by reads and writes of a stream after the remote has reset it with Stream.Reset.
+// Data received but not yet read when the reset arrived is discarded
+type StreamResetError struct {
+	// Code is the error code given by the remote
+	Code uint32
+}
+
+func (e *StreamResetError) Error() string {
+	return fmt.Sprintf("stream reset by remote with code %v", e.Code)
+}
+
+// CloseInitiator tells which end closed a stream
+type CloseInitiator uint32
+
+const (
+	// CloseInitiatorNone is for a stream that hasn't been closed
+	CloseInitiatorNone CloseInitiator = iota
+	// CloseInitiatorLocal is for a stream closed or reset by this end, including once it has been idle for too long
+	CloseInitiatorLocal
+	// CloseInitiatorRemote is for a stream closed or reset by the remote, or closed because the remote is going away
+	// without having processed it
+	CloseInitiatorRemote
+	// CloseInitiatorSession is for a stream closed because its session was closed
+	CloseInitiatorSession
+)
 
 // Stream implements net.Conn. It represents an optionally-ordered, full-duplex, self-contained connection.
 // If the session it belongs to runs in ordered mode, it provides ordering guarantee regardless of the underlying
@@ -30,8 +60,12 @@ type Stream struct {
 	writingM    sync.Mutex
 	nextSendSeq uint64
 
-	// atomic
+	// atomic. Only set through markClosed
 	closed uint32
+	// atomic. The CloseInitiator given to markClosed
+	closeInitiator uint32
+	// closed once the stream is closed
+	closedCh chan struct{}
 
 	// lazy allocation for obfsBuf. This is desirable because obfsBuf is only used when data is sent from
 	// the stream (through Write or ReadFrom). Some streams never send data so eager allocation will waste
@@ -40,6 +74,23 @@ type Stream struct {
 	// obfuscation happens in this buffer
 	obfsBuf []byte
 
+	// data written but held back to be sent in fewer frames, when session.StreamWriteBuffer is set. Guarded by
+	// writingM
+	writeBuf []byte
+	// sends writeBuf once session.StreamWriteDelay has passed since data was first held in it. nil while it's empty
+	flushTimer *time.Timer
+	// set by SetNoDelay to send each write straight away regardless of session.StreamWriteBuffer. Guarded by writingM
+	noDelay bool
+
+	// resets the stream if it isn't accepted within session.AcceptTimeout. Guarded by the session's acceptQueue
+	acceptTimer *time.Timer
+
+	// priorityM guards priorityWrites, the writes of WritePriority waiting to be sent in order
+	priorityM      sync.Mutex
+	priorityWrites []*priorityWrite
+	// set while priorityWrites are being sent, so that they aren't overtaken by those after them. Guarded by writingM
+	sendingPriority bool
+
 	// When we want order guarantee (i.e. session.Unordered is false),
 	// we assign each stream a fixed underlying connection.
 	// If the underlying connections the session uses provide ordering guarantee (most likely TCP),
@@ -48,35 +99,195 @@ type Stream struct {
 	// This is not used in unordered connection mode
 	assignedConnId uint32
 
+	// atomic. The id of the connection the last frame of this stream was received from
+	lastConnId uint32
+
+	// atomic. The amount of data received but not yet read, counted towards session.MaxBufferedBytes
+	unread int64
+
+	// []byte attached with Session.OpenStreamWithMeta
+	meta atomic.Value
+
+	// nil unless session.ReplayProtection is set in an unordered session
+	replay *replayWindow
+
 	readFromTimeout time.Duration
+
+	// atomic. Set through SetIdleTimeout
+	idleTimeout int64
+	// atomic. The time, in unix nanoseconds, of the last data sent, received or read, only kept while idleTimeout is
+	// set
+	lastActivity int64
+	// idleM guards idleGen, which is changed by each SetIdleTimeout call so that timers it has replaced do nothing
+	idleM   sync.Mutex
+	idleGen uint64
+
+	// frames sent that the client hasn't acknowledged. Only kept by servers with session.ResumableStreams
+	retention *retention
+	// for a client's stream made by MakeSessionFromToken, the first frame that hadn't been read in full, and how many
+	// bytes of it had been read, which are skipped when it's received again
+	resumeSeq  uint64
+	resumeSkip uint64
+	// atomic. The sequence number last acknowledged to the server
+	ackedSeq uint64
+
+	// *StreamResetError set once the remote has reset the stream
+	resetErr atomic.Value
 }
 
 func makeStream(sesh *Session, id uint32) *Stream {
-	var recvBuf recvBuffer
+	stream := &Stream{
+		id:       id,
+		session:  sesh,
+		closedCh: make(chan struct{}),
+	}
+
 	if sesh.Unordered {
-		recvBuf = NewDatagramBufferedPipe()
+		recvBuf := NewDatagramBufferedPipe()
+		recvBuf.initialSize = sesh.InitialStreamBuffer
+		recvBuf.sizeLimit = sesh.MaxStreamBuffer
+		recvBuf.dropLimit = sesh.UnorderedBufferLimit
+		recvBuf.dropPolicy = sesh.DropPolicy
+		recvBuf.onDrop = stream.datagramsDropped
+		stream.recvBuf = recvBuf
+		if sesh.ReplayProtection {
+			stream.replay = new(replayWindow)
+		}
 	} else {
-		recvBuf = NewStreamBuffer()
+		recvBuf := NewStreamBuffer()
+		recvBuf.buf.initialSize = sesh.InitialStreamBuffer
+		recvBuf.buf.sizeLimit = sesh.MaxStreamBuffer
+		recvBuf.reorderTimeout = sesh.ReorderTimeout
+		recvBuf.skipGaps = sesh.ReorderSkip
+		recvBuf.onReorderTimeout = stream.reorderTimedOut
+		recvBuf.onUnblocked = sesh.addHeadOfLineBlocked
+		recvBuf.strict = sesh.StrictSequencing
+		stream.recvBuf = recvBuf
+		if sesh.ResumableStreams {
+			switch sesh.Role {
+			case RoleServer:
+				stream.retention = new(retention)
+			case RoleClient:
+				recvBuf.trackDelivered = true
+			}
+		}
 	}
 
-	stream := &Stream{
-		id:      id,
-		session: sesh,
-		recvBuf: recvBuf,
+	if sesh.isLocalStreamID(id) {
+		stream.nextSendSeq = sesh.seqBase
+	} else if seq := atomic.LoadUint64(&sesh.remoteSeqBase); seq != 0 {
+		recvBuf := stream.recvBuf.(*streamBuffer)
+		recvBuf.nextRecvSeq, recvBuf.lateFloor = seq, seq
 	}
 
+	if sesh.StreamIdleTimeout > 0 {
+		stream.SetIdleTimeout(sesh.StreamIdleTimeout)
+	}
 	return stream
 }
 
+// ID returns the id of the stream, which is the same on both ends and unique within its session
+func (s *Stream) ID() uint32 { return s.id }
+
+// IsServerInitiated returns whether the stream was opened by the end with RoleServer. It always returns false if the
+// session has RoleUnspecified, as streams opened by either end can't be told apart
+func (s *Stream) IsServerInitiated() bool {
+	return s.session.Role != RoleUnspecified && s.id%2 == 1
+}
+
+// LastConnID returns the id of the underlying connection, as in ConnInfo.ID, that the most recently received frame of
+// this stream arrived on. This helps diagnose reordering and path asymmetry in sessions with multiple connections.
+// As frames are received ahead of being read, it only tells which connection delivered the data just read if reads
+// keep up with the data received. It returns 0 if no frame has been received
+func (s *Stream) LastConnID() uint32 { return atomic.LoadUint32(&s.lastConnId) }
+
 func (s *Stream) isClosed() bool { return atomic.LoadUint32(&s.closed) == 1 }
 
+// trackingReads returns whether how far the stream has been read is tracked, so that it can be resumed from there
+func (s *Stream) trackingReads() bool {
+	sb, ok := s.recvBuf.(*streamBuffer)
+	return ok && sb.trackDelivered
+}
+
+// markClosed marks the stream as closed by initiator and closes the channel returned by Closed. It returns false if
+// the stream has already been closed, so that only one caller tears the stream down
+func (s *Stream) markClosed(initiator CloseInitiator) bool {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return false
+	}
+	atomic.StoreUint32(&s.closeInitiator, uint32(initiator))
+	close(s.closedCh)
+	return true
+}
+
+// CloseInitiator returns what closed the stream, or CloseInitiatorNone if it's still open
+func (s *Stream) CloseInitiator() CloseInitiator {
+	return CloseInitiator(atomic.LoadUint32(&s.closeInitiator))
+}
+
+// brokenErr is the error returned by writes to a closed stream: the remote's reset if it has reset it, or
+// ErrBrokenStream otherwise
+func (s *Stream) brokenErr() error {
+	if resetErr, ok := s.resetErr.Load().(*StreamResetError); ok {
+		return resetErr
+	}
+	return ErrBrokenStream
+}
+
+// Closed returns a channel that is closed once the stream is closed, whether by Close, by the remote, or with the
+// session, so that the end of a stream can be waited for in a select. Data received before then may still be read
+func (s *Stream) Closed() <-chan struct{} { return s.closedCh }
+
 // receive a readily deobfuscated Frame so its payload can later be Read
-func (s *Stream) recvFrame(frame Frame) error {
+func (s *Stream) recvFrame(frame Frame, connId uint32) error {
+	if s.replay != nil && !s.replay.accept(frame.Seq) {
+		s.session.Logger.Debugf("dropped replayed frame %v of stream %v", frame.Seq, s.id)
+		return nil
+	}
+	atomic.StoreUint32(&s.lastConnId, connId)
+	s.markActive()
+	if frame.Closing == closingReset {
+		// a reset takes effect as soon as it arrives, even if frames sent before it are missing
+		return s.recvReset(frame.Payload)
+	}
+	if frame.Closing == streamMeta {
+		s.storeMeta(frame.Payload)
+		if s.session.Unordered {
+			return nil
+		}
+		// it still takes up a sequence number, so that data sent after it can't be read before it has arrived
+		frame.Closing = closingNothing
+		frame.Payload = nil
+	}
+	if s.resumeSkip > 0 && frame.Seq == s.resumeSeq && carriesData(frame.Closing) {
+		// read before the stream was resumed
+		skip := s.resumeSkip
+		if skip > uint64(len(frame.Payload)) {
+			skip = uint64(len(frame.Payload))
+		}
+		frame.Payload = frame.Payload[skip:]
+	}
+	countBuffered := s.session.MaxBufferedBytes > 0 && carriesData(frame.Closing)
+	if countBuffered {
+		// counted before the payload is written to recvBuf, so that it can't be read before it's counted
+		atomic.AddInt64(&s.unread, int64(len(frame.Payload)))
+		if err := s.session.holdBuffered(len(frame.Payload)); err != nil {
+			return err
+		}
+	}
 	toBeClosed, err := s.recvBuf.Write(frame)
+	if err != nil && countBuffered {
+		s.releaseBuffered(len(frame.Payload))
+	}
+	if err == ErrSequenceViolation {
+		s.session.SetTerminalMsg(fmt.Sprintf("stream %v received frame %v again", s.id, frame.Seq))
+		s.session.passiveClose()
+		return err
+	}
 	if toBeClosed {
 		err = s.passiveClose()
 		if errors.Is(err, errRepeatStreamClosing) {
-			log.Debug(err)
+			s.session.Logger.Debugf("%v", err)
 			return nil
 		}
 		return err
@@ -84,7 +295,94 @@ func (s *Stream) recvFrame(frame Frame) error {
 	return err
 }
 
-// Read implements io.Read
+// Meta returns the metadata attached to the stream when it was opened with Session.OpenStreamWithMeta, or nil if
+// there is none. In ordered sessions, it is available before any data of the stream can be read. In unordered
+// sessions with multiple connections, data may arrive before it does
+func (s *Stream) Meta() []byte {
+	meta, _ := s.meta.Load().([]byte)
+	return meta
+}
+
+func (s *Stream) storeMeta(meta []byte) {
+	// meta may be in a buffer reused by the caller
+	s.meta.Store(append([]byte(nil), meta...))
+}
+
+// sendMeta sends meta in the first frame of the stream
+func (s *Stream) sendMeta(meta []byte) error {
+	s.writingM.Lock()
+	defer s.writingM.Unlock()
+
+	s.storeMeta(meta)
+	if s.obfsBuf == nil {
+		s.obfsBuf = make([]byte, s.session.StreamSendBufferSize)
+	}
+	f := &Frame{
+		StreamID: s.id,
+		Seq:      s.nextSendSeq,
+		Closing:  streamMeta,
+		Payload:  meta,
+	}
+	s.nextSendSeq++
+	return s.obfuscateAndSend(f, 0)
+}
+
+// releaseBuffered stops counting up to n bytes of data received towards session.MaxBufferedBytes
+func (s *Stream) releaseBuffered(n int) {
+	if s.session.MaxBufferedBytes <= 0 {
+		return
+	}
+	for {
+		unread := atomic.LoadInt64(&s.unread)
+		released := int64(n)
+		if released > unread {
+			released = unread
+		}
+		if atomic.CompareAndSwapInt64(&s.unread, unread, unread-released) {
+			atomic.AddInt64(&s.session.bufferedBytes, -released)
+			return
+		}
+	}
+}
+
+// releasingWriter releases data written through it from being counted towards session.MaxBufferedBytes
+type releasingWriter struct {
+	io.Writer
+	s *Stream
+}
+
+func (w releasingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.s.releaseBuffered(n)
+	return n, err
+}
+
+// called by an unordered stream's recvBuf when it has dropped datagrams to stay within session.UnorderedBufferLimit
+func (s *Stream) datagramsDropped(datagrams int, bytes int) {
+	s.session.Logger.Tracef("stream %v dropped %v datagrams", s.id, datagrams)
+	s.releaseBuffered(bytes)
+	if s.session.OnDrop != nil {
+		s.session.OnDrop(s.id, datagrams)
+	}
+}
+
+// called by an ordered stream's recvBuf when it has given up waiting for missing frames
+func (s *Stream) reorderTimedOut(firstMissing uint64, numMissing uint64, toBeClosed bool) {
+	s.session.Logger.Debugf("stream %v gave up waiting for %v frames from seq %v", s.id, numMissing, firstMissing)
+	if s.session.ReorderSkip && s.session.OnReorderGap != nil {
+		s.session.OnReorderGap(s.id, firstMissing, numMissing)
+	}
+	if toBeClosed {
+		err := s.passiveClose()
+		if err != nil && !errors.Is(err, errRepeatStreamClosing) {
+			s.session.Logger.Debugf("%v", err)
+		}
+	}
+}
+
+// Read implements io.Read. In an ordered session, it reads as much of the data received as fits in buf, however many
+// frames it came in. In an unordered session, it reads at most one frame's payload. Either way, data received before
+// the stream was closed gracefully can still be read, after which Read fails with ErrBrokenStream
 func (s *Stream) Read(buf []byte) (n int, err error) {
 	//log.Tracef("attempting to read from stream %v", s.id)
 	if len(buf) == 0 {
@@ -92,33 +390,49 @@ func (s *Stream) Read(buf []byte) (n int, err error) {
 	}
 
 	n, err = s.recvBuf.Read(buf)
-	log.Tracef("%v read from stream %v with err %v", n, s.id, err)
+	s.releaseBuffered(n)
+	if n > 0 {
+		s.markActive()
+	}
+	s.session.Logger.Tracef("%v read from stream %v with err %v", n, s.id, err)
 	if err == io.EOF {
 		return n, ErrBrokenStream
 	}
 	return
 }
 
+// Buffered returns the number of bytes received on the stream but not yet read. Data received out of order isn't
+// counted until the frames before it have arrived. It stays accurate after the stream is closed, until the data left
+// in it has been read, and is zero once the stream has been reset
+func (s *Stream) Buffered() int { return s.recvBuf.buffered() }
+
 // WriteTo continuously write data Stream has received into the writer w.
 func (s *Stream) WriteTo(w io.Writer) (int64, error) {
 	// will keep writing until the underlying buffer is closed
+	if s.session.MaxBufferedBytes > 0 {
+		w = releasingWriter{w, s}
+	}
 	n, err := s.recvBuf.WriteTo(w)
-	log.Tracef("%v read from stream %v with err %v", n, s.id, err)
+	s.session.Logger.Tracef("%v read from stream %v with err %v", n, s.id, err)
 	if err == io.EOF {
 		return n, ErrBrokenStream
 	}
+	if resetErr, ok := err.(*StreamResetError); ok {
+		return n, resetErr
+	}
 	return n, nil
 }
 
 func (s *Stream) obfuscateAndSend(f *Frame, payloadOffsetInObfsBuf int) error {
+	s.retain(f)
 	var cipherTextLen int
-	cipherTextLen, err := s.session.Obfs(f, s.obfsBuf, payloadOffsetInObfsBuf)
+	cipherTextLen, err := s.session.obfs(f, s.obfsBuf, payloadOffsetInObfsBuf)
 	if err != nil {
 		return err
 	}
 
 	_, err = s.session.sb.send(s.obfsBuf[:cipherTextLen], &s.assignedConnId)
-	log.Tracef("%v sent to remote through stream %v with err %v. seq: %v", len(f.Payload), s.id, err, f.Seq)
+	s.session.Logger.Tracef("%v sent to remote through stream %v with err %v. seq: %v", len(f.Payload), s.id, err, f.Seq)
 	if err != nil {
 		if err == errBrokenSwitchboard {
 			s.session.SetTerminalMsg(err.Error())
@@ -126,23 +440,196 @@ func (s *Stream) obfuscateAndSend(f *Frame, payloadOffsetInObfsBuf int) error {
 		}
 		return err
 	}
+	s.markActive()
 	return nil
 }
 
-// Write implements io.Write
+// Write implements io.Write. It's safe to call concurrently: each call sends all of in before another call sends
+// anything, so the data of concurrent calls is never interleaved, though which call goes first is unspecified. Only
+// WritePriority can cut in
 func (s *Stream) Write(in []byte) (n int, err error) {
+	return s.write(in, false)
+}
+
+// priorityWrite is data written with WritePriority
+type priorityWrite struct {
+	data []byte
+	// receives the result of sending data
+	done chan error
+}
+
+// WritePriority writes b ahead of data written before it but not yet sent, which is the rest of a Write in progress
+// and data held back by StreamWriteBuffer. A Write in progress is cut into between two of its frames. Data already
+// sent stays ahead of b, and data written with WritePriority is sent in the order it's written. The remote reads b in
+// line with the rest of the data, so the application must be able to tell it apart, such as with its own framing.
+// It returns once the Write it cuts into is done. This is meant for in-band control messages in a stream carrying bulk
+// data
+func (s *Stream) WritePriority(b []byte) (n int, err error) {
+	if s.isClosed() {
+		return 0, s.brokenErr()
+	}
+	w := &priorityWrite{data: b, done: make(chan error, 1)}
+	s.priorityM.Lock()
+	s.priorityWrites = append(s.priorityWrites, w)
+	s.priorityM.Unlock()
+	// sent by whichever comes first: a Write in progress between its frames, or this once the Write is done. Like
+	// sendHeldWrites, it's drained in line rather than by a goroutine of its own
+	s.writingM.Lock()
+	_ = s.sendPriorityWrites()
+	s.writingM.Unlock()
+	if err = <-w.done; err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sendPriorityWrites sends the data of WritePriority waiting to be sent. writingM must be held by the caller
+func (s *Stream) sendPriorityWrites() error {
+	if s.sendingPriority {
+		return nil
+	}
+	s.sendingPriority = true
+	defer func() { s.sendingPriority = false }()
+	for {
+		s.priorityM.Lock()
+		if len(s.priorityWrites) == 0 {
+			s.priorityM.Unlock()
+			return nil
+		}
+		w := s.priorityWrites[0]
+		s.priorityWrites = s.priorityWrites[1:]
+		s.priorityM.Unlock()
+
+		var err error
+		if s.isClosed() {
+			err = s.brokenErr()
+		} else {
+			_, err = s.sendData(w.data, false)
+		}
+		w.done <- err
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// WriteMessage writes msg as a whole message, which the remote reads in one piece with ReadMessage. This allows a
+// stream to carry a series of requests and responses without the cost of opening a new stream for each of them.
+// msg must not be empty. The remote must support messages, which can be checked with PeerSupports(CapMessages)
+func (s *Stream) WriteMessage(msg []byte) error {
+	if len(msg) == 0 {
+		return errEmptyMessage
+	}
+	_, err := s.write(msg, true)
+	return err
+}
+
+// ReadMessage blocks until the next whole message written by the remote with WriteMessage has arrived and returns
+// it. Messages arrive in the order they were written. A message includes any data written by the remote with Write
+// since the previous message, but not data already read with Read or WriteTo. It returns io.ErrUnexpectedEOF if the
+// stream is closed in the middle of a message
+func (s *Stream) ReadMessage() ([]byte, error) {
+	msg, err := s.recvBuf.readMessage()
+	s.releaseBuffered(len(msg))
+	if err == io.EOF {
+		return nil, ErrBrokenStream
+	}
+	return msg, err
+}
+
+// write sends in, ending a message with its last frame if endOfMessage is true
+func (s *Stream) write(in []byte, endOfMessage bool) (n int, err error) {
 	s.writingM.Lock()
 	defer s.writingM.Unlock()
 	if s.isClosed() {
-		return 0, ErrBrokenStream
+		return 0, s.brokenErr()
 	}
 
+	if s.session.StreamWriteBuffer > 0 && !s.session.Unordered && !s.noDelay {
+		if !endOfMessage && len(s.writeBuf)+len(in) <= s.session.StreamWriteBuffer {
+			s.holdWrite(in)
+			if len(s.writeBuf) == s.session.StreamWriteBuffer {
+				if err = s.sendHeldWrites(); err != nil {
+					return 0, err
+				}
+			}
+			return len(in), nil
+		}
+		if err = s.sendHeldWrites(); err != nil {
+			return 0, err
+		}
+		if !endOfMessage && len(in) < s.session.StreamWriteBuffer {
+			s.holdWrite(in)
+			return len(in), nil
+		}
+	}
+	return s.sendData(in, endOfMessage)
+}
+
+// SetNoDelay sets whether each write is sent straight away, like TCP_NODELAY. It overrides the session's
+// StreamWriteBuffer for this stream only, so that interactive streams don't wait up to StreamWriteDelay for their
+// writes to be sent while bulk streams of the same session still have theirs coalesced. Turning it on sends any data
+// already held back. Without StreamWriteBuffer, writes are always sent straight away and this has no effect
+func (s *Stream) SetNoDelay(noDelay bool) error {
+	s.writingM.Lock()
+	defer s.writingM.Unlock()
+	s.noDelay = noDelay
+	if noDelay && !s.isClosed() {
+		return s.sendHeldWrites()
+	}
+	return nil
+}
+
+// holdWrite holds in back to be sent with later writes. s.writingM must be held by the caller
+func (s *Stream) holdWrite(in []byte) {
+	if s.writeBuf == nil {
+		s.writeBuf = make([]byte, 0, s.session.StreamWriteBuffer)
+	}
+	s.writeBuf = append(s.writeBuf, in...)
+	if s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(s.session.StreamWriteDelay, s.flushHeldWrites)
+	}
+}
+
+// sendHeldWrites sends data held back by holdWrite. s.writingM must be held by the caller
+func (s *Stream) sendHeldWrites() error {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if len(s.writeBuf) == 0 {
+		return nil
+	}
+	_, err := s.sendData(s.writeBuf, false)
+	s.writeBuf = s.writeBuf[:0]
+	return err
+}
+
+// flushHeldWrites sends data held back by holdWrite once StreamWriteDelay has passed
+func (s *Stream) flushHeldWrites() {
+	s.writingM.Lock()
+	defer s.writingM.Unlock()
+	if s.isClosed() {
+		return
+	}
+	if err := s.sendHeldWrites(); err != nil {
+		s.session.Logger.Debugf("failed to send data held back in stream %v: %v", s.id, err)
+	}
+}
+
+// sendData splits in into frames and sends them. s.writingM must be held by the caller
+func (s *Stream) sendData(in []byte, endOfMessage bool) (n int, err error) {
 	if s.obfsBuf == nil {
 		s.obfsBuf = make([]byte, s.session.StreamSendBufferSize)
 	}
+	unitLimit := s.session.frameUnitLimit()
 	for n < len(in) {
+		// between frames, so that data written with WritePriority overtakes the rest of in
+		if err = s.sendPriorityWrites(); err != nil {
+			return
+		}
 		var framePayload []byte
-		if len(in)-n <= s.session.maxStreamUnitWrite {
+		if len(in)-n <= unitLimit {
 			// if we can fit remaining data of in into one frame
 			framePayload = in[n:]
 		} else {
@@ -152,7 +639,7 @@ func (s *Stream) Write(in []byte) (n int, err error) {
 				err = io.ErrShortBuffer
 				return
 			}
-			framePayload = in[n : s.session.maxStreamUnitWrite+n]
+			framePayload = in[n : unitLimit+n]
 		}
 		f := &Frame{
 			StreamID: s.id,
@@ -160,6 +647,9 @@ func (s *Stream) Write(in []byte) (n int, err error) {
 			Closing:  closingNothing,
 			Payload:  framePayload,
 		}
+		if endOfMessage && n+len(framePayload) == len(in) {
+			f.Closing = messageEnd
+		}
 		s.nextSendSeq++
 		err = s.obfuscateAndSend(f, 0)
 		if err != nil {
@@ -173,34 +663,31 @@ func (s *Stream) Write(in []byte) (n int, err error) {
 // ReadFrom continuously read data from r and send it off, until either r returns error or nothing has been read
 // for readFromTimeout amount of time
 func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
-	if s.obfsBuf == nil {
-		s.obfsBuf = make([]byte, s.session.StreamSendBufferSize)
-	}
+	// read into a buffer of its own rather than obfsBuf, which data held back by StreamWriteBuffer and written with
+	// WritePriority is obfuscated in, possibly by the timer of StreamWriteDelay while r.Read is blocking
+	buf := make([]byte, s.session.StreamSendBufferSize)
 	for {
 		if s.readFromTimeout != 0 {
 			if rder, ok := r.(net.Conn); !ok {
-				log.Warn("ReadFrom timeout is set but reader doesn't implement SetReadDeadline")
+				s.session.Logger.Warnf("ReadFrom timeout is set but reader doesn't implement SetReadDeadline")
 			} else {
 				rder.SetReadDeadline(time.Now().Add(s.readFromTimeout))
 			}
 		}
-		read, er := r.Read(s.obfsBuf[frameHeaderLength : frameHeaderLength+s.session.maxStreamUnitWrite])
+		read, er := r.Read(buf[:s.session.frameUnitLimit()])
 		if er != nil {
 			return n, er
 		}
 		if s.isClosed() {
-			return n, ErrBrokenStream
+			return n, s.brokenErr()
 		}
 
 		s.writingM.Lock()
-		f := &Frame{
-			StreamID: s.id,
-			Seq:      s.nextSendSeq,
-			Closing:  closingNothing,
-			Payload:  s.obfsBuf[frameHeaderLength : frameHeaderLength+read],
+		if err = s.sendHeldWrites(); err != nil {
+			s.writingM.Unlock()
+			return
 		}
-		s.nextSendSeq++
-		err = s.obfuscateAndSend(f, frameHeaderLength)
+		_, err = s.sendData(buf[:read], false)
 		s.writingM.Unlock()
 
 		if err != nil {
@@ -210,6 +697,22 @@ func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 }
 
+// Flush blocks until all data previously written to the stream has been handed to an underlying connection. Data held
+// back by StreamWriteBuffer is sent straight away. Otherwise, Write sends frames synchronously, so this only waits for
+// writes in progress and for data held while the session is waiting to be resumed. The latter is bounded by the
+// session's ResumptionWindow
+func (s *Stream) Flush() error {
+	s.writingM.Lock()
+	defer s.writingM.Unlock()
+	if s.isClosed() {
+		return s.brokenErr()
+	}
+	if err := s.sendHeldWrites(); err != nil {
+		return err
+	}
+	return s.session.sb.waitPending()
+}
+
 func (s *Stream) passiveClose() error {
 	return s.session.closeStream(s, false)
 }
@@ -219,16 +722,138 @@ func (s *Stream) Close() error {
 	s.writingM.Lock()
 	defer s.writingM.Unlock()
 
+	if !s.isClosed() {
+		if err := s.sendHeldWrites(); err != nil {
+			return err
+		}
+	}
 	return s.session.closeStream(s, true)
 }
 
-func (s *Stream) LocalAddr() net.Addr  { return s.session.addrs.Load().([]net.Addr)[0] }
-func (s *Stream) RemoteAddr() net.Addr { return s.session.addrs.Load().([]net.Addr)[1] }
+// Reset abruptly closes the stream, like a TCP RST. Unlike Close, which lets the remote read all data sent before it,
+// the remote discards data it hasn't read yet, and its reads and writes return a *StreamResetError with code. Data received
+// locally but not yet read is discarded too. This is useful to relay the failure of an upstream connection.
+// A remote that doesn't support resets takes it as a normal Close
+func (s *Stream) Reset(code uint32) error {
+	s.writingM.Lock()
+	defer s.writingM.Unlock()
+
+	// data held back is discarded like everything else
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	s.writeBuf = nil
+	payload := append(make([]byte, resetCodeLen), genRandomPadding()...)
+	putU32(payload, code)
+	err := s.session.endStream(s, true, closingReset, payload)
+	s.recvBuf.reset(nil)
+	return err
+}
+
+func (s *Stream) recvReset(payload []byte) error {
+	var code uint32
+	if len(payload) >= resetCodeLen {
+		code = u32(payload)
+	}
+	s.session.Logger.Debugf("stream %v reset by remote with code %v", s.id, code)
+	resetErr := &StreamResetError{Code: code}
+	s.resetErr.Store(resetErr)
+	s.recvBuf.reset(resetErr)
+	s.releaseBuffered(math.MaxInt64)
+	err := s.passiveClose()
+	if errors.Is(err, errRepeatStreamClosing) {
+		s.session.Logger.Debugf("%v", err)
+		return nil
+	}
+	return err
+}
+
+// StreamAddr identifies a stream by the session it belongs to and its ID. As a stream's data may go through any of the
+// session's underlying connections, it has no network address of its own. Session.LocalAddrs and Session.RemoteAddrs
+// give the addresses of the underlying connections
+type StreamAddr struct {
+	SessionID uint32
+	StreamID  uint32
+}
+
+func (a StreamAddr) Network() string { return "cloak" }
+func (a StreamAddr) String() string {
+	return fmt.Sprintf("session %v stream %v", a.SessionID, a.StreamID)
+}
+
+// LocalAddr returns the StreamAddr of the stream
+func (s *Stream) LocalAddr() net.Addr { return StreamAddr{SessionID: s.session.id, StreamID: s.id} }
+
+// RemoteAddr returns the StreamAddr of the stream, which is the same on both ends
+func (s *Stream) RemoteAddr() net.Addr { return StreamAddr{SessionID: s.session.id, StreamID: s.id} }
+
+func (s *Stream) SetWriteToTimeout(d time.Duration) { s.recvBuf.SetWriteToTimeout(d) }
+
+// SetReadDeadline sets the deadline for pending and future Read calls, like net.Conn. Once the deadline has passed,
+// Read returns ErrTimeout immediately, even if there is data available, and keeps doing so until the deadline is
+// extended or reset. A zero value for t means Read will not time out.
+func (s *Stream) SetReadDeadline(t time.Time) error { s.recvBuf.SetReadDeadline(t); return nil }
 
-func (s *Stream) SetWriteToTimeout(d time.Duration)  { s.recvBuf.SetWriteToTimeout(d) }
-func (s *Stream) SetReadDeadline(t time.Time) error  { s.recvBuf.SetReadDeadline(t); return nil }
 func (s *Stream) SetReadFromTimeout(d time.Duration) { s.readFromTimeout = d }
 
+// Pause stops the stream from delivering data: Read, WriteTo and ReadMessage wait as if nothing had been received
+// until Resume is called, though they still return once the deadline set by SetReadDeadline has passed, or once the
+// stream is closed with nothing left to read. Data keeps being received meanwhile, up to MaxStreamBuffer. There is no
+// window for each stream, so beyond that, the remote is held back by the connection the data comes through no
+// longer being read, which holds back the other streams using the connection too, until the paused stream is resumed,
+// closed or reset
+func (s *Stream) Pause() { s.recvBuf.setPaused(true) }
+
+// Resume lets a stream paused with Pause deliver data again
+func (s *Stream) Resume() { s.recvBuf.setPaused(false) }
+
+// SetIdleTimeout makes the stream close itself, as with Close, once no data has been sent, received or read on it for
+// d. It replaces the session's StreamIdleTimeout and any previous call, and counts from the time it's called. Zero
+// disables it
+func (s *Stream) SetIdleTimeout(d time.Duration) {
+	s.idleM.Lock()
+	defer s.idleM.Unlock()
+	s.idleGen++
+	atomic.StoreInt64(&s.idleTimeout, int64(d))
+	if d <= 0 {
+		return
+	}
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+	gen := s.idleGen
+	time.AfterFunc(d, func() { s.checkIdle(gen) })
+}
+
+// markActive records activity on the stream for SetIdleTimeout
+func (s *Stream) markActive() {
+	if atomic.LoadInt64(&s.idleTimeout) > 0 {
+		atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+	}
+}
+
+// checkIdle closes the stream if it has been idle for longer than its idle timeout, or checks again once it could
+// have been. gen is the idleGen of the SetIdleTimeout call that started the checks
+func (s *Stream) checkIdle(gen uint64) {
+	s.idleM.Lock()
+	if gen != s.idleGen || s.isClosed() {
+		s.idleM.Unlock()
+		return
+	}
+	timeout := time.Duration(atomic.LoadInt64(&s.idleTimeout))
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActivity)))
+	if idle < timeout {
+		time.AfterFunc(timeout-idle, func() { s.checkIdle(gen) })
+		s.idleM.Unlock()
+		return
+	}
+	s.idleM.Unlock()
+
+	s.session.Logger.Debugf("stream %v of session %v has been idle for %v, closing", s.id, s.session.id, idle)
+	if err := s.Close(); err != nil && !errors.Is(err, errRepeatStreamClosing) {
+		s.session.Logger.Debugf("failed to close idle stream %v: %v", s.id, err)
+	}
+}
+
 var errNotImplemented = errors.New("Not implemented")
 
 // the following functions are purely for implementing net.Conn interface.
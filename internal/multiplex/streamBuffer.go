@@ -12,16 +12,25 @@ package multiplex
 
 import (
 	"container/heap"
-	"fmt"
+	"errors"
 	"io"
 	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
+// seqLess reports whether sequence number a comes before b. Sequence numbers are compared in serial number
+// arithmetic, so that ordering still works after a stream's sequence numbers have wrapped around past the maximum
+// of uint64, as long as the frames being compared are less than half of the sequence number space apart
+func seqLess(a, b uint64) bool {
+	return int64(a-b) < 0
+}
+
 type sorterHeap []*Frame
 
 func (sh sorterHeap) Less(i, j int) bool {
-	return sh[i].Seq < sh[j].Seq
+	return seqLess(sh[i].Seq, sh[j].Seq)
 }
 func (sh sorterHeap) Len() int {
 	return len(sh)
@@ -49,50 +58,273 @@ type streamBuffer struct {
 	sh          sorterHeap
 
 	buf *streamBufferedPipe
+	// the frames due to be delivered, whose payloads are written into buf once recvM has been released, as writing
+	// waits for room in buf, and the stream must still be able to be closed or reset in the meantime. Each delivery
+	// takes a ticket from nextTicket under recvM, and waits for servedTicket to reach it, so that deliveries from
+	// different connections are written in the order they were made
+	ready        []Frame
+	nextTicket   uint64
+	deliverCond  *sync.Cond
+	servedTicket uint64
+
+	// if a missing frame doesn't arrive within reorderTimeout, the streamBuffer gives up on it. If skipGaps is true,
+	// it skips the missing frames and carries on. Otherwise the streamBuffer is closed with ErrReorderTimeout.
+	// onReorderTimeout is then called with the range of sequence numbers given up on, and whether the streamBuffer
+	// should be closed.
+	reorderTimeout   time.Duration
+	skipGaps         bool
+	onReorderTimeout func(firstMissing uint64, numMissing uint64, toBeClosed bool)
+	reorderTimer     *time.Timer
+	// the nextRecvSeq at the time reorderTimer was started
+	reorderTimerSeq uint64
+
+	// if onUnblocked is set, it's called with how long frames have waited for a missing frame before it, once it
+	// has arrived or been skipped. blockedSince is when they started waiting for blockedSeq, and zero if they aren't
+	onUnblocked  func(blocked time.Duration)
+	blockedSince time.Time
+	blockedSeq   uint64
+
+	// if trackDelivered is true, the frames delivered that may not have been read in full are kept track of in
+	// delivered, so that resumePoint can tell where reading is up to
+	trackDelivered bool
+	delivered      []deliveredFrame
+	// the number of bytes delivered, including those not yet written into buf
+	deliveredBytes uint64
+
+	// if strict is true, receiving a frame already delivered is an error, unless it comes before lateFloor. Frames
+	// before lateFloor, where a gap was last skipped or the stream was last resumed, can legitimately arrive again
+	strict    bool
+	lateFloor uint64
 }
 
+// deliveredFrame is a frame whose payload has been delivered from start to end, in bytes since the stream started
+type deliveredFrame struct {
+	seq   uint64
+	start uint64
+	end   uint64
+}
+
+var ErrReorderTimeout = errors.New("timed out waiting for a missing frame")
+var ErrSequenceViolation = errors.New("received a frame that has already been delivered")
+
 // streamBuffer is a wrapper around streamBufferedPipe.
 // Its main function is to sort frames in order, and wait for frames to arrive
 // if they have arrived out-of-order. Then it writes the payload of frames into
 // a streamBufferedPipe.
 func NewStreamBuffer() *streamBuffer {
 	sb := &streamBuffer{
-		sh:  []*Frame{},
-		buf: NewStreamBufferedPipe(),
+		sh:          []*Frame{},
+		buf:         NewStreamBufferedPipe(),
+		deliverCond: sync.NewCond(&sync.Mutex{}),
 	}
 	return sb
 }
 
+// Write takes f, and delivers it and the frames waiting for it once they are in order. It returns once their payloads
+// have been written into the buffer, which waits for room if the buffer is full. It doesn't hold recvM while waiting,
+// so that the stream can still be closed or reset
 func (sb *streamBuffer) Write(f Frame) (toBeClosed bool, err error) {
 	sb.recvM.Lock()
-	defer sb.recvM.Unlock()
+	defer sb.unlockAndDeliver()
 	// when there'fs no ooo packages in heap and we receive the next package in order
 	if len(sb.sh) == 0 && f.Seq == sb.nextRecvSeq {
-		if f.Closing != closingNothing {
+		if !carriesData(f.Closing) {
+			// so that a retransmission of it is dropped too
+			sb.nextRecvSeq += 1
 			return true, nil
 		} else {
-			sb.buf.Write(f.Payload)
-			sb.nextRecvSeq += 1
+			sb.deliver(f)
 		}
 		return false, nil
 	}
 
-	if f.Seq < sb.nextRecvSeq {
-		return false, fmt.Errorf("seq %v is smaller than nextRecvSeq %v", f.Seq, sb.nextRecvSeq)
+	if seqLess(f.Seq, sb.nextRecvSeq) {
+		if sb.strict && !seqLess(f.Seq, sb.lateFloor) {
+			return false, ErrSequenceViolation
+		}
+		// everything before nextRecvSeq has been delivered, so this is a retransmission of a frame already received
+		log.Tracef("dropped frame %v already delivered, nextRecvSeq is %v", f.Seq, sb.nextRecvSeq)
+		return false, nil
 	}
 
+	// the payload is in a buffer that is reused for the next frame received through the same connection
+	f.Payload = append([]byte(nil), f.Payload...)
 	heap.Push(&sb.sh, &f)
-	// Keep popping from the heap until empty or to the point that the wanted seq was not received
-	for len(sb.sh) > 0 && sb.sh[0].Seq == sb.nextRecvSeq {
-		f = *heap.Pop(&sb.sh).(*Frame)
-		if f.Closing != closingNothing {
-			return true, nil
-		} else {
-			sb.buf.Write(f.Payload)
+	toBeClosed = sb.popInOrder()
+	sb.resetReorderTimer()
+	sb.trackBlocking()
+	return toBeClosed, nil
+}
+
+// popInOrder keeps popping from the heap until empty or to the point that the wanted seq was not received
+func (sb *streamBuffer) popInOrder() (toBeClosed bool) {
+	for len(sb.sh) > 0 && !seqLess(sb.nextRecvSeq, sb.sh[0].Seq) {
+		f := *heap.Pop(&sb.sh).(*Frame)
+		if f.Seq != sb.nextRecvSeq {
+			// a retransmission of a frame that was also waiting in the heap, and has just been delivered
+			continue
+		}
+		if !carriesData(f.Closing) {
 			sb.nextRecvSeq += 1
+			return true
+		} else {
+			sb.deliver(f)
+		}
+	}
+	return false
+}
+
+// deliver makes f the next frame whose payload is written into sb.buf by unlockAndDeliver. sb.recvM must be held by
+// the caller
+func (sb *streamBuffer) deliver(f Frame) {
+	if sb.trackDelivered {
+		sb.pruneDelivered()
+		start := sb.deliveredBytes
+		sb.deliveredBytes += uint64(len(f.Payload))
+		sb.delivered = append(sb.delivered, deliveredFrame{f.Seq, start, sb.deliveredBytes})
+	}
+	sb.ready = append(sb.ready, f)
+	sb.nextRecvSeq += 1
+}
+
+// unlockAndDeliver releases sb.recvM, then writes the payloads of the frames delivered into sb.buf, ending a message
+// where a frame does, once those delivered before them have been written. sb.recvM must be held by the caller
+func (sb *streamBuffer) unlockAndDeliver() {
+	ready := sb.ready
+	sb.ready = nil
+	ticket := sb.nextTicket
+	sb.nextTicket++
+	sb.recvM.Unlock()
+
+	sb.deliverCond.L.Lock()
+	for sb.servedTicket != ticket {
+		sb.deliverCond.Wait()
+	}
+	sb.deliverCond.L.Unlock()
+	for _, f := range ready {
+		if _, err := sb.buf.Write(f.Payload); err != nil {
+			// closed or reset, so the rest is discarded too
+			break
+		}
+		if f.Closing == messageEnd {
+			sb.buf.endMessage()
 		}
 	}
-	return false, nil
+	sb.deliverCond.L.Lock()
+	sb.servedTicket++
+	sb.deliverCond.Broadcast()
+	sb.deliverCond.L.Unlock()
+}
+
+// pruneDelivered stops keeping track of frames that have been read in full, and returns the number of bytes read.
+// sb.recvM must be held by the caller
+func (sb *streamBuffer) pruneDelivered() uint64 {
+	read := sb.buf.readBytes()
+	i := 0
+	for i < len(sb.delivered) && sb.delivered[i].end <= read {
+		i++
+	}
+	sb.delivered = sb.delivered[i:]
+	return read
+}
+
+// resumePoint returns the sequence number of the first frame that hasn't been read in full, and how many bytes of it
+// have been read. Only available with trackDelivered
+func (sb *streamBuffer) resumePoint() (seq uint64, skip uint64) {
+	sb.recvM.Lock()
+	defer sb.recvM.Unlock()
+	read := sb.pruneDelivered()
+	if len(sb.delivered) == 0 {
+		return sb.nextRecvSeq, 0
+	}
+	return sb.delivered[0].seq, read - sb.delivered[0].start
+}
+
+// resumeRecv carries on receiving from seq, which the remote resuming the stream sends next, dropping frames waiting
+// for missing ones as they will be sent again. It returns the number of bytes dropped
+func (sb *streamBuffer) resumeRecv(seq uint64) (dropped int) {
+	sb.recvM.Lock()
+	defer sb.recvM.Unlock()
+	for _, f := range sb.sh {
+		dropped += len(f.Payload)
+	}
+	sb.sh = sb.sh[:0]
+	if seqLess(sb.nextRecvSeq, seq) {
+		sb.lateFloor = seq
+	} else {
+		sb.lateFloor = sb.nextRecvSeq
+	}
+	sb.nextRecvSeq = seq
+	sb.resetReorderTimer()
+	sb.trackBlocking()
+	return dropped
+}
+
+// resetReorderTimer starts the reorder timer when we start waiting for a missing frame, restarts it when we start
+// waiting for a different one, and stops it when we aren't waiting any more. sb.recvM must be held by the caller
+func (sb *streamBuffer) resetReorderTimer() {
+	if sb.reorderTimeout <= 0 {
+		return
+	}
+	if sb.reorderTimer != nil {
+		if len(sb.sh) > 0 && sb.reorderTimerSeq == sb.nextRecvSeq {
+			return
+		}
+		sb.reorderTimer.Stop()
+		sb.reorderTimer = nil
+	}
+	if len(sb.sh) > 0 {
+		sb.reorderTimerSeq = sb.nextRecvSeq
+		var timer *time.Timer
+		timer = time.AfterFunc(sb.reorderTimeout, func() { sb.reorderTimedOut(&timer) })
+		sb.reorderTimer = timer
+	}
+}
+
+// trackBlocking starts timing when frames start waiting for a missing frame, and reports the time waited through
+// onUnblocked once they no longer wait for it. sb.recvM must be held by the caller
+func (sb *streamBuffer) trackBlocking() {
+	if sb.onUnblocked == nil {
+		return
+	}
+	blocked := len(sb.sh) > 0
+	if !sb.blockedSince.IsZero() && (!blocked || sb.blockedSeq != sb.nextRecvSeq) {
+		sb.onUnblocked(time.Since(sb.blockedSince))
+		sb.blockedSince = time.Time{}
+	}
+	if blocked && sb.blockedSince.IsZero() {
+		sb.blockedSince = time.Now()
+		sb.blockedSeq = sb.nextRecvSeq
+	}
+}
+
+// timer is only dereferenced once sb.recvM is held, as it may still be being assigned when the timer fires
+func (sb *streamBuffer) reorderTimedOut(timer **time.Timer) {
+	sb.recvM.Lock()
+	if sb.reorderTimer != *timer || len(sb.sh) == 0 {
+		// the missing frame has arrived in the meantime
+		sb.recvM.Unlock()
+		return
+	}
+	sb.reorderTimer = nil
+	firstMissing := sb.nextRecvSeq
+	numMissing := sb.sh[0].Seq - sb.nextRecvSeq
+	var toBeClosed bool
+	if sb.skipGaps {
+		sb.nextRecvSeq = sb.sh[0].Seq
+		sb.lateFloor = sb.nextRecvSeq
+		toBeClosed = sb.popInOrder()
+		sb.resetReorderTimer()
+		sb.trackBlocking()
+	} else {
+		sb.buf.closeWithError(ErrReorderTimeout)
+		toBeClosed = true
+	}
+	sb.unlockAndDeliver()
+
+	if sb.onReorderTimeout != nil {
+		sb.onReorderTimeout(firstMissing, numMissing, toBeClosed)
+	}
 }
 
 func (sb *streamBuffer) Read(buf []byte) (int, error) {
@@ -103,12 +335,36 @@ func (sb *streamBuffer) WriteTo(w io.Writer) (int64, error) {
 	return sb.buf.WriteTo(w)
 }
 
+func (sb *streamBuffer) readMessage() ([]byte, error) {
+	return sb.buf.readMessage()
+}
+
 func (sb *streamBuffer) Close() error {
 	sb.recvM.Lock()
 	defer sb.recvM.Unlock()
+	if sb.reorderTimer != nil {
+		sb.reorderTimer.Stop()
+		sb.reorderTimer = nil
+	}
 
 	return sb.buf.Close()
 }
 
+func (sb *streamBuffer) reset(err error) {
+	sb.recvM.Lock()
+	defer sb.recvM.Unlock()
+	if sb.reorderTimer != nil {
+		sb.reorderTimer.Stop()
+		sb.reorderTimer = nil
+	}
+	sb.sh = sb.sh[:0]
+
+	sb.buf.reset(err)
+}
+
+// buffered doesn't count frames waiting for missing frames before them, as they can't be read yet
+func (sb *streamBuffer) buffered() int { return sb.buf.buffered() }
+
+func (sb *streamBuffer) setPaused(paused bool)             { sb.buf.setPaused(paused) }
 func (sb *streamBuffer) SetReadDeadline(t time.Time)       { sb.buf.SetReadDeadline(t) }
 func (sb *streamBuffer) SetWriteToTimeout(d time.Duration) { sb.buf.SetWriteToTimeout(d) }
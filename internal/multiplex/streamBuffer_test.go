@@ -2,7 +2,13 @@ package multiplex
 
 import (
 	"encoding/binary"
+	"github.com/stretchr/testify/assert"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"time"
+
 	//"log"
 	"sort"
 	"testing"
@@ -13,6 +19,7 @@ func TestRecvNewFrame(t *testing.T) {
 	outOfOrder0 := []uint64{5, 7, 8, 6, 11, 10, 9}
 	outOfOrder1 := []uint64{1, 96, 47, 2, 29, 18, 60, 8, 74, 22, 82, 58, 44, 51, 57, 71, 90, 94, 68, 83, 61, 91, 39, 97, 85, 63, 46, 73, 54, 84, 76, 98, 93, 79, 75, 50, 67, 37, 92, 99, 42, 77, 17, 16, 38, 3, 100, 24, 31, 7, 36, 40, 86, 64, 34, 45, 12, 5, 9, 27, 21, 26, 35, 6, 65, 69, 53, 4, 48, 28, 30, 56, 32, 11, 80, 66, 25, 41, 78, 13, 88, 62, 15, 70, 49, 43, 72, 23, 10, 55, 52, 95, 14, 59, 87, 33, 19, 20, 81, 89}
 	outOfOrder2 := []uint64{1<<32 - 5, 1<<32 + 3, 1 << 32, 1<<32 - 3, 1<<32 - 4, 1<<32 + 2, 1<<32 - 2, 1<<32 - 1, 1<<32 + 1}
+	outOfOrderUint64Wrap := []uint64{math.MaxUint64 - 4, 2, math.MaxUint64, 0, math.MaxUint64 - 2, math.MaxUint64 - 3, 1, math.MaxUint64 - 1}
 
 	test := func(set []uint64, ct *testing.T) {
 		sb := NewStreamBuffer()
@@ -40,7 +47,7 @@ func TestRecvNewFrame(t *testing.T) {
 		}
 		targetSorted := make([]uint64, len(set))
 		copy(targetSorted, set)
-		sort.Slice(targetSorted, func(i, j int) bool { return targetSorted[i] < targetSorted[j] })
+		sort.Slice(targetSorted, func(i, j int) bool { return seqLess(targetSorted[i], targetSorted[j]) })
 
 		for i := range targetSorted {
 			if sortedResult[i] != targetSorted[i] {
@@ -68,6 +75,67 @@ func TestRecvNewFrame(t *testing.T) {
 	t.Run("out of order wrap", func(t *testing.T) {
 		test(outOfOrder2, t)
 	})
+	t.Run("out of order uint64 wrap", func(t *testing.T) {
+		test(outOfOrderUint64Wrap, t)
+	})
+}
+
+func TestSeqLess(t *testing.T) {
+	assert.True(t, seqLess(1, 2))
+	assert.False(t, seqLess(2, 1))
+	assert.False(t, seqLess(2, 2))
+	assert.True(t, seqLess(math.MaxUint64, 0), "wrapped around")
+	assert.False(t, seqLess(0, math.MaxUint64), "wrapped around")
+
+	t.Run("stale frame after wraparound", func(t *testing.T) {
+		sb := NewStreamBuffer()
+		sb.nextRecvSeq = 1
+		_, err := sb.Write(Frame{Seq: math.MaxUint64, Payload: []byte{0}})
+		assert.NoError(t, err)
+		assert.Zero(t, sb.buffered(), "a frame from before the wraparound is delivered")
+	})
+}
+
+func TestStreamBuffer_Retransmission(t *testing.T) {
+	frame := func(seq uint64) Frame {
+		return Frame{Seq: seq, Payload: []byte{byte(seq)}}
+	}
+	readAll := func(sb *streamBuffer) []byte {
+		sb.Close()
+		received, _ := ioutil.ReadAll(sb)
+		return received
+	}
+
+	t.Run("after delivery", func(t *testing.T) {
+		sb := NewStreamBuffer()
+		for _, seq := range []uint64{0, 1, 0, 2, 1} {
+			toBeClosed, err := sb.Write(frame(seq))
+			assert.NoError(t, err)
+			assert.False(t, toBeClosed)
+		}
+		assert.Equal(t, []byte{0, 1, 2}, readAll(sb))
+	})
+
+	t.Run("while waiting in the heap", func(t *testing.T) {
+		sb := NewStreamBuffer()
+		for _, seq := range []uint64{2, 1, 2, 1, 0, 2, 3} {
+			_, err := sb.Write(frame(seq))
+			assert.NoError(t, err)
+		}
+		assert.Empty(t, sb.sh, "retransmitted frames left in the heap")
+		assert.Equal(t, []byte{0, 1, 2, 3}, readAll(sb))
+	})
+
+	t.Run("closing frame", func(t *testing.T) {
+		sb := NewStreamBuffer()
+		_, _ = sb.Write(frame(0))
+		toBeClosed, err := sb.Write(Frame{Seq: 1, Closing: closingStream})
+		assert.NoError(t, err)
+		assert.True(t, toBeClosed)
+		toBeClosed, err = sb.Write(Frame{Seq: 1, Closing: closingStream})
+		assert.NoError(t, err)
+		assert.False(t, toBeClosed, "a retransmitted closing frame closes the stream again")
+	})
 }
 
 func TestStreamBuffer_RecvThenClose(t *testing.T) {
@@ -89,3 +157,136 @@ func TestStreamBuffer_RecvThenClose(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestStreamBuffer_ReorderTimeout(t *testing.T) {
+	const reorderTimeout = 50 * time.Millisecond
+	frames := []Frame{
+		{Seq: 0, Payload: []byte{0}},
+		// seq 1 is withheld
+		{Seq: 2, Payload: []byte{2}},
+		{Seq: 3, Payload: []byte{3}},
+	}
+
+	t.Run("error out", func(t *testing.T) {
+		sb := NewStreamBuffer()
+		sb.reorderTimeout = reorderTimeout
+		timedOut := make(chan bool, 1)
+		sb.onReorderTimeout = func(firstMissing uint64, numMissing uint64, toBeClosed bool) {
+			assert.Equal(t, uint64(1), firstMissing)
+			assert.Equal(t, uint64(1), numMissing)
+			timedOut <- toBeClosed
+		}
+		for _, f := range frames {
+			sb.Write(f)
+		}
+
+		readBuf := make([]byte, 1)
+		_, err := sb.Read(readBuf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0}, readBuf)
+
+		select {
+		case toBeClosed := <-timedOut:
+			assert.True(t, toBeClosed)
+		case <-time.After(10 * reorderTimeout):
+			t.Fatal("reorder timeout didn't trigger")
+		}
+		_, err = sb.Read(readBuf)
+		assert.Equal(t, ErrReorderTimeout, err)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		sb := NewStreamBuffer()
+		sb.reorderTimeout = reorderTimeout
+		sb.skipGaps = true
+		timedOut := make(chan bool, 1)
+		sb.onReorderTimeout = func(firstMissing uint64, numMissing uint64, toBeClosed bool) {
+			assert.Equal(t, uint64(1), firstMissing)
+			assert.Equal(t, uint64(1), numMissing)
+			timedOut <- toBeClosed
+		}
+		for _, f := range frames {
+			sb.Write(f)
+		}
+
+		select {
+		case toBeClosed := <-timedOut:
+			assert.False(t, toBeClosed)
+		case <-time.After(10 * reorderTimeout):
+			t.Fatal("reorder timeout didn't trigger")
+		}
+		readBuf := make([]byte, 3)
+		_, err := io.ReadFull(sb, readBuf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 2, 3}, readBuf)
+	})
+
+	t.Run("gap filled in time", func(t *testing.T) {
+		sb := NewStreamBuffer()
+		sb.reorderTimeout = reorderTimeout
+		sb.onReorderTimeout = func(uint64, uint64, bool) {
+			t.Error("reorder timeout triggered after the gap was filled")
+		}
+		for _, f := range frames {
+			sb.Write(f)
+		}
+		sb.Write(Frame{Seq: 1, Payload: []byte{1}})
+		time.Sleep(2 * reorderTimeout)
+
+		readBuf := make([]byte, 4)
+		_, err := io.ReadFull(sb, readBuf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 1, 2, 3}, readBuf)
+	})
+}
+
+func TestStream_ReorderTimeout(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	gaps := make(chan [2]uint64, 1)
+	sesh := MakeSession(0, SessionConfig{
+		Obfuscator:     obfuscator,
+		ReorderTimeout: 50 * time.Millisecond,
+		ReorderSkip:    true,
+		OnReorderGap: func(streamID uint32, firstMissing uint64, numMissing uint64) {
+			gaps <- [2]uint64{firstMissing, numMissing}
+		},
+	})
+
+	obfsBuf := make([]byte, obfsBufLen)
+	for _, seq := range []uint64{0, 3} {
+		f := &Frame{1, seq, closingNothing, []byte{byte(seq)}}
+		n, _ := sesh.Obfs(f, obfsBuf, 0)
+		err := sesh.recvDataFromRemote(obfsBuf[:n], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case gap := <-gaps:
+		assert.Equal(t, [2]uint64{1, 2}, gap)
+	case <-time.After(time.Second):
+		t.Fatal("OnReorderGap wasn't called")
+	}
+	stream, _ := sesh.Accept()
+	readBuf := make([]byte, 2)
+	_, err := io.ReadFull(stream, readBuf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 3}, readBuf)
+}
+
+func TestStreamBuffer_OutOfOrderPayloadCopied(t *testing.T) {
+	sb := NewStreamBuffer()
+	recvBuf := []byte{1}
+	sb.Write(Frame{Seq: 1, Payload: recvBuf})
+	// reused for the next frame received
+	recvBuf[0] = 0
+	sb.Write(Frame{Seq: 0, Payload: recvBuf})
+
+	readBuf := make([]byte, 2)
+	_, err := io.ReadFull(sb, readBuf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1}, readBuf)
+}
@@ -14,17 +14,33 @@ type streamBufferedPipe struct {
 	// only alloc when on first Read or Write
 	buf *bytes.Buffer
 
-	closed    bool
+	closed bool
+	// while set, reads wait as if there were no data
+	paused bool
+	// if non-nil, returned instead of io.EOF by reads from a closed and drained pipe
+	closeErr  error
 	rwCond    *sync.Cond
 	rDeadline time.Time
 	wtTimeout time.Duration
 
 	timeoutTimer *time.Timer
+
+	// the capacity allocated for buf when data is first written, and the amount of data in buf beyond which Write
+	// blocks until some of it has been read
+	initialSize int
+	sizeLimit   int
+
+	// the total amount of data written into and read from buf
+	written uint64
+	read    uint64
+	// the values of written at the end of each message not yet read
+	msgEnds []uint64
 }
 
 func NewStreamBufferedPipe() *streamBufferedPipe {
 	p := &streamBufferedPipe{
-		rwCond: sync.NewCond(&sync.Mutex{}),
+		rwCond:    sync.NewCond(&sync.Mutex{}),
+		sizeLimit: recvBufferSizeLimit,
 	}
 	return p
 }
@@ -37,7 +53,7 @@ func (p *streamBufferedPipe) Read(target []byte) (int, error) {
 	}
 	for {
 		if p.closed && p.buf.Len() == 0 {
-			return 0, io.EOF
+			return 0, p.eof()
 		}
 
 		hasRDeadline := !p.rDeadline.IsZero()
@@ -46,7 +62,7 @@ func (p *streamBufferedPipe) Read(target []byte) (int, error) {
 				return 0, ErrTimeout
 			}
 		}
-		if p.buf.Len() > 0 {
+		if p.buf.Len() > 0 && !p.paused {
 			break
 		}
 
@@ -57,10 +73,59 @@ func (p *streamBufferedPipe) Read(target []byte) (int, error) {
 	}
 	n, err := p.buf.Read(target)
 	// err will always be nil because we have already verified that buf.Len() != 0
+	p.read += uint64(n)
 	p.rwCond.Broadcast()
 	return n, err
 }
 
+// readMessage blocks until a whole message is available and reads it
+func (p *streamBufferedPipe) readMessage() ([]byte, error) {
+	p.rwCond.L.Lock()
+	defer p.rwCond.L.Unlock()
+	if p.buf == nil {
+		p.buf = new(bytes.Buffer)
+	}
+	for {
+		// messages whose ends have been read by Read or WriteTo
+		for len(p.msgEnds) > 0 && p.msgEnds[0] <= p.read {
+			p.msgEnds = p.msgEnds[1:]
+		}
+		if len(p.msgEnds) > 0 && !p.paused {
+			break
+		}
+		if p.closed && !(p.paused && p.buf.Len() > 0) {
+			if p.buf.Len() > 0 {
+				// the stream was closed in the middle of a message
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, p.eof()
+		}
+
+		hasRDeadline := !p.rDeadline.IsZero()
+		if hasRDeadline {
+			if time.Until(p.rDeadline) <= 0 {
+				return nil, ErrTimeout
+			}
+			p.broadcastAfter(time.Until(p.rDeadline))
+		}
+		p.rwCond.Wait()
+	}
+	msg := p.buf.Next(int(p.msgEnds[0] - p.read))
+	p.read = p.msgEnds[0]
+	p.msgEnds = p.msgEnds[1:]
+	p.rwCond.Broadcast()
+	return append([]byte(nil), msg...), nil
+}
+
+// endMessage marks the end of a message at the end of the data written so far
+func (p *streamBufferedPipe) endMessage() {
+	p.rwCond.L.Lock()
+	defer p.rwCond.L.Unlock()
+
+	p.msgEnds = append(p.msgEnds, p.written)
+	p.rwCond.Broadcast()
+}
+
 func (p *streamBufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
 	p.rwCond.L.Lock()
 	defer p.rwCond.L.Unlock()
@@ -69,7 +134,7 @@ func (p *streamBufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
 	}
 	for {
 		if p.closed && p.buf.Len() == 0 {
-			return 0, io.EOF
+			return 0, p.eof()
 		}
 
 		hasRDeadline := !p.rDeadline.IsZero()
@@ -78,8 +143,9 @@ func (p *streamBufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
 				return 0, ErrTimeout
 			}
 		}
-		if p.buf.Len() > 0 {
+		if p.buf.Len() > 0 && !p.paused {
 			written, er := p.buf.WriteTo(w)
+			p.read += uint64(written)
 			n += written
 			if er != nil {
 				p.rwCond.Broadcast()
@@ -87,7 +153,7 @@ func (p *streamBufferedPipe) WriteTo(w io.Writer) (n int64, err error) {
 			}
 			p.rwCond.Broadcast()
 		} else {
-			if p.wtTimeout == 0 {
+			if p.wtTimeout == 0 || p.paused {
 				if hasRDeadline {
 					p.broadcastAfter(time.Until(p.rDeadline))
 				}
@@ -111,14 +177,18 @@ func (p *streamBufferedPipe) Write(input []byte) (int, error) {
 		if p.closed {
 			return 0, io.ErrClosedPipe
 		}
-		if p.buf.Len() <= recvBufferSizeLimit {
+		if p.buf.Len() <= p.sizeLimit {
 			// if p.buf gets too large, write() will panic. We don't want this to happen
 			break
 		}
 		p.rwCond.Wait()
 	}
+	if p.buf.Cap() == 0 {
+		p.buf.Grow(p.initialSize)
+	}
 	n, err := p.buf.Write(input)
 	// err will always be nil
+	p.written += uint64(n)
 	p.rwCond.Broadcast()
 	return n, err
 }
@@ -132,6 +202,66 @@ func (p *streamBufferedPipe) Close() error {
 	return nil
 }
 
+// closeWithError closes the pipe such that reads return err instead of io.EOF once all data has been read
+func (p *streamBufferedPipe) closeWithError(err error) {
+	p.rwCond.L.Lock()
+	defer p.rwCond.L.Unlock()
+
+	p.closed = true
+	if p.closeErr == nil {
+		// the first reason given stays
+		p.closeErr = err
+	}
+	p.rwCond.Broadcast()
+}
+
+func (p *streamBufferedPipe) reset(err error) {
+	p.rwCond.L.Lock()
+	defer p.rwCond.L.Unlock()
+
+	p.closed = true
+	if p.closeErr == nil {
+		// the first reason given stays
+		p.closeErr = err
+	}
+	if p.buf != nil {
+		p.buf.Reset()
+	}
+	p.msgEnds = nil
+	p.rwCond.Broadcast()
+}
+
+func (p *streamBufferedPipe) setPaused(paused bool) {
+	p.rwCond.L.Lock()
+	defer p.rwCond.L.Unlock()
+
+	p.paused = paused
+	p.rwCond.Broadcast()
+}
+
+func (p *streamBufferedPipe) eof() error {
+	if p.closeErr != nil {
+		return p.closeErr
+	}
+	return io.EOF
+}
+
+func (p *streamBufferedPipe) buffered() int {
+	p.rwCond.L.Lock()
+	defer p.rwCond.L.Unlock()
+	if p.buf == nil {
+		return 0
+	}
+	return p.buf.Len()
+}
+
+// readBytes returns the total amount of data read
+func (p *streamBufferedPipe) readBytes() uint64 {
+	p.rwCond.L.Lock()
+	defer p.rwCond.L.Unlock()
+	return p.read
+}
+
 func (p *streamBufferedPipe) SetReadDeadline(t time.Time) {
 	p.rwCond.L.Lock()
 	defer p.rwCond.L.Unlock()
@@ -2,11 +2,16 @@ package multiplex
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -240,6 +245,574 @@ func TestStream_Close(t *testing.T) {
 	})
 }
 
+func TestStream_ConcurrentWrite(t *testing.T) {
+	clientSesh, serverSesh, _ := makeSessionPair(2)
+	defer clientSesh.Close()
+	defer serverSesh.Close()
+	stream, _ := clientSesh.OpenStream()
+
+	const numWriters = 20
+	const writesPerWriter = 5
+	// spanning several frames
+	const chunkLen = 50000
+	var wg sync.WaitGroup
+	for i := 1; i <= numWriters; i++ {
+		wg.Add(1)
+		go func(pattern byte) {
+			defer wg.Done()
+			chunk := bytes.Repeat([]byte{pattern}, chunkLen)
+			for j := 0; j < writesPerWriter; j++ {
+				if _, err := stream.Write(chunk); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(byte(i))
+	}
+
+	remoteStream, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	received := make([]byte, numWriters*writesPerWriter*chunkLen)
+	_, err = io.ReadFull(remoteStream, received)
+	assert.NoError(t, err)
+	wg.Wait()
+
+	counts := make(map[byte]int)
+	for i := 0; i < len(received); i += chunkLen {
+		chunk := received[i : i+chunkLen]
+		if !assert.Equal(t, bytes.Repeat(chunk[:1], chunkLen), chunk, "chunk at %v is interleaved", i) {
+			return
+		}
+		counts[chunk[0]]++
+	}
+	for i := 1; i <= numWriters; i++ {
+		assert.Equal(t, writesPerWriter, counts[byte(i)])
+	}
+}
+
+func TestStream_Closed(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+
+	t.Run("closed by peer", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+		stream, _ := clientSesh.OpenStream()
+		_, _ = stream.Write([]byte{1})
+		remoteStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		closed := stream.Closed()
+		select {
+		case <-closed:
+			t.Fatal("closed before the peer closed the stream")
+		default:
+		}
+		assert.Equal(t, CloseInitiatorNone, stream.CloseInitiator())
+		_ = remoteStream.Close()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Error("not closed after the peer closed the stream")
+		}
+		assert.Equal(t, CloseInitiatorRemote, stream.CloseInitiator())
+		assert.Equal(t, CloseInitiatorLocal, remoteStream.(*Stream).CloseInitiator())
+	})
+
+	t.Run("closed with the session", func(t *testing.T) {
+		sesh := setupSesh(false, sessionKey, EncryptionMethodPlain)
+		sesh.AddConnection(connutil.Discard())
+		stream, _ := sesh.OpenStream()
+		_ = stream.Close()
+		stream2, _ := sesh.OpenStream()
+		_ = sesh.Close()
+		// closed once only
+		<-stream.Closed()
+		<-stream2.Closed()
+		assert.Equal(t, CloseInitiatorLocal, stream.CloseInitiator())
+		assert.Equal(t, CloseInitiatorSession, stream2.CloseInitiator())
+	})
+}
+
+func TestStream_Reset(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	testPayload := []byte{42, 42, 42}
+
+	recvFrame := func(sesh *Session, f *Frame) {
+		obfsBuf := make([]byte, 512)
+		i, err := sesh.Obfs(f, obfsBuf, 0)
+		if err != nil {
+			t.Fatalf("failed to obfuscate frame %v", err)
+		}
+		err = sesh.recvDataFromRemote(obfsBuf[:i], 0)
+		if err != nil {
+			t.Fatalf("failed to receive frame %v", err)
+		}
+	}
+
+	for _, unordered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unordered=%v", unordered), func(t *testing.T) {
+			t.Run("close delivers residual data", func(t *testing.T) {
+				sesh := setupSesh(unordered, sessionKey, EncryptionMethodPlain)
+				recvFrame(sesh, &Frame{1, 0, closingNothing, testPayload})
+				recvFrame(sesh, &Frame{1, 1, closingStream, testPayload})
+				stream, _ := sesh.Accept()
+
+				readBuf := make([]byte, len(testPayload))
+				_, err := io.ReadFull(stream, readBuf)
+				assert.NoError(t, err)
+				assert.Equal(t, testPayload, readBuf)
+				_, err = stream.Read(readBuf)
+				assert.Equal(t, ErrBrokenStream, err)
+			})
+
+			t.Run("reset discards residual data", func(t *testing.T) {
+				sesh := setupSesh(unordered, sessionKey, EncryptionMethodPlain)
+				recvFrame(sesh, &Frame{1, 0, closingNothing, testPayload})
+				// the reset is sent after a frame that hasn't arrived
+				code := []byte{0, 0, 0, 7, 42, 42}
+				recvFrame(sesh, &Frame{1, 2, closingReset, code})
+				stream, _ := sesh.Accept()
+
+				_, err := stream.Read(make([]byte, len(testPayload)))
+				var resetErr *StreamResetError
+				if assert.True(t, errors.As(err, &resetErr), "unexpected error %v", err) {
+					assert.Equal(t, uint32(7), resetErr.Code)
+				}
+				_, err = stream.(*Stream).WriteTo(ioutil.Discard)
+				assert.Equal(t, resetErr, err)
+				_, err = stream.Write(testPayload)
+				assert.Equal(t, resetErr, err)
+				assert.Eventually(t, func() bool {
+					sI, _ := sesh.streams.Load(uint32(1))
+					return sI == nil
+				}, time.Second, 10*time.Millisecond, "stream still exists")
+			})
+		})
+	}
+
+	t.Run("local reset", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		stream, _ := clientSesh.OpenStream()
+		_, _ = stream.Write(testPayload)
+		serverStream, _ := serverSesh.Accept()
+		_, _ = serverStream.Write(testPayload)
+		assert.Eventually(t, func() bool {
+			return stream.Buffered() == len(testPayload)
+		}, time.Second, 10*time.Millisecond, "data not received")
+
+		err := stream.Reset(9)
+		assert.NoError(t, err)
+		_, err = stream.Read(make([]byte, len(testPayload)))
+		assert.Equal(t, ErrBrokenStream, err, "data received locally isn't discarded")
+
+		var resetErr *StreamResetError
+		assert.Eventually(t, func() bool {
+			_, err := serverStream.Read(make([]byte, len(testPayload)))
+			return errors.As(err, &resetErr)
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, uint32(9), resetErr.Code)
+		_, err = serverStream.Write(testPayload)
+		assert.Equal(t, resetErr, err)
+		_, err = stream.Write(testPayload)
+		assert.Equal(t, ErrBrokenStream, err, "the resetting side gets the remote's error")
+	})
+}
+
+func TestStream_Buffered(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	testPayload := []byte{42, 42, 42}
+
+	recvFrame := func(sesh *Session, f *Frame) {
+		obfsBuf := make([]byte, 512)
+		i, err := sesh.Obfs(f, obfsBuf, 0)
+		if err != nil {
+			t.Fatalf("failed to obfuscate frame %v", err)
+		}
+		err = sesh.recvDataFromRemote(obfsBuf[:i], 0)
+		if err != nil {
+			t.Fatalf("failed to receive frame %v", err)
+		}
+	}
+
+	for _, unordered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unordered=%v", unordered), func(t *testing.T) {
+			sesh := setupSesh(unordered, sessionKey, EncryptionMethodPlain)
+			recvFrame(sesh, &Frame{1, 0, closingNothing, testPayload})
+			streamI, _ := sesh.Accept()
+			stream := streamI.(*Stream)
+			assert.Equal(t, len(testPayload), stream.Buffered())
+
+			recvFrame(sesh, &Frame{1, 1, closingNothing, testPayload})
+			assert.Equal(t, 2*len(testPayload), stream.Buffered())
+
+			_, err := io.ReadFull(stream, make([]byte, len(testPayload)))
+			assert.NoError(t, err)
+			assert.Equal(t, len(testPayload), stream.Buffered())
+
+			// data left after the stream is closed is still counted
+			recvFrame(sesh, &Frame{1, 2, closingStream, testPayload})
+			buffered := stream.Buffered()
+			assert.GreaterOrEqual(t, buffered, len(testPayload))
+			residual, err := ioutil.ReadAll(stream)
+			assert.Equal(t, ErrBrokenStream, err)
+			assert.Equal(t, buffered, len(residual))
+			assert.Zero(t, stream.Buffered())
+		})
+	}
+
+	t.Run("out of order", func(t *testing.T) {
+		sesh := setupSesh(false, sessionKey, EncryptionMethodPlain)
+		recvFrame(sesh, &Frame{1, 1, closingNothing, testPayload})
+		recvFrame(sesh, &Frame{1, 2, closingNothing, testPayload})
+		streamI, _ := sesh.Accept()
+		stream := streamI.(*Stream)
+		assert.Zero(t, stream.Buffered(), "frames after a gap are counted")
+		recvFrame(sesh, &Frame{1, 0, closingNothing, testPayload})
+		assert.Equal(t, 3*len(testPayload), stream.Buffered())
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		sesh := setupSesh(false, sessionKey, EncryptionMethodPlain)
+		recvFrame(sesh, &Frame{1, 0, closingNothing, testPayload})
+		recvFrame(sesh, &Frame{1, 1, closingReset, []byte{0, 0, 0, 7}})
+		streamI, _ := sesh.Accept()
+		assert.Zero(t, streamI.(*Stream).Buffered())
+	})
+
+	t.Run("while receiving", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		stream, _ := clientSesh.OpenStream()
+		_, _ = stream.Write(testPayload)
+		serverStream, _ := serverSesh.Accept()
+
+		const numWrites = 100
+		go func() {
+			for i := 0; i < numWrites-1; i++ {
+				_, _ = stream.Write(testPayload)
+			}
+		}()
+		last := 0
+		assert.Eventually(t, func() bool {
+			buffered := serverStream.(*Stream).Buffered()
+			assert.GreaterOrEqual(t, buffered, last, "buffered data shrank without being read")
+			last = buffered
+			return buffered == numWrites*len(testPayload)
+		}, time.Second, time.Millisecond)
+	})
+}
+
+func TestStream_Flush(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	testData := make([]byte, payloadLen)
+	rand.Read(testData)
+
+	readAll := func(stream net.Conn) []byte {
+		var received []byte
+		buf := make([]byte, payloadLen)
+		for {
+			n, err := stream.Read(buf)
+			received = append(received, buf[:n]...)
+			if err != nil {
+				return received
+			}
+		}
+	}
+
+	t.Run("connected", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		stream, _ := clientSesh.OpenStream()
+		_, err := stream.Write(testData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = stream.Flush()
+		if err != nil {
+			t.Fatalf("failed to flush: %v", err)
+		}
+		stream.Close()
+
+		serverStream, _ := serverSesh.Accept()
+		assert.Equal(t, testData, readAll(serverStream))
+	})
+
+	t.Run("waiting for resumption", func(t *testing.T) {
+		obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+		seshConfig := SessionConfig{
+			Obfuscator:       obfuscator,
+			ResumptionWindow: time.Second,
+		}
+		clientSesh := MakeSession(0, seshConfig)
+		serverSesh := MakeSession(0, seshConfig)
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+		c.Close()
+		assert.Eventually(t, clientSesh.sb.awaitingResumption, time.Second, 10*time.Millisecond)
+
+		stream, _ := clientSesh.OpenStream()
+		_, err := stream.Write(testData)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		flushed := make(chan error)
+		go func() {
+			flushed <- stream.Flush()
+		}()
+		select {
+		case <-flushed:
+			t.Fatal("Flush returned before the session was resumed")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		c, s = connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+		select {
+		case err := <-flushed:
+			if err != nil {
+				t.Fatalf("failed to flush: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Flush didn't return after the session was resumed")
+		}
+		stream.Close()
+
+		serverStream, _ := serverSesh.Accept()
+		assert.Equal(t, testData, readAll(serverStream))
+	})
+}
+
+func TestStream_WriteBuffer(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	const writes = 1000
+
+	// writeBytes writes one byte at a time into a new stream and returns how many data frames were sent for it
+	writeBytes := func(t *testing.T, writeBuffer int, noDelay bool, finish func(*Stream) error) int {
+		var dataFrames int32
+		config := SessionConfig{
+			Obfuscator:        obfuscator,
+			Role:              RoleClient,
+			StreamWriteBuffer: writeBuffer,
+			StreamWriteDelay:  time.Minute,
+			FrameHook: func(f *Frame, outbound bool) {
+				if outbound && f.StreamID != 0xffffffff && len(f.Payload) > 0 {
+					atomic.AddInt32(&dataFrames, 1)
+				}
+			},
+		}
+		clientSesh := MakeSession(0, config)
+		serverSesh := MakeSession(0, config.Derive())
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+
+		stream, _ := clientSesh.OpenStream()
+		assert.NoError(t, stream.SetNoDelay(noDelay))
+		for i := 0; i < writes; i++ {
+			n, err := stream.Write([]byte{byte(i)})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, n)
+		}
+		assert.NoError(t, finish(stream))
+
+		serverStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		received := make([]byte, writes)
+		_, err = io.ReadFull(serverStream, received)
+		assert.NoError(t, err)
+		for i := range received {
+			if received[i] != byte(i) {
+				t.Fatalf("byte %v is %v", i, received[i])
+			}
+		}
+		return int(atomic.LoadInt32(&dataFrames))
+	}
+
+	flush := func(s *Stream) error { return s.Flush() }
+	unbuffered := writeBytes(t, 0, false, flush)
+	buffered := writeBytes(t, 256, false, flush)
+	assert.Equal(t, writes, unbuffered)
+	assert.LessOrEqual(t, buffered, writes/256+1)
+
+	t.Run("sent on close", func(t *testing.T) {
+		writeBytes(t, 4096, false, func(s *Stream) error { return s.Close() })
+	})
+
+	t.Run("no delay", func(t *testing.T) {
+		assert.Equal(t, writes, writeBytes(t, 256, true, flush))
+	})
+
+	t.Run("held data sent on no delay", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		clientSesh.StreamWriteBuffer = 4096
+		clientSesh.StreamWriteDelay = time.Minute
+		stream, _ := clientSesh.OpenStream()
+		_, err := stream.Write([]byte{1})
+		assert.NoError(t, err)
+		assert.NoError(t, stream.SetNoDelay(true))
+
+		serverStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf := make([]byte, 1)
+		serverStream.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = serverStream.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1}, buf)
+	})
+
+	t.Run("mixed with ReadFrom", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		clientSesh.StreamWriteBuffer = 1024
+		// so that held data is also sent by the timer while ReadFrom is reading
+		clientSesh.StreamWriteDelay = time.Millisecond
+		stream, _ := clientSesh.OpenStream()
+		var expected []byte
+		for i := 0; i < 100; i++ {
+			_, err := stream.Write([]byte("hello"))
+			assert.NoError(t, err)
+			_, _ = stream.ReadFrom(bytes.NewReader([]byte("world")))
+			expected = append(expected, "helloworld"...)
+		}
+
+		serverStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		received := make([]byte, len(expected))
+		serverStream.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(serverStream, received)
+		assert.NoError(t, err)
+		assert.Equal(t, string(expected), string(received))
+	})
+
+	t.Run("sent after delay", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		clientSesh.StreamWriteBuffer = 4096
+		clientSesh.StreamWriteDelay = 10 * time.Millisecond
+		stream, _ := clientSesh.OpenStream()
+		_, err := stream.Write([]byte{1})
+		assert.NoError(t, err)
+
+		serverStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf := make([]byte, 1)
+		serverStream.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = serverStream.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{1}, buf)
+	})
+}
+
+func TestStream_IdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	testPayload := []byte{42, 42, 42}
+
+	isClosed := func(s *Stream) func() bool {
+		return func() bool {
+			select {
+			case <-s.Closed():
+				return true
+			default:
+				return false
+			}
+		}
+	}
+
+	t.Run("session default", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		clientSesh.StreamIdleTimeout = timeout
+		stream, _ := clientSesh.OpenStream()
+		_, _ = stream.Write(testPayload)
+		serverStream, _ := serverSesh.Accept()
+
+		assert.Eventually(t, isClosed(stream), 2*timeout, 10*time.Millisecond, "idle stream isn't closed")
+		assert.Eventually(t, isClosed(serverStream.(*Stream)), time.Second, 10*time.Millisecond,
+			"remote stream isn't closed")
+	})
+
+	// keepAlive calls activity every timeout/3 for three timeouts, and asserts that stream is open throughout
+	keepAlive := func(t *testing.T, stream *Stream, activity func()) {
+		for i := 0; i < 9; i++ {
+			time.Sleep(timeout / 3)
+			activity()
+			assert.False(t, isClosed(stream)(), "active stream is closed")
+		}
+		assert.Eventually(t, isClosed(stream), 2*timeout, 10*time.Millisecond, "idle stream isn't closed")
+	}
+
+	t.Run("write activity", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		stream, _ := clientSesh.OpenStream()
+		stream.SetIdleTimeout(timeout)
+		_, _ = stream.Write(testPayload)
+		serverStream, _ := serverSesh.Accept()
+		go func() { _, _ = io.Copy(ioutil.Discard, serverStream) }()
+		keepAlive(t, stream, func() { _, _ = stream.Write(testPayload) })
+	})
+
+	t.Run("read activity", func(t *testing.T) {
+		clientSesh, serverSesh, _ := makeSessionPair(1)
+		stream, _ := clientSesh.OpenStream()
+		_, _ = stream.Write(testPayload)
+		serverStream, _ := serverSesh.Accept()
+		stream.SetIdleTimeout(timeout)
+		keepAlive(t, stream, func() {
+			_, _ = serverStream.Write(testPayload)
+			_, _ = io.ReadFull(stream, make([]byte, len(testPayload)))
+		})
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		clientSesh, _, _ := makeSessionPair(1)
+		clientSesh.StreamIdleTimeout = timeout
+		stream, _ := clientSesh.OpenStream()
+		stream.SetIdleTimeout(0)
+		time.Sleep(2 * timeout)
+		assert.False(t, isClosed(stream)())
+	})
+}
+
+func TestStream_LastConnID(t *testing.T) {
+	clientSesh, serverSesh, _ := makeSessionPair(4)
+	testData := make([]byte, payloadLen)
+	rand.Read(testData)
+
+	stream, _ := clientSesh.OpenStream()
+	_, err := stream.Write(testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverStream, _ := serverSesh.Accept()
+	assert.EqualValues(t, 0, stream.LastConnID())
+	_, err = io.ReadFull(serverStream, make([]byte, payloadLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// connections are added to both ends in the same order, so they have the same ids on both ends
+	assert.Equal(t, stream.assignedConnId, serverStream.(*Stream).LastConnID())
+}
+
 func TestStream_Read(t *testing.T) {
 	seshes := map[string]bool{
 		"ordered":   false,
@@ -355,6 +928,162 @@ func TestStream_Read(t *testing.T) {
 	}
 }
 
+func TestStream_ReadCoalesces(t *testing.T) {
+	sesh := setupSesh(false, emptyKey, EncryptionMethodPlain)
+	const frames = 64
+	payload := make([]byte, frames*100)
+	rand.Read(payload)
+	obfsBuf := make([]byte, 512)
+	recvFrame := func(seq uint64) {
+		f := &Frame{1, seq, closingNothing, payload[seq*100 : (seq+1)*100]}
+		i, _ := sesh.Obfs(f, obfsBuf, 0)
+		assert.NoError(t, sesh.recvDataFromRemote(obfsBuf[:i], 0))
+	}
+	// the first frame arrives last, so all of them are put in order at once
+	for seq := uint64(1); seq < frames; seq++ {
+		recvFrame(seq)
+	}
+	recvFrame(0)
+	stream, _ := sesh.Accept()
+
+	buf := make([]byte, 16384)
+	n, err := stream.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, len(payload), n, "not all contiguous data is read at once")
+	assert.Equal(t, payload, buf[:n])
+}
+
+func TestStream_Pause(t *testing.T) {
+	for _, unordered := range []bool{false, true} {
+		sesh := setupSesh(unordered, emptyKey, EncryptionMethodPlain)
+		sesh.MaxStreamBuffer = 100
+		name := "ordered"
+		if unordered {
+			name = "unordered"
+		}
+		t.Run(name, func(t *testing.T) {
+			obfsBuf := make([]byte, 512)
+			recvFrame := func(id uint32, seq uint64) error {
+				i, _ := sesh.Obfs(&Frame{id, seq, closingNothing, make([]byte, 100)}, obfsBuf, 0)
+				return sesh.recvDataFromRemote(obfsBuf[:i], 0)
+			}
+			assert.NoError(t, recvFrame(1, 0))
+			paused, _ := sesh.Accept()
+			paused.(*Stream).Pause()
+			assert.NoError(t, recvFrame(3, 0))
+			other, _ := sesh.Accept()
+
+			read := make(chan error, 1)
+			go func() {
+				_, err := paused.Read(make([]byte, 100))
+				read <- err
+			}()
+			// the paused stream takes data in until its buffer is full, then holds back what comes after
+			assert.NoError(t, recvFrame(1, 1))
+			received := make(chan error, 1)
+			go func() { received <- recvFrame(1, 2) }()
+
+			_, err := io.ReadFull(other, make([]byte, 100))
+			assert.NoError(t, err, "other streams are paused too")
+			select {
+			case <-read:
+				t.Fatal("paused stream is read")
+			case <-received:
+				t.Fatal("paused stream takes in data beyond its buffer")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			paused.(*Stream).Resume()
+			select {
+			case err := <-read:
+				assert.NoError(t, err)
+			case <-time.After(time.Second):
+				t.Fatal("resumed stream isn't read")
+			}
+			_, err = io.ReadFull(paused, make([]byte, 100))
+			assert.NoError(t, err)
+			select {
+			case err := <-received:
+				assert.NoError(t, err)
+			case <-time.After(time.Second):
+				t.Fatal("resumed stream doesn't take in data")
+			}
+		})
+	}
+}
+
+// gateConn blocks writes until gate is closed, signalling writing on the first one
+type gateConn struct {
+	net.Conn
+	gate    chan struct{}
+	writing chan struct{}
+	once    sync.Once
+}
+
+func (c *gateConn) Write(b []byte) (int, error) {
+	c.once.Do(func() { close(c.writing) })
+	<-c.gate
+	return c.Conn.Write(b)
+}
+
+func TestStream_WritePriority(t *testing.T) {
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, emptyKey)
+	config := SessionConfig{Obfuscator: obfuscator}
+	clientSesh := MakeSession(0, config)
+	serverSesh := MakeSession(0, config.Derive())
+	defer clientSesh.Close()
+	defer serverSesh.Close()
+	c, s := connutil.AsyncPipe()
+	gated := &gateConn{Conn: c, gate: make(chan struct{}), writing: make(chan struct{})}
+	clientSesh.AddConnection(common.NewTLSConn(gated))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	stream, _ := clientSesh.OpenStream()
+	// spanning several frames, the first of which is held up by the connection
+	bulk := make([]byte, 5*clientSesh.frameUnitLimit())
+	bulkWritten := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(bulk)
+		bulkWritten <- err
+	}()
+	<-gated.writing
+
+	priority := bytes.Repeat([]byte{0xff}, 100)
+	priorityWritten := make(chan error, 1)
+	go func() {
+		_, err := stream.WritePriority(priority)
+		priorityWritten <- err
+	}()
+	assert.Eventually(t, func() bool {
+		stream.priorityM.Lock()
+		defer stream.priorityM.Unlock()
+		return len(stream.priorityWrites) == 1
+	}, time.Second, time.Millisecond)
+	close(gated.gate)
+	assert.NoError(t, <-priorityWritten)
+	assert.NoError(t, <-bulkWritten)
+
+	remoteStream, err := serverSesh.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	received := make([]byte, len(bulk)+len(priority))
+	_, err = io.ReadFull(remoteStream, received)
+	assert.NoError(t, err)
+	k := bytes.IndexByte(received, 0xff)
+	assert.True(t, k > 0 && k < len(bulk), "priority data at %v doesn't overtake queued bulk data", k)
+	if k >= 0 {
+		assert.Equal(t, priority, received[k:k+len(priority)], "priority data is split")
+		assert.Equal(t, bulk, append(received[:k:k], received[k+len(priority):]...), "bulk data is corrupted")
+	}
+
+	t.Run("closed", func(t *testing.T) {
+		assert.NoError(t, stream.Close())
+		_, err := stream.WritePriority(priority)
+		assert.Equal(t, ErrBrokenStream, err)
+	})
+}
+
 func TestStream_SetWriteToTimeout(t *testing.T) {
 	seshes := map[string]*Session{
 		"ordered":   setupSesh(false, emptyKey, EncryptionMethodPlain),
@@ -403,3 +1132,130 @@ func TestStream_SetReadFromTimeout(t *testing.T) {
 		})
 	}
 }
+
+func TestStream_Meta(t *testing.T) {
+	meta := []byte("example.com:443")
+	testPayload := []byte{42, 42, 42}
+
+	for _, unordered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unordered=%v", unordered), func(t *testing.T) {
+			var sessionKey [32]byte
+			rand.Read(sessionKey[:])
+			clientSesh := setupSesh(unordered, sessionKey, EncryptionMethodPlain)
+			serverSesh := setupSesh(unordered, sessionKey, EncryptionMethodPlain)
+			c, s := connutil.AsyncPipe()
+			clientSesh.AddConnection(common.NewTLSConn(c))
+			serverSesh.AddConnection(common.NewTLSConn(s))
+
+			stream, err := clientSesh.OpenStreamWithMeta(meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, meta, stream.Meta())
+
+			// the stream is opened on the remote before anything is written
+			serverStream, err := serverSesh.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, meta, serverStream.(*Stream).Meta())
+
+			_, err = stream.Write(testPayload)
+			assert.NoError(t, err)
+			readBuf := make([]byte, len(testPayload))
+			_, err = io.ReadFull(serverStream, readBuf)
+			assert.NoError(t, err)
+			assert.Equal(t, testPayload, readBuf, "metadata is read as data")
+		})
+	}
+
+	t.Run("no meta", func(t *testing.T) {
+		sesh := setupSesh(false, emptyKey, EncryptionMethodPlain)
+		stream, _ := sesh.OpenStream()
+		assert.Nil(t, stream.Meta())
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		sesh := setupSesh(false, emptyKey, EncryptionMethodPlain)
+		_, err := sesh.OpenStreamWithMeta(make([]byte, MaxStreamMetaLen+1))
+		assert.Equal(t, errStreamMetaTooLong, err)
+		assert.Zero(t, sesh.streamCount())
+	})
+}
+
+func TestStream_Message(t *testing.T) {
+	for _, unordered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unordered=%v", unordered), func(t *testing.T) {
+			var sessionKey [32]byte
+			rand.Read(sessionKey[:])
+			clientSesh := setupSesh(unordered, sessionKey, EncryptionMethodPlain)
+			serverSesh := setupSesh(unordered, sessionKey, EncryptionMethodPlain)
+			c, s := connutil.AsyncPipe()
+			clientSesh.AddConnection(common.NewTLSConn(c))
+			serverSesh.AddConnection(common.NewTLSConn(s))
+
+			msgLens := []int{1, 100, 1000, 1}
+			if !unordered {
+				// spans several frames
+				msgLens = append(msgLens, 3*clientSesh.maxStreamUnitWrite+1)
+			}
+			var msgs [][]byte
+			for _, msgLen := range msgLens {
+				msg := make([]byte, msgLen)
+				rand.Read(msg)
+				msgs = append(msgs, msg)
+			}
+
+			stream, _ := clientSesh.OpenStream()
+			go func() {
+				for _, msg := range msgs {
+					err := stream.WriteMessage(msg)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+
+			serverStreamI, _ := serverSesh.Accept()
+			serverStream := serverStreamI.(*Stream)
+			for _, msg := range msgs {
+				received, err := serverStream.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, msg, received)
+			}
+
+			// back to back messages, with data written outside of them in between
+			_ = stream.WriteMessage([]byte{1, 2})
+			if !unordered {
+				_, _ = stream.Write([]byte{3})
+			}
+			_ = stream.WriteMessage([]byte{4})
+			received, _ := serverStream.ReadMessage()
+			assert.Equal(t, []byte{1, 2}, received)
+			if !unordered {
+				readBuf := make([]byte, 1)
+				_, _ = io.ReadFull(serverStream, readBuf)
+				assert.Equal(t, []byte{3}, readBuf)
+			}
+			received, _ = serverStream.ReadMessage()
+			assert.Equal(t, []byte{4}, received)
+
+			assert.Equal(t, errEmptyMessage, stream.WriteMessage(nil))
+		})
+	}
+
+	t.Run("closed mid-message", func(t *testing.T) {
+		sesh := setupSesh(false, emptyKey, EncryptionMethodPlain)
+		obfsBuf := make([]byte, 512)
+		for _, f := range []*Frame{{1, 0, closingNothing, []byte{1}}, {1, 1, closingStream, []byte{0}}} {
+			i, _ := sesh.Obfs(f, obfsBuf, 0)
+			_ = sesh.recvDataFromRemote(obfsBuf[:i], 0)
+		}
+		stream, _ := sesh.Accept()
+		_, err := stream.(*Stream).ReadMessage()
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	})
+}
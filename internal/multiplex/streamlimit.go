@@ -0,0 +1,101 @@
+package multiplex
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultOpenStreamInitialBackoff = 10 * time.Millisecond
+	defaultOpenStreamMaxBackoff     = time.Second
+)
+
+// OpenStreamRetry sets how OpenStream waits for a stream to end once a session has MaxStreams active streams.
+// It retries with exponential backoff, and straight away whenever a stream ends, until a stream can be opened or
+// MaxWait has passed, after which it gives up with ErrTooManyStreams
+type OpenStreamRetry struct {
+	// MaxWait is the longest OpenStream waits. Zero means it doesn't wait at all
+	MaxWait time.Duration
+	// InitialBackoff is the time between the first two retries, which doubles after each retry. Defaults to 10ms
+	InitialBackoff time.Duration
+	// MaxBackoff caps the time between retries. Defaults to 1s
+	MaxBackoff time.Duration
+}
+
+// streamSlots wakes up OpenStream calls waiting for a stream to end
+type streamSlots struct {
+	m sync.Mutex
+	// closed once a stream has ended, then replaced by the next call of freed. nil while no one is waiting
+	freedCh chan struct{}
+}
+
+// freed returns a channel that is closed once a stream has ended after the call
+func (ss *streamSlots) freed() <-chan struct{} {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	if ss.freedCh == nil {
+		ss.freedCh = make(chan struct{})
+	}
+	return ss.freedCh
+}
+
+func (ss *streamSlots) signal() {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	if ss.freedCh != nil {
+		close(ss.freedCh)
+		ss.freedCh = nil
+	}
+}
+
+// tryReserveStreams counts n more active streams if that doesn't take the session beyond MaxStreams
+func (sesh *Session) tryReserveStreams(n int) bool {
+	for {
+		count := sesh.streamCount()
+		if sesh.MaxStreams > 0 && int(count)+n > sesh.MaxStreams {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&sesh.activeStreamCount, count, count+uint32(n)) {
+			raisePeak(&sesh.peakStreams, int64(count)+int64(n))
+			return true
+		}
+	}
+}
+
+// reserveStreams counts n more active streams, waiting according to OpenStreamRetry if MaxStreams has been reached
+func (sesh *Session) reserveStreams(n int) error {
+	if sesh.tryReserveStreams(n) {
+		return nil
+	}
+	retry := sesh.OpenStreamRetry
+	if retry.MaxWait <= 0 || n > sesh.MaxStreams {
+		return ErrTooManyStreams
+	}
+	deadline := time.NewTimer(retry.MaxWait)
+	defer deadline.Stop()
+	backoff := retry.InitialBackoff
+	for {
+		// taken before retrying, so that a stream ending in between isn't missed
+		freed := sesh.slots.freed()
+		if sesh.tryReserveStreams(n) {
+			return nil
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-freed:
+		case <-timer.C:
+		case <-deadline.C:
+			timer.Stop()
+			return ErrTooManyStreams
+		case <-sesh.done:
+			timer.Stop()
+			return ErrBrokenSession
+		}
+		timer.Stop()
+		backoff *= 2
+		if backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package multiplex
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_MaxStreams(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	makeSesh := func(retry OpenStreamRetry) *Session {
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, MaxStreams: 2, OpenStreamRetry: retry})
+		sesh.AddConnection(connutil.Discard())
+		return sesh
+	}
+
+	t.Run("fails without retry", func(t *testing.T) {
+		sesh := makeSesh(OpenStreamRetry{})
+		defer sesh.Close()
+		_, _ = sesh.OpenStream()
+		stream, _ := sesh.OpenStream()
+		_, err := sesh.OpenStream()
+		assert.Equal(t, ErrTooManyStreams, err)
+		_, err = sesh.OpenStreamBatch(1)
+		assert.Equal(t, ErrTooManyStreams, err)
+
+		_ = stream.Close()
+		_, err = sesh.OpenStream()
+		assert.NoError(t, err)
+	})
+
+	t.Run("try open", func(t *testing.T) {
+		// TryOpenStream doesn't wait even if OpenStream would
+		sesh := makeSesh(OpenStreamRetry{MaxWait: 5 * time.Second})
+		defer sesh.Close()
+		stream, ok := sesh.TryOpenStream()
+		assert.True(t, ok)
+		assert.NotNil(t, stream)
+		_, ok = sesh.TryOpenStream()
+		assert.True(t, ok)
+
+		start := time.Now()
+		stream, ok = sesh.TryOpenStream()
+		assert.False(t, ok)
+		assert.Nil(t, stream)
+		assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond), "TryOpenStream blocks at MaxStreams")
+		assert.Equal(t, uint32(2), sesh.streamCount())
+	})
+
+	t.Run("freed slot unblocks", func(t *testing.T) {
+		// the backoff is too long for a retry to open the stream, so it must be woken up by the stream ending
+		sesh := makeSesh(OpenStreamRetry{MaxWait: 5 * time.Second, InitialBackoff: 5 * time.Second})
+		defer sesh.Close()
+		_, _ = sesh.OpenStream()
+		stream, _ := sesh.OpenStream()
+
+		opened := make(chan error)
+		go func() {
+			_, err := sesh.OpenStream()
+			opened <- err
+		}()
+		select {
+		case err := <-opened:
+			t.Fatalf("stream opened beyond MaxStreams with err %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		_ = stream.Close()
+		select {
+		case err := <-opened:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("OpenStream isn't unblocked by a stream ending")
+		}
+		assert.Equal(t, uint32(2), sesh.streamCount())
+	})
+
+	t.Run("gives up after MaxWait", func(t *testing.T) {
+		sesh := makeSesh(OpenStreamRetry{MaxWait: 100 * time.Millisecond})
+		defer sesh.Close()
+		_, _ = sesh.OpenStreamBatch(2)
+		start := time.Now()
+		_, err := sesh.OpenStream()
+		assert.Equal(t, ErrTooManyStreams, err)
+		assert.True(t, time.Since(start) >= 100*time.Millisecond, "gave up before MaxWait")
+		assert.Equal(t, uint32(2), sesh.streamCount())
+	})
+
+	t.Run("session closed while waiting", func(t *testing.T) {
+		sesh := makeSesh(OpenStreamRetry{MaxWait: 5 * time.Second})
+		_, _ = sesh.OpenStreamBatch(2)
+		time.AfterFunc(50*time.Millisecond, func() { _ = sesh.Close() })
+		_, err := sesh.OpenStream()
+		assert.Equal(t, ErrBrokenSession, err)
+	})
+}
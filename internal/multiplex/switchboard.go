@@ -2,11 +2,13 @@ package multiplex
 
 import (
 	"errors"
-	log "github.com/sirupsen/logrus"
+	"fmt"
 	"math/rand"
 	"net"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -27,18 +29,56 @@ type switchboard struct {
 	valve    Valve
 	strategy switchboardStrategy
 
+	// bytes sent and received through all connections, including frame headers and overheads
+	sent     *throughputMeter
+	received *throughputMeter
+
 	// map of connId to net.Conn
-	conns      sync.Map
+	conns sync.Map
+	// map of connId to ConnInfo
+	connInfos sync.Map
+	// map of connId to *connHealth
+	health     sync.Map
 	numConns   uint32
 	nextConnId uint32
+	// atomic. The connection to send all data through while it's alive, set when it's added with
+	// Session.AddPreferredConnection or hinted by the remote. 0 if there isn't one, as connIds start from 1
+	preferredConnId uint32
 
 	broken uint32
+
+	// resumeTimer is non-nil while all connections have dropped and the switchboard is waiting for a new one to be
+	// added within session.ResumptionWindow. Outbound data sent in the meantime is held in pending.
+	resumeM     sync.Mutex
+	resumeTimer *time.Timer
+	pending     [][]byte
+	pendingLen  int
+	// broadcast when pending has been emptied, and when flushing has been cleared
+	pendingCond *sync.Cond
+	// atomic, written with resumeM held. 1 while held data is being flushed into a connection added on resumption,
+	// which happens without holding resumeM. Data sent in the meantime waits, so that it doesn't overtake held data
+	flushing uint32
+	// closed while there is a connection to send data through. Replaced when all connections have dropped and the
+	// switchboard starts waiting for resumption. Guarded by resumeM
+	readyCh chan struct{}
+
+	// signalled when a connection has been lost, so that maintainConns can replace it
+	connLost chan struct{}
+
+	// atomic. The smallest path MTU of all connections. Only used with session.PathMTUDiscovery
+	pathMTU             uint32
+	pathMTUProbeTimeout time.Duration
+
+	// connections added with Session.AddLazyConnection, and the number of them being dialed
+	lazyM       sync.Mutex
+	lazyConns   []*lazyConn
+	lazyDialing int
 }
 
 func makeSwitchboard(sesh *Session) *switchboard {
 	var strategy switchboardStrategy
 	if sesh.Unordered {
-		log.Debug("Connection is unordered")
+		sesh.Logger.Debugf("Connection is unordered")
 		strategy = UNIFORM_SPREAD
 	} else {
 		strategy = FIXED_CONN_MAPPING
@@ -47,69 +87,332 @@ func makeSwitchboard(sesh *Session) *switchboard {
 		session:    sesh,
 		strategy:   strategy,
 		valve:      sesh.Valve,
+		sent:       newThroughputMeter(),
+		received:   newThroughputMeter(),
 		nextConnId: 1,
 	}
+	sb.pendingCond = sync.NewCond(&sb.resumeM)
+	sb.readyCh = make(chan struct{})
+	sb.connLost = make(chan struct{}, 1)
+	sb.pathMTU = basePathMTU
+	sb.pathMTUProbeTimeout = defaultPathMTUProbeTimeout
+	if sesh.MsgOnWireSizeLimit < basePathMTU {
+		sb.pathMTU = uint32(sesh.MsgOnWireSizeLimit)
+	}
 	return sb
 }
 
 var errBrokenSwitchboard = errors.New("the switchboard is broken")
+var errResumptionBufferFull = errors.New("resumption buffer is full")
+var errNoSuchConn = errors.New("no connection of this id")
+var errConnRemoved = errors.New("the connection has been removed")
+var errConnDrained = errors.New("the connection has been drained")
+
+// ErrRecvPanic is wrapped by the error passed to SessionConfig.OnError when receiving data from an underlying
+// connection has caused a panic. The connection is closed, while the session carries on with its other connections
+var ErrRecvPanic = errors.New("panicked while receiving a frame")
 
 func (sb *switchboard) connsCount() int {
 	return int(atomic.LoadUint32(&sb.numConns))
 }
 
-func (sb *switchboard) addConn(conn net.Conn) {
+// AddressFamily is the address family of an underlying connection
+type AddressFamily int
+
+const (
+	FamilyUnspecified AddressFamily = iota
+	FamilyIPv4
+	FamilyIPv6
+)
+
+// familyOf returns the address family of addr, or FamilyUnspecified if addr isn't an IP address
+func familyOf(addr net.Addr) AddressFamily {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return FamilyUnspecified
+	}
+	if ip == nil {
+		return FamilyUnspecified
+	}
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// ConnInfo describes an underlying connection in a Session's connection pool
+type ConnInfo struct {
+	ID         uint32
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	Family     AddressFamily
+	// Preferred is whether data is sent through this connection in preference to all others
+	Preferred bool
+	// EncryptionMethod is that of the Obfuscator of the connection, which is the session's unless the connection has
+	// been added with Session.AddConnectionWithObfuscator
+	EncryptionMethod byte
+}
+
+func (sb *switchboard) connInfoList() []ConnInfo {
+	var infos []ConnInfo
+	preferred := atomic.LoadUint32(&sb.preferredConnId)
+	sb.connInfos.Range(func(connIdI, infoI interface{}) bool {
+		info := infoI.(ConnInfo)
+		info.Preferred = connIdI.(uint32) == preferred
+		infos = append(infos, info)
+		return true
+	})
+	return infos
+}
+
+func (sb *switchboard) deleteConn(connId uint32) {
+	sb.conns.Delete(connId)
+	sb.connInfos.Delete(connId)
+	sb.health.Delete(connId)
+	atomic.CompareAndSwapUint32(&sb.preferredConnId, connId, 0)
+	sb.updatePathMTU()
+}
+
+func (sb *switchboard) setPreferredConn(connId uint32) {
+	atomic.StoreUint32(&sb.preferredConnId, connId)
+}
+
+// preferredConn returns the preferred connection if there is one and it's still in the pool
+func (sb *switchboard) preferredConn() (uint32, net.Conn, bool) {
+	connId := atomic.LoadUint32(&sb.preferredConnId)
+	if connId == 0 {
+		return 0, nil, false
+	}
+	connI, ok := sb.conns.Load(connId)
+	if !ok {
+		return 0, nil, false
+	}
+	return connId, connI.(net.Conn), true
+}
+
+func (sb *switchboard) addConn(conn net.Conn) (uint32, error) {
+	return sb.addConnOfFamily(conn, familyOf(conn.RemoteAddr()))
+}
+
+func (sb *switchboard) addConnOfFamily(conn net.Conn, family AddressFamily) (uint32, error) {
+	return sb.addConnWithObfuscator(conn, family, nil)
+}
+
+// addConnWithObfuscator adds conn to the pool, unless it already has MaxConnections connections. If obfuscator isn't
+// nil, frames through conn are obfuscated with it instead of the session's Obfuscator
+func (sb *switchboard) addConnWithObfuscator(conn net.Conn, family AddressFamily,
+	obfuscator *Obfuscator) (uint32, error) {
+	if sb.atMaxConns() {
+		return 0, ErrTooManyConnections
+	}
+	info := ConnInfo{
+		LocalAddr:        conn.LocalAddr(),
+		RemoteAddr:       conn.RemoteAddr(),
+		Family:           family,
+		EncryptionMethod: sb.session.Obfuscator.encryptionMethod,
+	}
+	if sb.session.TCPOptions != nil {
+		applyTCPOptions(conn, sb.session.TCPOptions)
+	}
+	if sb.session.ConnPrefix != nil {
+		// innermost, so that the prefix is sent and read as is
+		conn = &prefixConn{Conn: conn, prefix: sb.session.ConnPrefix}
+	}
+	if sb.session.MimicTLSRecordSizes {
+		conn = &recordConn{Conn: conn}
+	}
+	if sb.session.SendJitter.enabled() {
+		conn = &jitterConn{Conn: conn, jitter: sb.session.SendJitter}
+	}
+	if obfuscator != nil {
+		// outermost, so that it sees whole frames
+		conn = &obfsConn{
+			Conn:           conn,
+			session:        &sb.session.Obfuscator,
+			logger:         sb.session.Logger,
+			obfuscator:     obfuscator,
+			recvObfuscator: obfuscator,
+		}
+		info.EncryptionMethod = obfuscator.encryptionMethod
+	}
 	connId := atomic.AddUint32(&sb.nextConnId, 1) - 1
+	info.ID = connId
+	health := &connHealth{
+		lastRecv:   time.Now().UnixNano(),
+		deplexDone: make(chan struct{}),
+		pathMTUAck: make(chan uint32, pathMTUMaxProbes),
+	}
+	sb.session.sendResumeRequest(conn)
+	sb.resumeM.Lock()
+	if sb.atMaxConns() {
+		// another connection has been added in the meantime
+		sb.resumeM.Unlock()
+		return 0, ErrTooManyConnections
+	}
+	flush := sb.resume()
 	atomic.AddUint32(&sb.numConns, 1)
+	sb.connInfos.Store(connId, info)
+	sb.health.Store(connId, health)
 	sb.conns.Store(connId, conn)
-	go sb.deplex(connId, conn)
+	select {
+	case <-sb.readyCh:
+	default:
+		close(sb.readyCh)
+	}
+	sb.resumeM.Unlock()
+	go sb.deplex(connId, conn, health)
+	if flush {
+		sb.flushPending(conn)
+	}
+	if sb.session.PathMTUDiscovery {
+		sb.updatePathMTU()
+		if sb.session.MsgOnWireSizeLimit > basePathMTU {
+			go sb.discoverPathMTU(connId, health)
+		}
+	}
+	return connId, nil
+}
+
+// atMaxConns returns whether the session has as many connections as MaxConnections allows
+func (sb *switchboard) atMaxConns() bool {
+	return sb.session.MaxConnections > 0 && sb.connsCount() >= sb.session.MaxConnections
 }
 
 // a pointer to connId is passed here so that the switchboard can reassign it if that connId isn't usable
 func (sb *switchboard) send(data []byte, connId *uint32) (n int, err error) {
-	writeAndRegUsage := func(conn net.Conn, d []byte) (int, error) {
-		n, err = conn.Write(d)
-		if err != nil {
-			sb.conns.Delete(*connId)
-			sb.close("failed to write to remote " + err.Error())
+	sb.valve.txWait(len(data))
+	for {
+		n, err = sb.sendOnce(data, connId)
+		if err != errConnRemoved {
 			return n, err
 		}
-		sb.valve.AddTx(int64(n))
-		return n, nil
+		// the connection has been taken out of the pool since it was picked, so another one will be picked
 	}
+}
 
-	sb.valve.txWait(len(data))
-	if atomic.LoadUint32(&sb.broken) == 1 || sb.connsCount() == 0 {
+func (sb *switchboard) sendOnce(data []byte, connId *uint32) (n int, err error) {
+	if atomic.LoadUint32(&sb.broken) == 1 {
 		return 0, errBrokenSwitchboard
 	}
+	if atomic.LoadUint32(&sb.flushing) == 1 {
+		sb.waitFlushed()
+	}
+	if sb.connsCount() == 0 {
+		if sb.hasLazyConns() {
+			if err := sb.waitLazy(); err != nil {
+				return 0, err
+			}
+			return sb.sendOnce(data, connId)
+		}
+		return sb.hold(data)
+	}
 
 	switch sb.strategy {
 	case UNIFORM_SPREAD:
-		_, conn, err := sb.pickRandConn()
+		id, conn, err := sb.pickRandConn()
 		if err != nil {
-			return 0, errBrokenSwitchboard
+			return sb.hold(data)
 		}
-		return writeAndRegUsage(conn, data)
+		return sb.writeAndRegUsage(id, conn, data)
 	case FIXED_CONN_MAPPING:
+		// streams migrate to the preferred connection when there is one
+		if preferredId, conn, ok := sb.preferredConn(); ok {
+			*connId = preferredId
+			return sb.writeAndRegUsage(preferredId, conn, data)
+		}
 		connI, ok := sb.conns.Load(*connId)
 		if ok {
 			conn := connI.(net.Conn)
-			return writeAndRegUsage(conn, data)
+			return sb.writeAndRegUsage(*connId, conn, data)
 		} else {
 			newConnId, conn, err := sb.pickRandConn()
 			if err != nil {
-				return 0, errBrokenSwitchboard
+				return sb.hold(data)
 			}
 			*connId = newConnId
-			return writeAndRegUsage(conn, data)
+			return sb.writeAndRegUsage(newConnId, conn, data)
 		}
 	default:
 		return 0, errors.New("unsupported traffic distribution strategy")
 	}
 }
 
-// returns a random connId
+// sendTo sends data through the connection of connId only
+func (sb *switchboard) sendTo(data []byte, connId uint32) (int, error) {
+	sb.valve.txWait(len(data))
+	if atomic.LoadUint32(&sb.broken) == 1 {
+		return 0, errBrokenSwitchboard
+	}
+	connI, ok := sb.conns.Load(connId)
+	if !ok {
+		return 0, errNoSuchConn
+	}
+	return sb.writeAndRegUsage(connId, connI.(net.Conn), data)
+}
+
+func (sb *switchboard) writeAndRegUsage(id uint32, conn net.Conn, d []byte) (int, error) {
+	healthI, ok := sb.health.Load(id)
+	if !ok {
+		return 0, errConnRemoved
+	}
+	health := healthI.(*connHealth)
+	// a connection being drained waits for writes in progress
+	health.writeM.RLock()
+	defer health.writeM.RUnlock()
+	if atomic.LoadUint32(&health.removed) == 1 {
+		return 0, errConnRemoved
+	}
+	var deadline time.Time
+	if sb.session.ConnWriteTimeout > 0 {
+		deadline = time.Now().Add(sb.session.ConnWriteTimeout)
+		_ = conn.SetWriteDeadline(deadline)
+	}
+	n, err := conn.Write(d)
+	if err != nil {
+		if atomic.LoadUint32(&health.removed) == 1 {
+			// closed while draining, so whatever has been written will be discarded by the remote
+			return 0, errConnRemoved
+		}
+		if timedOut(err, deadline) {
+			// whatever has been written will be discarded by the remote once the connection is closed, so send will
+			// pick another connection for the whole of d
+			sb.evictConn(id, conn, health, "a write into it has timed out")
+			return 0, errConnRemoved
+		}
+		sb.deleteConn(id)
+		if sb.session.ResumptionWindow > 0 {
+			// deplex will notice the closed connection and start waiting for resumption if necessary
+			conn.Close()
+			return sb.hold(d)
+		}
+		sb.close("failed to write to remote " + err.Error())
+		return n, err
+	}
+	sb.valve.AddTx(int64(n))
+	sb.sent.add(n)
+	return n, nil
+}
+
+// returns a random connId, preferring the preferred connection if there is one, then connections of
+// session.PreferredFamily if there are any
 func (sb *switchboard) pickRandConn() (uint32, net.Conn, error) {
+	if id, conn, ok := sb.preferredConn(); ok {
+		return id, conn, nil
+	}
+	if preferred := sb.session.PreferredFamily; preferred != FamilyUnspecified {
+		id, conn, ok := sb.pickRandConnOfFamily(preferred)
+		if ok {
+			return id, conn, nil
+		}
+	}
+
 	connCount := sb.connsCount()
 	if atomic.LoadUint32(&sb.broken) == 1 || connCount == 0 {
 		return 0, nil, errBrokenSwitchboard
@@ -123,9 +426,9 @@ func (sb *switchboard) pickRandConn() (uint32, net.Conn, error) {
 	r := rand.Intn(connCount)
 	var c int
 	sb.conns.Range(func(connIdI, connI interface{}) bool {
+		id = connIdI.(uint32)
+		conn = connI.(net.Conn)
 		if r == c {
-			id = connIdI.(uint32)
-			conn = connI.(net.Conn)
 			return false
 		}
 		c++
@@ -138,6 +441,26 @@ func (sb *switchboard) pickRandConn() (uint32, net.Conn, error) {
 	return id, conn, nil
 }
 
+func (sb *switchboard) pickRandConnOfFamily(family AddressFamily) (uint32, net.Conn, bool) {
+	var ids []uint32
+	sb.connInfos.Range(func(connIdI, infoI interface{}) bool {
+		if infoI.(ConnInfo).Family == family {
+			ids = append(ids, connIdI.(uint32))
+		}
+		return true
+	})
+	// a connection may have been removed since its info was visited
+	for len(ids) > 0 {
+		i := rand.Intn(len(ids))
+		connI, ok := sb.conns.Load(ids[i])
+		if ok {
+			return ids[i], connI.(net.Conn), true
+		}
+		ids = append(ids[:i], ids[i+1:]...)
+	}
+	return 0, nil, false
+}
+
 func (sb *switchboard) close(terminalMsg string) {
 	atomic.StoreUint32(&sb.broken, 1)
 	if !sb.session.IsClosed() {
@@ -146,35 +469,303 @@ func (sb *switchboard) close(terminalMsg string) {
 	}
 }
 
+// hold keeps a copy of data to be sent once a new connection is added, if the switchboard may be resumed. Otherwise
+// it returns errBrokenSwitchboard
+func (sb *switchboard) hold(data []byte) (int, error) {
+	if sb.session.ResumptionWindow <= 0 {
+		return 0, errBrokenSwitchboard
+	}
+	sb.resumeM.Lock()
+	defer sb.resumeM.Unlock()
+	if atomic.LoadUint32(&sb.broken) == 1 || sb.session.IsClosed() {
+		return 0, errBrokenSwitchboard
+	}
+	if sb.resumeTimer == nil && sb.connsCount() == 0 {
+		// no connection has ever been added
+		return 0, errBrokenSwitchboard
+	}
+	if sb.pendingLen+len(data) > sb.session.ResumptionBufferSize {
+		return 0, errResumptionBufferFull
+	}
+	sb.pending = append(sb.pending, append([]byte(nil), data...))
+	sb.pendingLen += len(data)
+	return len(data), nil
+}
+
+func (sb *switchboard) awaitingResumption() bool {
+	sb.resumeM.Lock()
+	defer sb.resumeM.Unlock()
+	return sb.resumeTimer != nil
+}
+
+// connDropped is called when a connection has dropped and the session may be resumed. If it was the last connection,
+// the session will be closed unless a new connection is added within session.ResumptionWindow
+func (sb *switchboard) connDropped() {
+	sb.resumeM.Lock()
+	defer sb.resumeM.Unlock()
+	remaining := atomic.AddUint32(&sb.numConns, ^uint32(0))
+	sb.signalConnLost()
+	if remaining != 0 || sb.resumeTimer != nil || atomic.LoadUint32(&sb.broken) == 1 || sb.session.IsClosed() {
+		return
+	}
+	sb.session.Logger.Debugf("all connections of session %v have dropped, waiting for resumption", sb.session.id)
+	sb.readyCh = make(chan struct{})
+	var timer *time.Timer
+	timer = time.AfterFunc(sb.session.ResumptionWindow, func() {
+		sb.resumeM.Lock()
+		if sb.resumeTimer != timer {
+			// resumed in the meantime
+			sb.resumeM.Unlock()
+			return
+		}
+		sb.resumeTimer = nil
+		sb.pending = nil
+		sb.pendingLen = 0
+		sb.pendingCond.Broadcast()
+		sb.resumeM.Unlock()
+		sb.close("session was not resumed within the resumption window")
+	})
+	sb.resumeTimer = timer
+}
+
+// ready returns a channel that is closed once there is a connection to send data through
+func (sb *switchboard) ready() <-chan struct{} {
+	sb.resumeM.Lock()
+	defer sb.resumeM.Unlock()
+	return sb.readyCh
+}
+
+// resume stops waiting for resumption as a connection is being added, and returns whether there is held data to be
+// flushed into it with flushPending, in which case data sent from now on waits until that is done. sb.resumeM must be
+// held by the caller
+func (sb *switchboard) resume() bool {
+	if sb.resumeTimer != nil {
+		sb.resumeTimer.Stop()
+		sb.resumeTimer = nil
+		sb.session.Logger.Debugf("session %v resumed", sb.session.id)
+	}
+	if len(sb.pending) == 0 || atomic.LoadUint32(&sb.flushing) == 1 {
+		// nothing held, or another connection is being flushed into already
+		return false
+	}
+	atomic.StoreUint32(&sb.flushing, 1)
+	return true
+}
+
+// flushPending writes outbound data held during resumption into conn, a newly added connection, in the order it was
+// sent. resumeM is only held between writes, so that a slow connection doesn't block the rest of the switchboard
+func (sb *switchboard) flushPending(conn net.Conn) {
+	sb.resumeM.Lock()
+	defer sb.resumeM.Unlock()
+	defer sb.pendingCond.Broadcast()
+	defer atomic.StoreUint32(&sb.flushing, 0)
+	for len(sb.pending) > 0 {
+		data := sb.pending[0]
+		sb.resumeM.Unlock()
+		n, err := conn.Write(data)
+		sb.resumeM.Lock()
+		if err != nil {
+			// whatever is left will be flushed into the next connection
+			sb.session.Logger.Debugf("failed to flush held data into a resumed connection: %v", err)
+			return
+		}
+		sb.valve.AddTx(int64(n))
+		sb.sent.add(n)
+		if len(sb.pending) == 0 {
+			// dropped as the session closed in the meantime
+			return
+		}
+		sb.pendingLen -= len(sb.pending[0])
+		sb.pending = sb.pending[1:]
+	}
+	sb.pending = nil
+}
+
+// waitFlushed blocks until held data being flushed by flushPending has been written
+func (sb *switchboard) waitFlushed() {
+	sb.resumeM.Lock()
+	defer sb.resumeM.Unlock()
+	for atomic.LoadUint32(&sb.flushing) == 1 {
+		sb.pendingCond.Wait()
+	}
+}
+
+// waitPending blocks until all outbound data held during resumption has been handed to a connection. It returns
+// errBrokenSwitchboard if the held data was dropped because the session closed
+func (sb *switchboard) waitPending() error {
+	sb.resumeM.Lock()
+	defer sb.resumeM.Unlock()
+	for len(sb.pending) > 0 || atomic.LoadUint32(&sb.flushing) == 1 {
+		sb.pendingCond.Wait()
+	}
+	if atomic.LoadUint32(&sb.broken) == 1 || sb.session.IsClosed() {
+		return errBrokenSwitchboard
+	}
+	return nil
+}
+
 // actively triggered by session.Close()
 func (sb *switchboard) closeAll() {
+	sb.resumeM.Lock()
+	if sb.resumeTimer != nil {
+		sb.resumeTimer.Stop()
+		sb.resumeTimer = nil
+	}
+	sb.pending = nil
+	sb.pendingLen = 0
+	sb.pendingCond.Broadcast()
+	sb.resumeM.Unlock()
 	sb.conns.Range(func(key, connI interface{}) bool {
 		conn := connI.(net.Conn)
 		conn.Close()
-		sb.conns.Delete(key)
+		sb.deleteConn(key.(uint32))
 		return true
 	})
 }
 
 // deplex function costantly reads from a TCP connection
-func (sb *switchboard) deplex(connId uint32, conn net.Conn) {
+func (sb *switchboard) deplex(connId uint32, conn net.Conn, health *connHealth) {
+	defer close(health.deplexDone)
 	defer conn.Close()
+	var pipeline *decryptPipeline
+	if sb.session.decryptJobs != nil {
+		pipeline = sb.startDecryptPipeline(connId, conn, health)
+		defer pipeline.finish()
+	}
 	buf := make([]byte, sb.session.ConnReceiveBufferSize)
 	for {
+		var deadline time.Time
+		if sb.session.ConnReadTimeout > 0 {
+			deadline = time.Now().Add(sb.session.ConnReadTimeout)
+			_ = conn.SetReadDeadline(deadline)
+		}
+		// conn must return exactly one frame per Read, however the frame has arrived. common.TLSConn reads the length
+		// of each record first, then the record in full
 		n, err := conn.Read(buf)
 		sb.valve.rxWait(n)
 		sb.valve.AddRx(int64(n))
+		sb.received.add(n)
 		if err != nil {
-			log.Debugf("a connection for session %v has closed: %v", sb.session.id, err)
-			sb.conns.Delete(connId)
+			if pipeline != nil {
+				// frames received before the error are acted on first
+				pipeline.finish()
+			}
+			if atomic.LoadUint32(&health.removed) == 1 {
+				// already taken out of the pool by removeConn
+				return
+			}
+			if timedOut(err, deadline) {
+				sb.evictConn(connId, conn, health, "nothing has been read from it within the read timeout")
+				return
+			}
+			sb.session.Logger.Debugf("a connection for session %v has closed: %v", sb.session.id, err)
+			sb.deleteConn(connId)
+			if sb.session.ResumptionWindow > 0 {
+				sb.connDropped()
+				return
+			}
 			atomic.AddUint32(&sb.numConns, ^uint32(0))
 			sb.close("a connection has dropped unexpectedly")
 			return
 		}
 
-		err = sb.session.recvDataFromRemote(buf[:n])
-		if err != nil {
-			log.Error(err)
+		if sb.session.ProbeInterval > 0 {
+			atomic.StoreInt64(&health.lastRecv, time.Now().UnixNano())
+		}
+
+		if pipeline != nil {
+			// buf is reused for the next record before this one is deobfuscated
+			if !pipeline.submit(append([]byte(nil), buf[:n]...)) {
+				return
+			}
+			continue
+		}
+		if sb.recvFailed(connId, conn, health, sb.recvFrame(buf[:n], connId)) {
+			// closed by the deferred conn.Close
+			return
 		}
 	}
 }
+
+// recvFailed handles err from receiving a frame from the connection of connId. It returns whether the connection
+// is no longer to be read from
+func (sb *switchboard) recvFailed(connId uint32, conn net.Conn, health *connHealth, err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == errConnDrained {
+		return true
+	}
+	sb.session.Logger.Errorf("failed to receive a frame for session %v: %v", sb.session.id, err)
+	sb.session.recordError(err)
+	if sb.session.OnError != nil {
+		sb.session.OnError(err)
+	}
+	if errors.Is(err, ErrRecvPanic) {
+		// the connection may be in a bad state, but the session can carry on without it
+		sb.removeConn(connId, conn, health, "the last connection has been closed after a panic")
+		return true
+	}
+	return false
+}
+
+// timedOut returns whether err, from an operation on a connection with deadline set, is due to the deadline. Not all
+// connections return a net.Error when their deadline is exceeded, so any error returned past the deadline counts
+func timedOut(err error, deadline time.Time) bool {
+	if deadline.IsZero() {
+		return false
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return !time.Now().Before(deadline)
+}
+
+// recvFrame passes data received from the connection of connId to the session, recovering from any panic caused by
+// malformed data so that it doesn't take down the process
+func (sb *switchboard) recvFrame(data []byte, connId uint32) (err error) {
+	defer sb.session.recoverRecv(&err)
+	return sb.session.recvDataFromRemote(data, connId)
+}
+
+// recoverRecv turns a panic receiving a frame into an error wrapping ErrRecvPanic, stored in err. It must be deferred
+func (sesh *Session) recoverRecv(err *error) {
+	if r := recover(); r != nil {
+		sesh.Logger.Errorf("recovered from a panic receiving a frame for session %v: %v\n%s", sesh.id, r, debug.Stack())
+		*err = fmt.Errorf("%w: %v", ErrRecvPanic, r)
+	}
+}
+
+// removeConn takes a connection out of the pool and closes it without waiting for deplex to notice that it's closed.
+// If it was the last connection, the session is closed with terminalMsg, unless the session may be resumed or the
+// connection will be replaced by session.Dialer. It returns false if the connection had already been removed
+func (sb *switchboard) removeConn(connId uint32, conn net.Conn, health *connHealth, terminalMsg string) bool {
+	if !atomic.CompareAndSwapUint32(&health.removed, 0, 1) {
+		return false
+	}
+	sb.deleteConn(connId)
+	conn.Close()
+	sb.connRemoved(terminalMsg)
+	return true
+}
+
+// connRemoved counts a connection that has been taken out of the pool. If it was the last connection, the session is
+// closed with terminalMsg, unless the session may be resumed or the connection will be replaced by session.Dialer
+func (sb *switchboard) connRemoved(terminalMsg string) {
+	if sb.session.ResumptionWindow > 0 {
+		sb.connDropped()
+		return
+	}
+	remaining := atomic.AddUint32(&sb.numConns, ^uint32(0))
+	sb.signalConnLost()
+	if remaining == 0 && sb.session.Dialer == nil {
+		sb.close(terminalMsg)
+	}
+}
+
+func (sb *switchboard) signalConnLost() {
+	select {
+	case sb.connLost <- struct{}{}:
+	default:
+	}
+}
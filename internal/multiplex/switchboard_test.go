@@ -1,17 +1,27 @@
 package multiplex
 
 import (
+	"bytes"
+	"errors"
+	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/connutil"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"math/rand"
+	"net"
 	"sync"
 	"testing"
 	"time"
 )
 
 func TestSwitchboard_Send(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
 	doTest := func(seshConfig SessionConfig) {
+		seshConfig.Obfuscator = obfuscator
 		sesh := MakeSession(0, seshConfig)
+		defer sesh.Close()
 		hole0 := connutil.Discard()
 		sesh.sb.addConn(hole0)
 		connId, _, err := sesh.sb.pickRandConn()
@@ -86,10 +96,15 @@ func BenchmarkSwitchboard_Send(b *testing.B) {
 }
 
 func TestSwitchboard_TxCredit(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
 	seshConfig := SessionConfig{
-		Valve: MakeValve(1<<20, 1<<20),
+		Obfuscator: obfuscator,
+		Valve:      MakeValve(1<<20, 1<<20),
 	}
 	sesh := MakeSession(0, seshConfig)
+	defer sesh.Close()
 	hole := connutil.Discard()
 	sesh.sb.addConn(hole)
 	connId, _, err := sesh.sb.pickRandConn()
@@ -183,3 +198,300 @@ func TestSwitchboard_ConnsCount(t *testing.T) {
 		return sesh.sb.connsCount() == 0
 	}, time.Second, 10*time.Millisecond, "connsCount incorrect: %v", sesh.sb.connsCount())
 }
+
+func TestSwitchboard_MaxConnections(t *testing.T) {
+	const maxConns = 4
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, [32]byte{})
+	seshConfig := SessionConfig{Obfuscator: obfuscator, MaxConnections: maxConns}
+	sesh := MakeSession(0, seshConfig)
+	defer sesh.Close()
+
+	// added concurrently, so that the cap can't be overshot by connections added at the same time
+	errs := make(chan error, 2*maxConns)
+	for i := 0; i < 2*maxConns; i++ {
+		go func() { errs <- sesh.AddConnection(connutil.Discard()) }()
+	}
+	added := 0
+	for i := 0; i < 2*maxConns; i++ {
+		err := <-errs
+		if err == nil {
+			added++
+		} else {
+			assert.Equal(t, ErrTooManyConnections, err)
+		}
+	}
+	assert.Equal(t, maxConns, added)
+	assert.Equal(t, maxConns, sesh.sb.connsCount())
+
+	t.Run("one more", func(t *testing.T) {
+		sesh := MakeSession(0, seshConfig)
+		defer sesh.Close()
+		for i := 0; i < maxConns; i++ {
+			assert.NoError(t, sesh.AddConnection(connutil.Discard()))
+		}
+		assert.Equal(t, ErrTooManyConnections, sesh.AddConnection(connutil.Discard()))
+		assert.Equal(t, ErrTooManyConnections, sesh.AddPreferredConnection(connutil.Discard()))
+	})
+}
+
+func TestSwitchboard_PreferredFamily(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	seshConfig := SessionConfig{
+		Obfuscator:      obfuscator,
+		PreferredFamily: FamilyIPv6,
+	}
+	sesh := MakeSession(0, seshConfig)
+	defer sesh.Close()
+	sesh.AddConnectionWithFamily(connutil.Discard(), FamilyIPv4)
+	sesh.AddConnectionWithFamily(connutil.Discard(), FamilyIPv6)
+	sesh.AddConnectionWithFamily(connutil.Discard(), FamilyIPv4)
+
+	infos := sesh.Connections()
+	if len(infos) != 3 {
+		t.Fatalf("expecting 3 connections, got %v", len(infos))
+	}
+	var v6Id uint32
+	for _, info := range infos {
+		if info.Family == FamilyIPv6 {
+			v6Id = info.ID
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		connId, _, err := sesh.sb.pickRandConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connId != v6Id {
+			t.Fatalf("picked connection %v instead of the IPv6 connection %v", connId, v6Id)
+		}
+	}
+
+	sesh.sb.deleteConn(v6Id)
+	_, _, err := sesh.sb.pickRandConn()
+	assert.NoError(t, err, "should fall back to connections of other families")
+}
+
+func TestSession_AddPreferredConnection(t *testing.T) {
+	clientSesh, serverSesh, _ := makeSessionPair(1)
+
+	c, s := connutil.AsyncPipe()
+	serverSesh.AddConnection(common.NewTLSConn(s))
+	err := clientSesh.AddPreferredConnection(common.NewTLSConn(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preferredId := func(sesh *Session) uint32 {
+		for _, info := range sesh.Connections() {
+			if info.Preferred {
+				return info.ID
+			}
+		}
+		return 0
+	}
+	// connIds start from 1, so the second connection on each end has the id of 2
+	assert.EqualValues(t, 2, preferredId(clientSesh))
+	assert.Eventually(t, func() bool {
+		return preferredId(serverSesh) == 2
+	}, time.Second, 10*time.Millisecond, "remote doesn't prefer the new connection")
+
+	for _, sesh := range []*Session{clientSesh, serverSesh} {
+		for i := 0; i < 100; i++ {
+			connId, _, err := sesh.sb.pickRandConn()
+			assert.NoError(t, err)
+			assert.EqualValues(t, 2, connId)
+		}
+	}
+
+	stream, _ := clientSesh.OpenStream()
+	_, err = stream.Write([]byte{1})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, stream.assignedConnId)
+
+	clientSesh.sb.deleteConn(2)
+	assert.EqualValues(t, 0, preferredId(clientSesh))
+	connId, _, err := clientSesh.sb.pickRandConn()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, connId, "should fall back to the other connection")
+}
+
+func TestFamilyOf(t *testing.T) {
+	assert.Equal(t, FamilyIPv4, familyOf(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+	assert.Equal(t, FamilyIPv6, familyOf(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}))
+	assert.Equal(t, FamilyIPv4, familyOf(&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}))
+	assert.Equal(t, FamilyUnspecified, familyOf(&net.UnixAddr{Name: "sock"}))
+	assert.Equal(t, FamilyUnspecified, familyOf(nil))
+}
+
+func TestSwitchboard_RecvPanic(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+	corrupt := make([]byte, 64)
+	rand.Read(corrupt)
+	deobfs := obfuscator.Deobfs
+	// simulates a bug in frame decoding triggered by malformed data
+	obfuscator.Deobfs = func(in []byte) (*Frame, error) {
+		if bytes.Equal(in, corrupt) {
+			panic("malformed frame")
+		}
+		return deobfs(in)
+	}
+
+	var errs []error
+	var errsM sync.Mutex
+	sesh := MakeSession(0, SessionConfig{
+		Obfuscator: obfuscator,
+		OnError: func(err error) {
+			errsM.Lock()
+			errs = append(errs, err)
+			errsM.Unlock()
+		},
+	})
+
+	conn0client, conn0server := connutil.AsyncPipe()
+	sesh.AddConnection(common.NewTLSConn(conn0client))
+	conn1client, conn1server := connutil.AsyncPipe()
+	sesh.AddConnection(common.NewTLSConn(conn1client))
+
+	_, _ = common.NewTLSConn(conn0server).Write(corrupt)
+
+	assert.Eventually(t, func() bool {
+		return len(sesh.Connections()) == 1
+	}, time.Second, 10*time.Millisecond, "the connection isn't closed")
+	assert.False(t, sesh.IsClosed(), "the session doesn't survive")
+	errsM.Lock()
+	if assert.Len(t, errs, 1) {
+		assert.True(t, errors.Is(errs[0], ErrRecvPanic))
+	}
+	errsM.Unlock()
+
+	// the session still works through the other connection
+	remoteSesh := setupSesh(false, sessionKey, EncryptionMethodPlain)
+	remoteSesh.AddConnection(common.NewTLSConn(conn1server))
+	stream, _ := remoteSesh.OpenStream()
+	_, _ = stream.Write([]byte{1})
+	_, err := sesh.Accept()
+	assert.NoError(t, err)
+
+	t.Run("last connection", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+		connClient, connServer := connutil.AsyncPipe()
+		sesh.AddConnection(common.NewTLSConn(connClient))
+		_, _ = common.NewTLSConn(connServer).Write(corrupt)
+		assert.Eventually(t, func() bool {
+			return sesh.IsClosed()
+		}, time.Second, 10*time.Millisecond, "the session isn't closed")
+	})
+}
+
+// trickleConn writes data one byte at a time, so that the remote receives frames in as many pieces as possible
+type trickleConn struct {
+	net.Conn
+}
+
+func (c trickleConn) Write(b []byte) (int, error) {
+	for i := range b {
+		if _, err := c.Conn.Write(b[i : i+1]); err != nil {
+			return i, err
+		}
+	}
+	return len(b), nil
+}
+
+func TestSwitchboard_PartialReads(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	sender := setupSesh(false, sessionKey, EncryptionMethodChaha20Poly1305)
+	receiver := setupSesh(false, sessionKey, EncryptionMethodChaha20Poly1305)
+	defer sender.Close()
+	defer receiver.Close()
+
+	c, s := connutil.AsyncPipe()
+	sender.AddConnection(common.NewTLSConn(trickleConn{c}))
+	receiver.AddConnection(common.NewTLSConn(s))
+
+	var pieces [][]byte
+	var sent []byte
+	for i := 0; i < 50; i++ {
+		data := make([]byte, rand.Intn(4096)+1)
+		rand.Read(data)
+		pieces = append(pieces, data)
+		sent = append(sent, data...)
+	}
+	stream, _ := sender.OpenStream()
+	go func() {
+		for _, data := range pieces {
+			if _, err := stream.Write(data); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	accepted, err := receiver.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	received := make([]byte, len(sent))
+	_, err = io.ReadFull(accepted, received)
+	assert.NoError(t, err)
+	assert.Equal(t, sent, received)
+}
+
+func TestSwitchboard_ConnTimeouts(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+
+	t.Run("write timeout", func(t *testing.T) {
+		clientSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, ConnWriteTimeout: 50 * time.Millisecond})
+		serverSesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+		// the other end is never read from, and its buffer is already full, so every write blocks
+		stalled, _ := connutil.LimitedAsyncPipe(1)
+		_, _ = stalled.Write([]byte{0, 0})
+		stalledId, _ := clientSesh.sb.addConn(common.NewTLSConn(stalled))
+		clientSesh.sb.setPreferredConn(stalledId)
+
+		stream, _ := clientSesh.OpenStream()
+		testData := make([]byte, 100)
+		rand.Read(testData)
+		for i := 0; i < 3; i++ {
+			_, err := stream.Write(testData)
+			assert.NoError(t, err)
+		}
+		conns := clientSesh.Connections()
+		if assert.Len(t, conns, 1) {
+			assert.NotEqual(t, stalledId, conns[0].ID, "the stalled connection isn't evicted")
+		}
+		assert.False(t, clientSesh.IsClosed())
+
+		// data that timed out is sent through the healthy connection
+		serverStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		readBuf := make([]byte, len(testData))
+		_, err = io.ReadFull(serverStream, readBuf)
+		assert.NoError(t, err)
+		assert.Equal(t, testData, readBuf)
+	})
+
+	t.Run("read timeout", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, ConnReadTimeout: 50 * time.Millisecond})
+		defer sesh.Close()
+		silent, _ := connutil.AsyncPipe()
+		sesh.AddConnection(common.NewTLSConn(silent))
+		assert.Eventually(t, sesh.IsClosed, time.Second, 10*time.Millisecond)
+		assert.Equal(t, "all connections have been evicted", sesh.TerminalMsg())
+	})
+}
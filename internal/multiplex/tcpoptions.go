@@ -0,0 +1,65 @@
+package multiplex
+
+import (
+	"net"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// TCPOptions are socket options applied to the TCP connections underlying the connections added to a session
+type TCPOptions struct {
+	// NoDelay sets TCP_NODELAY, which disables Nagle's algorithm so that small frames are sent without delay. Go sets
+	// it on all TCP connections by default
+	NoDelay bool
+	// KeepAlive, if positive, enables SO_KEEPALIVE with KeepAlive as the period between keep-alive probes, so that a
+	// dead remote is detected by the transport. If negative, SO_KEEPALIVE is disabled. Zero leaves it as it is
+	KeepAlive time.Duration
+}
+
+// tcpConnOf returns the TCP connection underlying conn, or nil if there isn't one or it can't be reached. It sees
+// through common.TLSConn, and wrappers exposing their underlying connection as crypto/tls.Conn and
+// gorilla/websocket.Conn do
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *common.TLSConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		case interface{ UnderlyingConn() net.Conn }:
+			conn = c.UnderlyingConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// applyTCPOptions applies opts to the TCP connection underlying conn. Connections that aren't TCP are left alone.
+// Failures are logged, as the connection is usable regardless
+func applyTCPOptions(conn net.Conn, opts *TCPOptions) {
+	tcpConn := tcpConnOf(conn)
+	if tcpConn == nil {
+		log.Tracef("not applying TCP options to %v, which isn't a TCP connection", conn.RemoteAddr())
+		return
+	}
+	if err := tcpConn.SetNoDelay(opts.NoDelay); err != nil {
+		log.Warnf("failed to set TCP_NODELAY on a connection to %v: %v", conn.RemoteAddr(), err)
+	}
+	if opts.KeepAlive == 0 {
+		return
+	}
+	if err := tcpConn.SetKeepAlive(opts.KeepAlive > 0); err != nil {
+		log.Warnf("failed to set SO_KEEPALIVE on a connection to %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if opts.KeepAlive > 0 {
+		if err := tcpConn.SetKeepAlivePeriod(opts.KeepAlive); err != nil {
+			log.Warnf("failed to set the keep-alive period of a connection to %v: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
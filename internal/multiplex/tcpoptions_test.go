@@ -0,0 +1,100 @@
+// +build linux
+
+package multiplex
+
+import (
+	"math/rand"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_TCPOptions(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodPlain, sessionKey)
+
+	sockopt := func(conn *net.TCPConn, level, opt int) int {
+		raw, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value int
+		var sockErr error
+		err = raw.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+		})
+		if err != nil || sockErr != nil {
+			t.Fatal(err, sockErr)
+		}
+		return value
+	}
+
+	// tcpPair returns both ends of a TCP connection through the loopback interface
+	tcpPair := func() (*net.TCPConn, *net.TCPConn) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		accepted := make(chan net.Conn)
+		go func() {
+			conn, _ := listener.Accept()
+			accepted <- conn
+		}()
+		c, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.(*net.TCPConn), (<-accepted).(*net.TCPConn)
+	}
+
+	for _, opts := range []TCPOptions{
+		{NoDelay: false, KeepAlive: 10 * time.Second},
+		{NoDelay: true, KeepAlive: -1},
+	} {
+		c, s := tcpPair()
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, TCPOptions: &opts})
+		remote := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+		// wrapped like connections are in practice
+		sesh.AddConnection(common.NewTLSConn(c))
+		remote.AddConnection(common.NewTLSConn(s))
+
+		noDelay := sockopt(c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0
+		assert.Equal(t, opts.NoDelay, noDelay)
+		keepAlive := sockopt(c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0
+		assert.Equal(t, opts.KeepAlive > 0, keepAlive)
+		if opts.KeepAlive > 0 {
+			assert.Equal(t, int(opts.KeepAlive/time.Second), sockopt(c, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+		}
+
+		// the connection still works
+		stream, _ := sesh.OpenStream()
+		_, err := stream.Write([]byte{1})
+		assert.NoError(t, err)
+		_, err = remote.Accept()
+		assert.NoError(t, err)
+		sesh.Close()
+		remote.Close()
+	}
+
+	t.Run("not TCP", func(t *testing.T) {
+		sesh := MakeSession(0, SessionConfig{Obfuscator: obfuscator, TCPOptions: &TCPOptions{KeepAlive: time.Second}})
+		remote := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+		defer sesh.Close()
+		defer remote.Close()
+		c, s := connutil.AsyncPipe()
+		sesh.AddConnection(common.NewTLSConn(c))
+		remote.AddConnection(common.NewTLSConn(s))
+		stream, _ := sesh.OpenStream()
+		_, err := stream.Write([]byte{1})
+		assert.NoError(t, err)
+		_, err = remote.Accept()
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,57 @@
+package multiplex
+
+import (
+	"io"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+// TestVector is a frame obfuscated with a known key and source of randomness, so that other implementations of the
+// wire format can check that they produce and accept exactly the same bytes
+type TestVector struct {
+	EncryptionMethod byte
+	// Compact is whether the frame is serialised with a compact header where it's shorter, as it is once both ends
+	// support CapCompactHeader
+	Compact    bool
+	Key        [32]byte
+	Frame      Frame
+	Obfuscated []byte
+}
+
+// MakeTestVectors obfuscates f with key by each encryption method available in this build, with standard and then
+// compact headers, in the order of ObfuscatorMethodsAvailable. The random bytes EncryptionMethodPlain pads payloads
+// shorter than 8 bytes with, and the nonces of EncryptionMethodXorStream, are read from rand in that order, so the
+// same rand gives the same vectors. Unlike changing Rand, this is safe to call while sessions are in use
+func MakeTestVectors(key [32]byte, f Frame, rand io.Reader) ([]TestVector, error) {
+	readRand := func(buf []byte) { common.RandRead(rand, buf) }
+	var vectors []TestVector
+	for _, method := range availableEncryptionMethods {
+		payloadCipher, err := makePayloadCipher(method, key)
+		if err != nil {
+			return nil, err
+		}
+		bufLen := frameHeaderLength + len(f.Payload) + salsa20NonceSize
+		if payloadCipher != nil {
+			bufLen += payloadCipher.Overhead()
+		}
+		if xs, ok := payloadCipher.(*xorStream); ok {
+			xs.readRand = readRand
+		}
+		for _, compact := range []bool{false, true} {
+			obfs := makeObfs(key, payloadCipher, compact, readRand)
+			buf := make([]byte, bufLen)
+			n, err := obfs(&f, buf, 0)
+			if err != nil {
+				return nil, err
+			}
+			vectors = append(vectors, TestVector{
+				EncryptionMethod: method,
+				Compact:          compact,
+				Key:              key,
+				Frame:            Frame{f.StreamID, f.Seq, f.Closing, append([]byte(nil), f.Payload...)},
+				Obfuscated:       buf[:n],
+			})
+		}
+	}
+	return vectors, nil
+}
@@ -0,0 +1,60 @@
+package multiplex
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeTestVectors(t *testing.T) {
+	var key [32]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	f := Frame{StreamID: 1, Seq: 2, Closing: closingNothing, Payload: []byte("hi")}
+	// standard and compact vectors of each method. Any change breaks compatibility with other implementations and
+	// older versions
+	golden := map[byte][2]string{
+		EncryptionMethodPlain: {
+			"7e0a9ae8fd673722ee497ea431446869aaaaaaaaaaaa",
+			"800a9ce8ff6869aaaaaaaaaaaa",
+		},
+		EncryptionMethodAESGCM: {
+			"e324dfef4a5deb5a722648828dc7b8c1d0f40bf6b42d0835584c3aecddea3caf",
+			"1d24cfef48b8c1d0f40bf6b42d0835584c3aecddea3caf",
+		},
+		EncryptionMethodChaha20Poly1305: {
+			"28d24de93ea103af175ae5f106f9d100df4915238b70ce9c030cc9a2ef8e48a3",
+			"d6d25de93cd100df4915238b70ce9c030cc9a2ef8e48a3",
+		},
+		EncryptionMethodXorStream: {
+			"6fb69fa38ad7bc8224636be70c46dfc0aaaaaaaaaaaaaaaa",
+			"91b697a388dfc0aaaaaaaaaaaaaaaa",
+		},
+	}
+
+	vectors, err := MakeTestVectors(key, f, bytes.NewReader(bytes.Repeat([]byte{0xaa}, 64)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, vectors, 2*len(availableEncryptionMethods))
+	for _, v := range vectors {
+		i := 0
+		if v.Compact {
+			i = 1
+		}
+		assert.Equal(t, golden[v.EncryptionMethod][i], hex.EncodeToString(v.Obfuscated),
+			"vector of %v with compact header %v has changed", encryptionMethodName(v.EncryptionMethod), v.Compact)
+
+		obfuscator, _ := MakeObfuscator(v.EncryptionMethod, key)
+		deobfsed, err := obfuscator.anyDeobfser()(append([]byte(nil), v.Obfuscated...))
+		if assert.NoError(t, err) {
+			assert.Equal(t, f, *deobfsed)
+		}
+	}
+
+	again, _ := MakeTestVectors(key, f, bytes.NewReader(bytes.Repeat([]byte{0xaa}, 64)))
+	assert.Equal(t, vectors, again)
+}
@@ -0,0 +1,62 @@
+package multiplex
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// throughputSampleInterval is the minimum duration between samples of a throughputMeter. Queries in between return
+	// the previous estimate, so that querying it frequently is cheap
+	throughputSampleInterval = 100 * time.Millisecond
+	// throughputWindow is the time constant of the moving average of a throughputMeter: the weight of a rate sampled
+	// this long ago has decayed to 1/e
+	throughputWindow = time.Second
+)
+
+// throughputMeter estimates the rate at which bytes are transferred from a running count of them. The rates over
+// each period between samples are combined in an exponentially weighted moving average, which starts from the first
+// sample. Samples are taken when the estimate is queried, rather than on a timer, and weighted by the length of the
+// period they cover
+type throughputMeter struct {
+	// atomic. Must be the first field for 64-bit alignment on 32-bit platforms
+	total uint64
+
+	m          sync.Mutex
+	lastTotal  uint64
+	lastSample time.Time
+	rate       float64
+	hasSampled bool
+}
+
+func newThroughputMeter() *throughputMeter {
+	return &throughputMeter{lastSample: time.Now()}
+}
+
+func (t *throughputMeter) add(n int) {
+	atomic.AddUint64(&t.total, uint64(n))
+}
+
+// estimate returns the estimated rate in bytes per second at now
+func (t *throughputMeter) estimate(now time.Time) float64 {
+	t.m.Lock()
+	defer t.m.Unlock()
+	elapsed := now.Sub(t.lastSample)
+	if elapsed < throughputSampleInterval {
+		return t.rate
+	}
+	total := atomic.LoadUint64(&t.total)
+	sampled := float64(total-t.lastTotal) / elapsed.Seconds()
+	if t.hasSampled {
+		weight := 1 - math.Exp(-elapsed.Seconds()/throughputWindow.Seconds())
+		t.rate += weight * (sampled - t.rate)
+	} else {
+		t.rate = sampled
+		t.hasSampled = true
+	}
+	t.lastTotal = total
+	t.lastSample = now
+	return t.rate
+}
@@ -0,0 +1,70 @@
+package multiplex
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThroughputMeter(t *testing.T) {
+	start := time.Now()
+	meter := &throughputMeter{lastSample: start}
+	const rate = 1 << 20
+	const step = 50 * time.Millisecond
+
+	now := start
+	for now.Sub(start) < 5*time.Second {
+		now = now.Add(step)
+		meter.add(int(rate * step.Seconds()))
+		meter.estimate(now)
+	}
+	assert.InEpsilon(t, rate, meter.estimate(now), 0.05, "steady rate isn't tracked")
+
+	// rate halves
+	for i := 0; i < 100; i++ {
+		now = now.Add(step)
+		meter.add(int(rate / 2 * step.Seconds()))
+		meter.estimate(now)
+	}
+	assert.InEpsilon(t, rate/2, meter.estimate(now), 0.05, "change of rate isn't tracked")
+
+	// nothing is transferred for a long time before the next query
+	now = now.Add(time.Minute)
+	assert.InDelta(t, 0, meter.estimate(now), 1)
+
+	t.Run("queried more often than sampled", func(t *testing.T) {
+		meter := &throughputMeter{lastSample: start}
+		meter.add(1000)
+		assert.Equal(t, float64(0), meter.estimate(start.Add(throughputSampleInterval/2)))
+		assert.NotZero(t, meter.estimate(start.Add(throughputSampleInterval)))
+	})
+}
+
+func TestSession_Throughput(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	sesh := setupSesh(false, sessionKey, EncryptionMethodPlain)
+	sesh.AddConnection(connutil.Discard())
+
+	stream, _ := sesh.OpenStream()
+	data := make([]byte, 1000)
+	const rate = 200 * 1000
+	start := time.Now()
+	written := 0
+	for time.Since(start) < 1500*time.Millisecond {
+		// keeps to the rate on average however long each sleep actually takes
+		for float64(written) < time.Since(start).Seconds()*rate {
+			_, _ = stream.Write(data)
+			written += len(data)
+		}
+		time.Sleep(5 * time.Millisecond)
+		sesh.Throughput()
+	}
+	sent, received := sesh.Throughput()
+	// frames carry overheads
+	assert.InEpsilon(t, rate, sent, 0.2)
+	assert.Zero(t, received)
+}
@@ -0,0 +1,74 @@
+package multiplex
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// With SessionConfig.Timestamped, the time each frame is sent at is appended to its payload, after any padding and
+// before any checksum, so that the receiver can estimate the one-way delay of data frames and its jitter. The delay
+// is the difference between the clocks of both ends, so it's only meaningful if they are roughly in sync. Its
+// variation, the jitter, doesn't depend on the clocks being in sync.
+
+const timestampLen = 8
+
+// ErrShortTimestamp is returned when a frame received is too short to carry a timestamp
+var ErrShortTimestamp = errors.New("frame too short for a timestamp")
+
+// delayStats keeps estimates of the one-way delay of data frames received, smoothed like TCP's round trip time, and of
+// its jitter as defined for RTP in RFC 3550
+type delayStats struct {
+	m       sync.Mutex
+	sampled bool
+	delay   time.Duration
+	jitter  time.Duration
+	// the delay of the last frame
+	last time.Duration
+}
+
+func (d *delayStats) add(sample time.Duration) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if !d.sampled {
+		d.sampled = true
+		d.delay = sample
+		d.last = sample
+		return
+	}
+	d.delay += (sample - d.delay) / 8
+	variation := sample - d.last
+	if variation < 0 {
+		variation = -variation
+	}
+	d.jitter += (variation - d.jitter) / 16
+	d.last = sample
+}
+
+// timestampTrailerLen returns the number of bytes added to each frame payload for its timestamp
+func (sesh *Session) timestampTrailerLen() int {
+	if sesh.Timestamped {
+		return timestampLen
+	}
+	return 0
+}
+
+// stripTimestamp strips the timestamp at the end of the payload of f and returns it
+func stripTimestamp(f *Frame) (time.Time, error) {
+	if len(f.Payload) < timestampLen {
+		return time.Time{}, ErrShortTimestamp
+	}
+	payload := f.Payload[:len(f.Payload)-timestampLen]
+	sentAt := time.Unix(0, int64(u64(f.Payload[len(payload):])))
+	f.Payload = payload
+	return sentAt, nil
+}
+
+// OneWayDelay returns the estimated one-way delay of data frames received from the remote and its jitter, and whether
+// any timestamped data frame has been received. The delay includes the difference between the clocks of both ends,
+// and may be negative if the remote's clock is ahead. Both ends must set SessionConfig.Timestamped
+func (sesh *Session) OneWayDelay() (delay time.Duration, jitter time.Duration, ok bool) {
+	sesh.delay.m.Lock()
+	defer sesh.delay.m.Unlock()
+	return sesh.delay.delay, sesh.delay.jitter, sesh.delay.sampled
+}
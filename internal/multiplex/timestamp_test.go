@@ -0,0 +1,100 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_Timestamped(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodAESGCM, sessionKey)
+
+	for _, config := range []SessionConfig{
+		{Obfuscator: obfuscator, Timestamped: true},
+		{Obfuscator: obfuscator, Timestamped: true, FrameChecksum: true, PaddingScheme: PaddingScheme{BucketSize: 512}},
+	} {
+		sesh := MakeSession(0, config)
+		obfsBuf := make([]byte, sesh.MsgOnWireSizeLimit)
+		for _, payloadLen := range []int{1, 100, sesh.maxStreamUnitWrite} {
+			payload := make([]byte, payloadLen)
+			rand.Read(payload)
+			f := &Frame{
+				StreamID: 1,
+				Seq:      2,
+				Closing:  closingNothing,
+				Payload:  payload,
+			}
+			n, err := sesh.obfs(f, obfsBuf, 0)
+			if err != nil {
+				t.Fatalf("failed to obfs payload of length %v: %v", payloadLen, err)
+			}
+			assert.LessOrEqual(t, n, sesh.MsgOnWireSizeLimit)
+
+			resultFrame, err := sesh.deobfs(obfsBuf[:n])
+			if err != nil {
+				t.Fatalf("failed to deobfs payload of length %v: %v", payloadLen, err)
+			}
+			if !bytes.Equal(payload, resultFrame.Payload) {
+				t.Errorf("expecting %x, got %x", payload, resultFrame.Payload)
+			}
+		}
+	}
+
+	t.Run("delay measured", func(t *testing.T) {
+		config := SessionConfig{Obfuscator: obfuscator, Timestamped: true, Unordered: true, Role: RoleClient}
+		clientSesh := MakeSession(0, config)
+		serverSesh := MakeSession(0, config.Derive())
+		defer clientSesh.Close()
+		defer serverSesh.Close()
+		c, s := connutil.AsyncPipe()
+		clientSesh.AddConnection(common.NewTLSConn(c))
+		serverSesh.AddConnection(common.NewTLSConn(s))
+
+		_, _, ok := serverSesh.OneWayDelay()
+		assert.False(t, ok)
+
+		stream, _ := clientSesh.OpenStream()
+		testData := []byte{1, 2, 3}
+		for i := 0; i < 10; i++ {
+			_, err := stream.Write(testData)
+			assert.NoError(t, err)
+		}
+		serverStream, err := serverSesh.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		readBuf := make([]byte, len(testData))
+		for i := 0; i < 10; i++ {
+			_, err = io.ReadFull(serverStream, readBuf)
+			assert.NoError(t, err)
+			assert.Equal(t, testData, readBuf)
+		}
+
+		delay, jitter, ok := serverSesh.OneWayDelay()
+		assert.True(t, ok)
+		// both ends share a clock
+		assert.True(t, delay >= 0 && delay < time.Second, "delay of %v", delay)
+		assert.True(t, jitter >= 0 && jitter < time.Second, "jitter of %v", jitter)
+	})
+}
+
+func TestDelayStats(t *testing.T) {
+	var d delayStats
+	d.add(10 * time.Millisecond)
+	assert.Equal(t, 10*time.Millisecond, d.delay)
+	assert.Zero(t, d.jitter)
+	d.add(26 * time.Millisecond)
+	assert.Equal(t, 12*time.Millisecond, d.delay)
+	assert.Equal(t, time.Millisecond, d.jitter)
+	d.add(10 * time.Millisecond)
+	assert.Equal(t, 11750*time.Microsecond, d.delay)
+	assert.Equal(t, 1937500*time.Nanosecond, d.jitter)
+}
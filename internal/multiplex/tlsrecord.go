@@ -0,0 +1,116 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// frames are prefixed with their length so that they can be reassembled from records
+	recordFrameLenFieldSize = 2
+	maxRecordFrameLen       = 1<<(8*recordFrameLenFieldSize) - 1
+
+	// the size of a full TLS 1.3 record with AES-GCM: 2^14 bytes of plaintext, the inner content type and the tag
+	fullRecordLen = 1<<14 + 1 + 16
+	// the size of records that fit into a single TCP segment, which TLS implementations with dynamic record sizing
+	// use at the start of a transfer. This is the default in nginx
+	smallRecordLen = 1369
+	// the number of small records sent before switching to full records
+	smallRecordsThreshold = 40
+	// the idle time after which records go back to being small
+	recordSizeResetIdle = time.Second
+
+	// big enough for any record that can be read from common.TLSConn
+	recordReadBufSize = 1 << 16
+)
+
+var errRecordFrameTooLong = errors.New("frame is too long to be sent in TLS records")
+
+// recordConn sends frames through the connection it wraps as a stream of TLS records with sizes typical of real TLS
+// traffic, instead of one record per frame. Like TLS implementations with dynamic record sizing, it starts each
+// transfer with small records and switches to full records after a while. Each Write is sent as full records with the
+// remainder in a shorter record, so a record may contain the end of a frame and the start of the next one.
+//
+// The connection it wraps must send each Write in its own record, as common.TLSConn does. Frames are reassembled from
+// records using a length prefix before each frame. The length prefix isn't encrypted.
+type recordConn struct {
+	net.Conn
+
+	writeM       sync.Mutex
+	writeBuf     []byte
+	smallRecords int
+	lastWrite    time.Time
+
+	// only used by switchboard.deplex
+	readBuf   bytes.Buffer
+	recordBuf []byte
+}
+
+func (c *recordConn) recordLen() int {
+	if c.smallRecords < smallRecordsThreshold {
+		c.smallRecords++
+		return smallRecordLen
+	}
+	return fullRecordLen
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	if len(b) > maxRecordFrameLen {
+		return 0, errRecordFrameTooLong
+	}
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastWrite) > recordSizeResetIdle {
+		c.smallRecords = 0
+	}
+	c.lastWrite = now
+
+	c.writeBuf = append(c.writeBuf[:0], make([]byte, recordFrameLenFieldSize)...)
+	putU16(c.writeBuf, uint16(len(b)))
+	c.writeBuf = append(c.writeBuf, b...)
+	toWrite := c.writeBuf
+	for len(toWrite) > 0 {
+		recordLen := c.recordLen()
+		if recordLen > len(toWrite) {
+			recordLen = len(toWrite)
+		}
+		_, err := c.Conn.Write(toWrite[:recordLen])
+		if err != nil {
+			return 0, err
+		}
+		toWrite = toWrite[recordLen:]
+	}
+	return len(b), nil
+}
+
+// Read reads one whole frame into b, reading as many records as needed
+func (c *recordConn) Read(b []byte) (int, error) {
+	if c.recordBuf == nil {
+		c.recordBuf = make([]byte, recordReadBufSize)
+	}
+	for {
+		buffered := c.readBuf.Bytes()
+		if len(buffered) >= recordFrameLenFieldSize {
+			frameLen := int(u16(buffered))
+			if len(buffered) >= recordFrameLenFieldSize+frameLen {
+				if frameLen > len(b) {
+					return 0, io.ErrShortBuffer
+				}
+				c.readBuf.Next(recordFrameLenFieldSize)
+				return c.readBuf.Read(b[:frameLen])
+			}
+		}
+
+		n, err := c.Conn.Read(c.recordBuf)
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf.Write(c.recordBuf[:n])
+	}
+}
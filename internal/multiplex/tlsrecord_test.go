@@ -0,0 +1,115 @@
+package multiplex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordConn(t *testing.T) {
+	c, s := connutil.AsyncPipe()
+	sender := &recordConn{Conn: common.NewTLSConn(c)}
+	receiver := &recordConn{Conn: common.NewTLSConn(s)}
+
+	var frames [][]byte
+	for _, frameLen := range []int{1, 100, smallRecordLen, 3 * smallRecordLen, 20000} {
+		frame := make([]byte, frameLen)
+		rand.Read(frame)
+		frames = append(frames, frame)
+	}
+
+	go func() {
+		for i := 0; i < smallRecordsThreshold; i++ {
+			for _, frame := range frames {
+				_, err := sender.Write(frame)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, 30000)
+	for i := 0; i < smallRecordsThreshold; i++ {
+		for _, frame := range frames {
+			n, err := receiver.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(frame, buf[:n]) {
+				t.Fatalf("frame of length %v isn't reassembled correctly", len(frame))
+			}
+		}
+	}
+
+	t.Run("record sizes", func(t *testing.T) {
+		c, s := connutil.AsyncPipe()
+		sender := &recordConn{Conn: common.NewTLSConn(c)}
+		frame := make([]byte, 60000)
+
+		go func() {
+			sender.Write(frame)
+			sender.Write(frame)
+		}()
+
+		var recordLens []int
+		header := make([]byte, 5)
+		for received := 0; received < 2*(len(frame)+recordFrameLenFieldSize); {
+			_, err := io.ReadFull(s, header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recordLen := int(binary.BigEndian.Uint16(header[3:5]))
+			_, err = io.ReadFull(s, make([]byte, recordLen))
+			if err != nil {
+				t.Fatal(err)
+			}
+			recordLens = append(recordLens, recordLen)
+			received += recordLen
+		}
+		for i, recordLen := range recordLens {
+			if i < smallRecordsThreshold {
+				assert.LessOrEqual(t, recordLen, smallRecordLen)
+			} else {
+				assert.LessOrEqual(t, recordLen, fullRecordLen)
+			}
+		}
+		// the first frame ends after the small records
+		assert.Equal(t, fullRecordLen, recordLens[smallRecordsThreshold+1], "didn't switch to full records")
+	})
+}
+
+func TestSession_MimicTLSRecordSizes(t *testing.T) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := MakeObfuscator(EncryptionMethodChaha20Poly1305, sessionKey)
+	seshConfig := SessionConfig{
+		Obfuscator:          obfuscator,
+		MimicTLSRecordSizes: true,
+	}
+	clientSesh := MakeSession(0, seshConfig)
+	serverSesh := MakeSession(0, seshConfig)
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+
+	testData := make([]byte, 1<<20)
+	rand.Read(testData)
+	stream, _ := clientSesh.OpenStream()
+	go stream.Write(testData)
+
+	serverStream, _ := serverSesh.Accept()
+	recvBuf := make([]byte, len(testData))
+	_, err := io.ReadFull(serverStream, recvBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testData, recvBuf)
+}
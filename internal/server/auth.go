@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -17,6 +18,7 @@ type ClientInfo struct {
 	ProxyMethod      string
 	EncryptionMethod byte
 	Unordered        bool
+	Capabilities     mux.Capability
 	Transport        Transport
 }
 
@@ -46,6 +48,8 @@ func decryptClientInfo(fragments authFragments, serverTime time.Time) (info Clie
 		ProxyMethod:      string(bytes.Trim(plaintext[16:28], "\x00")),
 		EncryptionMethod: plaintext[28],
 		Unordered:        plaintext[41]&UNORDERED_FLAG != 0,
+		// zero if the client doesn't know about capabilities
+		Capabilities: mux.Capability(binary.BigEndian.Uint32(plaintext[42:46])),
 	}
 
 	timestamp := int64(binary.BigEndian.Uint64(plaintext[29:37]))
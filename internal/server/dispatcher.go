@@ -185,6 +185,8 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		Valve:              nil,
 		Unordered:          ci.Unordered,
 		MsgOnWireSizeLimit: appDataMaxLength,
+		Capabilities:       sta.Capabilities,
+		MaxConnections:     sta.MaxConnectionsPerSession,
 	}
 
 	// adminUID can use the server as normal with unlimited QoS credits. The adminUID is not
@@ -199,6 +201,7 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		}
 		log.Trace("finished handshake")
 		sesh.AddConnection(preparedConn)
+		sesh.SetPeerCapabilities(ci.Capabilities)
 		//TODO: Router could be nil in cnc mode
 		log.WithField("remoteAddr", preparedConn.RemoteAddr()).Info("New admin session")
 		err = http.Serve(sesh, usermanager.APIRouterOf(sta.Panel.Manager))
@@ -236,7 +239,17 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		return
 	}
 	log.Trace("finished handshake")
-	sesh.AddConnection(preparedConn)
+	if err := sesh.AddConnection(preparedConn); err != nil {
+		log.WithFields(log.Fields{
+			"UID":        b64(ci.UID),
+			"sessionID":  ci.SessionId,
+			"remoteAddr": preparedConn.RemoteAddr(),
+			"error":      err,
+		}).Warn("rejected a connection joining a session")
+		preparedConn.Close()
+		return
+	}
+	sesh.SetPeerCapabilities(ci.Capabilities)
 
 	if !existing {
 		// if the session was newly made, we serve connections from the session streams to the proxy server
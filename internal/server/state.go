@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
 	"io/ioutil"
 	"net"
@@ -24,6 +25,10 @@ type RawConfig struct {
 	DatabasePath string
 	KeepAlive    int
 	CncMode      bool
+	// MaxConnectionsPerSession caps the number of connections a client can join to one session. Zero means no limit
+	MaxConnectionsPerSession int
+	// Capabilities names the multiplexing capabilities advertised to clients, see mux.ParseCapabilities
+	Capabilities []string
 }
 
 // State type stores the global state of the program
@@ -45,6 +50,11 @@ type State struct {
 	usedRandomM sync.RWMutex
 	UsedRandom  map[[32]byte]int64
 
+	// the MaxConnections of each session
+	MaxConnectionsPerSession int
+	// the Capabilities of each session
+	Capabilities mux.Capability
+
 	Panel *userPanel
 }
 
@@ -138,6 +148,8 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 		UsedRandom:  map[[32]byte]int64{},
 		RedirDialer: &net.Dialer{},
 		WorldState:  worldState,
+
+		MaxConnectionsPerSession: preParse.MaxConnectionsPerSession,
 	}
 	if preParse.CncMode {
 		err = errors.New("command & control mode not implemented")
@@ -168,6 +180,12 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 		return
 	}
 
+	sta.Capabilities, err = mux.ParseCapabilities(preParse.Capabilities)
+	if err != nil {
+		err = fmt.Errorf("unable to parse Capabilities: %v", err)
+		return
+	}
+
 	if len(preParse.PrivateKey) == 0 {
 		err = fmt.Errorf("must have a valid private key. Run `ck-server -key` to generate one")
 		return
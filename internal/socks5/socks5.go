@@ -0,0 +1,178 @@
+// Package socks5 is a SOCKS5 front-end for a Cloak session. Each SOCKS5 connection accepted is relayed through a
+// stream of its own, opened with the address the SOCKS5 client asked to connect to as the stream's metadata, in the
+// form of "host:port". The remote end can then dial string(stream.Meta()) and relay the stream to it. Only the CONNECT
+// command without authentication is supported.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	version5 = 0x05
+
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	repSucceeded               = 0x00
+	repGeneralFailure          = 0x01
+	repCommandNotSupported     = 0x07
+	repAddressTypeNotSupported = 0x08
+)
+
+// handshakeTimeout bounds the time a SOCKS5 client has to send its greeting and request
+const handshakeTimeout = 10 * time.Second
+
+var ErrBadVersion = errors.New("not a SOCKS5 client")
+var ErrNoAcceptableMethod = errors.New("client doesn't offer authenticating with no authentication")
+var ErrCommandNotSupported = errors.New("only the CONNECT command is supported")
+var ErrAddressTypeNotSupported = errors.New("unknown address type")
+
+// Serve accepts SOCKS5 connections from l and relays each of them through a stream opened on sesh, until l fails to
+// accept, whose error is returned. The remote end of sesh must support stream metadata, see mux.CapStreamMeta
+func Serve(l net.Listener, sesh *mux.Session) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := ServeConn(conn, sesh); err != nil {
+				log.Debugf("SOCKS5 connection from %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn does the SOCKS5 handshake with conn, opens a stream on sesh for the address requested, and relays data
+// between them until either end closes. conn is closed when ServeConn returns. The SOCKS5 client is told it has
+// connected as soon as the stream is opened, as the remote end doesn't report whether it could reach the address
+func ServeConn(conn net.Conn, sesh *mux.Session) error {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	target, err := handshake(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	stream, err := sesh.OpenStreamWithMeta([]byte(target))
+	if err != nil {
+		_ = reply(conn, repGeneralFailure)
+		conn.Close()
+		return fmt.Errorf("failed to open stream to %v: %w", target, err)
+	}
+	if err = reply(conn, repSucceeded); err != nil {
+		conn.Close()
+		stream.Close()
+		return err
+	}
+
+	go func() {
+		if _, err := common.Copy(conn, stream); err != nil {
+			log.Tracef("copying stream to SOCKS5 client: %v", err)
+		}
+	}()
+	if _, err = common.Copy(stream, conn); err != nil {
+		log.Tracef("copying SOCKS5 client to stream: %v", err)
+	}
+	return nil
+}
+
+// handshake reads the greeting and request of a SOCKS5 client from conn, answering the greeting, and returns the
+// address requested. If the request can't be served, the client is told why before an error is returned
+func handshake(conn net.Conn) (target string, err error) {
+	// VER, NMETHODS
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != version5 {
+		return "", ErrBadVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == methodNoAuth {
+			method = methodNoAuth
+			break
+		}
+	}
+	if _, err = conn.Write([]byte{version5, method}); err != nil {
+		return "", err
+	}
+	if method == methodNoAcceptable {
+		return "", ErrNoAcceptableMethod
+	}
+
+	// VER, CMD, RSV, ATYP
+	request := make([]byte, 4)
+	if _, err = io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[0] != version5 {
+		return "", ErrBadVersion
+	}
+	if request[1] != cmdConnect {
+		_ = reply(conn, repCommandNotSupported)
+		return "", ErrCommandNotSupported
+	}
+
+	var host string
+	switch request[3] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		domainLen := make([]byte, 1)
+		if _, err = io.ReadFull(conn, domainLen); err != nil {
+			return "", err
+		}
+		domain := make([]byte, domainLen[0])
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = reply(conn, repAddressTypeNotSupported)
+		return "", ErrAddressTypeNotSupported
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// reply sends a reply with rep to a SOCKS5 client. The bound address is always 0.0.0.0:0, as the connection to the
+// address requested is made by the remote end of the session
+func reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{version5, rep, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
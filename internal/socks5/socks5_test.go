@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeSessionPair() (*mux.Session, *mux.Session) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+	obfuscator, _ := mux.MakeObfuscator(mux.EncryptionMethodAESGCM, sessionKey)
+	clientConfig := mux.SessionConfig{
+		Obfuscator: obfuscator,
+		Role:       mux.RoleClient,
+	}
+	clientSesh := mux.MakeSession(1, clientConfig)
+	serverSesh := mux.MakeSession(1, clientConfig.Derive())
+	c, s := connutil.AsyncPipe()
+	clientSesh.AddConnection(common.NewTLSConn(c))
+	serverSesh.AddConnection(common.NewTLSConn(s))
+	return clientSesh, serverSesh
+}
+
+// dial connects to a SOCKS5 server at addr and asks it to connect to host:port
+func dial(t *testing.T, addr string, atyp byte, host []byte, port uint16) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte{version5, 2, 0x02, methodNoAuth})
+	assert.NoError(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{version5, methodNoAuth}, method)
+
+	request := []byte{version5, cmdConnect, 0x00, atyp}
+	if atyp == atypDomain {
+		request = append(request, byte(len(host)))
+	}
+	request = append(request, host...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], port)
+	_, err = conn.Write(request)
+	assert.NoError(t, err)
+	rep := make([]byte, 10)
+	_, err = io.ReadFull(conn, rep)
+	assert.NoError(t, err)
+	return conn, rep[1]
+}
+
+func TestServe(t *testing.T) {
+	clientSesh, serverSesh := makeSessionPair()
+	defer clientSesh.Close()
+	defer serverSesh.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l, clientSesh)
+
+	t.Run("target in metadata", func(t *testing.T) {
+		for _, tc := range []struct {
+			atyp   byte
+			host   []byte
+			target string
+		}{
+			{atypIPv4, []byte{192, 0, 2, 1}, "192.0.2.1:443"},
+			{atypIPv6, net.ParseIP("2001:db8::1"), "[2001:db8::1]:443"},
+			{atypDomain, []byte("example.com"), "example.com:443"},
+		} {
+			conn, rep := dial(t, l.Addr().String(), tc.atyp, tc.host, 443)
+			assert.Equal(t, byte(repSucceeded), rep)
+			stream, err := serverSesh.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tc.target, string(stream.(*mux.Stream).Meta()))
+			conn.Close()
+			stream.Close()
+		}
+	})
+
+	t.Run("echo", func(t *testing.T) {
+		go serverSesh.ServeEcho()
+		conn, rep := dial(t, l.Addr().String(), atypDomain, []byte("echo.test"), 7)
+		defer conn.Close()
+		assert.Equal(t, byte(repSucceeded), rep)
+		data := make([]byte, 100000)
+		rand.Read(data)
+		go conn.Write(data)
+		echoed := make([]byte, len(data))
+		_, err := io.ReadFull(conn, echoed)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, echoed), "echoed data is corrupted")
+	})
+
+	t.Run("unsupported command", func(t *testing.T) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte{version5, 1, methodNoAuth})
+		_, _ = io.ReadFull(conn, make([]byte, 2))
+		// UDP ASSOCIATE
+		_, _ = conn.Write([]byte{version5, 0x03, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+		rep := make([]byte, 10)
+		_, err = io.ReadFull(conn, rep)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(repCommandNotSupported), rep[1])
+	})
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// username/password only
+		_, _ = conn.Write([]byte{version5, 1, 0x02})
+		method := make([]byte, 2)
+		_, err = io.ReadFull(conn, method)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{version5, methodNoAcceptable}, method)
+	})
+}